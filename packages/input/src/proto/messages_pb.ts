@@ -14,7 +14,7 @@ import type { Message } from "@bufbuild/protobuf";
  * Describes the file messages.proto.
  */
 export const file_messages: GenFile = /*@__PURE__*/
-  fileDesc("Cg5tZXNzYWdlcy5wcm90bxIFcHJvdG8iVQoQUHJvdG9NZXNzYWdlQmFzZRIUCgxwYXlsb2FkX3R5cGUYASABKAkSKwoHbGF0ZW5jeRgCIAEoCzIaLnByb3RvLlByb3RvTGF0ZW5jeVRyYWNrZXIiYwoRUHJvdG9NZXNzYWdlSW5wdXQSLQoMbWVzc2FnZV9iYXNlGAEgASgLMhcucHJvdG8uUHJvdG9NZXNzYWdlQmFzZRIfCgRkYXRhGAIgASgLMhEucHJvdG8uUHJvdG9JbnB1dEIWWhRyZWxheS9pbnRlcm5hbC9wcm90b2IGcHJvdG8z", [file_types, file_latency_tracker]);
+  fileDesc("Cg5tZXNzYWdlcy5wcm90bxIFcHJvdG8iVQoQUHJvdG9NZXNzYWdlQmFzZRIUCgxwYXlsb2FkX3R5cGUYASABKAkSKwoHbGF0ZW5jeRgCIAEoCzIaLnByb3RvLlByb3RvTGF0ZW5jeVRyYWNrZXIiYwoRUHJvdG9NZXNzYWdlSW5wdXQSLQoMbWVzc2FnZV9iYXNlGAEgASgLMhcucHJvdG8uUHJvdG9NZXNzYWdlQmFzZRIfCgRkYXRhGAIgASgLMhEucHJvdG8uUHJvdG9JbnB1dCJAChBQcm90b0NsaXBSZXF1ZXN0EhgKEGR1cmF0aW9uX3NlY29uZHMYASABKA0SEgoKcmVxdWVzdF9pZBgCIAEoDSJoChBQcm90b01lc3NhZ2VDbGlwEi0KDG1lc3NhZ2VfYmFzZRgBIAEoCzIXLnByb3RvLlByb3RvTWVzc2FnZUJhc2USJQoEZGF0YRgCIAEoCzIXLnByb3RvLlByb3RvQ2xpcFJlcXVlc3QiQwoPUHJvdG9DbGlwUmVzdWx0Eg0KBWZpbGVzGAEgAygJEg0KBWVycm9yGAIgASgJEhIKCnJlcXVlc3RfaWQYAyABKA0ibQoWUHJvdG9NZXNzYWdlQ2xpcFJlc3VsdBItCgxtZXNzYWdlX2Jhc2UYASABKAsyFy5wcm90by5Qcm90b01lc3NhZ2VCYXNlEiQKBGRhdGEYAiABKAsyFi5wcm90by5Qcm90b0NsaXBSZXN1bHQiLgoNUHJvdG9WaWV3cG9ydBINCgV3aWR0aBgBIAEoDRIOCgZoZWlnaHQYAiABKA0iaQoUUHJvdG9NZXNzYWdlVmlld3BvcnQSLQoMbWVzc2FnZV9iYXNlGAEgASgLMhcucHJvdG8uUHJvdG9NZXNzYWdlQmFzZRIiCgRkYXRhGAIgASgLMhQucHJvdG8uUHJvdG9WaWV3cG9ydEIWWhRyZWxheS9pbnRlcm5hbC9wcm90b2IGcHJvdG8z", [file_types, file_latency_tracker]);
 
 /**
  * @generated from message proto.ProtoMessageBase
@@ -60,3 +60,156 @@ export type ProtoMessageInput = Message<"proto.ProtoMessageInput"> & {
 export const ProtoMessageInputSchema: GenMessage<ProtoMessageInput> = /*@__PURE__*/
   messageDesc(file_messages, 1);
 
+/**
+ * Request of a participant to save the last seconds of the room stream as a clip
+ *
+ * @generated from message proto.ProtoClipRequest
+ */
+export type ProtoClipRequest = Message<"proto.ProtoClipRequest"> & {
+  /**
+   * 0 for everything buffered
+   *
+   * @generated from field: uint32 duration_seconds = 1;
+   */
+  durationSeconds: number;
+
+  /**
+   * Echoed in the result, to match results of requests forwarded between relays
+   *
+   * @generated from field: uint32 request_id = 2;
+   */
+  requestId: number;
+};
+
+/**
+ * Describes the message proto.ProtoClipRequest.
+ * Use `create(ProtoClipRequestSchema)` to create a new message.
+ */
+export const ProtoClipRequestSchema: GenMessage<ProtoClipRequest> = /*@__PURE__*/
+  messageDesc(file_messages, 2);
+
+/**
+ * @generated from message proto.ProtoMessageClip
+ */
+export type ProtoMessageClip = Message<"proto.ProtoMessageClip"> & {
+  /**
+   * @generated from field: proto.ProtoMessageBase message_base = 1;
+   */
+  messageBase?: ProtoMessageBase;
+
+  /**
+   * @generated from field: proto.ProtoClipRequest data = 2;
+   */
+  data?: ProtoClipRequest;
+};
+
+/**
+ * Describes the message proto.ProtoMessageClip.
+ * Use `create(ProtoMessageClipSchema)` to create a new message.
+ */
+export const ProtoMessageClipSchema: GenMessage<ProtoMessageClip> = /*@__PURE__*/
+  messageDesc(file_messages, 3);
+
+/**
+ * Result of a clip request, sent back to the requesting participant
+ *
+ * @generated from message proto.ProtoClipResult
+ */
+export type ProtoClipResult = Message<"proto.ProtoClipResult"> & {
+  /**
+   * Names of the written clip files
+   *
+   * @generated from field: repeated string files = 1;
+   */
+  files: string[];
+
+  /**
+   * Set if the clip could not be saved
+   *
+   * @generated from field: string error = 2;
+   */
+  error: string;
+
+  /**
+   * Of the request this is the result of
+   *
+   * @generated from field: uint32 request_id = 3;
+   */
+  requestId: number;
+};
+
+/**
+ * Describes the message proto.ProtoClipResult.
+ * Use `create(ProtoClipResultSchema)` to create a new message.
+ */
+export const ProtoClipResultSchema: GenMessage<ProtoClipResult> = /*@__PURE__*/
+  messageDesc(file_messages, 4);
+
+/**
+ * @generated from message proto.ProtoMessageClipResult
+ */
+export type ProtoMessageClipResult = Message<"proto.ProtoMessageClipResult"> & {
+  /**
+   * @generated from field: proto.ProtoMessageBase message_base = 1;
+   */
+  messageBase?: ProtoMessageBase;
+
+  /**
+   * @generated from field: proto.ProtoClipResult data = 2;
+   */
+  data?: ProtoClipResult;
+};
+
+/**
+ * Describes the message proto.ProtoMessageClipResult.
+ * Use `create(ProtoMessageClipResultSchema)` to create a new message.
+ */
+export const ProtoMessageClipResultSchema: GenMessage<ProtoMessageClipResult> = /*@__PURE__*/
+  messageDesc(file_messages, 5);
+
+/**
+ * Size a participant displays the room video at, in device pixels, to choose a video layer for it
+ *
+ * @generated from message proto.ProtoViewport
+ */
+export type ProtoViewport = Message<"proto.ProtoViewport"> & {
+  /**
+   * @generated from field: uint32 width = 1;
+   */
+  width: number;
+
+  /**
+   * @generated from field: uint32 height = 2;
+   */
+  height: number;
+};
+
+/**
+ * Describes the message proto.ProtoViewport.
+ * Use `create(ProtoViewportSchema)` to create a new message.
+ */
+export const ProtoViewportSchema: GenMessage<ProtoViewport> = /*@__PURE__*/
+  messageDesc(file_messages, 6);
+
+/**
+ * @generated from message proto.ProtoMessageViewport
+ */
+export type ProtoMessageViewport = Message<"proto.ProtoMessageViewport"> & {
+  /**
+   * @generated from field: proto.ProtoMessageBase message_base = 1;
+   */
+  messageBase?: ProtoMessageBase;
+
+  /**
+   * @generated from field: proto.ProtoViewport data = 2;
+   */
+  data?: ProtoViewport;
+};
+
+/**
+ * Describes the message proto.ProtoMessageViewport.
+ * Use `create(ProtoMessageViewportSchema)` to create a new message.
+ */
+export const ProtoMessageViewportSchema: GenMessage<ProtoMessageViewport> = /*@__PURE__*/
+  messageDesc(file_messages, 7);
+
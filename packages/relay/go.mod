@@ -7,10 +7,13 @@ require (
 	github.com/libp2p/go-libp2p-pubsub v0.13.1
 	github.com/libp2p/go-reuseport v0.4.0
 	github.com/multiformats/go-multiaddr v0.15.0
+	github.com/multiformats/go-multistream v0.6.0
 	github.com/oklog/ulid/v2 v2.1.1
 	github.com/pion/ice/v4 v4.0.10
 	github.com/pion/interceptor v0.1.38
+	github.com/pion/rtcp v1.2.15
 	github.com/pion/rtp v1.8.15
+	github.com/pion/sdp/v3 v3.0.13
 	github.com/pion/webrtc/v4 v4.1.1
 	google.golang.org/protobuf v1.36.6
 )
@@ -65,7 +68,6 @@ require (
 	github.com/multiformats/go-multibase v0.2.0 // indirect
 	github.com/multiformats/go-multicodec v0.9.0 // indirect
 	github.com/multiformats/go-multihash v0.2.3 // indirect
-	github.com/multiformats/go-multistream v0.6.0 // indirect
 	github.com/multiformats/go-varint v0.0.7 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/onsi/ginkgo/v2 v2.23.4 // indirect
@@ -77,9 +79,7 @@ require (
 	github.com/pion/logging v0.2.3 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.15 // indirect
 	github.com/pion/sctp v1.8.39 // indirect
-	github.com/pion/sdp/v3 v3.0.13 // indirect
 	github.com/pion/srtp/v3 v3.0.4 // indirect
 	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/stun/v3 v3.0.0 // indirect
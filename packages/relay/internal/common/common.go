@@ -4,14 +4,31 @@ import (
 	"fmt"
 	"log/slog"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-reuseport"
 	"github.com/pion/ice/v4"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/webrtc/v4"
 )
 
+// ICE consent timers, failure of a disconnected agent follows after the grace period
+const (
+	iceDisconnectedTimeout = 5 * time.Second
+	iceKeepaliveInterval   = 2 * time.Second
+	iceMinGracePeriod      = 1 * time.Second // Zero would disable ICE failure detection
+)
+
 var globalWebRTCAPI *webrtc.API
+
+// Bandwidth estimators are created with the interceptors of a PeerConnection, handed over while it's created
+var estimatorMutex sync.Mutex
+var pendingEstimator cc.BandwidthEstimator
+var bandwidthEstimators = NewSafeMap[*webrtc.PeerConnection, cc.BandwidthEstimator]()
 var globalWebRTCConfig = webrtc.Configuration{
 	ICETransportPolicy: webrtc.ICETransportPolicyAll,
 	BundlePolicy:       webrtc.BundlePolicyBalanced,
@@ -56,9 +73,46 @@ func InitWebRTCAPI() error {
 	// Interceptor registry
 	interceptorRegistry := &interceptor.Registry{}
 
-	// Use default set
-	err = webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry)
+	// Default set, except NACKs of sent media are answered by room tracks from their shared packet cache,
+	// only packets missing on received media are NACKed
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	nackGenerator, err := nack.NewGeneratorInterceptor()
 	if err != nil {
+		return fmt.Errorf("failed to create NACK generator: %w", err)
+	}
+	interceptorRegistry.Add(nackGenerator)
+	if err = webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return err
+	}
+	if err = webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return err
+	}
+	if err = webrtc.ConfigureTWCCSender(mediaEngine, interceptorRegistry); err != nil {
+		return err
+	}
+
+	// Congestion control of sent media, estimated from TWCC feedback. Not paced, latency matters more to us,
+	// the estimate instead picks what to send
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		estimator, err := gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(flags.BWEInitialKbps*1000),
+			gcc.SendSideBWEMaxBitrate(flags.BWEMaxKbps*1000),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return rtxEstimator{estimator}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create congestion controller: %w", err)
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		pendingEstimator = estimator
+	})
+	interceptorRegistry.Add(congestionController)
+	if err = webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
 		return err
 	}
 
@@ -100,32 +154,117 @@ func InitWebRTCAPI() error {
 
 	settingEngine.SetIncludeLoopbackCandidate(true) // Just in case
 
+	// Disconnected agents get the grace period to recover before they fail
+	settingEngine.SetICETimeouts(iceDisconnectedTimeout, ICEGracePeriod(), iceKeepaliveInterval)
+
 	// Create a new API object with our customized settings
 	globalWebRTCAPI = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine), webrtc.WithInterceptorRegistry(interceptorRegistry))
 
 	return nil
 }
 
-// CreatePeerConnection sets up a new peer connection
-func CreatePeerConnection(onClose func()) (*webrtc.PeerConnection, error) {
+// rtxEstimator registers the RTX stream of sent media with the bandwidth estimator too, its pacer only lets
+// through packets of registered streams. Retransmissions count to the estimate that way
+type rtxEstimator struct {
+	*gcc.SendSideBWE
+}
+
+func (e rtxEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if info.SSRCRetransmission != 0 {
+		rtxInfo := *info
+		rtxInfo.SSRC = info.SSRCRetransmission
+		e.SendSideBWE.AddStream(&rtxInfo, writer)
+	}
+	return e.SendSideBWE.AddStream(info, writer)
+}
+
+// ICEGracePeriod returns how long a disconnected PeerConnection may recover before it's closed
+func ICEGracePeriod() time.Duration {
+	return max(time.Duration(GetFlags().ICEGraceMS)*time.Millisecond, iceMinGracePeriod)
+}
+
+// CreatePeerConnection sets up a new peer connection, onDisconnected is called when it gets disconnected
+// and may try to recover it with an ICE restart, it's only closed if it fails after the grace period
+func CreatePeerConnection(onClose func(), onDisconnected func()) (*webrtc.PeerConnection, error) {
+	estimatorMutex.Lock()
+	pendingEstimator = nil
 	pc, err := globalWebRTCAPI.NewPeerConnection(globalWebRTCConfig)
+	estimator := pendingEstimator
+	estimatorMutex.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	if estimator != nil {
+		bandwidthEstimators.Set(pc, estimator)
+	}
+
+	var mutex sync.Mutex
+	var graceUntil time.Time // end of grace period of the current disconnect, zero if connected
+	var closeOnce sync.Once
+
+	closePC := func() {
+		if err := pc.Close(); err != nil {
+			slog.Error("Failed to close PeerConnection", "err", err)
+		}
+		closeOnce.Do(onClose)
+	}
 
 	// Log connection state changes and handle failed/disconnected connections
 	pc.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
-		// Close PeerConnection in cases
-		if connectionState == webrtc.PeerConnectionStateFailed ||
-			connectionState == webrtc.PeerConnectionStateDisconnected ||
-			connectionState == webrtc.PeerConnectionStateClosed {
-			err = pc.Close()
-			if err != nil {
-				slog.Error("Failed to close PeerConnection", "err", err)
+		switch connectionState {
+		case webrtc.PeerConnectionStateConnected:
+			mutex.Lock()
+			graceUntil = time.Time{}
+			mutex.Unlock()
+		case webrtc.PeerConnectionStateDisconnected:
+			mutex.Lock()
+			if graceUntil.IsZero() {
+				graceUntil = time.Now().Add(ICEGracePeriod())
+				// Close if it failed meanwhile and nothing else closed it yet
+				time.AfterFunc(ICEGracePeriod(), func() {
+					if pc.ConnectionState() == webrtc.PeerConnectionStateFailed {
+						closePC()
+					}
+				})
+			}
+			mutex.Unlock()
+			slog.Debug("PeerConnection disconnected, waiting for it to recover", "grace", ICEGracePeriod())
+			if onDisconnected != nil {
+				onDisconnected()
+			}
+		case webrtc.PeerConnectionStateFailed:
+			mutex.Lock()
+			inGrace := time.Now().Before(graceUntil)
+			mutex.Unlock()
+			if !inGrace {
+				closePC()
 			}
-			onClose()
+		case webrtc.PeerConnectionStateClosed:
+			bandwidthEstimators.Delete(pc)
+			closeOnce.Do(onClose)
 		}
 	})
 
 	return pc, nil
 }
+
+// BandwidthEstimate returns the current estimate of the bandwidth media can be sent to the other side
+// of a PeerConnection with, in bits per second, false if there is none
+func BandwidthEstimate(pc *webrtc.PeerConnection) (int, bool) {
+	estimator, ok := bandwidthEstimators.Get(pc)
+	if !ok {
+		return 0, false
+	}
+	return estimator.GetTargetBitrate(), true
+}
+
+// OnBandwidthEstimate sets a callback for when the estimate of the bandwidth media can be sent to the other side
+// of a PeerConnection with changes, in bits per second. Returns false if there is no estimate
+func OnBandwidthEstimate(pc *webrtc.PeerConnection, f func(bitrate int)) bool {
+	estimator, ok := bandwidthEstimators.Get(pc)
+	if !ok {
+		return false
+	}
+	estimator.OnTargetBitrateChange(f)
+	return true
+}
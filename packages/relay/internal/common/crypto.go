@@ -3,6 +3,7 @@ package common
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
@@ -49,3 +50,34 @@ func LoadED25519Key(filePath string) (ed25519.PrivateKey, error) {
 	}
 	return data, nil
 }
+
+// MeshAdmissionPayload returns the data signed to admit a relay to the mesh
+func MeshAdmissionPayload(relayID string) []byte {
+	return []byte("nestri-mesh-admission/" + relayID)
+}
+
+// DecodeED25519PublicKey decodes a base64 encoded ED25519 public key
+func DecodeED25519PublicKey(encoded string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ED25519 public key: %w", err)
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("ED25519 public key must be exactly %d bytes, got %d", ed25519.PublicKeySize, len(data))
+	}
+	return data, nil
+}
+
+// SignMeshAdmission signs the admission of a relay with an operator mesh key, returning base64 signature
+func SignMeshAdmission(meshKey ed25519.PrivateKey, relayID string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(meshKey, MeshAdmissionPayload(relayID)))
+}
+
+// VerifyMeshAdmission checks a base64 operator signature admitting a relay
+func VerifyMeshAdmission(meshKey ed25519.PublicKey, relayID string, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(meshKey, MeshAdmissionPayload(relayID), sig)
+}
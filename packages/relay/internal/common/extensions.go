@@ -3,7 +3,11 @@ package common
 import "github.com/pion/webrtc/v4"
 
 const (
-	ExtensionPlayoutDelay string = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+	ExtensionPlayoutDelay         string = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+	ExtensionMID                  string = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	ExtensionRID                  string = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	ExtensionRepairedRID          string = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+	ExtensionDependencyDescriptor string = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
 )
 
 // ExtensionMap maps audio/video extension URIs to their IDs based on registration order
@@ -24,6 +28,21 @@ func RegisterExtensions(mediaEngine *webrtc.MediaEngine) error {
 		return err
 	}
 
+	// Simulcast (Video), encodings are told apart by their RID
+	for _, uri := range []string{ExtensionMID, ExtensionRID, ExtensionRepairedRID} {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{
+			URI: uri,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	// Dependency Descriptor (Video), tells the SVC layers of AV1 frames
+	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{
+		URI: ExtensionDependencyDescriptor,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
 	// Register the extension IDs for both audio and video
 	ExtensionMap[webrtc.RTPCodecTypeAudio] = map[string]uint8{
 		ExtensionPlayoutDelay: 1,
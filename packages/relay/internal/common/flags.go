@@ -24,6 +24,24 @@ type Flags struct {
 	AutoAddLocalIP bool   // Automatically add local IP to NAT 1 to 1 IPs
 	NAT11IP        string // WebRTC NAT 1 to 1 IP - allows specifying IP of relay if behind NAT
 	PersistDir     string // Directory to save persistent data to
+	HeartbeatMS    int    // Mesh failure detector probe interval in milliseconds
+	SuspicionMS    int    // How long a suspected relay has to refute before removal, in milliseconds
+	IndirectProbes int    // How many relays to ask for indirect probes of an unresponsive relay
+	MeshPublicKey  string // Operator ED25519 public key (base64) - if set, relays must be admitted to join the mesh
+	MeshToken      string // Operator signature (base64) over this relay's ID, admitting it to the mesh
+	MeshApprovals  int    // Signed approvals from existing members needed to admit a relay without operator signature
+	MeshTrusted    string // Comma separated relay IDs this relay approves without further credentials
+	ICEGraceMS     int    // How long a disconnected PeerConnection may recover, e.g. by ICE restart, before it's closed, in milliseconds
+	HTTPPort       int    // Port for HTTP WHIP/WHEP endpoints (TCP) - disabled if 0
+	HTTPToken      string // Bearer token required by HTTP WHIP/WHEP endpoints - no authentication if empty
+	WHEPInput      bool   // Forward input of WHEP viewers over their DataChannel to the room
+	RecordRotateS  int    // Rotate room recording files after this many seconds - no rotation by duration if 0
+	RecordRotateMB int    // Rotate room recording files after this many megabytes - no rotation by size if 0
+	ReplayBufferS  int    // How many seconds of room tracks to keep for saving clips - disabled if 0
+	ReplayBufferMB int    // Upper limit of megabytes kept per room track for saving clips
+	ClipsMaxMB     int    // Upper limit of megabytes of clips kept per room, oldest are deleted beyond it - no limit if 0
+	BWEInitialKbps int    // Bandwidth estimate served participants start with, in kilobits per second
+	BWEMaxKbps     int    // Upper limit of bandwidth estimates of served participants, in kilobits per second
 }
 
 func (flags *Flags) DebugLog() {
@@ -39,6 +57,22 @@ func (flags *Flags) DebugLog() {
 		"autoAddLocalIP", flags.AutoAddLocalIP,
 		"webrtcNAT11IPs", flags.NAT11IP,
 		"persistDir", flags.PersistDir,
+		"heartbeatMS", flags.HeartbeatMS,
+		"suspicionMS", flags.SuspicionMS,
+		"indirectProbes", flags.IndirectProbes,
+		"meshPublicKey", flags.MeshPublicKey,
+		"meshApprovals", flags.MeshApprovals,
+		"meshTrusted", flags.MeshTrusted,
+		"iceGraceMS", flags.ICEGraceMS,
+		"httpPort", flags.HTTPPort,
+		"whepInput", flags.WHEPInput,
+		"recordRotateS", flags.RecordRotateS,
+		"recordRotateMB", flags.RecordRotateMB,
+		"replayBufferS", flags.ReplayBufferS,
+		"replayBufferMB", flags.ReplayBufferMB,
+		"clipsMaxMB", flags.ClipsMaxMB,
+		"bweInitialKbps", flags.BWEInitialKbps,
+		"bweMaxKbps", flags.BWEMaxKbps,
 	)
 }
 
@@ -85,6 +119,24 @@ func InitFlags() {
 	nat11IP := ""
 	flag.StringVar(&nat11IP, "webrtcNAT11IP", getEnvAsString("WEBRTC_NAT_IP", ""), "WebRTC NAT 1 to 1 IP")
 	flag.StringVar(&globalFlags.PersistDir, "persistDir", getEnvAsString("PERSIST_DIR", "./persist-data"), "Directory to save persistent data to")
+	flag.IntVar(&globalFlags.HeartbeatMS, "heartbeatMS", getEnvAsInt("HEARTBEAT_MS", 1000), "Mesh failure detector probe interval in milliseconds")
+	flag.IntVar(&globalFlags.SuspicionMS, "suspicionMS", getEnvAsInt("SUSPICION_MS", 5000), "Suspected relay refute timeout in milliseconds")
+	flag.IntVar(&globalFlags.IndirectProbes, "indirectProbes", getEnvAsInt("INDIRECT_PROBES", 3), "Number of relays to ask for indirect probes")
+	flag.StringVar(&globalFlags.MeshPublicKey, "meshPublicKey", getEnvAsString("MESH_PUBLIC_KEY", ""), "Operator mesh ED25519 public key (base64), enables mesh admission")
+	flag.StringVar(&globalFlags.MeshToken, "meshToken", getEnvAsString("MESH_TOKEN", ""), "Operator signature (base64) over this relay's ID")
+	flag.IntVar(&globalFlags.MeshApprovals, "meshApprovals", getEnvAsInt("MESH_APPROVALS", 1), "Member approvals needed to admit a relay without operator signature")
+	flag.StringVar(&globalFlags.MeshTrusted, "meshTrusted", getEnvAsString("MESH_TRUSTED", ""), "Comma separated relay IDs to approve without credentials")
+	flag.IntVar(&globalFlags.HTTPPort, "httpPort", getEnvAsInt("HTTP_PORT", 0), "HTTP WHIP/WHEP endpoint port, 0 to disable")
+	flag.StringVar(&globalFlags.HTTPToken, "httpToken", getEnvAsString("HTTP_TOKEN", ""), "Bearer token required by HTTP WHIP/WHEP endpoints")
+	flag.BoolVar(&globalFlags.WHEPInput, "whepInput", getEnvAsBool("WHEP_INPUT", false), "Forward input of WHEP viewers to rooms")
+	flag.IntVar(&globalFlags.RecordRotateS, "recordRotateS", getEnvAsInt("RECORD_ROTATE_S", 600), "Room recording file rotation interval in seconds, 0 to disable")
+	flag.IntVar(&globalFlags.RecordRotateMB, "recordRotateMB", getEnvAsInt("RECORD_ROTATE_MB", 1024), "Room recording file rotation size in megabytes, 0 to disable")
+	flag.IntVar(&globalFlags.ReplayBufferS, "replayBufferS", getEnvAsInt("REPLAY_BUFFER_S", 0), "Seconds of room tracks to keep for saving clips, 0 to disable")
+	flag.IntVar(&globalFlags.ReplayBufferMB, "replayBufferMB", getEnvAsInt("REPLAY_BUFFER_MB", 64), "Megabytes of room track kept for saving clips")
+	flag.IntVar(&globalFlags.ClipsMaxMB, "clipsMaxMB", getEnvAsInt("CLIPS_MAX_MB", 1024), "Megabytes of clips kept per room, oldest deleted beyond it, 0 for no limit")
+	flag.IntVar(&globalFlags.BWEInitialKbps, "bweInitialKbps", getEnvAsInt("BWE_INITIAL_KBPS", 2500), "Initial bandwidth estimate of served participants in kilobits per second")
+	flag.IntVar(&globalFlags.BWEMaxKbps, "bweMaxKbps", getEnvAsInt("BWE_MAX_KBPS", 50000), "Upper limit of bandwidth estimates of served participants in kilobits per second")
+	flag.IntVar(&globalFlags.ICEGraceMS, "iceGraceMS", getEnvAsInt("ICE_GRACE_MS", 15000), "Grace period of disconnected WebRTC connections to recover in milliseconds")
 	// Parse flags
 	flag.Parse()
 
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// IsKeyframeStart reports whether an RTP payload of given codec starts a keyframe,
+// or the parameter sets sent right before one
+func IsKeyframeStart(mimeType string, payload []byte) bool {
+	switch { // Called for every packet, so without allocating a lowercase copy
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		return isH265KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return isAV1KeyframeStart(payload)
+	default:
+		return false
+	}
+}
+
+// --- H.264 (RFC 6184) ---
+
+func isH264KeyframeNAL(nalType byte) bool {
+	return nalType == 5 || nalType == 7 // IDR slice or SPS
+}
+
+func isH264KeyframeStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				return false
+			}
+			if isH264KeyframeNAL(payload[offset] & 0x1F) {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case 28: // FU-A, only the first fragment starts the NAL unit
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isH264KeyframeNAL(payload[1]&0x1F)
+	default:
+		return isH264KeyframeNAL(nalType)
+	}
+}
+
+// --- H.265 (RFC 7798) ---
+
+func isH265KeyframeNAL(nalType byte) bool {
+	return (nalType >= 16 && nalType <= 21) || (nalType >= 32 && nalType <= 34) // IRAP slice or VPS/SPS/PPS
+}
+
+func isH265KeyframeStart(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch nalType := (payload[0] >> 1) & 0x3F; nalType {
+	case 48: // Aggregation packet
+		for offset := 2; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				return false
+			}
+			if isH265KeyframeNAL((payload[offset] >> 1) & 0x3F) {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case 49: // Fragmentation unit, only the first fragment starts the NAL unit
+		return len(payload) > 2 && payload[2]&0x80 != 0 && isH265KeyframeNAL(payload[2]&0x3F)
+	default:
+		return isH265KeyframeNAL(nalType)
+	}
+}
+
+// --- VP8 (RFC 7741) ---
+
+func isVP8KeyframeStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// Start of partition 0 is required
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 { // Extended control bits
+		if len(payload) <= offset {
+			return false
+		}
+		ext := payload[offset]
+		offset++
+		if ext&0x80 != 0 { // PictureID, 15 bits if M is set
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			offset++
+		}
+		if ext&0x30 != 0 { // TID/KEYIDX
+			offset++
+		}
+	}
+	// Inverse key frame flag of the VP8 payload header
+	return len(payload) > offset && payload[offset]&0x01 == 0
+}
+
+// --- VP9 (RFC 9628) ---
+
+func isVP9KeyframeStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// Start of a frame which is not inter-predicted
+	if payload[0]&0x08 == 0 || payload[0]&0x40 != 0 {
+		return false
+	}
+	if payload[0]&0x20 == 0 { // No layer indices, single spatial layer
+		return true
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 { // PictureID, 15 bits if M is set
+		if len(payload) <= offset {
+			return false
+		}
+		if payload[offset]&0x80 != 0 {
+			offset++
+		}
+		offset++
+	}
+	// Only the base spatial layer starts a keyframe
+	return len(payload) > offset && (payload[offset]>>1)&0x07 == 0
+}
+
+// --- AV1 (AV1 RTP payload format) ---
+
+func isAV1KeyframeStart(payload []byte) bool {
+	// N bit of the aggregation header marks the first packet of a coded video sequence
+	return len(payload) > 0 && payload[0]&0x08 != 0
+}
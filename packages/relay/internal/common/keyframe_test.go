@@ -0,0 +1,88 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestIsKeyframeStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		// H.264
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67, 0x42}, true},
+		{"h264 non-idr", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"h264 lowercase mime type", "video/h264", []byte{0x65, 0x88}, true},
+		{"h264 stap-a with sps and pps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"h264 stap-a with sps second", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x06, 0x05, 0x00, 0x02, 0x67, 0x42}, true},
+		{"h264 stap-a without keyframe", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"h264 stap-a truncated unit", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x10, 0x67}, false},
+		{"h264 stap-a zero size", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x00, 0x67}, false},
+		{"h264 stap-a truncated size", webrtc.MimeTypeH264, []byte{0x78, 0x00}, false},
+		{"h264 fu-a start of idr", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"h264 fu-a middle of idr", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"h264 fu-a start of non-idr", webrtc.MimeTypeH264, []byte{0x7c, 0x81, 0x9a}, false},
+		{"h264 fu-a truncated", webrtc.MimeTypeH264, []byte{0x7c}, false},
+		{"h264 empty", webrtc.MimeTypeH264, nil, false},
+
+		// H.265
+		{"h265 idr", webrtc.MimeTypeH265, []byte{0x26, 0x01, 0xaf}, true},
+		{"h265 cra", webrtc.MimeTypeH265, []byte{0x2a, 0x01, 0xaf}, true},
+		{"h265 vps", webrtc.MimeTypeH265, []byte{0x40, 0x01, 0x0c}, true},
+		{"h265 trail", webrtc.MimeTypeH265, []byte{0x02, 0x01, 0xd0}, false},
+		{"h265 ap with vps", webrtc.MimeTypeH265, []byte{0x60, 0x01, 0x00, 0x02, 0x40, 0x01, 0x00, 0x02, 0x42, 0x01}, true},
+		{"h265 ap without keyframe", webrtc.MimeTypeH265, []byte{0x60, 0x01, 0x00, 0x02, 0x02, 0x01}, false},
+		{"h265 ap truncated unit", webrtc.MimeTypeH265, []byte{0x60, 0x01, 0x00, 0x10, 0x40}, false},
+		{"h265 ap zero size", webrtc.MimeTypeH265, []byte{0x60, 0x01, 0x00, 0x00, 0x40}, false},
+		{"h265 fu start of idr", webrtc.MimeTypeH265, []byte{0x62, 0x01, 0x93, 0xaf}, true},
+		{"h265 fu middle of idr", webrtc.MimeTypeH265, []byte{0x62, 0x01, 0x13, 0xaf}, false},
+		{"h265 fu start of trail", webrtc.MimeTypeH265, []byte{0x62, 0x01, 0x81, 0xd0}, false},
+		{"h265 fu truncated", webrtc.MimeTypeH265, []byte{0x62, 0x01}, false},
+		{"h265 truncated header", webrtc.MimeTypeH265, []byte{0x26}, false},
+
+		// VP8
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 other partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"vp8 extended keyframe", webrtc.MimeTypeVP8, []byte{0x90, 0xe0, 0x80, 0x01, 0x05, 0x20, 0x00}, true},
+		{"vp8 extended 7 bit picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x05, 0x00}, true},
+		{"vp8 extended interframe", webrtc.MimeTypeVP8, []byte{0x90, 0xe0, 0x80, 0x01, 0x05, 0x20, 0x01}, false},
+		{"vp8 truncated extension", webrtc.MimeTypeVP8, []byte{0x90}, false},
+		{"vp8 truncated picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 truncated long picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x80}, false},
+		{"vp8 truncated payload header", webrtc.MimeTypeVP8, []byte{0x10}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+
+		// VP9
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08, 0x82}, true},
+		{"vp9 inter-predicted", webrtc.MimeTypeVP9, []byte{0x48, 0x82}, false},
+		{"vp9 continuation", webrtc.MimeTypeVP9, []byte{0x00, 0x82}, false},
+		{"vp9 base spatial layer", webrtc.MimeTypeVP9, []byte{0x28, 0x00, 0x00}, true},
+		{"vp9 upper spatial layer", webrtc.MimeTypeVP9, []byte{0x28, 0x02, 0x00}, false},
+		{"vp9 long picture id", webrtc.MimeTypeVP9, []byte{0xa8, 0x80, 0x01, 0x00, 0x00}, true},
+		{"vp9 short picture id", webrtc.MimeTypeVP9, []byte{0xa8, 0x01, 0x00, 0x00}, true},
+		{"vp9 truncated picture id", webrtc.MimeTypeVP9, []byte{0xa8}, false},
+		{"vp9 truncated layer indices", webrtc.MimeTypeVP9, []byte{0xa8, 0x80, 0x01}, false},
+		{"vp9 empty", webrtc.MimeTypeVP9, nil, false},
+
+		// AV1
+		{"av1 new coded video sequence", webrtc.MimeTypeAV1, []byte{0x18, 0x0a}, true},
+		{"av1 continuation", webrtc.MimeTypeAV1, []byte{0x10, 0x32}, false},
+		{"av1 empty", webrtc.MimeTypeAV1, nil, false},
+
+		{"unknown codec", webrtc.MimeTypeOpus, []byte{0x65}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsKeyframeStart(tt.mimeType, tt.payload); got != tt.want {
+				t.Errorf("IsKeyframeStart(%s, % x) = %v, want %v", tt.mimeType, tt.payload, got, tt.want)
+			}
+		})
+	}
+}
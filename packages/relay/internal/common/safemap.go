@@ -42,6 +42,22 @@ func (sm *SafeMap[K, V]) Set(key K, value V) {
 	sm.m[key] = value
 }
 
+// GetOrCreate retrieves the value of a key, setting it to a value made by create if the key is missing.
+// Values are only set if the key is still missing, so concurrent callers all get the same one
+func (sm *SafeMap[K, V]) GetOrCreate(key K, create func() V) V {
+	if v, ok := sm.Get(key); ok {
+		return v
+	}
+	created := create()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if v, ok := sm.m[key]; ok {
+		return v // Another caller was first
+	}
+	sm.m[key] = created
+	return created
+}
+
 // Delete removes a key from the map
 func (sm *SafeMap[K, V]) Delete(key K) {
 	sm.mu.Lock()
@@ -49,6 +65,15 @@ func (sm *SafeMap[K, V]) Delete(key K) {
 	delete(sm.m, key)
 }
 
+// Take removes a key from the map and returns its value, only one of concurrent callers gets it
+func (sm *SafeMap[K, V]) Take(key K) (V, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	v, ok := sm.m[key]
+	delete(sm.m, key)
+	return v, ok
+}
+
 // Len returns the number of items in the map
 func (sm *SafeMap[K, V]) Len() int {
 	sm.mu.RLock()
@@ -5,6 +5,7 @@ import (
 	gen "relay/internal/proto"
 
 	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -31,14 +32,18 @@ func NewNestriDataChannel(dc *webrtc.DataChannel) *NestriDataChannel {
 		}
 
 		// Decode message
-		var base gen.ProtoMessageInput
-		if err := proto.Unmarshal(msg.Data, &base); err != nil {
+		base, err := decodeMessageBase(msg.Data)
+		if err != nil {
 			slog.Error("failed to decode binary DataChannel message", "err", err)
 			return
 		}
 
-		// Handle message type callback
-		if callback, ok := ndc.callbacks["input"]; ok {
+		// Handle message type callback, anything without a callback of its own is input
+		callback, ok := ndc.callbacks[base.GetPayloadType()]
+		if !ok {
+			callback, ok = ndc.callbacks["input"]
+		}
+		if ok {
 			go callback(msg.Data)
 		} // We don't care about unhandled messages
 	})
@@ -46,6 +51,35 @@ func NewNestriDataChannel(dc *webrtc.DataChannel) *NestriDataChannel {
 	return ndc
 }
 
+// decodeMessageBase decodes only the message base of a message, its data differs between message types
+func decodeMessageBase(data []byte) (*gen.ProtoMessageBase, error) {
+	base := &gen.ProtoMessageBase{}
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if number == 1 && wireType == protowire.BytesType {
+			value, m := protowire.ConsumeBytes(data)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			if err := proto.Unmarshal(value, base); err != nil {
+				return nil, err
+			}
+			data = data[m:]
+			continue
+		}
+		m := protowire.ConsumeFieldValue(number, wireType, data)
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		data = data[m:]
+	}
+	return base, nil
+}
+
 // SendBinary sends a binary message to the data channel
 func (ndc *NestriDataChannel) SendBinary(data []byte) error {
 	return ndc.Send(data)
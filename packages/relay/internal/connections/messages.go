@@ -92,3 +92,21 @@ func NewMessageSDP(t string, sdp webrtc.SessionDescription) *MessageSDP {
 		SDP: sdp,
 	}
 }
+
+type MessageError struct {
+	MessageBase
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	RoomName string `json:"room_name,omitempty"`
+}
+
+func NewMessageError(t string, code, message, roomName string) *MessageError {
+	return &MessageError{
+		MessageBase: MessageBase{
+			Type: t,
+		},
+		Code:     code,
+		Message:  message,
+		RoomName: roomName,
+	}
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+)
+
+// --- Structs ---
+
+// meshAdmission tracks which relays are allowed to take part in the mesh
+type meshAdmission struct {
+	meshKey  ed25519.PublicKey              // operator mesh key, nil if admission is disabled
+	admitted *common.SafeMap[peer.ID, bool] // relays whose credentials were verified
+	trusted  *common.SafeMap[peer.ID, bool] // relays this relay approves without credentials
+}
+
+func newMeshAdmission() (*meshAdmission, error) {
+	flags := common.GetFlags()
+	ma := &meshAdmission{
+		admitted: common.NewSafeMap[peer.ID, bool](),
+		trusted:  common.NewSafeMap[peer.ID, bool](),
+	}
+
+	if len(flags.MeshPublicKey) > 0 {
+		meshKey, err := common.DecodeED25519PublicKey(flags.MeshPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mesh public key: %w", err)
+		}
+		ma.meshKey = meshKey
+	} else {
+		slog.Warn("No mesh public key set, any relay is admitted to the mesh")
+	}
+
+	for _, id := range strings.Split(flags.MeshTrusted, ",") {
+		id = strings.TrimSpace(id)
+		if len(id) == 0 {
+			continue
+		}
+		peerID, err := peer.Decode(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted relay ID '%s': %w", id, err)
+		}
+		ma.trusted.Set(peerID, true)
+	}
+
+	return ma, nil
+}
+
+// enabled returns whether relays need to be admitted to the mesh
+func (ma *meshAdmission) enabled() bool {
+	return ma.meshKey != nil
+}
+
+// --- Credentials ---
+
+// initCredentials loads the operator signature of this relay, if one was given
+func (r *Relay) initCredentials() {
+	token := common.GetFlags().MeshToken
+	if len(token) == 0 {
+		return
+	}
+	if r.admission.enabled() && !common.VerifyMeshAdmission(r.admission.meshKey, r.ID.String(), token) {
+		slog.Warn("Mesh token is not a valid operator signature for this relay, ignoring")
+		return
+	}
+	r.Approvals.Set(meshApprovalKey, token)
+}
+
+// signApproval signs the admission of a relay with this relay's identity, returning base64 signature
+func (r *Relay) signApproval(peerID peer.ID) (string, error) {
+	privKey := r.Host.Peerstore().PrivKey(r.ID)
+	if privKey == nil {
+		return "", errors.New("missing private key of this relay")
+	}
+	sig, err := privKey.Sign(common.MeshAdmissionPayload(peerID.String()))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign approval: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyApproval checks a base64 signature of a member relay approving given relay
+func verifyApproval(signerID peer.ID, peerID peer.ID, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	pubKey, err := signerID.ExtractPublicKey()
+	if err != nil {
+		return false
+	}
+	ok, err := pubKey.Verify(common.MeshAdmissionPayload(peerID.String()), sig)
+	return err == nil && ok
+}
+
+// verifyCredentials checks if a relay is trusted, signed by the operator key or approved by enough admitted members
+func (r *Relay) verifyCredentials(peerID peer.ID, approvals map[string]string) error {
+	if !r.admission.enabled() || r.admission.trusted.Has(peerID) {
+		return nil
+	}
+
+	if token, ok := approvals[meshApprovalKey]; ok && common.VerifyMeshAdmission(r.admission.meshKey, peerID.String(), token) {
+		return nil
+	}
+
+	valid := 0
+	for signer, signature := range approvals {
+		if signer == meshApprovalKey {
+			continue
+		}
+		signerID, err := peer.Decode(signer)
+		if err != nil || signerID == peerID {
+			continue
+		}
+		if signerID != r.ID && !r.admission.admitted.Has(signerID) {
+			continue // Only approvals of mesh members count
+		}
+		if verifyApproval(signerID, peerID, signature) {
+			valid++
+		}
+	}
+	required := max(common.GetFlags().MeshApprovals, 1)
+	if valid < required {
+		return fmt.Errorf("relay has %d valid approvals, %d required", valid, required)
+	}
+	return nil
+}
+
+// mergeApprovals adds approvals of this relay received from other relays, keeping only valid ones
+func (r *Relay) mergeApprovals(signerID peer.ID, approvals map[string]string) {
+	signature, ok := approvals[r.ID.String()]
+	if !ok {
+		return
+	}
+	if !verifyApproval(signerID, r.ID, signature) {
+		slog.Warn("Received invalid mesh approval", "signer", signerID)
+		return
+	}
+	r.Approvals.Set(signerID.String(), signature)
+}
+
+// --- Admission ---
+
+// isRelayAdmitted checks if a relay is allowed to take part in the mesh
+func (r *Relay) isRelayAdmitted(peerID peer.ID) bool {
+	if !r.admission.enabled() || peerID == r.ID {
+		return true
+	}
+	return r.admission.admitted.Has(peerID) || r.admission.trusted.Has(peerID)
+}
+
+// isRequesterAdmitted checks if the peer of a connection may request streams over given protocol. The protobuf
+// protocol is only spoken by relays, which need admission. The JSON one is spoken by clients too, peers identifying
+// as relays by the handshake protocol need admission there as well, and peers not identified in time are rejected
+func (r *Relay) isRequesterAdmitted(conn network.Conn, protocolID protocol.ID) bool {
+	peerID := conn.RemotePeer()
+	if r.isRelayAdmitted(peerID) {
+		return true
+	}
+	if protocolID != protocolStreamRequest {
+		return false
+	}
+
+	identified, ok := r.Host.(interface{ IDService() identify.IDService })
+	if !ok {
+		return false
+	}
+	select {
+	case <-identified.IDService().IdentifyWait(conn):
+	case <-time.After(identifyTimeout):
+		slog.Debug("Stream requester was not identified in time", "peer", peerID)
+		return false
+	}
+	// Identify also ends without result on failure
+	known, err := r.Host.Peerstore().GetProtocols(peerID)
+	if err != nil || len(known) == 0 {
+		return false
+	}
+	protocols, err := r.Host.Peerstore().SupportsProtocols(peerID, protocolHandshake)
+	return err == nil && len(protocols) == 0
+}
+
+// admitRelay verifies the credentials of a relay and admits it to the mesh
+func (r *Relay) admitRelay(peerID peer.ID, approvals map[string]string) error {
+	if r.isRelayAdmitted(peerID) {
+		return nil
+	}
+	if err := r.verifyCredentials(peerID, approvals); err != nil {
+		return err
+	}
+	r.admission.admitted.Set(peerID, true)
+	slog.Info("Relay admitted to mesh", "peer", peerID)
+	return nil
+}
+
+// forgetRelay drops the admission of a relay, it has to present its credentials again
+func (r *Relay) forgetRelay(peerID peer.ID) {
+	if r.admission.admitted.Has(peerID) {
+		r.admission.admitted.Delete(peerID)
+	}
+}
+
+// --- Public Usable Methods ---
+
+// ApproveRelay trusts a relay, admitting it and signing its approval on next handshake
+func (r *Relay) ApproveRelay(peerID peer.ID) {
+	r.admission.trusted.Set(peerID, true)
+	slog.Info("Relay approved for mesh", "peer", peerID)
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"relay/internal/common"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// enableAdmission makes a test relay require admission to the mesh, returning the operator mesh key
+func enableAdmission(t *testing.T, r *Relay) ed25519.PrivateKey {
+	t.Helper()
+	meshPublic, meshKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.admission.meshKey = meshPublic
+	return meshKey
+}
+
+// testIdentity is a relay identity which can sign approvals without running a host
+type testIdentity struct {
+	id  peer.ID
+	key crypto.PrivKey
+}
+
+func newTestIdentity(t *testing.T) testIdentity {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIdentity{id: id, key: key}
+}
+
+func (ti testIdentity) approve(t *testing.T, peerID peer.ID) string {
+	t.Helper()
+	sig, err := ti.key.Sign(common.MeshAdmissionPayload(peerID.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func setMeshApprovals(t *testing.T, approvals int) {
+	t.Helper()
+	flags := common.GetFlags()
+	previous := flags.MeshApprovals
+	flags.MeshApprovals = approvals
+	t.Cleanup(func() { flags.MeshApprovals = previous })
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	setMeshApprovals(t, 2)
+	r := newTestRelay(t)
+	meshKey := enableAdmission(t, r)
+	_, otherMeshKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner, other := newTestIdentity(t), newTestIdentity(t)
+	first, second, outsider, forgotten := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	for _, member := range []testIdentity{first, second, forgotten} {
+		r.admission.admitted.Set(member.id, true)
+	}
+	r.forgetRelay(forgotten.id)
+	ownApproval, err := r.signApproval(joiner.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		approvals map[string]string
+		valid     bool
+	}{
+		{"no credentials", nil, false},
+		{"operator signature", map[string]string{meshApprovalKey: common.SignMeshAdmission(meshKey, joiner.id.String())}, true},
+		{"operator signature of other mesh", map[string]string{meshApprovalKey: common.SignMeshAdmission(otherMeshKey, joiner.id.String())}, false},
+		{"operator signature reused from other relay", map[string]string{meshApprovalKey: common.SignMeshAdmission(meshKey, other.id.String())}, false},
+		{"malformed operator signature", map[string]string{meshApprovalKey: "not base64"}, false},
+		{"enough member approvals", map[string]string{first.id.String(): first.approve(t, joiner.id), second.id.String(): second.approve(t, joiner.id)}, true},
+		{"own approval counts", map[string]string{first.id.String(): first.approve(t, joiner.id), r.ID.String(): ownApproval}, true},
+		{"too few member approvals", map[string]string{first.id.String(): first.approve(t, joiner.id)}, false},
+		{"approval of non-member", map[string]string{first.id.String(): first.approve(t, joiner.id), outsider.id.String(): outsider.approve(t, joiner.id)}, false},
+		{"approval of member no longer admitted", map[string]string{first.id.String(): first.approve(t, joiner.id), forgotten.id.String(): forgotten.approve(t, joiner.id)}, false},
+		{"approval reused from other relay", map[string]string{first.id.String(): first.approve(t, joiner.id), second.id.String(): second.approve(t, other.id)}, false},
+		{"approval signed by other member", map[string]string{first.id.String(): first.approve(t, joiner.id), second.id.String(): first.approve(t, joiner.id)}, false},
+		{"self approval", map[string]string{first.id.String(): first.approve(t, joiner.id), joiner.id.String(): joiner.approve(t, joiner.id)}, false},
+		{"malformed signer", map[string]string{first.id.String(): first.approve(t, joiner.id), "relay": second.approve(t, joiner.id)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := r.verifyCredentials(joiner.id, tt.approvals); (err == nil) != tt.valid {
+				t.Errorf("verifyCredentials() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAdmitRelay(t *testing.T) {
+	r := newTestRelay(t)
+	joiner, trusted := newTestIdentity(t), newTestIdentity(t)
+	if !r.isRelayAdmitted(joiner.id) {
+		t.Error("relay not admitted with admission disabled")
+	}
+
+	enableAdmission(t, r)
+	if r.isRelayAdmitted(joiner.id) || !r.isRelayAdmitted(r.ID) {
+		t.Fatal("admission doesn't keep others out while admitting itself")
+	}
+	if err := r.admitRelay(joiner.id, nil); err == nil || r.isRelayAdmitted(joiner.id) {
+		t.Fatal("relay without credentials was admitted")
+	}
+	ownApproval, err := r.signApproval(joiner.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.admitRelay(joiner.id, map[string]string{r.ID.String(): ownApproval}); err != nil || !r.isRelayAdmitted(joiner.id) {
+		t.Fatalf("relay approved by us was not admitted: %v", err)
+	}
+	r.forgetRelay(joiner.id)
+	if r.isRelayAdmitted(joiner.id) {
+		t.Error("forgotten relay is still admitted")
+	}
+
+	// Trusted relays are admitted without credentials, forgetting them doesn't drop the trust
+	r.ApproveRelay(trusted.id)
+	if err = r.admitRelay(trusted.id, nil); err != nil {
+		t.Fatalf("trusted relay was not admitted: %v", err)
+	}
+	r.forgetRelay(trusted.id)
+	if !r.isRelayAdmitted(trusted.id) {
+		t.Error("trusted relay lost admission when forgotten")
+	}
+}
+
+func TestMergeApprovals(t *testing.T) {
+	r := newTestRelay(t)
+	signer, other := newTestIdentity(t), newTestIdentity(t)
+
+	r.mergeApprovals(signer.id, map[string]string{r.ID.String(): other.approve(t, r.ID)})
+	r.mergeApprovals(signer.id, map[string]string{r.ID.String(): signer.approve(t, other.id)})
+	if r.Approvals.Len() != 0 {
+		t.Errorf("kept invalid approvals %v", r.Approvals.Copy())
+	}
+	r.mergeApprovals(signer.id, map[string]string{r.ID.String(): signer.approve(t, r.ID), other.id.String(): signer.approve(t, other.id)})
+	if approval, ok := r.Approvals.Get(signer.id.String()); !ok || r.Approvals.Len() != 1 || !verifyApproval(signer.id, r.ID, approval) {
+		t.Errorf("approvals %v, want only the approval of %s", r.Approvals.Copy(), signer.id)
+	}
+}
+
+// newRequester connects a host to a relay, returning the connection as seen by the relay
+func newRequester(t *testing.T, r *Relay, protocols ...protocol.ID) network.Conn {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	for _, protocolID := range protocols {
+		h.SetStreamHandler(protocolID, func(stream network.Stream) { _ = stream.Reset() })
+	}
+	if err = h.Connect(context.Background(), peer.AddrInfo{ID: r.ID, Addrs: r.Host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	conns := r.Host.Network().ConnsToPeer(h.ID())
+	if len(conns) == 0 {
+		t.Fatal("relay has no connection to requester")
+	}
+	return conns[0]
+}
+
+func TestIsRequesterAdmitted(t *testing.T) {
+	r := newTestRelay(t)
+	enableAdmission(t, r)
+	client := newRequester(t, r)
+	relay := newRequester(t, r, protocolHandshake)
+
+	if !r.isRequesterAdmitted(client, protocolStreamRequest) {
+		t.Error("client was refused a JSON stream request")
+	}
+	if r.isRequesterAdmitted(client, protocolStreamRequestV2) {
+		t.Error("client not admitted to the mesh was allowed a protobuf stream request")
+	}
+	if r.isRequesterAdmitted(relay, protocolStreamRequest) {
+		t.Error("relay not admitted to the mesh was allowed a JSON stream request")
+	}
+
+	r.ApproveRelay(relay.RemotePeer())
+	for _, protocolID := range []protocol.ID{protocolStreamRequest, protocolStreamRequestV2} {
+		if !r.isRequesterAdmitted(relay, protocolID) {
+			t.Errorf("admitted relay was refused a stream request over %s", protocolID)
+		}
+	}
+}
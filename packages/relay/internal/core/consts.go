@@ -7,7 +7,61 @@ const (
 	// PubSub Topics
 	roomStateTopicName    = "room-states"
 	relayMetricsTopicName = "relay-metrics"
+	relayHealthTopicName  = "relay-health"
+
+	// Entity Types
+	entityTypeRoom = "room"
 
 	// Timers and Intervals
 	metricsPublishInterval = 15 * time.Second // How often to publish own metrics
+	stateAnnounceInterval  = 10 * time.Second // How often to announce latest state sequence number
+	stateRequestTimeout    = 10 * time.Second // Timeout for retransmission requests to a peer
+	tombstoneGCInterval    = 1 * time.Minute  // How often to garbage collect deleted room tombstones
+	tombstoneTTL           = 5 * time.Minute  // How long deleted room tombstones are kept
+	removedRelayTTL        = 5 * time.Minute  // How long the incarnation of a relay removed from the mesh is kept
+	handshakeTimeout       = 10 * time.Second // Timeout for mesh admission handshakes
+	identifyTimeout        = 5 * time.Second  // How long stream requesters may take to be identified before they're rejected
+
+	// State Synchronization
+	stateHistorySize = 256 // How many sent state updates to keep for answering retransmission requests
+	maxStateGap      = 64  // Gap size after which a full state snapshot is requested instead
+
+	// Stream Forwarding
+	maxStreamHops          = 4                      // How many relays a stream may pass through from its owner
+	failoverAttempts       = 8                      // How many times to re-request a stream after its upstream went away
+	failoverInitialBackoff = 500 * time.Millisecond // Wait after first failed failover attempt, doubled for each next one
+	failoverMaxBackoff     = 10 * time.Second       // Upper limit of wait between failover attempts
+	failoverAttemptTimeout = 5 * time.Second        // How long a failover attempt may take to get the stream flowing
+
+	// Stream Signaling
+	signalingTimeout     = 30 * time.Second // How long a stream negotiation may take until its PeerConnection connects
+	renegotiationTimeout = 5 * time.Second  // How long a renegotiation waits for an ongoing one to settle
+
+	// RTCP Feedback
+	keyframeRequestInterval = 500 * time.Millisecond // Upper rate of keyframe requests sent upstream per room
+	bitrateFeedbackInterval = 1 * time.Second        // Upper rate of bitrate estimates sent upstream per room
+	bitrateEstimateTTL      = 5 * time.Second        // How long a participant's bitrate estimate counts without refresh
+
+	// Room Recording
+	recordingsDirName = "recordings" // Directory under the persist directory recordings are written to
+
+	// Replay Buffer
+	clipsDirName          = "clips"          // Directory under the persist directory clips are written to
+	clipRequestInterval   = 5 * time.Second  // Upper rate of clips saved per room on participant request
+	clipMessageType       = "clip"           // DataChannel message type of participant clip requests
+	clipResultMessageType = "clip-result"    // DataChannel message type of clip results sent to participants
+	clipForwardTimeout    = 30 * time.Second // How long a clip request forwarded upstream waits for its result
+
+	// Video Layer Selection
+	viewportMessageType  = "viewport" // DataChannel message type of participant viewport hints
+	layerBitrateHeadroom = 0.85       // Share of a participant's bandwidth estimate its video layer may take
+	layerLossHigh        = 0.1        // Loss rate reported by a participant without bandwidth estimate that steps its layer down
+	layerLossLow         = 0.02       // Loss rate reported by a participant without bandwidth estimate that lets its layer step up
+	layerProbeFactor     = 1.5        // How much more bitrate a layer stepped up to may take, without bandwidth estimate
+
+	// RTP Statistics
+	statsWindow = 1 * time.Second // Window over which bitrates and loss rates are measured
+
+	// Mesh Admission
+	meshApprovalKey = "mesh" // Approvals key of the operator mesh key signature
 )
@@ -33,9 +33,12 @@ var globalRelay *Relay
 // RelayInfo contains light information of Relay, in mesh-friendly format
 type RelayInfo struct {
 	ID            peer.ID
-	MeshAddrs     []string                                 // Addresses of this relay
-	MeshRooms     *common.SafeMap[string, shared.RoomInfo] // Rooms hosted by this relay
-	MeshLatencies *common.SafeMap[string, time.Duration]   // Latencies to other peers from this relay
+	MeshAddrs     []string                               // Addresses of this relay
+	MeshRooms     *RoomRegistry                          // Versioned registry of rooms in the mesh
+	MeshLatencies *common.SafeMap[string, time.Duration] // Latencies to other peers from this relay
+	MeshStreams   *common.SafeMap[string, []peer.ID]     // Room streams carried by this relay, room name -> relays from owner to this relay, nearest first
+	Approvals     *common.SafeMap[string, string]        // Signatures admitting this relay to the mesh, signer ID (or "mesh" for operator) -> signature
+	Traffic       *TrafficSummary                        // Media moved by this relay, refreshed with every metrics publish
 }
 
 // Relay structure enhanced with metrics and state
@@ -50,6 +53,7 @@ type Relay struct {
 	LocalRooms           *common.SafeMap[ulid.ULID, *shared.Room]         // room ID -> local Room struct (hosted by this relay)
 	LocalMeshPeers       *common.SafeMap[peer.ID, *RelayInfo]             // peer ID -> mesh peer relay info (connected to this relay)
 	LocalMeshConnections *common.SafeMap[peer.ID, *webrtc.PeerConnection] // peer ID -> PeerConnection (connected to this relay)
+	roomCopies           *common.SafeMap[string, *shared.Room]            // room name -> local copy of remote room, so it's created once
 
 	// Protocols
 	ProtocolRegistry
@@ -57,6 +61,26 @@ type Relay struct {
 	// PubSub Topics
 	pubTopicState        *pubsub.Topic // topic for room states
 	pubTopicRelayMetrics *pubsub.Topic // topic for relay metrics/status
+	pubTopicRelayHealth  *pubsub.Topic // topic for relay suspicion/disconnect gossip
+
+	// State Synchronization
+	stateHistory       *stateHistory                                // sequenced state updates sent by this relay
+	peerStateSequences *common.SafeMap[peer.ID, *peerStateSequence] // peer ID -> sequence tracking of received state updates
+
+	// Stream Routing
+	streamRoutes *common.SafeMap[string, *StreamRoute] // room name -> last chosen route of requested stream
+
+	// Failure Detection
+	failureDetector *failureDetector
+
+	// Mesh Admission
+	admission *meshAdmission
+
+	// Room Recording
+	recordings *common.SafeMap[string, *roomRecording] // room name -> recording of local room
+
+	// HTTP WHIP/WHEP endpoints, nil if disabled
+	httpEndpoint *httpEndpoint
 }
 
 func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay, error) {
@@ -102,6 +126,13 @@ func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay
 		return nil, fmt.Errorf("failed to create pubsub: %w, addrs: %v", err, p2pHost.Addrs())
 	}
 
+	// Load mesh admission settings
+	admission, err := newMeshAdmission()
+	if err != nil {
+		_ = p2pHost.Close()
+		return nil, fmt.Errorf("failed to setup mesh admission: %w", err)
+	}
+
 	// Initialize Ping Service
 	pingSvc := ping.NewPingService(p2pHost)
 
@@ -114,15 +145,25 @@ func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay
 		RelayInfo: RelayInfo{
 			ID:            p2pHost.ID(),
 			MeshAddrs:     addresses,
-			MeshRooms:     common.NewSafeMap[string, shared.RoomInfo](),
+			MeshRooms:     NewRoomRegistry(),
 			MeshLatencies: common.NewSafeMap[string, time.Duration](),
+			MeshStreams:   common.NewSafeMap[string, []peer.ID](),
+			Approvals:     common.NewSafeMap[string, string](),
 		},
-		Host:           p2pHost,
-		PubSub:         p2pPubsub,
-		PingService:    pingSvc,
-		LocalRooms:     common.NewSafeMap[ulid.ULID, *shared.Room](),
-		LocalMeshPeers: common.NewSafeMap[peer.ID, *RelayInfo](),
+		Host:               p2pHost,
+		PubSub:             p2pPubsub,
+		PingService:        pingSvc,
+		LocalRooms:         common.NewSafeMap[ulid.ULID, *shared.Room](),
+		LocalMeshPeers:     common.NewSafeMap[peer.ID, *RelayInfo](),
+		roomCopies:         common.NewSafeMap[string, *shared.Room](),
+		stateHistory:       newStateHistory(stateHistorySize),
+		peerStateSequences: common.NewSafeMap[peer.ID, *peerStateSequence](),
+		streamRoutes:       common.NewSafeMap[string, *StreamRoute](),
+		failureDetector:    newFailureDetector(),
+		admission:          admission,
+		recordings:         common.NewSafeMap[string, *roomRecording](),
 	}
+	r.initCredentials()
 
 	// Add network notifier after relay is initialized
 	p2pHost.Network().Notify(&networkNotifier{relay: r})
@@ -146,6 +187,8 @@ func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay
 
 	// Start background tasks
 	go r.periodicMetricsPublisher(ctx)
+	go r.periodicStateAnnouncer(ctx)
+	go r.periodicFailureDetector(ctx)
 
 	printConnectInstructions(p2pHost)
 
@@ -209,6 +252,9 @@ func InitRelay(ctx context.Context, ctxCancel context.CancelFunc) error {
 		return err
 	}
 
+	// HTTP endpoints create PeerConnections, so they are started once WebRTC is ready
+	globalRelay.startHTTPEndpoint(ctx)
+
 	slog.Info("Relay initialized", "id", globalRelay.ID)
 	return nil
 }
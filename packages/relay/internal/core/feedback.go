@@ -0,0 +1,197 @@
+package core
+
+import (
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/shared"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Structs ---
+
+// feedbackAggregator merges RTCP feedback of all participants of a room into rate-limited feedback for its upstream,
+// the pushing node or the relay the room stream is requested from, which aggregates it further on its side
+type feedbackAggregator struct {
+	mutex            sync.Mutex
+	lastKeyframeReq  time.Time
+	keyframePending  bool                          // whether a keyframe request waits for the rate limit
+	bitrates         map[ulid.ULID]bitrateEstimate // participant ID -> latest bitrate estimate
+	lastBitrateSent  time.Time
+	sendKeyframeReq  func()
+	sendBitrateLimit func(bitrate float32)
+}
+
+// bitrateEstimate is a REMB estimate of a participant. Congestion control estimates of what we send are left out,
+// they start from a guess and only select layers
+type bitrateEstimate struct {
+	bitrate float32
+	at      time.Time
+}
+
+func newFeedbackAggregator(sendKeyframeReq func(), sendBitrateLimit func(bitrate float32)) *feedbackAggregator {
+	return &feedbackAggregator{
+		bitrates:         make(map[ulid.ULID]bitrateEstimate),
+		sendKeyframeReq:  sendKeyframeReq,
+		sendBitrateLimit: sendBitrateLimit,
+	}
+}
+
+// requestKeyframe asks upstream for a keyframe, requests within the rate limit are merged into one sent when it ends
+func (fa *feedbackAggregator) requestKeyframe() {
+	fa.mutex.Lock()
+	defer fa.mutex.Unlock()
+	if fa.keyframePending {
+		return // Already scheduled
+	}
+	wait := keyframeRequestInterval - time.Since(fa.lastKeyframeReq)
+	if wait <= 0 {
+		fa.lastKeyframeReq = time.Now()
+		go fa.sendKeyframeReq()
+		return
+	}
+	fa.keyframePending = true
+	time.AfterFunc(wait, func() {
+		fa.mutex.Lock()
+		fa.keyframePending = false
+		fa.lastKeyframeReq = time.Now()
+		fa.mutex.Unlock()
+		fa.sendKeyframeReq()
+	})
+}
+
+// reportBitrate records the REMB estimate of a participant
+func (fa *feedbackAggregator) reportBitrate(participantID ulid.ULID, bitrate float32, layered bool) {
+	fa.mutex.Lock()
+	defer fa.mutex.Unlock()
+	now := time.Now()
+	fa.bitrates[participantID] = bitrateEstimate{bitrate: bitrate, at: now}
+	fa.sendLimit(now, layered)
+}
+
+// sendLimit sends upstream the bitrate limit of the participant estimates, rate-limited. Upstream is limited to the
+// lowest estimate when all participants receive the same encoding, to the highest when layered video lets each get
+// a layer fitting it. Must hold fa.mutex
+func (fa *feedbackAggregator) sendLimit(now time.Time, layered bool) {
+	if now.Sub(fa.lastBitrateSent) < bitrateFeedbackInterval {
+		return
+	}
+
+	limit := float32(-1)
+	for id, estimate := range fa.bitrates {
+		if now.Sub(estimate.at) > bitrateEstimateTTL {
+			delete(fa.bitrates, id) // Participant left or stopped estimating
+			continue
+		}
+		if limit < 0 || (!layered && estimate.bitrate < limit) || (layered && estimate.bitrate > limit) {
+			limit = estimate.bitrate
+		}
+	}
+	if limit < 0 {
+		return
+	}
+	fa.lastBitrateSent = now
+	go fa.sendBitrateLimit(limit)
+}
+
+// forget drops the feedback state of a participant that left
+func (fa *feedbackAggregator) forget(participantID ulid.ULID) {
+	fa.mutex.Lock()
+	defer fa.mutex.Unlock()
+	delete(fa.bitrates, participantID)
+}
+
+// --- Upstream Feedback ---
+
+// getFeedback returns the feedback aggregator of a room, creating it if needed
+func (sp *StreamProtocol) getFeedback(roomName string) *feedbackAggregator {
+	return sp.feedback.GetOrCreate(roomName, func() *feedbackAggregator {
+		return newFeedbackAggregator(func() {
+			sp.writeUpstreamRTCP(roomName, func(ssrc uint32) rtcp.Packet {
+				return &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+			})
+		}, func(bitrate float32) {
+			sp.writeUpstreamRTCP(roomName, func(ssrc uint32) rtcp.Packet {
+				return &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate, SSRCs: []uint32{ssrc}}
+			})
+		})
+	})
+}
+
+// forgetFeedback drops the feedback state of a participant that left a room
+func (sp *StreamProtocol) forgetFeedback(roomName string, participantID ulid.ULID) {
+	if fa, ok := sp.feedback.Get(roomName); ok {
+		fa.forget(participantID)
+	}
+}
+
+// onParticipantRTCP returns the RTCP handler of a served participant, merging its feedback into the room's,
+// recording its receiver reports and selecting its video layer from them
+func (sp *StreamProtocol) onParticipantRTCP(roomName string, participantID ulid.ULID) shared.RTCPHandler {
+	return func(kind webrtc.RTPCodecType, ssrc webrtc.SSRC, packets []rtcp.Packet) {
+		for _, packet := range packets {
+			if report, ok := packet.(*rtcp.ReceiverReport); ok {
+				if block, ok := sp.getViewerStats(participantID).onReceiverReport(kind, ssrc, report.Reports); ok && kind == webrtc.RTPCodecTypeVideo {
+					sp.onViewerLoss(roomName, participantID, float64(block.FractionLost)/256)
+				}
+			}
+		}
+		if kind != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		fa := sp.getFeedback(roomName)
+		layered := sp.videoLayered(roomName)
+		for _, packet := range packets {
+			switch pkt := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				fa.requestKeyframe()
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				fa.reportBitrate(participantID, pkt.Bitrate, layered)
+				sp.onViewerBitrate(roomName, participantID, float64(pkt.Bitrate))
+			}
+			// NACKs are answered by the room track from its packet cache
+		}
+	}
+}
+
+// watchSendEstimate follows the congestion control estimate of what we send a served participant, selecting its
+// video layer by it. Only changes are reported, so the initial guess of the estimator never counts
+func (sp *StreamProtocol) watchSendEstimate(roomName string, participantID ulid.ULID, pc *webrtc.PeerConnection) {
+	common.OnBandwidthEstimate(pc, func(bitrate int) {
+		sp.onViewerSendEstimate(roomName, participantID, float64(bitrate))
+	})
+}
+
+// videoLayered reports whether the video track of a room has several layers to select from
+func (sp *StreamProtocol) videoLayered(roomName string) bool {
+	room := sp.relay.GetRoomByName(roomName)
+	return room != nil && room.VideoTrack != nil && room.VideoTrack.Layered()
+}
+
+// writeUpstreamRTCP sends feedback for the video track of a room to where the room stream comes from,
+// for each of its simulcast encodings
+func (sp *StreamProtocol) writeUpstreamRTCP(roomName string, makePacket func(ssrc uint32) rtcp.Packet) {
+	conn, ok := sp.incomingConns.Get(roomName)
+	if !ok {
+		if conn, ok = sp.requestedConns.Get(roomName); !ok {
+			return // No upstream right now
+		}
+	}
+	for _, receiver := range conn.pc.GetReceivers() {
+		if track := receiver.Track(); track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		var packets []rtcp.Packet
+		for _, track := range receiver.Tracks() {
+			packets = append(packets, makePacket(uint32(track.SSRC())))
+		}
+		if err := conn.pc.WriteRTCP(packets); err != nil {
+			slog.Error("Failed to send RTCP feedback upstream", "room", roomName, "err", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// newTestFeedback returns an aggregator counting keyframe requests and passing on bitrate limits
+func newTestFeedback() (*feedbackAggregator, *atomic.Int32, chan float32) {
+	keyframes := &atomic.Int32{}
+	limits := make(chan float32, 8)
+	fa := newFeedbackAggregator(func() { keyframes.Add(1) }, func(bitrate float32) { limits <- bitrate })
+	return fa, keyframes, limits
+}
+
+// awaitCount waits for a counter to reach a value, returning its value then or after a timeout
+func awaitCount(counter *atomic.Int32, want int32, timeout time.Duration) int32 {
+	deadline := time.Now().Add(timeout)
+	for counter.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return counter.Load()
+}
+
+func TestFeedbackMergesKeyframeRequests(t *testing.T) {
+	fa, keyframes, _ := newTestFeedback()
+
+	fa.requestKeyframe()
+	if count := awaitCount(keyframes, 1, time.Second); count != 1 {
+		t.Fatalf("sent %d keyframe requests for the first one, want 1", count)
+	}
+	// Requests within the rate limit are merged into one sent when it ends
+	for range 5 {
+		fa.requestKeyframe()
+	}
+	time.Sleep(keyframeRequestInterval / 2)
+	if count := keyframes.Load(); count != 1 {
+		t.Errorf("sent %d keyframe requests within the rate limit, want 1", count)
+	}
+	if count := awaitCount(keyframes, 2, 2*keyframeRequestInterval); count != 2 {
+		t.Fatalf("sent %d keyframe requests after the rate limit, want 2", count)
+	}
+	time.Sleep(keyframeRequestInterval + 100*time.Millisecond)
+	if count := keyframes.Load(); count != 2 {
+		t.Errorf("sent %d keyframe requests in total, want 2", count)
+	}
+}
+
+// sentLimit returns the bitrate limit sent upstream, or -1 if none was
+func sentLimit(limits chan float32) float32 {
+	select {
+	case limit := <-limits:
+		return limit
+	case <-time.After(time.Second):
+		return -1
+	}
+}
+
+func TestFeedbackBitrateLimit(t *testing.T) {
+	first, second, third := ulid.Make(), ulid.Make(), ulid.Make()
+	for _, test := range []struct {
+		name    string
+		layered bool
+		want    float32
+	}{
+		{"single encoding limited to the lowest", false, 1_000_000},
+		{"layered video limited to the highest", true, 5_000_000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fa, _, limits := newTestFeedback()
+			fa.reportBitrate(first, 3_000_000, test.layered)
+			if limit := sentLimit(limits); limit != 3_000_000 {
+				t.Fatalf("sent limit %v for a single estimate, want 3000000", limit)
+			}
+
+			// Within the rate limit, estimates are recorded without sending
+			fa.reportBitrate(second, 1_000_000, test.layered)
+			fa.reportBitrate(third, 5_000_000, test.layered)
+			select {
+			case limit := <-limits:
+				t.Fatalf("sent limit %v within the rate limit", limit)
+			default:
+			}
+
+			fa.mutex.Lock()
+			fa.lastBitrateSent = time.Now().Add(-bitrateFeedbackInterval)
+			fa.sendLimit(time.Now(), test.layered)
+			fa.mutex.Unlock()
+			if limit := sentLimit(limits); limit != test.want {
+				t.Errorf("sent limit %v, want %v", limit, test.want)
+			}
+		})
+	}
+}
+
+func TestFeedbackBitrateExpires(t *testing.T) {
+	fa, _, limits := newTestFeedback()
+	stale, fresh := ulid.Make(), ulid.Make()
+	fa.reportBitrate(stale, 500_000, false)
+	if limit := sentLimit(limits); limit != 500_000 {
+		t.Fatalf("sent limit %v, want 500000", limit)
+	}
+
+	fa.mutex.Lock()
+	fa.bitrates[stale] = bitrateEstimate{bitrate: 500_000, at: time.Now().Add(-bitrateEstimateTTL - time.Second)}
+	fa.lastBitrateSent = time.Time{}
+	fa.mutex.Unlock()
+	fa.reportBitrate(fresh, 2_000_000, false)
+	if limit := sentLimit(limits); limit != 2_000_000 {
+		t.Errorf("sent limit %v with an expired lower estimate, want 2000000", limit)
+	}
+	fa.mutex.Lock()
+	_, kept := fa.bitrates[stale]
+	fa.mutex.Unlock()
+	if kept {
+		t.Error("expired estimate was kept")
+	}
+
+	// Nothing is sent once every estimate expired
+	fa.mutex.Lock()
+	fa.bitrates[fresh] = bitrateEstimate{bitrate: 2_000_000, at: time.Now().Add(-bitrateEstimateTTL - time.Second)}
+	fa.sendLimit(time.Now().Add(bitrateFeedbackInterval), false)
+	fa.mutex.Unlock()
+	select {
+	case limit := <-limits:
+		t.Errorf("sent limit %v without current estimates", limit)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Stream Paths ---
+
+// streamPath returns the relays a local room stream passes through from its owner, nearest first,
+// false if this relay does not carry the stream
+func (r *Relay) streamPath(roomName string) ([]peer.ID, bool) {
+	room := r.GetRoomByName(roomName)
+	if room == nil || !room.IsOnline() {
+		return nil, false
+	}
+	if room.OwnerID == r.ID {
+		return []peer.ID{}, true
+	}
+	upstream, ok := r.StreamProtocol.upstreams.Get(roomName)
+	if !ok {
+		return nil, false
+	}
+	upstreamPath, _ := r.peerStreamPath(upstream, roomName)
+	return append([]peer.ID{upstream}, upstreamPath...), true
+}
+
+// peerStreamPath returns the stream path a mesh peer last published for a room, false if it does not carry the stream
+func (r *Relay) peerStreamPath(peerID peer.ID, roomName string) ([]peer.ID, bool) {
+	info, ok := r.LocalMeshPeers.Get(peerID)
+	if !ok || info.MeshStreams == nil {
+		return nil, false
+	}
+	return info.MeshStreams.Get(roomName)
+}
+
+// refreshMeshStreams updates the published stream paths of all rooms this relay carries
+func (r *Relay) refreshMeshStreams() {
+	for name := range r.MeshStreams.Copy() {
+		if _, ok := r.streamPath(name); !ok {
+			r.MeshStreams.Delete(name)
+		}
+	}
+	for _, room := range r.LocalRooms.Copy() {
+		if path, ok := r.streamPath(room.Name); ok {
+			r.MeshStreams.Set(room.Name, path)
+		}
+	}
+}
+
+// --- Failover ---
+
+// failover is a running failover of a requested room stream, claimed by the first disconnect noticed
+type failover struct {
+	failed peer.ID // upstream relay that went away
+}
+
+// failoverStream re-requests a room stream after its upstream relay went away, from the same or another relay
+// carrying it, backing off between attempts until it flows again or nobody needs it anymore
+func (r *Relay) failoverStream(roomName string, failed peer.ID) {
+	claim := &failover{failed: failed}
+	if r.StreamProtocol.failovers.GetOrCreate(roomName, func() *failover { return claim }) != claim {
+		return // Already failing over
+	}
+	defer r.StreamProtocol.failovers.Delete(roomName)
+
+	backoff := failoverInitialBackoff
+	exclude := failed
+	for attempt := 1; attempt <= failoverAttempts; attempt++ {
+		room := r.GetRoomByName(roomName)
+		if room == nil || room.OwnerID == r.ID || !r.MeshRooms.Has(roomName) {
+			slog.Debug("Room no longer needs failover", "room", roomName)
+			return
+		}
+		if r.StreamProtocol.upstreams.Has(roomName) {
+			return // Stream flows again
+		}
+
+		route, err := r.routeStream(roomName, exclude)
+		if err != nil {
+			slog.Warn("No source for room stream failover", "room", roomName, "attempt", attempt, "err", err)
+		} else {
+			slog.Info("Failing over room stream", "room", roomName, "failed", failed, "source", route.Source, "attempt", attempt)
+			if err = r.StreamProtocol.RequestStream(context.Background(), room, route.Source); err != nil {
+				slog.Error("Failed to request room stream for failover", "room", roomName, "source", route.Source, "err", err)
+			} else if r.StreamProtocol.awaitUpstream(roomName, failoverAttemptTimeout) {
+				slog.Info("Room stream failed over", "room", roomName, "source", route.Source, "attempt", attempt)
+				return
+			}
+		}
+
+		if attempt == failoverAttempts {
+			break // No point waiting after the last attempt
+		}
+		// Failed relay may come back, consider it again after first attempt
+		exclude = ""
+		time.Sleep(backoff)
+		backoff = min(backoff*2, failoverMaxBackoff)
+	}
+	slog.Warn("Giving up room stream failover", "room", roomName, "attempts", failoverAttempts)
+}
+
+// checkStreamRequest verifies a requesting relay can be served a room stream, without loops or exceeding the hop limit
+func (r *Relay) checkStreamRequest(roomName string, requester peer.ID) error {
+	path, ok := r.streamPath(roomName)
+	if !ok {
+		return errors.New("room stream not available")
+	}
+	if slices.Contains(path, requester) {
+		return errors.New("requester is upstream of this relay")
+	}
+	if len(path)+1 > maxStreamHops {
+		return fmt.Errorf("hop limit of %d exceeded", maxStreamHops)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"relay/internal/common"
+	"relay/internal/shared"
+	"slices"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/oklog/ulid/v2"
+)
+
+// addOnlineRoom adds a local room with both tracks set, owned by given relay
+func addOnlineRoom(r *Relay, name string, owner peer.ID) *shared.Room {
+	room := shared.NewRoom(name, ulid.Make(), owner)
+	room.AudioTrack, room.VideoTrack = &shared.RoomTrack{}, &shared.RoomTrack{}
+	r.LocalRooms.Set(room.ID, room)
+	return room
+}
+
+// setUpstream pulls a room stream from a mesh peer, which carries it over given path, nearest first
+func setUpstream(r *Relay, roomName string, upstream peer.ID, path ...peer.ID) {
+	info := r.LocalMeshPeers.GetOrCreate(upstream, func() *RelayInfo {
+		return &RelayInfo{ID: upstream, MeshStreams: common.NewSafeMap[string, []peer.ID]()}
+	})
+	info.MeshStreams.Set(roomName, path)
+	r.StreamProtocol.upstreams.Set(roomName, upstream)
+}
+
+func TestCheckStreamRequest(t *testing.T) {
+	r := newTestRelay(t)
+	owner, upstream, middle, requester := peer.ID("owner"), peer.ID("upstream"), peer.ID("middle"), peer.ID("requester")
+	addOnlineRoom(r, "own", r.ID)
+	addOnlineRoom(r, "pulled", owner)
+	addOnlineRoom(r, "far", owner)
+	addOnlineRoom(r, "unpulled", owner)
+	setUpstream(r, "pulled", upstream, middle, owner)
+	setUpstream(r, "far", upstream, middle, "another", owner)
+	offline := shared.NewRoom("offline", ulid.Make(), r.ID)
+	r.LocalRooms.Set(offline.ID, offline)
+
+	tests := []struct {
+		name      string
+		room      string
+		requester peer.ID
+		allowed   bool
+	}{
+		{"own room", "own", requester, true},
+		{"pulled room within hop limit", "pulled", requester, true},
+		{"requester is upstream", "pulled", upstream, false},
+		{"requester is further upstream", "pulled", middle, false},
+		{"requester is owner", "pulled", owner, false},
+		{"hop limit exceeded", "far", requester, false},
+		{"room not pulled", "unpulled", requester, false},
+		{"room offline", "offline", requester, false},
+		{"unknown room", "unknown", requester, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := r.checkStreamRequest(tt.room, tt.requester); (err == nil) != tt.allowed {
+				t.Errorf("checkStreamRequest(%s, %s) = %v, want allowed %v", tt.room, tt.requester, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestRefreshMeshStreams(t *testing.T) {
+	r := newTestRelay(t)
+	owner, upstream := peer.ID("owner"), peer.ID("upstream")
+	addOnlineRoom(r, "own", r.ID)
+	addOnlineRoom(r, "pulled", owner)
+	setUpstream(r, "pulled", upstream, owner)
+	r.MeshStreams.Set("gone", []peer.ID{owner})
+
+	r.refreshMeshStreams()
+	want := map[string][]peer.ID{"own": {}, "pulled": {upstream, owner}}
+	streams := r.MeshStreams.Copy()
+	if len(streams) != len(want) {
+		t.Fatalf("published streams %v, want %v", streams, want)
+	}
+	for name, path := range want {
+		if got, ok := streams[name]; !ok || !slices.Equal(got, path) {
+			t.Errorf("published path %v of room %s, want %v", got, name, path)
+		}
+	}
+}
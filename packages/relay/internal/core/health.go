@@ -0,0 +1,485 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Structs ---
+
+// memberHealth is the failure detector view of a single mesh relay
+type memberHealth struct {
+	lastAlive   time.Time
+	suspectedAt time.Time // zero if not suspected
+	reason      string    // reason of current suspicion
+	incarnation uint64    // latest known incarnation, gossip about older ones is outdated
+	removedAt   time.Time // when removed from the mesh, zero while a member
+}
+
+// failureDetector is a SWIM-style failure detector over the mesh relays
+type failureDetector struct {
+	mutex      sync.Mutex
+	members    map[peer.ID]*memberHealth
+	probeOrder []peer.ID // shuffled round-robin order of probe targets
+	probeIndex int
+	// Incarnation of this relay, raised to refute gossip about it. Starts at the current time, so gossip about
+	// a previous run is outdated too
+	incarnation uint64
+}
+
+func newFailureDetector() *failureDetector {
+	return &failureDetector{
+		members:     make(map[peer.ID]*memberHealth),
+		incarnation: uint64(time.Now().UnixMilli()),
+	}
+}
+
+// member returns the health of a relay, creating it if needed, must hold fd.mutex
+func (fd *failureDetector) member(peerID peer.ID) *memberHealth {
+	health, ok := fd.members[peerID]
+	if !ok {
+		health = &memberHealth{lastAlive: time.Now()}
+		fd.members[peerID] = health
+	}
+	return health
+}
+
+// ownIncarnation returns the current incarnation of this relay
+func (fd *failureDetector) ownIncarnation() uint64 {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	return fd.incarnation
+}
+
+// refute raises the incarnation of this relay above the one gossip about it applies to,
+// returning false if the gossip is outdated and needs no refutation
+func (fd *failureDetector) refute(incarnation uint64) bool {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if incarnation < fd.incarnation {
+		return false
+	}
+	fd.incarnation = incarnation + 1
+	return true
+}
+
+// incarnationOf returns the latest known incarnation of a relay, 0 if unknown
+func (fd *failureDetector) incarnationOf(peerID peer.ID) uint64 {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	if health, ok := fd.members[peerID]; ok {
+		return health.incarnation
+	}
+	return 0
+}
+
+// pruneRemoved forgets relays removed from the mesh longer than removedRelayTTL ago, gossip about their
+// incarnation has settled by then
+func (fd *failureDetector) pruneRemoved() {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	for peerID, health := range fd.members {
+		if !health.removedAt.IsZero() && time.Since(health.removedAt) > removedRelayTTL {
+			delete(fd.members, peerID)
+		}
+	}
+}
+
+// --- Timings ---
+
+func heartbeatInterval() time.Duration {
+	return time.Duration(max(common.GetFlags().HeartbeatMS, 100)) * time.Millisecond
+}
+
+func suspicionTimeout() time.Duration {
+	return time.Duration(max(common.GetFlags().SuspicionMS, 0)) * time.Millisecond
+}
+
+// probeTimeout is how long a direct or indirect probe may take before it counts as failed
+func probeTimeout() time.Duration {
+	return heartbeatInterval() / 2
+}
+
+// --- PubSub Message Handlers ---
+
+// handleRelayHealthMessages processes suspicion, disconnect and refuting heartbeat gossip from peers.
+func (r *Relay) handleRelayHealthMessages(ctx context.Context, sub *pubsub.Subscription) {
+	slog.Debug("Starting relay health message handler...")
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping relay health message handler")
+			return
+		default:
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, pubsub.ErrSubscriptionCancelled) || errors.Is(err, context.DeadlineExceeded) {
+					slog.Info("Relay health subscription ended", "err", err)
+					return
+				}
+				slog.Error("Error receiving relay health message", "err", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			if msg.GetFrom() == r.Host.ID() {
+				continue
+			}
+			if !r.isRelayAdmitted(msg.GetFrom()) {
+				slog.Debug("Ignoring health message from relay not admitted to mesh", "from", msg.GetFrom())
+				continue
+			}
+
+			var meshMsg gen.MeshMessage
+			if err := proto.Unmarshal(msg.Data, &meshMsg); err != nil {
+				slog.Error("Failed to unmarshal relay health message", "from", msg.GetFrom(), "data_len", len(msg.Data), "err", err)
+				continue
+			}
+
+			switch meshMsgType := meshMsg.GetType().(type) {
+			case *gen.MeshMessage_Heartbeat:
+				if meshMsgType.Heartbeat.GetRelayId() != msg.GetFrom().String() {
+					slog.Error("Peer ID mismatch in heartbeat", "expected", meshMsgType.Heartbeat.GetRelayId(), "actual", msg.GetFrom())
+					continue
+				}
+				if !r.markRelayAlive(msg.GetFrom(), meshMsgType.Heartbeat.GetIncarnation(), true) {
+					slog.Debug("Ignoring outdated heartbeat", "from", msg.GetFrom(), "incarnation", meshMsgType.Heartbeat.GetIncarnation())
+				}
+			case *gen.MeshMessage_SuspectRelay:
+				r.onSuspectRelay(ctx, msg.GetFrom(), meshMsgType.SuspectRelay)
+			case *gen.MeshMessage_Disconnect:
+				r.onDisconnectRelay(ctx, msg.GetFrom(), meshMsgType.Disconnect)
+			default:
+				slog.Warn("Unexpected message type on relay health topic", "from", msg.GetFrom(), "type", meshMsgType)
+			}
+		}
+	}
+}
+
+// onSuspectRelay handles suspicion gossip, refuting it if it's about us
+func (r *Relay) onSuspectRelay(ctx context.Context, from peer.ID, suspect *gen.SuspectRelay) {
+	suspectID, err := peer.Decode(suspect.GetRelayId())
+	if err != nil {
+		slog.Error("Failed to decode suspected relay ID", "from", from, "err", err)
+		return
+	}
+	if suspectID == r.ID {
+		if r.failureDetector.refute(suspect.GetIncarnation()) {
+			slog.Warn("Refuting suspicion about this relay", "from", from, "reason", suspect.GetReason())
+			r.publishHealthMessage(ctx, r.HealthProtocol.newHeartbeat())
+		}
+		return
+	}
+	r.suspectRelay(ctx, suspectID, suspect.GetReason(), suspect.GetIncarnation(), false)
+}
+
+// onDisconnectRelay handles removal gossip, refuting it if it's about us
+func (r *Relay) onDisconnectRelay(ctx context.Context, from peer.ID, disconnect *gen.Disconnect) {
+	relayID, err := peer.Decode(disconnect.GetRelayId())
+	if err != nil {
+		slog.Error("Failed to decode disconnected relay ID", "from", from, "err", err)
+		return
+	}
+	incarnation := disconnect.GetIncarnation()
+	if relayID == r.ID {
+		if r.failureDetector.refute(incarnation) {
+			slog.Warn("Refuting removal of this relay from mesh", "from", from, "reason", disconnect.GetReason())
+			go r.refuteRemoval(ctx)
+		}
+		return
+	}
+	if incarnation < r.failureDetector.incarnationOf(relayID) {
+		slog.Debug("Ignoring outdated removal gossip", "peer", relayID, "from", from, "incarnation", incarnation)
+		return
+	}
+
+	// The relay may only be gone for the sender, it's kept while it still responds to us
+	go func() {
+		if r.respondsToProbe(ctx, relayID) {
+			slog.Info("Ignoring removal gossip of mesh peer still responding", "peer", relayID, "from", from)
+			return
+		}
+		if r.removeRelay(relayID, incarnation) {
+			slog.Info("Mesh peer removed by gossip", "peer", relayID, "from", from, "reason", disconnect.GetReason())
+		}
+	}()
+}
+
+// refuteRemoval restores this relay on relays that removed it. They forgot its admission and rooms,
+// which our status brings back, before the heartbeat of the new incarnation makes outdated removals lose
+func (r *Relay) refuteRemoval(ctx context.Context) {
+	if err := r.publishRelayMetrics(ctx); err != nil {
+		slog.Error("Failed to publish relay metrics on refuted removal", "err", err)
+	} else if err = r.publishRoomStates(ctx); err != nil {
+		slog.Error("Failed to publish room states on refuted removal", "err", err)
+	}
+	r.publishHealthMessage(ctx, r.HealthProtocol.newHeartbeat())
+}
+
+// --- Failure Detection ---
+
+// periodicFailureDetector probes one mesh relay per heartbeat interval, expires unrefuted suspicions and
+// forgets long removed relays
+func (r *Relay) periodicFailureDetector(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping failure detector")
+			return
+		case <-ticker.C:
+			if target, ok := r.nextProbeTarget(); ok {
+				go r.probeRelay(ctx, target)
+			}
+			r.expireSuspicions(ctx)
+			r.failureDetector.pruneRemoved()
+		}
+	}
+}
+
+// nextProbeTarget picks the next mesh relay to probe, in a reshuffled round-robin order
+func (r *Relay) nextProbeTarget() (peer.ID, bool) {
+	fd := r.failureDetector
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	for {
+		if fd.probeIndex >= len(fd.probeOrder) {
+			fd.probeOrder = fd.probeOrder[:0]
+			for peerID := range r.LocalMeshPeers.Copy() {
+				if peerID != r.ID {
+					fd.probeOrder = append(fd.probeOrder, peerID)
+				}
+			}
+			rand.Shuffle(len(fd.probeOrder), func(i, j int) {
+				fd.probeOrder[i], fd.probeOrder[j] = fd.probeOrder[j], fd.probeOrder[i]
+			})
+			fd.probeIndex = 0
+			if len(fd.probeOrder) == 0 {
+				return "", false
+			}
+		}
+
+		target := fd.probeOrder[fd.probeIndex]
+		fd.probeIndex++
+		if r.LocalMeshPeers.Has(target) {
+			return target, true
+		}
+	}
+}
+
+// probeRelay probes a relay directly, then through other relays, and suspects it if neither got a response
+func (r *Relay) probeRelay(ctx context.Context, target peer.ID) {
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout())
+	incarnation, err := r.HealthProtocol.Probe(probeCtx, target)
+	cancel()
+	if err == nil {
+		r.markRelayAlive(target, incarnation, false)
+		return
+	}
+	slog.Debug("Direct probe failed, trying indirect probes", "peer", target, "err", err)
+
+	// Ask random other relays to probe the target for us
+	var helpers []peer.ID
+	for peerID := range r.LocalMeshPeers.Copy() {
+		if peerID != target && peerID != r.ID {
+			helpers = append(helpers, peerID)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	helpers = helpers[:min(len(helpers), max(common.GetFlags().IndirectProbes, 0))]
+
+	indirectCtx, indirectCancel := context.WithTimeout(ctx, probeTimeout()*2)
+	defer indirectCancel()
+	results := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helperID peer.ID) {
+			alive, err := r.HealthProtocol.ProbeIndirect(indirectCtx, helperID, target)
+			if err != nil {
+				slog.Debug("Indirect probe failed", "peer", target, "helper", helperID, "err", err)
+			}
+			results <- alive
+		}(helper)
+	}
+	for range helpers {
+		if <-results {
+			r.markRelayAlive(target, 0, false)
+			return
+		}
+	}
+
+	r.suspectRelay(ctx, target, "no heartbeat", r.failureDetector.incarnationOf(target), true)
+}
+
+// respondsToProbe probes a relay that is still connected to us directly, marking it alive if it responded
+func (r *Relay) respondsToProbe(ctx context.Context, peerID peer.ID) bool {
+	if r.Host.Network().Connectedness(peerID) != network.Connected {
+		return false
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout())
+	incarnation, err := r.HealthProtocol.Probe(probeCtx, peerID)
+	cancel()
+	if err != nil {
+		return false
+	}
+	r.markRelayAlive(peerID, incarnation, false)
+	return true
+}
+
+// markRelayAlive clears any suspicion of a relay, raising its known incarnation. Gossip is only trusted if it's
+// about a newer incarnation than the suspicion, or at least the known one otherwise, so outdated gossip can't win.
+// Returns false if it was outdated
+func (r *Relay) markRelayAlive(peerID peer.ID, incarnation uint64, gossip bool) bool {
+	fd := r.failureDetector
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	health := fd.member(peerID)
+	if gossip && (incarnation < health.incarnation || (!health.suspectedAt.IsZero() && incarnation == health.incarnation)) {
+		return false
+	}
+	if !health.suspectedAt.IsZero() {
+		slog.Info("Suspected mesh peer is alive again", "peer", peerID, "suspected_for", time.Since(health.suspectedAt))
+	}
+	health.lastAlive = time.Now()
+	health.suspectedAt = time.Time{}
+	health.reason = ""
+	health.removedAt = time.Time{}
+	health.incarnation = max(health.incarnation, incarnation)
+	return true
+}
+
+// suspectRelay starts the suspicion timeout of an incarnation of a known mesh relay, gossiping it if we're the first
+// to notice. Suspicion of an older incarnation than known is outdated
+func (r *Relay) suspectRelay(ctx context.Context, peerID peer.ID, reason string, incarnation uint64, gossip bool) {
+	if !r.LocalMeshPeers.Has(peerID) {
+		return
+	}
+
+	fd := r.failureDetector
+	fd.mutex.Lock()
+	health := fd.member(peerID)
+	if !health.suspectedAt.IsZero() || incarnation < health.incarnation {
+		fd.mutex.Unlock()
+		return
+	}
+	health.suspectedAt = time.Now()
+	health.reason = reason
+	health.incarnation = incarnation
+	fd.mutex.Unlock()
+
+	slog.Warn("Suspecting mesh peer", "peer", peerID, "reason", reason, "timeout", suspicionTimeout())
+	if gossip {
+		r.publishHealthMessage(ctx, &gen.MeshMessage{
+			Type: &gen.MeshMessage_SuspectRelay{
+				SuspectRelay: &gen.SuspectRelay{
+					RelayId:     peerID.String(),
+					Reason:      reason,
+					Incarnation: incarnation,
+				},
+			},
+		})
+	}
+}
+
+// expireSuspicions removes relays that did not refute their suspicion in time and gossips their removal
+func (r *Relay) expireSuspicions(ctx context.Context) {
+	fd := r.failureDetector
+	fd.mutex.Lock()
+	expired := make(map[peer.ID]memberHealth)
+	for peerID, health := range fd.members {
+		if !health.suspectedAt.IsZero() && time.Since(health.suspectedAt) > suspicionTimeout() {
+			expired[peerID] = *health
+		}
+	}
+	fd.mutex.Unlock()
+
+	for peerID, health := range expired {
+		// Last chance, a connection might have come back since
+		if r.respondsToProbe(ctx, peerID) {
+			continue
+		}
+		if !r.removeRelay(peerID, health.incarnation) {
+			continue
+		}
+
+		slog.Warn("Suspected mesh peer did not refute in time, removing from mesh", "peer", peerID, "reason", health.reason)
+		r.publishHealthMessage(ctx, &gen.MeshMessage{
+			Type: &gen.MeshMessage_Disconnect{
+				Disconnect: &gen.Disconnect{
+					RelayId:     peerID.String(),
+					Reason:      fmt.Sprintf("unresponsive: %s", health.reason),
+					Incarnation: health.incarnation,
+				},
+			},
+		})
+	}
+}
+
+// removeRelay removes an incarnation of a relay and cleans up everything associated with it, returning false if
+// the relay has a newer incarnation meanwhile. The known incarnation is kept for removedRelayTTL, so outdated
+// gossip about it loses once the relay is back
+func (r *Relay) removeRelay(peerID peer.ID, incarnation uint64) bool {
+	fd := r.failureDetector
+	fd.mutex.Lock()
+	health := fd.member(peerID)
+	if incarnation < health.incarnation {
+		fd.mutex.Unlock()
+		return false
+	}
+	health.suspectedAt = time.Time{}
+	health.reason = ""
+	if health.removedAt.IsZero() {
+		health.removedAt = time.Now()
+	}
+	fd.mutex.Unlock()
+
+	r.onPeerDisconnected(peerID)
+	return true
+}
+
+// onPeerConnectionLost suspects a mesh peer whose last connection closed, giving it time to come back before removal
+func (r *Relay) onPeerConnectionLost(peerID peer.ID) {
+	if r.Host.Network().Connectedness(peerID) == network.Connected {
+		return // Other connections to the peer remain
+	}
+	if !r.LocalMeshPeers.Has(peerID) {
+		r.onPeerDisconnected(peerID)
+		return
+	}
+	r.suspectRelay(context.Background(), peerID, "connection lost", r.failureDetector.incarnationOf(peerID), true)
+}
+
+// --- Health Publishing ---
+
+// publishHealthMessage gossips a health message to the mesh
+func (r *Relay) publishHealthMessage(ctx context.Context, msg *gen.MeshMessage) {
+	if r.pubTopicRelayHealth == nil {
+		slog.Warn("Cannot publish relay health message: topic is nil")
+		return
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		slog.Error("Failed to marshal relay health message", "err", err)
+		return
+	}
+	if pubErr := r.pubTopicRelayHealth.Publish(ctx, data); pubErr != nil {
+		slog.Error("Failed to publish relay health message", "err", pubErr)
+	}
+}
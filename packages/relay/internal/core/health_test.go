@@ -0,0 +1,185 @@
+package core
+
+import (
+	"context"
+	"io"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// memberOf returns a copy of the failure detector view of a relay, false if it has none
+func memberOf(r *Relay, peerID peer.ID) (memberHealth, bool) {
+	fd := r.failureDetector
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	health, ok := fd.members[peerID]
+	if !ok {
+		return memberHealth{}, false
+	}
+	return *health, true
+}
+
+// setHealthFlags changes the failure detector flags for a test
+func setHealthFlags(t *testing.T, heartbeatMS, suspicionMS, indirectProbes int) {
+	t.Helper()
+	flags := common.GetFlags()
+	previous := *flags
+	flags.HeartbeatMS, flags.SuspicionMS, flags.IndirectProbes = heartbeatMS, suspicionMS, indirectProbes
+	t.Cleanup(func() {
+		flags.HeartbeatMS, flags.SuspicionMS, flags.IndirectProbes = previous.HeartbeatMS, previous.SuspicionMS, previous.IndirectProbes
+	})
+}
+
+func TestSuspicion(t *testing.T) {
+	r := newTestRelay(t)
+	ctx := context.Background()
+	suspect := peer.ID("suspect")
+
+	r.suspectRelay(ctx, suspect, "no heartbeat", 5, false)
+	if _, ok := memberOf(r, suspect); ok {
+		t.Fatal("relay not in the mesh was suspected")
+	}
+
+	r.LocalMeshPeers.Set(suspect, &RelayInfo{ID: suspect})
+	r.suspectRelay(ctx, suspect, "no heartbeat", 5, false)
+	if health, _ := memberOf(r, suspect); health.suspectedAt.IsZero() || health.incarnation != 5 || health.reason != "no heartbeat" {
+		t.Fatalf("suspicion recorded as %+v, want incarnation 5 suspected for no heartbeat", health)
+	}
+
+	// Heartbeats gossiped about the suspected incarnation or older ones can't clear the suspicion
+	for _, incarnation := range []uint64{4, 5} {
+		if r.markRelayAlive(suspect, incarnation, true) {
+			t.Errorf("heartbeat of incarnation %d cleared suspicion of incarnation 5", incarnation)
+		}
+	}
+	if !r.markRelayAlive(suspect, 6, true) {
+		t.Fatal("heartbeat of a newer incarnation did not clear the suspicion")
+	}
+	if health, _ := memberOf(r, suspect); !health.suspectedAt.IsZero() || health.incarnation != 6 {
+		t.Errorf("relay is %+v after refuting, want unsuspected incarnation 6", health)
+	}
+
+	r.suspectRelay(ctx, suspect, "outdated", 5, false)
+	if health, _ := memberOf(r, suspect); !health.suspectedAt.IsZero() {
+		t.Error("suspicion of an outdated incarnation was recorded")
+	}
+
+	// Responding to our own probe clears a suspicion, whatever incarnation it was about
+	r.suspectRelay(ctx, suspect, "ping failed", 6, false)
+	if !r.markRelayAlive(suspect, 0, false) {
+		t.Error("probe response did not clear the suspicion")
+	}
+}
+
+// TestSuspicionExpiry lets a suspicion expire, the relay is removed and forgotten once its removal settled
+func TestSuspicionExpiry(t *testing.T) {
+	setHealthFlags(t, 100, 0, 0)
+	r := newTestRelay(t)
+	suspect := peer.ID("suspect")
+	r.LocalMeshPeers.Set(suspect, &RelayInfo{ID: suspect})
+	r.suspectRelay(context.Background(), suspect, "connection lost", 3, false)
+
+	time.Sleep(time.Millisecond)
+	r.expireSuspicions(context.Background())
+	if r.LocalMeshPeers.Has(suspect) {
+		t.Fatal("relay with expired suspicion is still a mesh peer")
+	}
+	health, ok := memberOf(r, suspect)
+	if !ok || health.removedAt.IsZero() || health.incarnation != 3 {
+		t.Fatalf("removed relay is %+v, want its incarnation 3 kept as removed", health)
+	}
+	if r.removeRelay(suspect, 2) {
+		t.Error("removal gossip of an older incarnation was applied")
+	}
+
+	r.failureDetector.pruneRemoved()
+	if _, ok = memberOf(r, suspect); !ok {
+		t.Fatal("removed relay forgotten before its removal settled")
+	}
+	r.failureDetector.mutex.Lock()
+	r.failureDetector.members[suspect].removedAt = time.Now().Add(-removedRelayTTL - time.Second)
+	r.failureDetector.mutex.Unlock()
+	r.failureDetector.pruneRemoved()
+	if _, ok = memberOf(r, suspect); ok {
+		t.Error("relay removed long ago is still remembered")
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	r := newTestRelay(t)
+	own := r.failureDetector.ownIncarnation()
+	from := peer.ID("gossiper")
+
+	if r.failureDetector.refute(own - 1) {
+		t.Error("refuted gossip about an older incarnation")
+	}
+	r.onSuspectRelay(context.Background(), from, &gen.SuspectRelay{RelayId: r.ID.String(), Reason: "no heartbeat", Incarnation: own})
+	if incarnation := r.failureDetector.ownIncarnation(); incarnation != own+1 {
+		t.Fatalf("incarnation %d after refuting suspicion of %d, want %d", incarnation, own, own+1)
+	}
+	r.onSuspectRelay(context.Background(), from, &gen.SuspectRelay{RelayId: r.ID.String(), Reason: "no heartbeat", Incarnation: own})
+	if incarnation := r.failureDetector.ownIncarnation(); incarnation != own+1 {
+		t.Errorf("incarnation %d after outdated suspicion, want it kept at %d", incarnation, own+1)
+	}
+}
+
+// newSilentHealthPeer returns a host that takes health probes without ever answering them, counting them
+func newSilentHealthPeer(t *testing.T) (host.Host, chan struct{}) {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	asked := make(chan struct{}, 4)
+	h.SetStreamHandler(protocolHealth, func(stream network.Stream) {
+		asked <- struct{}{}
+		_, _ = io.Copy(io.Discard, stream) // Until the prober gives up
+		_ = stream.Close()
+	})
+	return h, asked
+}
+
+// TestIndirectProbeTimeout probes a relay which doesn't respond, with a helper which never answers the indirect
+// probe. The probe has to give up in time and suspect the relay
+func TestIndirectProbeTimeout(t *testing.T) {
+	setHealthFlags(t, 100, 5000, 2)
+	r := newTestRelay(t)
+	target, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")) // Doesn't speak the health protocol
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = target.Close() })
+	helper, asked := newSilentHealthPeer(t)
+
+	for _, h := range []host.Host{target, helper} {
+		if err = r.Host.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+		r.LocalMeshPeers.Set(h.ID(), &RelayInfo{ID: h.ID()})
+	}
+
+	start := time.Now()
+	r.probeRelay(context.Background(), target.ID())
+	if elapsed := time.Since(start); elapsed > 4*probeTimeout() {
+		t.Errorf("probe took %v, want it to give up after about %v", elapsed, 3*probeTimeout())
+	}
+	select {
+	case <-asked:
+	case <-time.After(time.Second):
+		t.Error("helper was not asked for an indirect probe")
+	}
+	if health, _ := memberOf(r, target.ID()); health.suspectedAt.IsZero() || health.reason != "no heartbeat" {
+		t.Errorf("unresponsive relay is %+v, want it suspected", health)
+	}
+	if health, _ := memberOf(r, helper.ID()); !health.suspectedAt.IsZero() {
+		t.Error("helper was suspected for not answering the indirect probe")
+	}
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"relay/internal/common"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Constants ---
+const (
+	contentTypeSDP     = "application/sdp"
+	contentTypeSDPFrag = "application/trickle-ice-sdpfrag"
+	maxHTTPSDPSize     = 64 * 1024        // Upper limit of SDP bodies accepted over HTTP
+	httpHeaderTimeout  = 10 * time.Second // Timeout for reading HTTP request headers
+)
+
+// --- Structs ---
+
+// httpSession is a WebRTC session negotiated over an HTTP endpoint
+type httpSession struct {
+	ID   ulid.ULID
+	Room string
+	pc   *webrtc.PeerConnection
+}
+
+// httpEndpoint serves the HTTP WHIP/WHEP and admin endpoints of the relay
+type httpEndpoint struct {
+	relay    *Relay
+	server   *http.Server
+	sessions *common.SafeMap[ulid.ULID, *httpSession] // session ID -> session created over HTTP
+}
+
+func newHTTPEndpoint(relay *Relay, port int) *httpEndpoint {
+	he := &httpEndpoint{
+		relay:    relay,
+		sessions: common.NewSafeMap[ulid.ULID, *httpSession](),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /whip/{room}", he.handleWHIP)
+	mux.HandleFunc("PATCH /whip/{room}/{session}", he.handlePatchSession)
+	mux.HandleFunc("DELETE /whip/{room}/{session}", he.handleDeleteSession)
+	mux.HandleFunc("OPTIONS /whip/{room}", he.handleOptions)
+	mux.HandleFunc("OPTIONS /whip/{room}/{session}", he.handleSessionOptions)
+	mux.HandleFunc("POST /whep/{room}", he.handleWHEP)
+	mux.HandleFunc("PATCH /whep/{room}/{session}", he.handlePatchSession)
+	mux.HandleFunc("DELETE /whep/{room}/{session}", he.handleDeleteSession)
+	mux.HandleFunc("OPTIONS /whep/{room}", he.handleOptions)
+	mux.HandleFunc("OPTIONS /whep/{room}/{session}", he.handleSessionOptions)
+	mux.HandleFunc("POST /admin/rooms/{room}/recording", he.handleStartRecording)
+	mux.HandleFunc("DELETE /admin/rooms/{room}/recording", he.handleStopRecording)
+
+	he.server = &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           withCORS(mux),
+		ReadHeaderTimeout: httpHeaderTimeout,
+	}
+	return he
+}
+
+// start serves the endpoints until the context is done
+func (he *httpEndpoint) start(ctx context.Context) {
+	go func() {
+		slog.Info("Serving HTTP WHIP/WHEP endpoints", "addr", he.server.Addr)
+		if err := he.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP endpoint stopped", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := he.server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shutdown HTTP endpoint", "err", err)
+		}
+	}()
+}
+
+// --- Helpers ---
+
+// withCORS allows browsers of other origins to use the endpoints
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, ETag, Link")
+		next.ServeHTTP(w, req)
+	})
+}
+
+// authorize checks the bearer token of a request if one is required, replying 401 if it does not match
+func (he *httpEndpoint) authorize(w http.ResponseWriter, req *http.Request) bool {
+	token := common.GetFlags().HTTPToken
+	if len(token) == 0 {
+		return true
+	}
+	given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// readSDP reads the SDP body of a request, replying with an error status if it's missing or not of given type
+func readSDP(w http.ResponseWriter, req *http.Request, contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != contentType {
+		http.Error(w, "content type must be "+contentType, http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxHTTPSDPSize+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return "", false
+	}
+	if len(body) == 0 || len(body) > maxHTTPSDPSize {
+		http.Error(w, "invalid SDP body size", http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
+
+// getSession returns the session addressed by a request URL, replying with an error status if there is none
+func (he *httpEndpoint) getSession(w http.ResponseWriter, req *http.Request) (*httpSession, bool) {
+	id, err := ulid.Parse(req.PathValue("session"))
+	if err != nil {
+		http.Error(w, "invalid session ID", http.StatusBadRequest)
+		return nil, false
+	}
+	session, ok := he.sessions.Get(id)
+	if !ok || session.Room != req.PathValue("room") {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+// signalingErrorStatus maps a signaling error code to its HTTP status
+func signalingErrorStatus(code string) int {
+	switch code {
+	case signalErrorRoomTaken:
+		return http.StatusConflict
+	case signalErrorNotOwner, signalErrorUnauthorized:
+		return http.StatusForbidden
+	case signalErrorBadRequest:
+		return http.StatusBadRequest
+	case signalErrorUnavailable:
+		return http.StatusServiceUnavailable
+	case signalErrorTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parseTrickleFragment returns the ICE candidates of a trickle ICE SDP fragment (RFC 8840)
+func parseTrickleFragment(fragment string) []webrtc.ICECandidateInit {
+	var candidates []webrtc.ICECandidateInit
+	var ufrag, mid *string
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+			ufrag = &value
+		} else if value, ok = strings.CutPrefix(line, "a=mid:"); ok {
+			mid = &value
+		} else if value, ok = strings.CutPrefix(line, "a="); ok && strings.HasPrefix(value, "candidate:") {
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:        value,
+				SDPMid:           mid,
+				UsernameFragment: ufrag,
+			})
+		}
+	}
+	return candidates
+}
+
+// completeAnswer answers the remote offer set on a PeerConnection with all ICE candidates gathered,
+// as HTTP sessions have no channel to trickle them
+func completeAnswer(ctx context.Context, pc *webrtc.PeerConnection) (*webrtc.SessionDescription, error) {
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create answer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return nil, fmt.Errorf("failed to set local description: %w", err)
+	}
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("ICE gathering interrupted: %w", ctx.Err())
+	case <-time.After(signalingTimeout):
+		return nil, errors.New("ICE gathering timed out")
+	}
+	return pc.LocalDescription(), nil
+}
+
+// --- Handlers ---
+
+func (he *httpEndpoint) handleOptions(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Accept-Post", contentTypeSDP)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSessionOptions answers CORS preflights of browsers trickling candidates to or deleting a session
+func (he *httpEndpoint) handleSessionOptions(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Accept-Patch", contentTypeSDPFrag)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePatchSession adds ICE candidates trickled by the client of a session
+func (he *httpEndpoint) handlePatchSession(w http.ResponseWriter, req *http.Request) {
+	if !he.authorize(w, req) {
+		return
+	}
+	session, ok := he.getSession(w, req)
+	if !ok {
+		return
+	}
+	fragment, ok := readSDP(w, req, contentTypeSDPFrag)
+	if !ok {
+		return
+	}
+	for _, candidate := range parseTrickleFragment(fragment) {
+		if err := session.pc.AddICECandidate(candidate); err != nil {
+			slog.Error("Failed to add trickled ICE candidate", "room", session.Room, "session", session.ID, "err", err)
+			http.Error(w, "invalid ICE candidate", http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteSession tears down a session created over HTTP
+func (he *httpEndpoint) handleDeleteSession(w http.ResponseWriter, req *http.Request) {
+	if !he.authorize(w, req) {
+		return
+	}
+	session, ok := he.getSession(w, req)
+	if !ok {
+		return
+	}
+	he.sessions.Delete(session.ID)
+	if err := session.pc.Close(); err != nil {
+		slog.Error("Failed to close PeerConnection of HTTP session", "room", session.Room, "session", session.ID, "err", err)
+	}
+	slog.Info("HTTP session deleted", "room", session.Room, "session", session.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// --- Initialization ---
+
+// startHTTPEndpoint starts the HTTP WHIP/WHEP endpoints if a port is configured
+func (r *Relay) startHTTPEndpoint(ctx context.Context) {
+	port := common.GetFlags().HTTPPort
+	if port <= 0 {
+		return
+	}
+	r.httpEndpoint = newHTTPEndpoint(r, port)
+	r.httpEndpoint.start(ctx)
+}
@@ -0,0 +1,284 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"relay/internal/common"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var initWebRTCOnce sync.Once
+
+// newTestHTTPEndpoint serves the HTTP endpoints of a test relay, requiring given bearer token if set
+func newTestHTTPEndpoint(t *testing.T, token string) (*Relay, *httptest.Server) {
+	t.Helper()
+	flags := common.GetFlags()
+	initWebRTCOnce.Do(func() {
+		flags.UDPMuxPort = 0 // Sessions get ports of their own
+		if err := common.InitWebRTCAPI(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	previous := flags.HTTPToken
+	flags.HTTPToken = token
+	t.Cleanup(func() { flags.HTTPToken = previous })
+
+	r := newTestRelay(t)
+	r.httpEndpoint = newHTTPEndpoint(r, 0)
+	server := httptest.NewServer(r.httpEndpoint.server.Handler)
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+// doHTTP sends a request to a test endpoint, returning the response with its body read
+func doHTTP(t *testing.T, method, url, contentType, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+// newTestOffer returns a complete offer of a client PeerConnection with an audio and video transceiver each
+func newTestOffer(t *testing.T, direction webrtc.RTPTransceiverDirection) (*webrtc.PeerConnection, string) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	for _, codec := range []webrtc.RTPCodecCapability{testOpusCodec, testVP8Codec} {
+		if direction == webrtc.RTPTransceiverDirectionSendonly {
+			track, err := webrtc.NewTrackLocalStaticRTP(codec, strings.Split(codec.MimeType, "/")[0], "stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: direction})
+		} else {
+			kind := webrtc.RTPCodecTypeAudio
+			if codec.MimeType == webrtc.MimeTypeVP8 {
+				kind = webrtc.RTPCodecTypeVideo
+			}
+			_, err = pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: direction})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc, pc.LocalDescription().SDP
+}
+
+func TestHTTPAuthorization(t *testing.T) {
+	_, server := newTestHTTPEndpoint(t, "secret")
+	for _, test := range []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"not a bearer token", "Basic secret", http.StatusUnauthorized},
+		{"token", "Bearer secret", http.StatusUnsupportedMediaType}, // Authorized, fails on the missing SDP
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if len(test.authorization) > 0 {
+				header.Set("Authorization", test.authorization)
+			}
+			for _, path := range []string{"/whip/room", "/whep/room"} {
+				resp, _ := doHTTP(t, http.MethodPost, server.URL+path, "", "", header)
+				if resp.StatusCode != test.status {
+					t.Errorf("POST %s answered %d, want %d", path, resp.StatusCode, test.status)
+				}
+				if test.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+					t.Errorf("POST %s without authorization doesn't ask for a bearer token", path)
+				}
+			}
+			want := http.StatusNotFound // Authorized, fails on the unknown session
+			if test.status == http.StatusUnauthorized {
+				want = http.StatusUnauthorized
+			}
+			resp, _ := doHTTP(t, http.MethodDelete, server.URL+"/whip/room/01ARZ3NDEKTSV4RRFFQ69G5FAV", "", "", header)
+			if resp.StatusCode != want {
+				t.Errorf("DELETE of session answered %d, want %d", resp.StatusCode, want)
+			}
+		})
+	}
+}
+
+// TestHTTPPreflight answers CORS preflights of browsers, which never send the bearer token along
+func TestHTTPPreflight(t *testing.T) {
+	_, server := newTestHTTPEndpoint(t, "secret")
+	for _, test := range []struct {
+		path   string
+		header string
+		accept string
+	}{
+		{"/whip/room", "Accept-Post", contentTypeSDP},
+		{"/whep/room", "Accept-Post", contentTypeSDP},
+		{"/whip/room/session", "Accept-Patch", contentTypeSDPFrag},
+		{"/whep/room/session", "Accept-Patch", contentTypeSDPFrag},
+	} {
+		resp, _ := doHTTP(t, http.MethodOptions, server.URL+test.path, "", "", http.Header{"Access-Control-Request-Method": {"POST"}})
+		if resp.StatusCode != http.StatusNoContent || resp.Header.Get(test.header) != test.accept {
+			t.Errorf("OPTIONS %s answered %d with %s %q, want 204 with %q", test.path, resp.StatusCode, test.header, resp.Header.Get(test.header), test.accept)
+		}
+		if resp.Header.Get("Access-Control-Allow-Origin") != "*" || !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization") ||
+			!strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "Location") {
+			t.Errorf("OPTIONS %s answered without CORS headers: %v", test.path, resp.Header)
+		}
+	}
+}
+
+func TestHTTPSDPBody(t *testing.T) {
+	_, server := newTestHTTPEndpoint(t, "")
+	for _, test := range []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"wrong content type", "application/json", "v=0", http.StatusUnsupportedMediaType},
+		{"empty body", contentTypeSDP, "", http.StatusBadRequest},
+		{"too large body", contentTypeSDP, strings.Repeat("a", maxHTTPSDPSize+1), http.StatusBadRequest},
+		{"invalid offer", contentTypeSDP + "; charset=utf-8", "not an offer", http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp, _ := doHTTP(t, http.MethodPost, server.URL+"/whip/"+strings.ReplaceAll(test.name, " ", "-"), test.contentType, test.body, nil)
+			if resp.StatusCode != test.status {
+				t.Errorf("answered %d, want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestParseTrickleFragment(t *testing.T) {
+	fragment := "a=ice-options:trickle ice2\r\n" +
+		"a=group:BUNDLE 0 1\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+		"a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0 ufrag EsAw network-id 1\r\n" +
+		"a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ host generation 0 ufrag EsAw network-id 2\r\n" +
+		"a=end-of-candidates\r\n"
+	candidates := parseTrickleFragment(fragment)
+	if len(candidates) != 2 {
+		t.Fatalf("parsed %d candidates, want 2", len(candidates))
+	}
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate.Candidate, "candidate:") || strings.HasSuffix(candidate.Candidate, "\r") {
+			t.Errorf("candidate %q, want its attribute value only", candidate.Candidate)
+		}
+		if candidate.SDPMid == nil || *candidate.SDPMid != "0" || candidate.UsernameFragment == nil || *candidate.UsernameFragment != "EsAw" {
+			t.Errorf("candidate %q not of media 0 with ufrag EsAw", candidate.Candidate)
+		}
+	}
+	if candidates := parseTrickleFragment("a=end-of-candidates\r\n"); len(candidates) != 0 {
+		t.Errorf("parsed %d candidates of a fragment ending candidates, want none", len(candidates))
+	}
+}
+
+func TestSignalingErrorStatus(t *testing.T) {
+	for code, status := range map[string]int{
+		signalErrorRoomTaken:    http.StatusConflict,
+		signalErrorNotOwner:     http.StatusForbidden,
+		signalErrorUnauthorized: http.StatusForbidden,
+		signalErrorBadRequest:   http.StatusBadRequest,
+		signalErrorUnavailable:  http.StatusServiceUnavailable,
+		signalErrorTimeout:      http.StatusGatewayTimeout,
+		signalErrorInternal:     http.StatusInternalServerError,
+		"unknown":               http.StatusInternalServerError,
+	} {
+		if got := signalingErrorStatus(code); got != status {
+			t.Errorf("signalingErrorStatus(%q) = %d, want %d", code, got, status)
+		}
+	}
+}
+
+// TestWHIPSession pushes a room over WHIP, trickles a candidate to the session and tears it down again
+func TestWHIPSession(t *testing.T) {
+	r, server := newTestHTTPEndpoint(t, "")
+	_, offer := newTestOffer(t, webrtc.RTPTransceiverDirectionSendonly)
+
+	resp, answer := doHTTP(t, http.MethodPost, server.URL+"/whip/room", contentTypeSDP, offer, nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != contentTypeSDP || !strings.HasPrefix(answer, "v=0") {
+		t.Fatalf("WHIP offer answered %d with %q: %s", resp.StatusCode, resp.Header.Get("Content-Type"), answer)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/whip/room/") {
+		t.Fatalf("session location %q, want under /whip/room/", location)
+	}
+	if !r.StreamProtocol.incomingConns.Has("room") {
+		t.Error("pushed room has no incoming connection")
+	}
+
+	// Room is taken until the session goes away
+	_, second := newTestOffer(t, webrtc.RTPTransceiverDirectionSendonly)
+	if resp, _ = doHTTP(t, http.MethodPost, server.URL+"/whip/room", contentTypeSDP, second, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second push to the room answered %d, want 409", resp.StatusCode)
+	}
+
+	fragment := "a=ice-ufrag:abcd\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 127.0.0.1 5000 typ host\r\n"
+	for _, test := range []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"trickled candidate", location, fragment, http.StatusNoContent},
+		{"invalid candidate", location, "a=candidate:broken\r\n", http.StatusBadRequest},
+		{"invalid session ID", "/whip/room/session", fragment, http.StatusBadRequest},
+		{"unknown session", "/whip/room/01ARZ3NDEKTSV4RRFFQ69G5FAV", fragment, http.StatusNotFound},
+		{"session of other room", strings.Replace(location, "/room/", "/other/", 1), fragment, http.StatusNotFound},
+	} {
+		if resp, _ = doHTTP(t, http.MethodPatch, server.URL+test.path, contentTypeSDPFrag, test.body, nil); resp.StatusCode != test.status {
+			t.Errorf("PATCH of %s answered %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+
+	if resp, _ = doHTTP(t, http.MethodDelete, server.URL+location, "", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE of session answered %d, want 200", resp.StatusCode)
+	}
+	if resp, _ = doHTTP(t, http.MethodDelete, server.URL+location, "", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE of session answered %d, want 404", resp.StatusCode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.StreamProtocol.incomingConns.Has("room") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.StreamProtocol.incomingConns.Has("room") {
+		t.Error("deleted session still pushes to the room")
+	}
+}
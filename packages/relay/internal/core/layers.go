@@ -0,0 +1,252 @@
+package core
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"relay/internal/shared"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Structs ---
+
+// viewerLayers keeps what the video layer served to a participant is chosen from
+type viewerLayers struct {
+	mutex          sync.Mutex
+	estimate       float64 // bits per second, from the participant's bandwidth estimate
+	estimateAt     time.Time
+	sendEstimate   float64 // bits per second, from congestion control of what we send it
+	sendEstimateAt time.Time
+	lossRate       float64 // reported by the participant for its video
+	lossAt         time.Time
+	viewport       int // height the participant displays video at, 0 if not told
+}
+
+// --- Selection ---
+
+// choose returns the layer to serve out of the received ones, the best one fitting the participant's bandwidth
+// and viewport. The lower of our own and the participant's bandwidth estimate counts. Without either, steps from
+// the current layer by reported loss
+func (vl *viewerLayers) choose(layers []shared.LayerInfo, current shared.Layer, hasCurrent bool, now time.Time) shared.Layer {
+	vl.mutex.Lock()
+	defer vl.mutex.Unlock()
+
+	// Layers larger than the smallest one covering the viewport are of no use
+	maxHeight := math.MaxInt
+	if vl.viewport > 0 {
+		for _, layer := range layers {
+			if layer.Height >= vl.viewport && layer.Height < maxHeight {
+				maxHeight = layer.Height
+			}
+		}
+	}
+
+	budget := math.Inf(1)
+	sendEstimated := now.Sub(vl.sendEstimateAt) <= bitrateEstimateTTL
+	if sendEstimated {
+		budget = vl.sendEstimate * layerBitrateHeadroom
+	}
+	if now.Sub(vl.estimateAt) <= bitrateEstimateTTL {
+		budget = min(budget, vl.estimate*layerBitrateHeadroom)
+	} else if !sendEstimated && hasCurrent && now.Sub(vl.lossAt) <= bitrateEstimateTTL {
+		for _, layer := range layers {
+			if layer.Layer != current {
+				continue
+			}
+			switch {
+			case vl.lossRate >= layerLossHigh:
+				budget = layer.Bitrate * layerBitrateHeadroom
+			case vl.lossRate <= layerLossLow:
+				budget = layer.Bitrate * layerProbeFactor
+			default:
+				budget = layer.Bitrate
+			}
+		}
+	}
+
+	// Layers are sorted by ascending bitrate, so the lowest one fitting the viewport is kept if none fits the budget
+	chosen, found := shared.Layer{}, false
+	for _, layer := range layers {
+		if layer.Height > maxHeight {
+			continue
+		}
+		if !found || layer.Bitrate <= budget {
+			chosen, found = layer.Layer, true
+		}
+	}
+	if !found {
+		return current
+	}
+	return chosen
+}
+
+// getViewerLayers returns the layer selection state of a served participant, creating it if needed
+func (sp *StreamProtocol) getViewerLayers(participantID ulid.ULID) *viewerLayers {
+	return sp.viewerLayers.GetOrCreate(participantID, func() *viewerLayers {
+		return &viewerLayers{}
+	})
+}
+
+// onViewerBitrate records the bandwidth estimate of a served participant and reselects its video layer
+func (sp *StreamProtocol) onViewerBitrate(roomName string, participantID ulid.ULID, bitrate float64) {
+	vl := sp.getViewerLayers(participantID)
+	vl.mutex.Lock()
+	vl.estimate = bitrate
+	vl.estimateAt = time.Now()
+	vl.mutex.Unlock()
+	sp.selectVideoLayer(roomName, participantID)
+}
+
+// onViewerSendEstimate records the congestion control estimate of what we send a served participant
+// and reselects its video layer
+func (sp *StreamProtocol) onViewerSendEstimate(roomName string, participantID ulid.ULID, bitrate float64) {
+	vl := sp.getViewerLayers(participantID)
+	vl.mutex.Lock()
+	vl.sendEstimate = bitrate
+	vl.sendEstimateAt = time.Now()
+	vl.mutex.Unlock()
+	sp.selectVideoLayer(roomName, participantID)
+}
+
+// onViewerLoss records the video loss rate reported by a served participant and reselects its video layer
+func (sp *StreamProtocol) onViewerLoss(roomName string, participantID ulid.ULID, lossRate float64) {
+	vl := sp.getViewerLayers(participantID)
+	vl.mutex.Lock()
+	vl.lossRate = lossRate
+	vl.lossAt = time.Now()
+	vl.mutex.Unlock()
+	sp.selectVideoLayer(roomName, participantID)
+}
+
+// selectVideoLayer chooses the video layer served to a participant of a room, if the room video is layered
+func (sp *StreamProtocol) selectVideoLayer(roomName string, participantID ulid.ULID) {
+	room := sp.relay.GetRoomByName(roomName)
+	if room == nil {
+		return
+	}
+	track := room.VideoTrack
+	if track == nil || !track.Layered() {
+		return
+	}
+	participant, ok := room.Participants.Get(participantID)
+	if !ok || participant.Relay {
+		return // Relays are sent all layers and select them for their own participants
+	}
+	ssrc, ok := senderSSRC(participant, track)
+	if !ok {
+		return
+	}
+
+	current, hasCurrent := track.ForwardedLayer(ssrc)
+	layer := sp.getViewerLayers(participantID).choose(track.Layers(), current, hasCurrent, time.Now())
+	if hasCurrent && layer == current {
+		return
+	}
+	if track.SelectLayer(ssrc, layer) {
+		slog.Debug("Selected video layer for participant", "room", roomName, "participant", participantID,
+			"spatial", layer.Spatial, "temporal", layer.Temporal)
+	}
+}
+
+// senderSSRC returns the SSRC a participant is sent a track with, false if it's not sent the track
+func senderSSRC(participant *shared.Participant, track *shared.RoomTrack) (webrtc.SSRC, bool) {
+	if participant.PeerConnection == nil {
+		return 0, false
+	}
+	for _, sender := range participant.PeerConnection.GetSenders() {
+		if sender.Track() != track {
+			continue
+		}
+		if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+			return encodings[0].SSRC, true
+		}
+	}
+	return 0, false
+}
+
+// --- Ingest ---
+
+// ingestRoomTrack returns the local track a pushed track is written to, the encoding its packets are and whether
+// the track was created for it. Joins the track of the other encodings if it's one of several simulcast encodings
+func (sp *StreamProtocol) ingestRoomTrack(room *shared.Room, remoteTrack *webrtc.TrackRemote) (*shared.RoomTrack, int, bool, error) {
+	sp.ingestMutex.Lock()
+	defer sp.ingestMutex.Unlock()
+
+	rid := remoteTrack.RID()
+	if existing := room.VideoTrack; len(rid) > 0 && existing != nil && len(existing.RIDs()) > 0 &&
+		existing.Codec().MimeType == remoteTrack.Codec().MimeType {
+		slog.Debug("Received simulcast encoding for pushed stream", "room", room.Name, "rid", rid)
+		encoding := existing.AddEncoding(rid)
+		go sp.updateServedTracks(room, remoteTrack.Kind()) // Relays are sent a track per encoding
+		return existing, encoding, false, nil
+	}
+
+	localTrack, err := shared.NewRoomTrack(remoteTrack.Codec().RTPCodecCapability, remoteTrack.Kind().String(), fmt.Sprintf("nestri-%s-%s", room.Name, remoteTrack.Kind().String()))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	encoding := localTrack.AddEncoding(rid)
+	room.SetTrack(remoteTrack.Kind(), localTrack)
+	return localTrack, encoding, true, nil
+}
+
+// requestedRoomTrack returns the local track a track of a requested stream is written to and the encoding its
+// packets are. The local track is kept across upstream changes of the same codec, so tracks served onward stay valid
+func (sp *StreamProtocol) requestedRoomTrack(room *shared.Room, remoteTrack *webrtc.TrackRemote) (*shared.RoomTrack, int, error) {
+	sp.ingestMutex.Lock()
+	defer sp.ingestMutex.Unlock()
+
+	rid := remoteTrack.RID()
+	if existing := room.GetTrack(remoteTrack.Kind()); existing != nil && existing.Codec().MimeType == remoteTrack.Codec().MimeType {
+		encoding := existing.AddEncoding(rid)
+		if len(rid) > 0 {
+			go sp.updateServedTracks(room, remoteTrack.Kind()) // Relays are sent a track per encoding
+		}
+		return existing, encoding, nil
+	}
+
+	localTrack, err := shared.NewRoomTrack(remoteTrack.Codec().RTPCodecCapability, remoteTrack.ID(), "relay-"+room.Name+"-"+remoteTrack.Kind().String())
+	if err != nil {
+		return nil, 0, err
+	}
+	localTrack.OnKeyframeNeeded(func() {
+		sp.getFeedback(room.Name).requestKeyframe()
+	})
+	encoding := localTrack.AddEncoding(rid)
+	room.SetTrack(remoteTrack.Kind(), localTrack)
+	return localTrack, encoding, nil
+}
+
+// dependencyDescriptorID returns the ID of the dependency descriptor header extension negotiated for a receiver,
+// 0 if none was
+func dependencyDescriptorID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == common.ExtensionDependencyDescriptor {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// --- DataChannel Command ---
+
+// handleViewport records the viewport a participant tells over its DataChannel and reselects its video layer
+func (sp *StreamProtocol) handleViewport(roomName string, participantID ulid.ULID, data []byte) {
+	var message gen.ProtoMessageViewport
+	if err := proto.Unmarshal(data, &message); err != nil {
+		slog.Error("Failed to decode viewport message", "room", roomName, "participant", participantID, "err", err)
+		return
+	}
+	vl := sp.getViewerLayers(participantID)
+	vl.mutex.Lock()
+	vl.viewport = int(message.GetData().GetHeight())
+	vl.mutex.Unlock()
+	sp.selectVideoLayer(roomName, participantID)
+}
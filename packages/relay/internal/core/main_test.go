@@ -0,0 +1,13 @@
+package core
+
+import (
+	"os"
+	"relay/internal/common"
+	"testing"
+)
+
+// TestMain sets up the flags with their defaults, tests change what they depend on
+func TestMain(m *testing.M) {
+	common.InitFlags()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,633 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Matroska element IDs, with their marker bits
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvInfo               = 0x1549A966
+	mkvTimestampScale     = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvFlagLacing         = 0x9C
+	mkvCodecID            = 0x86
+	mkvCodecPrivate       = 0x63A2
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvCluster            = 0x1F43B675
+	mkvTimestamp          = 0xE7
+	mkvSimpleBlock        = 0xA3
+)
+
+// mkvUnknownSize is the size of elements written before their end is known, readers take them up to the next
+// element of their level. Keeps files playable if the relay stops without finalizing them
+var mkvUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// mkvMaxBlockOffset is how far a block may be from the timestamp of its cluster, in milliseconds
+const mkvMaxBlockOffset = 1<<15 - 1
+
+// --- Writer ---
+
+// matroskaWriter records a H.264 or H.265 RTP stream to a Matroska file with the timestamps of its frames,
+// starting at the first keyframe
+type matroskaWriter struct {
+	file      *os.File
+	out       *bufio.Writer
+	hevc      bool
+	clockRate uint32
+
+	// Parameter sets, the latest of each kind
+	vps, sps, pps []byte
+
+	// Frame being assembled from packets of the same timestamp
+	frame       [][]byte
+	frameTS     uint32
+	fragment    []byte // NAL unit being reassembled from fragmentation units
+	lastSeq     uint16
+	seqReceived bool
+
+	headerWritten bool
+	lastTS        uint32 // of the latest written frame
+	elapsed       int64  // RTP time since the first written frame
+	clusterOpen   bool
+	clusterTime   int64 // milliseconds
+}
+
+func newMatroskaWriter(path string, codec webrtc.RTPCodecCapability) (*matroskaWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	clockRate := codec.ClockRate
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+	return &matroskaWriter{
+		file:      file,
+		out:       bufio.NewWriter(file),
+		hevc:      strings.EqualFold(codec.MimeType, webrtc.MimeTypeH265),
+		clockRate: clockRate,
+	}, nil
+}
+
+// WriteRTP adds a packet to the frame of its timestamp, writing the frame once complete
+func (mw *matroskaWriter) WriteRTP(packet *rtp.Packet) error {
+	if len(mw.frame) > 0 && packet.Timestamp != mw.frameTS {
+		// Marker of the previous frame was lost
+		if err := mw.writeFrame(); err != nil {
+			return err
+		}
+	}
+	if mw.seqReceived && packet.SequenceNumber != mw.lastSeq+1 {
+		mw.fragment = nil // Rest of a fragmented NAL unit is lost
+	}
+	mw.lastSeq, mw.seqReceived = packet.SequenceNumber, true
+	mw.frameTS = packet.Timestamp
+
+	if mw.hevc {
+		mw.depacketizeH265(packet.Payload)
+	} else {
+		mw.depacketizeH264(packet.Payload)
+	}
+	if packet.Marker && len(mw.frame) > 0 {
+		return mw.writeFrame()
+	}
+	return nil
+}
+
+// Close writes the last frame and closes the file
+func (mw *matroskaWriter) Close() error {
+	var err error
+	if len(mw.frame) > 0 {
+		err = mw.writeFrame()
+	}
+	return errors.Join(err, mw.out.Flush(), mw.file.Close())
+}
+
+// writeFrame writes the assembled frame as a block, starting a cluster at keyframes
+func (mw *matroskaWriter) writeFrame() error {
+	units := mw.frame
+	mw.frame = nil
+
+	keyframe, picture := false, false
+	for _, unit := range units {
+		nalType := mw.nalType(unit)
+		switch {
+		case mw.hevc && nalType == 32:
+			mw.vps = unit
+		case (mw.hevc && nalType == 33) || (!mw.hevc && nalType == 7):
+			mw.sps = unit
+		case (mw.hevc && nalType == 34) || (!mw.hevc && nalType == 8):
+			mw.pps = unit
+		}
+		if mw.hevc {
+			picture = picture || nalType < 32
+			keyframe = keyframe || (nalType >= 16 && nalType <= 21)
+		} else {
+			picture = picture || (nalType >= 1 && nalType <= 5)
+			keyframe = keyframe || nalType == 5
+		}
+	}
+	if !picture {
+		// Parameter sets or SEI sent ahead of their picture
+		mw.frame = units
+		return nil
+	}
+
+	if !mw.headerWritten {
+		if !keyframe || mw.sps == nil || mw.pps == nil || (mw.hevc && mw.vps == nil) {
+			return nil // Undecodable until the first keyframe
+		}
+		if err := mw.writeHeader(); err != nil {
+			return err
+		}
+		mw.headerWritten = true
+		mw.lastTS = mw.frameTS
+	}
+	mw.elapsed += int64(int32(mw.frameTS - mw.lastTS))
+	mw.lastTS = mw.frameTS
+	millis := mw.elapsed * 1000 / int64(mw.clockRate)
+
+	var buf []byte
+	offset := millis - mw.clusterTime
+	if !mw.clusterOpen || keyframe || offset > mkvMaxBlockOffset || offset < -mkvMaxBlockOffset {
+		buf = appendEBMLID(buf, mkvCluster)
+		buf = append(buf, mkvUnknownSize...)
+		buf = appendEBMLUint(buf, mkvTimestamp, uint64(max(millis, 0)))
+		mw.clusterOpen, mw.clusterTime = true, max(millis, 0)
+		offset = millis - mw.clusterTime
+	}
+
+	var flags byte
+	if keyframe {
+		flags = 0x80
+	}
+	block := []byte{0x81, 0, 0, flags} // Track number 1
+	binary.BigEndian.PutUint16(block[1:], uint16(int16(offset)))
+	for _, unit := range units {
+		block = binary.BigEndian.AppendUint32(block, uint32(len(unit)))
+		block = append(block, unit...)
+	}
+	buf = appendEBMLElement(buf, mkvSimpleBlock, block)
+	if _, err := mw.out.Write(buf); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// writeHeader writes the file header and the track, described by the current parameter sets
+func (mw *matroskaWriter) writeHeader() error {
+	var codecID string
+	var codecPrivate []byte
+	var sps *spsInfo
+	var err error
+	if mw.hevc {
+		codecID = "V_MPEGH/ISO/HEVC"
+		if sps, err = parseH265SPS(mw.sps); err == nil {
+			codecPrivate = hevcDecoderConfig(mw.vps, mw.sps, mw.pps, sps)
+		}
+	} else {
+		codecID = "V_MPEG4/ISO/AVC"
+		if sps, err = parseH264SPS(mw.sps); err == nil {
+			codecPrivate = avcDecoderConfig(mw.sps, mw.pps)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse sequence parameter set: %w", err)
+	}
+
+	var ebml []byte
+	ebml = appendEBMLUint(ebml, mkvEBMLVersion, 1)
+	ebml = appendEBMLUint(ebml, mkvEBMLReadVersion, 1)
+	ebml = appendEBMLUint(ebml, mkvEBMLMaxIDLength, 4)
+	ebml = appendEBMLUint(ebml, mkvEBMLMaxSizeLength, 8)
+	ebml = appendEBMLElement(ebml, mkvDocType, []byte("matroska"))
+	ebml = appendEBMLUint(ebml, mkvDocTypeVersion, 4)
+	ebml = appendEBMLUint(ebml, mkvDocTypeReadVersion, 2)
+
+	var info []byte
+	info = appendEBMLUint(info, mkvTimestampScale, 1000000) // Milliseconds
+	info = appendEBMLElement(info, mkvMuxingApp, []byte("nestri-relay"))
+	info = appendEBMLElement(info, mkvWritingApp, []byte("nestri-relay"))
+
+	var video []byte
+	video = appendEBMLUint(video, mkvPixelWidth, uint64(sps.width))
+	video = appendEBMLUint(video, mkvPixelHeight, uint64(sps.height))
+	var track []byte
+	track = appendEBMLUint(track, mkvTrackNumber, 1)
+	track = appendEBMLUint(track, mkvTrackUID, 1)
+	track = appendEBMLUint(track, mkvTrackType, 1) // Video
+	track = appendEBMLUint(track, mkvFlagLacing, 0)
+	track = appendEBMLElement(track, mkvCodecID, []byte(codecID))
+	track = appendEBMLElement(track, mkvCodecPrivate, codecPrivate)
+	track = appendEBMLElement(track, mkvVideo, video)
+
+	var buf []byte
+	buf = appendEBMLElement(buf, mkvEBML, ebml)
+	buf = appendEBMLID(buf, mkvSegment)
+	buf = append(buf, mkvUnknownSize...)
+	buf = appendEBMLElement(buf, mkvInfo, info)
+	buf = appendEBMLElement(buf, mkvTracks, appendEBMLElement(nil, mkvTrackEntry, track))
+	if _, err = mw.out.Write(buf); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+// nalType returns the type of a NAL unit of the written codec
+func (mw *matroskaWriter) nalType(unit []byte) byte {
+	if mw.hevc {
+		return (unit[0] >> 1) & 0x3F
+	}
+	return unit[0] & 0x1F
+}
+
+// --- Depacketization ---
+
+// depacketizeH264 adds the NAL units of a H.264 payload (RFC 6184) to the frame, copied as packets may be reused
+func (mw *matroskaWriter) depacketizeH264(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	switch nalType := payload[0] & 0x1F; {
+	case nalType == 24: // STAP-A
+		mw.addAggregated(payload[1:])
+	case nalType == 28: // FU-A
+		if len(payload) < 2 {
+			return
+		}
+		if payload[1]&0x80 != 0 {
+			mw.fragment = []byte{payload[0]&0xE0 | payload[1]&0x1F}
+		}
+		mw.addFragment(payload[2:], payload[1]&0x40 != 0)
+	case nalType >= 1 && nalType <= 23:
+		mw.frame = append(mw.frame, append([]byte(nil), payload...))
+	}
+}
+
+// depacketizeH265 adds the NAL units of a H.265 payload (RFC 7798, without DONL) to the frame
+func (mw *matroskaWriter) depacketizeH265(payload []byte) {
+	if len(payload) < 3 {
+		return
+	}
+	switch nalType := (payload[0] >> 1) & 0x3F; {
+	case nalType == 48: // Aggregation packet
+		mw.addAggregated(payload[2:])
+	case nalType == 49: // Fragmentation unit
+		if payload[2]&0x80 != 0 {
+			mw.fragment = []byte{payload[0]&0x81 | (payload[2]&0x3F)<<1, payload[1]}
+		}
+		mw.addFragment(payload[3:], payload[2]&0x40 != 0)
+	case nalType < 48:
+		mw.frame = append(mw.frame, append([]byte(nil), payload...))
+	}
+}
+
+// addAggregated adds the size-prefixed NAL units of an aggregation packet to the frame
+func (mw *matroskaWriter) addAggregated(units []byte) {
+	for offset := 0; offset+2 < len(units); {
+		size := int(binary.BigEndian.Uint16(units[offset:]))
+		offset += 2
+		if size == 0 || offset+size > len(units) {
+			return
+		}
+		mw.frame = append(mw.frame, append([]byte(nil), units[offset:offset+size]...))
+		offset += size
+	}
+}
+
+// addFragment appends to the fragmented NAL unit, adding it to the frame with its last fragment
+func (mw *matroskaWriter) addFragment(data []byte, end bool) {
+	if mw.fragment == nil {
+		return // Start was lost
+	}
+	mw.fragment = append(mw.fragment, data...)
+	if end {
+		mw.frame = append(mw.frame, mw.fragment)
+		mw.fragment = nil
+	}
+}
+
+// --- Codec Configuration ---
+
+// spsInfo is what a track header needs from a sequence parameter set
+type spsInfo struct {
+	width, height uint32
+	// H.265 only
+	profileTierLevel []byte // general profile, tier and level, 12 bytes
+	chromaFormat     uint32
+	bitDepthLuma     uint32 // minus 8
+	bitDepthChroma   uint32 // minus 8
+	subLayers        uint32 // minus 1
+	temporalNesting  uint32
+}
+
+// avcDecoderConfig returns the AVCDecoderConfigurationRecord (ISO 14496-15) of a H.264 stream,
+// with 4 byte NAL unit lengths
+func avcDecoderConfig(sps, pps []byte) []byte {
+	config := []byte{1, sps[1], sps[2], sps[3], 0xFC | 3, 0xE0 | 1}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(sps)))
+	config = append(config, sps...)
+	config = append(config, 1)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(pps)))
+	return append(config, pps...)
+}
+
+// hevcDecoderConfig returns the HEVCDecoderConfigurationRecord (ISO 14496-15) of a H.265 stream,
+// with 4 byte NAL unit lengths
+func hevcDecoderConfig(vps, sps, pps []byte, info *spsInfo) []byte {
+	config := append([]byte{1}, info.profileTierLevel...)
+	config = append(config,
+		0xF0, 0x00, // No minimum spatial segmentation
+		0xFC, // Unknown parallelism
+		0xFC|byte(info.chromaFormat),
+		0xF8|byte(info.bitDepthLuma),
+		0xF8|byte(info.bitDepthChroma),
+		0x00, 0x00, // Unknown frame rate
+		byte(info.subLayers+1)<<3|byte(info.temporalNesting)<<2|3,
+		3, // Arrays of VPS, SPS and PPS
+	)
+	for _, unit := range [][]byte{vps, sps, pps} {
+		config = append(config, 0x80|(unit[0]>>1)&0x3F, 0, 1)
+		config = binary.BigEndian.AppendUint16(config, uint16(len(unit)))
+		config = append(config, unit...)
+	}
+	return config
+}
+
+// parseH264SPS reads the picture size from a H.264 SPS NAL unit
+func parseH264SPS(unit []byte) (*spsInfo, error) {
+	if len(unit) < 4 {
+		return nil, errors.New("sequence parameter set too short")
+	}
+	br := &bitReader{data: unescapeRBSP(unit[1:])}
+	profile := br.bits(8)
+	br.bits(16) // Constraint flags and level
+	br.ue()     // SPS ID
+	chromaFormat, separatePlanes := uint32(1), uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = br.ue(); chromaFormat == 3 {
+			separatePlanes = br.bits(1)
+		}
+		br.ue()              // Luma bit depth
+		br.ue()              // Chroma bit depth
+		br.bits(1)           // Transform bypass
+		if br.bits(1) == 1 { // Scaling matrix
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if br.bits(1) == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					br.skipScalingList(size)
+				}
+			}
+		}
+	}
+	br.ue()          // Max frame number
+	switch br.ue() { // Picture order count type
+	case 0:
+		br.ue()
+	case 1:
+		br.bits(1)
+		br.se()
+		br.se()
+		for range br.ue() {
+			br.se()
+		}
+	}
+	br.ue()    // Max reference frames
+	br.bits(1) // Gaps in frame numbers
+	widthMbs := br.ue() + 1
+	heightMapUnits := br.ue() + 1
+	frameMbsOnly := br.bits(1)
+	if frameMbsOnly == 0 {
+		br.bits(1) // Adaptive frame/field
+	}
+	br.bits(1) // Direct 8x8 inference
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if br.bits(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = br.ue(), br.ue(), br.ue(), br.ue()
+	}
+	if br.overrun {
+		return nil, errors.New("sequence parameter set truncated")
+	}
+
+	cropX, cropY := uint32(1), 2-frameMbsOnly
+	if chromaFormat != 0 && separatePlanes == 0 {
+		if chromaFormat != 3 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+	}
+	return &spsInfo{
+		width:  widthMbs*16 - (cropLeft+cropRight)*cropX,
+		height: (2-frameMbsOnly)*heightMapUnits*16 - (cropTop+cropBottom)*cropY,
+	}, nil
+}
+
+// parseH265SPS reads the picture size and format from a H.265 SPS NAL unit
+func parseH265SPS(unit []byte) (*spsInfo, error) {
+	if len(unit) < 16 {
+		return nil, errors.New("sequence parameter set too short")
+	}
+	rbsp := unescapeRBSP(unit[2:])
+	br := &bitReader{data: rbsp}
+	info := &spsInfo{}
+	br.bits(4) // VPS ID
+	info.subLayers = br.bits(3)
+	info.temporalNesting = br.bits(1)
+	info.profileTierLevel = rbsp[1:13]
+	br.bits(32) // General profile, tier and level, read above
+	br.bits(32)
+	br.bits(32)
+	subProfiles := make([]bool, info.subLayers)
+	subLevels := make([]bool, info.subLayers)
+	for i := range info.subLayers {
+		subProfiles[i] = br.bits(1) == 1
+		subLevels[i] = br.bits(1) == 1
+	}
+	if info.subLayers > 0 {
+		for range 8 - info.subLayers {
+			br.bits(2) // Reserved
+		}
+	}
+	for i := range info.subLayers {
+		if subProfiles[i] {
+			br.bits(32)
+			br.bits(32)
+			br.bits(24)
+		}
+		if subLevels[i] {
+			br.bits(8)
+		}
+	}
+	br.ue() // SPS ID
+	subWidth, subHeight := uint32(1), uint32(1)
+	switch info.chromaFormat = br.ue(); info.chromaFormat {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	case 3:
+		br.bits(1) // Separate colour planes
+	}
+	info.width, info.height = br.ue(), br.ue()
+	if br.bits(1) == 1 { // Conformance window
+		left, right, top, bottom := br.ue(), br.ue(), br.ue(), br.ue()
+		info.width -= (left + right) * subWidth
+		info.height -= (top + bottom) * subHeight
+	}
+	info.bitDepthLuma, info.bitDepthChroma = br.ue(), br.ue()
+	if br.overrun {
+		return nil, errors.New("sequence parameter set truncated")
+	}
+	return info, nil
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit payload
+func unescapeRBSP(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// bitReader reads the fields of a parameter set, reading past the end gives zeros and sets overrun
+type bitReader struct {
+	data    []byte
+	pos     int // in bits
+	overrun bool
+}
+
+func (br *bitReader) bits(n int) uint32 {
+	var value uint32
+	for range n {
+		if br.pos >= len(br.data)*8 {
+			br.overrun = true
+			return 0
+		}
+		value = value<<1 | uint32(br.data[br.pos/8]>>(7-br.pos%8)&1)
+		br.pos++
+	}
+	return value
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (br *bitReader) ue() uint32 {
+	zeros := 0
+	for br.bits(1) == 0 {
+		if br.overrun || zeros == 31 {
+			br.overrun = true
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + br.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (br *bitReader) se() int32 {
+	code := br.ue()
+	if code%2 == 1 {
+		return int32(code/2 + 1)
+	}
+	return -int32(code / 2)
+}
+
+func (br *bitReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for range size {
+		if next != 0 {
+			next = (last + br.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// --- EBML ---
+
+// appendEBMLID appends an element ID, which carries its own length marker
+func appendEBMLID(buf []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(buf, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(buf, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(buf, byte(id>>8), byte(id))
+	default:
+		return append(buf, byte(id))
+	}
+}
+
+// appendEBMLSize appends an element size as variable length integer of the fewest bytes
+func appendEBMLSize(buf []byte, size uint64) []byte {
+	length := 1
+	for length < 8 && size >= 1<<(7*length)-1 {
+		length++
+	}
+	size |= 1 << (7 * length) // Length marker
+	for i := length - 1; i >= 0; i-- {
+		buf = append(buf, byte(size>>(8*i)))
+	}
+	return buf
+}
+
+func appendEBMLElement(buf []byte, id uint32, data []byte) []byte {
+	buf = appendEBMLID(buf, id)
+	buf = appendEBMLSize(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendEBMLUint(buf []byte, id uint32, value uint64) []byte {
+	data := binary.BigEndian.AppendUint64(nil, value)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+	return appendEBMLElement(buf, id, data)
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Parameter sets of 1920x1080 streams, coded 1088 lines high and cropped, truncated after the fields read
+var (
+	testH264SPS = mustHex("67640028ace501e0089f95") // High profile
+	testH264PPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testH265VPS = []byte{0x40, 0x01, 0x0c, 0x01}
+	testH265SPS = mustHex("420101016000000300900000030000030078a003c0801107cbc0") // Main profile
+	testH265PPS = []byte{0x44, 0x01, 0xc1, 0x72}
+)
+
+func mustHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestParseSPS(t *testing.T) {
+	info, err := parseH264SPS(testH264SPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.width != 1920 || info.height != 1080 {
+		t.Errorf("H.264 picture is %dx%d, want 1920x1080", info.width, info.height)
+	}
+
+	if info, err = parseH265SPS(testH265SPS); err != nil {
+		t.Fatal(err)
+	}
+	if info.width != 1920 || info.height != 1080 {
+		t.Errorf("H.265 picture is %dx%d, want 1920x1080", info.width, info.height)
+	}
+	if info.chromaFormat != 1 || info.bitDepthLuma != 0 || info.bitDepthChroma != 0 || info.subLayers != 0 || info.temporalNesting != 1 {
+		t.Errorf("H.265 format %+v, want 8 bit 4:2:0 of a single temporally nested layer", info)
+	}
+	if profile := info.profileTierLevel; len(profile) != 12 || profile[0] != 0x01 || profile[11] != 120 {
+		t.Errorf("H.265 profile, tier and level %x, want main profile at level 4", profile)
+	}
+
+	if _, err = parseH264SPS(testH264SPS[:6]); err == nil {
+		t.Error("parsed truncated H.264 SPS")
+	}
+}
+
+// mkvElement is an element read back from a written file, masters are flattened into their children
+type mkvElement struct {
+	id   uint32
+	data []byte
+}
+
+var mkvMasters = map[uint32]bool{
+	mkvEBML: true, mkvSegment: true, mkvInfo: true, mkvTracks: true, mkvTrackEntry: true, mkvVideo: true, mkvCluster: true,
+}
+
+func readMatroska(t *testing.T, path string) []mkvElement {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var elements []mkvElement
+	for len(data) > 0 {
+		length := 1
+		for length < 4 && data[0]&(0x80>>(length-1)) == 0 {
+			length++
+		}
+		var id uint32
+		for _, b := range data[:length] {
+			id = id<<8 | uint32(b)
+		}
+		data = data[length:]
+
+		length = 1
+		for length < 8 && data[0]&(0x80>>(length-1)) == 0 {
+			length++
+		}
+		size := uint64(data[0] & (0xFF >> length))
+		for _, b := range data[1:length] {
+			size = size<<8 | uint64(b)
+		}
+		data = data[length:]
+		if mkvMasters[id] {
+			elements = append(elements, mkvElement{id: id})
+			continue // Children follow
+		}
+		if size > uint64(len(data)) {
+			t.Fatalf("element %x of %d bytes overruns file", id, size)
+		}
+		elements = append(elements, mkvElement{id: id, data: data[:size]})
+		data = data[size:]
+	}
+	return elements
+}
+
+// mkvBlock is a written frame with its timestamp
+type mkvBlock struct {
+	millis   int64
+	keyframe bool
+	units    [][]byte
+}
+
+func matroskaBlocks(elements []mkvElement) []mkvBlock {
+	var blocks []mkvBlock
+	var clusterTime int64
+	for _, element := range elements {
+		switch element.id {
+		case mkvTimestamp:
+			clusterTime = 0
+			for _, b := range element.data {
+				clusterTime = clusterTime<<8 | int64(b)
+			}
+		case mkvSimpleBlock:
+			block := mkvBlock{
+				millis:   clusterTime + int64(int16(binary.BigEndian.Uint16(element.data[1:]))),
+				keyframe: element.data[3]&0x80 != 0,
+			}
+			for units := element.data[4:]; len(units) > 4; {
+				size := binary.BigEndian.Uint32(units)
+				block.units = append(block.units, units[4:4+size])
+				units = units[4+size:]
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+func findElement(elements []mkvElement, id uint32) []byte {
+	for _, element := range elements {
+		if element.id == id {
+			return element.data
+		}
+	}
+	return nil
+}
+
+// stapA aggregates NAL units into a H.264 STAP-A payload
+func stapA(units ...[]byte) []byte {
+	payload := []byte{0x78}
+	for _, unit := range units {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(unit)))
+		payload = append(payload, unit...)
+	}
+	return payload
+}
+
+func TestMatroskaWriterH264(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mkv")
+	mw, err := newMatroskaWriter(path, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idr := []byte{0x65, 0x88, 0x80, 0x40, 0x20, 0x10}
+	inter := []byte{0x41, 0x9a, 0x02}
+
+	var seq uint16
+	write := func(ts uint32, marker bool, payload []byte) {
+		t.Helper()
+		seq++
+		packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: marker}, Payload: payload}
+		if err := mw.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := uint32(0xFFFFF000)                                    // Wraps around while recording
+	write(start-3000, true, inter)                                 // Before any keyframe, dropped
+	write(start, false, stapA(testH264SPS, testH264PPS))           // Parameter sets ahead of the keyframe
+	write(start, false, []byte{0x7c, 0x85, 0x88, 0x80})            // FU-A start
+	write(start, false, []byte{0x7c, 0x05, 0x40})                  // FU-A middle
+	write(start, true, []byte{0x7c, 0x45, 0x20, 0x10})             // FU-A end
+	write(start+3000, true, inter)                                 // 33 ms later
+	write(start+6000, false, inter)                                // Marker lost
+	write(start+9000, false, []byte{0x7c, 0x85, 0x88})             // FU-A of which the end is lost
+	seq++                                                          // Lost packet
+	write(start+9000, true, []byte{0x7c, 0x45, 0x20})              // Dropped with its start
+	write(start+90000, true, stapA(testH264SPS, testH264PPS, idr)) // Keyframe a second in
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	elements := readMatroska(t, path)
+	if docType := string(findElement(elements, mkvDocType)); docType != "matroska" {
+		t.Errorf("doc type %q, want matroska", docType)
+	}
+	if codecID := string(findElement(elements, mkvCodecID)); codecID != "V_MPEG4/ISO/AVC" {
+		t.Errorf("codec ID %q, want V_MPEG4/ISO/AVC", codecID)
+	}
+	if config := findElement(elements, mkvCodecPrivate); !bytes.Equal(config, avcDecoderConfig(testH264SPS, testH264PPS)) || config[1] != 100 || config[4] != 0xFF {
+		t.Errorf("codec private %x, want high profile config with 4 byte lengths", config)
+	}
+	if width, height := findElement(elements, mkvPixelWidth), findElement(elements, mkvPixelHeight); !bytes.Equal(width, []byte{0x07, 0x80}) || !bytes.Equal(height, []byte{0x04, 0x38}) {
+		t.Errorf("picture size %x by %x, want 1920x1080", width, height)
+	}
+
+	blocks := matroskaBlocks(elements)
+	want := []struct {
+		millis   int64
+		keyframe bool
+		units    int
+	}{
+		{0, true, 3},
+		{33, false, 1},
+		{66, false, 1},
+		{1000, true, 3},
+	}
+	if len(blocks) != len(want) {
+		t.Fatalf("wrote %d frames, want %d", len(blocks), len(want))
+	}
+	for i, block := range blocks {
+		if block.millis != want[i].millis || block.keyframe != want[i].keyframe || len(block.units) != want[i].units {
+			t.Errorf("frame %d at %d ms, keyframe %v with %d NAL units, want %+v", i, block.millis, block.keyframe, len(block.units), want[i])
+		}
+	}
+	if got := blocks[0].units; !bytes.Equal(got[0], testH264SPS) || !bytes.Equal(got[1], testH264PPS) || !bytes.Equal(got[2], idr) {
+		t.Errorf("first frame has NAL units %x, want SPS, PPS and the reassembled IDR slice", got)
+	}
+}
+
+func TestMatroskaWriterH265(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mkv")
+	mw, err := newMatroskaWriter(path, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idr := []byte{0x26, 0x01, 0xaf, 0x10, 0x20}
+	ap := []byte{0x60, 0x01}
+	for _, unit := range [][]byte{testH265VPS, testH265SPS, testH265PPS} {
+		ap = binary.BigEndian.AppendUint16(ap, uint16(len(unit)))
+		ap = append(ap, unit...)
+	}
+	packets := []*rtp.Packet{
+		{Header: rtp.Header{SequenceNumber: 1, Timestamp: 1000}, Payload: ap},
+		{Header: rtp.Header{SequenceNumber: 2, Timestamp: 1000}, Payload: []byte{0x62, 0x01, 0x93, 0xaf}}, // FU start of IDR
+		{Header: rtp.Header{SequenceNumber: 3, Timestamp: 1000, Marker: true}, Payload: []byte{0x62, 0x01, 0x53, 0x10, 0x20}},
+		{Header: rtp.Header{SequenceNumber: 4, Timestamp: 2500, Marker: true}, Payload: []byte{0x02, 0x01, 0xd0}},
+	}
+	for _, packet := range packets {
+		if err = mw.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	elements := readMatroska(t, path)
+	if codecID := string(findElement(elements, mkvCodecID)); codecID != "V_MPEGH/ISO/HEVC" {
+		t.Errorf("codec ID %q, want V_MPEGH/ISO/HEVC", codecID)
+	}
+	config := findElement(elements, mkvCodecPrivate)
+	if len(config) < 23 || config[0] != 1 || config[1] != 0x01 || config[12] != 120 || config[16] != 0xFD || config[21] != 0x0F || config[22] != 3 {
+		t.Errorf("codec private %x, want main profile 4:2:0 config of 3 parameter set arrays with 4 byte lengths", config)
+	}
+	blocks := matroskaBlocks(elements)
+	if len(blocks) != 2 || blocks[1].millis != 16 || !blocks[0].keyframe || blocks[1].keyframe {
+		t.Fatalf("wrote frames %+v, want a keyframe and one 16 ms later", blocks)
+	}
+	if got := blocks[0].units; len(got) != 4 || !bytes.Equal(got[3], idr) {
+		t.Errorf("first frame has NAL units %x, want parameter sets and the reassembled IDR slice", got)
+	}
+}
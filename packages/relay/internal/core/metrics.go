@@ -45,6 +45,10 @@ func (r *Relay) publishRelayMetrics(ctx context.Context) error {
 
 	// Check all peer latencies
 	r.checkAllPeerLatencies(ctx)
+	// Update which room streams we can serve onward
+	r.refreshMeshStreams()
+	// Sum up the media we move
+	r.refreshTrafficSummary()
 
 	data, err := json.Marshal(r.RelayInfo)
 	if err != nil {
@@ -107,11 +111,9 @@ func (r *Relay) measureLatencyToPeer(ctx context.Context, peerID peer.ID) {
 
 		// Received ping result
 		if result.Error != nil {
-			slog.Warn("Latency check failed, removing peer from local peers map", "peer", peerID, "err", result.Error)
-			// Remove from MeshPeers if ping failed
-			if r.LocalMeshPeers.Has(peerID) {
-				r.LocalMeshPeers.Delete(peerID)
-			}
+			slog.Warn("Latency check failed, suspecting peer", "peer", peerID, "err", result.Error)
+			// Let the failure detector decide if the peer is gone
+			r.suspectRelay(ctx, peerID, "ping failed", r.failureDetector.incarnationOf(peerID), true)
 			return
 		}
 
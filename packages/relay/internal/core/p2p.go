@@ -22,16 +22,16 @@ type networkNotifier struct {
 
 // Connected is called when a connection is established
 func (n *networkNotifier) Connected(net network.Network, conn network.Conn) {
-	if n.relay == nil {
-		n.relay.onPeerConnected(conn.RemotePeer())
+	if n.relay != nil {
+		go n.relay.onPeerConnected(conn.RemotePeer())
 	}
 }
 
 // Disconnected is called when a connection is terminated
 func (n *networkNotifier) Disconnected(net network.Network, conn network.Conn) {
-	// Update the status of the disconnected peer
+	// Suspect the disconnected peer, it's removed if it doesn't come back in time
 	if n.relay != nil {
-		n.relay.onPeerDisconnected(conn.RemotePeer())
+		go n.relay.onPeerConnectionLost(conn.RemotePeer())
 	}
 }
 
@@ -69,6 +69,17 @@ func (r *Relay) setupPubSub(ctx context.Context) error {
 	}
 	go r.handleRelayMetricsMessages(ctx, metricsSub) // Handler in relay_state.go
 
+	// Relay Health Topic
+	r.pubTopicRelayHealth, err = r.PubSub.Join(relayHealthTopicName)
+	if err != nil {
+		return fmt.Errorf("failed to join relay health topic '%s': %w", relayHealthTopicName, err)
+	}
+	healthSub, err := r.pubTopicRelayHealth.Subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to relay health topic '%s': %w", relayHealthTopicName, err)
+	}
+	go r.handleRelayHealthMessages(ctx, healthSub) // Handler in health.go
+
 	slog.Info("PubSub topics joined and subscriptions started")
 	return nil
 }
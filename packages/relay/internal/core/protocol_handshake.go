@@ -0,0 +1,143 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolHandshake = "/nestri-relay/handshake/1.0.0" // For admission of relays to the mesh
+)
+
+// --- Protocol Types ---
+
+// HandshakeProtocol deals with admission of joining relays to the mesh
+type HandshakeProtocol struct {
+	relay *Relay
+}
+
+func NewHandshakeProtocol(relay *Relay) *HandshakeProtocol {
+	protocol := &HandshakeProtocol{
+		relay: relay,
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolHandshake, protocol.handleHandshake)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleHandshake verifies the credentials of a joining relay, responding with our approval if admitted
+func (hp *HandshakeProtocol) handleHandshake(stream network.Stream) {
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	peerID := stream.Conn().RemotePeer()
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	var msg gen.MeshMessage
+	if err := safeBRW.ReceiveProto(&msg); err != nil {
+		slog.Debug("Failed to receive handshake", "peer", peerID, "err", err)
+		_ = stream.Reset()
+		return
+	}
+	handshake := msg.GetHandshake()
+	if handshake == nil {
+		slog.Warn("Unexpected handshake message type", "peer", peerID)
+		_ = stream.Reset()
+		return
+	}
+
+	approvals := make(map[string]string)
+	if handshake.GetRelayId() != peerID.String() {
+		slog.Error("Peer ID mismatch in handshake", "expected", handshake.GetRelayId(), "actual", peerID)
+	} else if err := hp.relay.admitRelay(peerID, handshake.GetApprovals()); err != nil {
+		slog.Warn("Rejected relay from mesh", "peer", peerID, "err", err)
+	} else {
+		signature, err := hp.relay.signApproval(peerID)
+		if err != nil {
+			slog.Error("Failed to sign approval for relay", "peer", peerID, "err", err)
+		} else {
+			approvals[hp.relay.ID.String()] = signature
+		}
+		if !hp.relay.LocalMeshPeers.Has(peerID) {
+			hp.relay.LocalMeshPeers.Set(peerID, &RelayInfo{ID: peerID})
+		}
+	}
+
+	// Empty approvals tell the joiner it was not admitted
+	if err := safeBRW.SendProto(&gen.MeshMessage{
+		Type: &gen.MeshMessage_HandshakeResponse{
+			HandshakeResponse: &gen.HandshakeResponse{
+				RelayId:   hp.relay.ID.String(),
+				Approvals: approvals,
+			},
+		},
+	}); err != nil {
+		slog.Debug("Failed to send handshake response", "peer", peerID, "err", err)
+		_ = stream.Reset()
+	}
+}
+
+// --- Public Usable Methods ---
+
+// Handshake presents our credentials to a relay, merging any approval it gives back
+func (hp *HandshakeProtocol) Handshake(ctx context.Context, peerID peer.ID) error {
+	stream, err := hp.relay.Host.NewStream(ctx, peerID, protocolHandshake)
+	if err != nil {
+		return fmt.Errorf("failed to create handshake stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	// Noise transport already provides an authenticated key exchange, no DH key needed
+	if err = safeBRW.SendProto(&gen.MeshMessage{
+		Type: &gen.MeshMessage_Handshake{
+			Handshake: &gen.Handshake{
+				RelayId:   hp.relay.ID.String(),
+				Approvals: hp.relay.Approvals.Copy(),
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	var msg gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&msg); err != nil {
+		return fmt.Errorf("failed to receive handshake response: %w", err)
+	}
+	response := msg.GetHandshakeResponse()
+	if response == nil {
+		return errors.New("unexpected response to handshake")
+	}
+	if response.GetRelayId() != peerID.String() {
+		return fmt.Errorf("peer ID mismatch in handshake response: %s", response.GetRelayId())
+	}
+	if len(response.GetApprovals()) == 0 {
+		return errors.New("relay did not admit us to the mesh")
+	}
+
+	hp.relay.mergeApprovals(peerID, response.GetApprovals())
+	return nil
+}
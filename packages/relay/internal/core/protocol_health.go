@@ -0,0 +1,173 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolHealth = "/nestri-relay/health/1.0.0" // For direct and indirect liveness probes between relays
+)
+
+// --- Protocol Types ---
+
+// HealthProtocol deals with liveness probes of the mesh failure detector
+type HealthProtocol struct {
+	relay *Relay
+}
+
+func NewHealthProtocol(relay *Relay) *HealthProtocol {
+	protocol := &HealthProtocol{
+		relay: relay,
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolHealth, protocol.handleHealth)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleHealth answers a heartbeat probe, or probes another relay on behalf of the requester
+func (hp *HealthProtocol) handleHealth(stream network.Stream) {
+	if !hp.relay.isRelayAdmitted(stream.Conn().RemotePeer()) {
+		slog.Debug("Rejecting health probe from relay not admitted to mesh", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(probeTimeout() * 2))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	var msg gen.MeshMessage
+	if err := safeBRW.ReceiveProto(&msg); err != nil {
+		slog.Debug("Failed to receive health probe", "peer", stream.Conn().RemotePeer(), "err", err)
+		_ = stream.Reset()
+		return
+	}
+
+	var response *gen.MeshMessage
+	switch msgType := msg.GetType().(type) {
+	case *gen.MeshMessage_Heartbeat:
+		response = hp.newHeartbeat()
+	case *gen.MeshMessage_IndirectProbe:
+		targetID, err := peer.Decode(msgType.IndirectProbe.GetRelayId())
+		if err != nil {
+			slog.Error("Failed to decode indirect probe target", "peer", stream.Conn().RemotePeer(), "err", err)
+			_ = stream.Reset()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
+		_, err = hp.Probe(ctx, targetID)
+		alive := err == nil
+		cancel()
+
+		slog.Debug("Indirect probe on behalf of peer", "peer", stream.Conn().RemotePeer(), "target", targetID, "alive", alive)
+		response = &gen.MeshMessage{
+			Type: &gen.MeshMessage_IndirectProbeResult{
+				IndirectProbeResult: &gen.IndirectProbeResult{
+					RelayId: targetID.String(),
+					Alive:   alive,
+				},
+			},
+		}
+	default:
+		slog.Warn("Unexpected health message type", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+
+	if err := safeBRW.SendProto(response); err != nil {
+		slog.Debug("Failed to send health probe response", "peer", stream.Conn().RemotePeer(), "err", err)
+		_ = stream.Reset()
+	}
+}
+
+// newHeartbeat creates a heartbeat message of this relay
+func (hp *HealthProtocol) newHeartbeat() *gen.MeshMessage {
+	return &gen.MeshMessage{
+		Type: &gen.MeshMessage_Heartbeat{
+			Heartbeat: &gen.Heartbeat{
+				RelayId:     hp.relay.ID.String(),
+				Timestamp:   timestamppb.Now(),
+				Incarnation: hp.relay.failureDetector.ownIncarnation(),
+			},
+		},
+	}
+}
+
+// exchange sends a single health message to a relay and returns its response
+func (hp *HealthProtocol) exchange(ctx context.Context, peerID peer.ID, msg *gen.MeshMessage) (*gen.MeshMessage, error) {
+	stream, err := hp.relay.Host.NewStream(ctx, peerID, protocolHealth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create health stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	if err = safeBRW.SendProto(msg); err != nil {
+		return nil, fmt.Errorf("failed to send health message: %w", err)
+	}
+	var response gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&response); err != nil {
+		return nil, fmt.Errorf("failed to receive health response: %w", err)
+	}
+	return &response, nil
+}
+
+// --- Public Usable Methods ---
+
+// Probe sends a heartbeat to a relay directly, returning its incarnation if it responded in time
+func (hp *HealthProtocol) Probe(ctx context.Context, peerID peer.ID) (uint64, error) {
+	response, err := hp.exchange(ctx, peerID, hp.newHeartbeat())
+	if err != nil {
+		return 0, err
+	}
+	heartbeat := response.GetHeartbeat()
+	if heartbeat == nil || heartbeat.GetRelayId() != peerID.String() {
+		return 0, errors.New("unexpected heartbeat response")
+	}
+	return heartbeat.GetIncarnation(), nil
+}
+
+// ProbeIndirect asks a helper relay to probe the target, returning whether the target responded to it
+func (hp *HealthProtocol) ProbeIndirect(ctx context.Context, helperID, targetID peer.ID) (bool, error) {
+	response, err := hp.exchange(ctx, helperID, &gen.MeshMessage{
+		Type: &gen.MeshMessage_IndirectProbe{
+			IndirectProbe: &gen.IndirectProbe{
+				RelayId: targetID.String(),
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	result := response.GetIndirectProbeResult()
+	if result == nil || result.GetRelayId() != targetID.String() {
+		return false, errors.New("unexpected indirect probe response")
+	}
+	return result.GetAlive(), nil
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolStateSync = "/nestri-relay/state-sync/1.0.0" // For requesting missed state updates from relay
+)
+
+// --- Protocol Types ---
+
+// StateProtocol deals with point-to-point recovery of missed mesh state updates
+type StateProtocol struct {
+	relay *Relay
+}
+
+func NewStateProtocol(relay *Relay) *StateProtocol {
+	protocol := &StateProtocol{
+		relay: relay,
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolStateSync, protocol.handleStateSync)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleStateSync answers retransmission requests from another relay from our state history
+func (sp *StateProtocol) handleStateSync(stream network.Stream) {
+	if !sp.relay.isRelayAdmitted(stream.Conn().RemotePeer()) {
+		slog.Debug("Rejecting state sync from relay not admitted to mesh", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	for {
+		var msg gen.MeshMessage
+		if err := safeBRW.ReceiveProto(&msg); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, network.ErrReset) {
+				slog.Debug("State sync connection closed by peer", "peer", stream.Conn().RemotePeer())
+				return
+			}
+
+			slog.Error("Failed to receive state sync message", "err", err)
+			_ = stream.Reset()
+
+			return
+		}
+
+		request := msg.GetRetransmissionRequest()
+		if request == nil {
+			slog.Warn("Unexpected state sync message type", "peer", stream.Conn().RemotePeer())
+			continue
+		}
+
+		// Respond with a full snapshot if the requested update is no longer kept
+		update, ok := sp.relay.stateHistory.get(request.GetSequenceNumber())
+		if !ok {
+			update = sp.relay.stateHistory.snapshot()
+		}
+		slog.Debug("Answering state retransmission request", "peer", stream.Conn().RemotePeer(), "requested", request.GetSequenceNumber(), "sequence", update.GetSequenceNumber())
+
+		if err := safeBRW.SendProto(&gen.MeshMessage{
+			Type: &gen.MeshMessage_Retransmission{
+				Retransmission: &gen.Retransmission{
+					RelayId:     sp.relay.ID.String(),
+					StateUpdate: update,
+				},
+			},
+		}); err != nil {
+			slog.Error("Failed to send state retransmission", "peer", stream.Conn().RemotePeer(), "err", err)
+			_ = stream.Reset()
+			return
+		}
+	}
+}
+
+// --- Public Usable Methods ---
+
+// RequestRetransmission requests the given state update sequence numbers from a relay, 0 requests a snapshot
+func (sp *StateProtocol) RequestRetransmission(ctx context.Context, peerID peer.ID, sequences []uint64) ([]*gen.Retransmission, error) {
+	stream, err := sp.relay.Host.NewStream(ctx, peerID, protocolStateSync)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state sync stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	retransmissions := make([]*gen.Retransmission, 0, len(sequences))
+	for _, sequence := range sequences {
+		if err = safeBRW.SendProto(&gen.MeshMessage{
+			Type: &gen.MeshMessage_RetransmissionRequest{
+				RetransmissionRequest: &gen.RetransmissionRequest{
+					RelayId:        sp.relay.ID.String(),
+					SequenceNumber: sequence,
+				},
+			},
+		}); err != nil {
+			return nil, fmt.Errorf("failed to send retransmission request: %w", err)
+		}
+
+		var msg gen.MeshMessage
+		if err = safeBRW.ReceiveProto(&msg); err != nil {
+			return nil, fmt.Errorf("failed to receive retransmission: %w", err)
+		}
+		retransmission := msg.GetRetransmission()
+		if retransmission == nil {
+			return nil, errors.New("unexpected response to retransmission request")
+		}
+		retransmissions = append(retransmissions, retransmission)
+	}
+
+	return retransmissions, nil
+}
@@ -1,9 +1,7 @@
 package core
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,22 +9,27 @@ import (
 	"relay/internal/common"
 	"relay/internal/connections"
 	"relay/internal/shared"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/oklog/ulid/v2"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
 // TODO:s
 // TODO: When disconnecting with stream open, causes crash on requester
-// TODO: Need to trigger stream request if remote room is online and there are participants in local waiting
-// TODO: Cleanup local room state when stream is closed upstream
 
 // --- Protocol IDs ---
 const (
-	protocolStreamRequest = "/nestri-relay/stream-request/1.0.0" // For requesting a stream from relay
-	protocolStreamPush    = "/nestri-relay/stream-push/1.0.0"    // For pushing a stream to relay
+	protocolStreamRequest   = "/nestri-relay/stream-request/1.0.0" // For requesting a stream from relay, JSON signaling
+	protocolStreamPush      = "/nestri-relay/stream-push/1.0.0"    // For pushing a stream to relay, JSON signaling
+	protocolStreamRequestV2 = "/nestri-relay/stream-request/2.0.0" // For requesting a stream from relay, protobuf signaling
+	protocolStreamPushV2    = "/nestri-relay/stream-push/2.0.0"    // For pushing a stream to relay, protobuf signaling
 )
 
 // --- Protocol Types ---
@@ -35,26 +38,65 @@ const (
 type StreamConnection struct {
 	pc  *webrtc.PeerConnection
 	ndc *connections.NestriDataChannel
+	sig signalingChannel // signaling stream, set for served and pushed streams
+
+	negotiationMutex sync.Mutex // serializes renegotiations of served streams
 }
 
 // StreamProtocol deals with meshed stream forwarding
 type StreamProtocol struct {
 	relay          *Relay
-	servedConns    *common.SafeMap[peer.ID, *StreamConnection] // peer ID -> StreamConnection (for served streams)
-	incomingConns  *common.SafeMap[string, *StreamConnection]  // room name -> StreamConnection (for incoming pushed streams)
-	requestedConns *common.SafeMap[string, *StreamConnection]  // room name -> StreamConnection (for requested streams from other relays)
+	servedConns    *common.SafeMap[ulid.ULID, *StreamConnection] // participant ID -> StreamConnection (for served streams)
+	incomingConns  *common.SafeMap[string, *StreamConnection]    // room name -> StreamConnection (for incoming pushed streams)
+	requestedConns *common.SafeMap[string, *StreamConnection]    // room name -> StreamConnection (for requested streams from other relays)
+	upstreams      *common.SafeMap[string, peer.ID]              // room name -> relay the requested stream is pulled from
+	waiting        *waitingList                                  // requesters waiting for offline rooms to come online
+	pulls          *common.SafeMap[string, *roomPull]            // room name -> pull for waiting requesters until its stream flows
+	failovers      *common.SafeMap[string, *failover]            // room name -> running failover of requested stream
+	rewriters      *common.SafeMap[string, *rtpRewriter]         // room name + track kind + RID -> RTP rewriter of requested stream track
+	feedback       *common.SafeMap[string, *feedbackAggregator]  // room name -> RTCP feedback of participants for upstream
+	ingressStats   *common.SafeMap[string, *rtpCounters]         // room name + track kind -> counters of track received for room
+	viewerStats    *common.SafeMap[ulid.ULID, *viewerStats]      // participant ID -> feedback of served participant about its tracks
+	replayBuffers  *common.SafeMap[string, *replayBuffer]        // room name + track kind -> rolling buffer of track received for room
+	lastClips      *common.SafeMap[string, time.Time]            // room name -> when a clip was last saved on participant request
+	clipForwards   *common.SafeMap[uint32, *clipForward]         // forwarded request ID -> clip request waiting for its upstream result
+	lastClipID     atomic.Uint32                                 // ID of the latest clip request forwarded upstream
+	viewerLayers   *common.SafeMap[ulid.ULID, *viewerLayers]     // participant ID -> what its video layer is chosen from
+	ingestMutex    sync.Mutex                                    // serializes joining simulcast encodings of pushed tracks
+	pushMutex      sync.Mutex                                    // makes checking and claiming rooms to push to a single step
+	pushClaims     map[string]*pushClaim                         // room name -> claim of a push not connected yet, guarded by pushMutex
+}
+
+// pushClaim reserves a room for a push until its connection is stored, so concurrent pushes can't both take it
+type pushClaim struct {
+	roomName string
 }
 
 func NewStreamProtocol(relay *Relay) *StreamProtocol {
 	protocol := &StreamProtocol{
 		relay:          relay,
-		servedConns:    common.NewSafeMap[peer.ID, *StreamConnection](),
+		servedConns:    common.NewSafeMap[ulid.ULID, *StreamConnection](),
 		incomingConns:  common.NewSafeMap[string, *StreamConnection](),
 		requestedConns: common.NewSafeMap[string, *StreamConnection](),
+		upstreams:      common.NewSafeMap[string, peer.ID](),
+		waiting:        newWaitingList(),
+		pulls:          common.NewSafeMap[string, *roomPull](),
+		failovers:      common.NewSafeMap[string, *failover](),
+		rewriters:      common.NewSafeMap[string, *rtpRewriter](),
+		feedback:       common.NewSafeMap[string, *feedbackAggregator](),
+		ingressStats:   common.NewSafeMap[string, *rtpCounters](),
+		viewerStats:    common.NewSafeMap[ulid.ULID, *viewerStats](),
+		replayBuffers:  common.NewSafeMap[string, *replayBuffer](),
+		lastClips:      common.NewSafeMap[string, time.Time](),
+		clipForwards:   common.NewSafeMap[uint32, *clipForward](),
+		viewerLayers:   common.NewSafeMap[ulid.ULID, *viewerLayers](),
+		pushClaims:     make(map[string]*pushClaim),
 	}
 
 	protocol.relay.Host.SetStreamHandler(protocolStreamRequest, protocol.handleStreamRequest)
+	protocol.relay.Host.SetStreamHandler(protocolStreamRequestV2, protocol.handleStreamRequest)
 	protocol.relay.Host.SetStreamHandler(protocolStreamPush, protocol.handleStreamPush)
+	protocol.relay.Host.SetStreamHandler(protocolStreamPushV2, protocol.handleStreamPush)
 
 	return protocol
 }
@@ -63,13 +105,19 @@ func NewStreamProtocol(relay *Relay) *StreamProtocol {
 
 // handleStreamRequest manages a request from another relay for a stream hosted locally
 func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
-	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	safeBRW := common.NewSafeBufioRW(brw)
+	sig := newSignalingChannel(stream)
+	defer sp.waiting.remove(sig)
 
+	// Latest session requested over this stream, signaling messages apply to it
+	var participant *shared.Participant
 	iceHolder := make([]webrtc.ICECandidateInit, 0)
 	for {
-		data, err := safeBRW.Receive()
+		msg, err := sig.receive()
 		if err != nil {
+			if errors.Is(err, errInvalidSignaling) {
+				slog.Error("Failed to decode signaling message", "err", err)
+				continue
+			}
 			if errors.Is(err, io.EOF) || errors.Is(err, network.ErrReset) {
 				slog.Debug("Stream request connection closed by peer", "peer", stream.Conn().RemotePeer())
 				return
@@ -81,70 +129,79 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 			return
 		}
 
-		var baseMsg connections.MessageBase
-		if err = json.Unmarshal(data, &baseMsg); err != nil {
-			slog.Error("Failed to unmarshal base message", "err", err)
-			continue
-		}
-
-		switch baseMsg.Type {
-		case "request-stream-room":
-			var rawMsg connections.MessageRaw
-			if err = json.Unmarshal(data, &rawMsg); err != nil {
-				slog.Error("Failed to unmarshal raw message for room stream request", "err", err)
-				continue
-			}
-
-			var roomName string
-			if err = json.Unmarshal(rawMsg.Data, &roomName); err != nil {
-				slog.Error("Failed to unmarshal room name from raw message", "err", err)
+		switch msg.Type {
+		case signalRequestRoom:
+			roomName := msg.RoomName
+			slog.Info("Received stream request for room", "room", roomName)
+			if !sp.relay.isRequesterAdmitted(stream.Conn(), stream.Protocol()) {
+				slog.Warn("Rejecting stream request of relay not admitted to mesh", "room", roomName, "peer", stream.Conn().RemotePeer())
+				sendSignalingError(sig, roomName, signalErrorUnauthorized, "relay is not admitted to the mesh")
 				continue
 			}
-
-			slog.Info("Received stream request for room", "room", roomName)
 			room := sp.relay.GetRoomByName(roomName)
-			if room == nil || !room.IsOnline() || room.OwnerID != sp.relay.ID {
-				// TODO: Allow forward requests to other relays from here?
-				slog.Debug("Cannot provide stream for nil, offline or non-owned room", "room", roomName, "is_online", room != nil && room.IsOnline(), "is_owner", room != nil && room.OwnerID == sp.relay.ID)
-				// Respond with "request-stream-offline" message with room name
-				// TODO: Store the peer and send "online" message when the room comes online
-				roomNameData, err := json.Marshal(roomName)
-				if err != nil {
-					slog.Error("Failed to marshal room name for request stream offline", "room", roomName, "err", err)
+			// Owned rooms and requested copies of remote rooms can be served onward
+			if err = sp.relay.checkStreamRequest(roomName, stream.Conn().RemotePeer()); err != nil {
+				slog.Debug("Cannot provide stream for room", "room", roomName, "peer", stream.Conn().RemotePeer(), "reason", err)
+				if room != nil && room.IsOnline() {
+					sendSignalingError(sig, roomName, signalErrorUnavailable, err.Error())
 					continue
-				} else {
-					if err = safeBRW.SendJSON(connections.NewMessageRaw(
-						"request-stream-offline",
-						roomNameData,
-					)); err != nil {
-						slog.Error("Failed to send request stream offline message", "room", roomName, "err", err)
-					}
+				}
+				// Keep the requester waiting if the room is offline, it's notified when the room comes online
+				sp.waiting.add(roomName, sig, stream.Conn().RemotePeer())
+				sp.relay.pullRoomForWaiting(roomName)
+				// Respond with "request-stream-offline" message with room name
+				if err = sig.send(&signalingMessage{Type: signalOffline, RoomName: roomName}); err != nil {
+					slog.Error("Failed to send request stream offline message", "room", roomName, "err", err)
 				}
 				continue
 			}
 
-			pc, err := common.CreatePeerConnection(func() {
-				slog.Info("PeerConnection closed for requested stream", "room", roomName)
-				// Cleanup the stream connection
-				if ok := sp.servedConns.Has(stream.Conn().RemotePeer()); ok {
-					sp.servedConns.Delete(stream.Conn().RemotePeer())
+			// Every request is a session of its own, a peer may hold many
+			newParticipant, err := shared.NewParticipant(stream.Conn().RemotePeer())
+			if err != nil {
+				slog.Error("Failed to create participant for requested stream", "room", roomName, "err", err)
+				sendSignalingError(sig, roomName, signalErrorInternal, "failed to create participant")
+				continue
+			}
+
+			var pc *webrtc.PeerConnection
+			pc, err = common.CreatePeerConnection(func() {
+				slog.Info("PeerConnection closed for requested stream", "room", roomName, "participant", newParticipant.ID)
+				// Cleanup the stream connection and participant
+				if ok := sp.servedConns.Has(newParticipant.ID); ok {
+					sp.servedConns.Delete(newParticipant.ID)
 				}
+				room.RemoveParticipantByID(newParticipant.ID)
+				sp.forgetFeedback(roomName, newParticipant.ID)
+				sp.viewerStats.Delete(newParticipant.ID)
+				sp.viewerLayers.Delete(newParticipant.ID)
+				sp.relay.DeleteRoomIfEmpty(room)
+			}, func() {
+				// We are the offering side, so recovering the connection is up to us
+				restartICE(sig, roomName, pc)
 			})
 			if err != nil {
 				slog.Error("Failed to create PeerConnection for requested stream", "room", roomName, "err", err)
+				sendSignalingError(sig, roomName, signalErrorInternal, "failed to create PeerConnection")
 				continue
 			}
+			newParticipant.PeerConnection = pc
+			newParticipant.Relay = sp.relay.LocalMeshPeers.Has(stream.Conn().RemotePeer())
+			newParticipant.OnRTCP(sp.onParticipantRTCP(roomName, newParticipant.ID))
+			sp.watchSendEstimate(roomName, newParticipant.ID, pc)
 
 			// Add tracks
 			if room.AudioTrack != nil {
-				if _, err = pc.AddTrack(room.AudioTrack); err != nil {
+				if err = newParticipant.AddTrack(room.AudioTrack); err != nil {
 					slog.Error("Failed to add audio track for requested stream", "room", roomName, "err", err)
+					rejectSession(sig, roomName, pc, "failed to add audio track")
 					continue
 				}
 			}
 			if room.VideoTrack != nil {
-				if _, err = pc.AddTrack(room.VideoTrack); err != nil {
+				if err = newParticipant.AddTrack(room.VideoTrack); err != nil {
 					slog.Error("Failed to add video track for requested stream", "room", roomName, "err", err)
+					rejectSession(sig, roomName, pc, "failed to add video track")
 					continue
 				}
 			}
@@ -158,9 +215,11 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 			})
 			if err != nil {
 				slog.Error("Failed to create DataChannel for requested stream", "room", roomName, "err", err)
+				rejectSession(sig, roomName, pc, "failed to create DataChannel")
 				continue
 			}
 			ndc := connections.NewNestriDataChannel(dc)
+			newParticipant.DataChannel = ndc
 
 			ndc.RegisterOnOpen(func() {
 				slog.Debug("Relay DataChannel opened for requested stream", "room", roomName)
@@ -175,6 +234,12 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 					}
 				}
 			})
+			ndc.RegisterMessageCallback(clipMessageType, func(data []byte) {
+				sp.handleClipRequest(roomName, newParticipant.ID, ndc, data)
+			})
+			ndc.RegisterMessageCallback(viewportMessageType, func(data []byte) {
+				sp.handleViewport(roomName, newParticipant.ID, data)
+			})
 
 			// ICE Candidate handling
 			pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
@@ -182,7 +247,7 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 					return
 				}
 
-				if err = safeBRW.SendJSON(connections.NewMessageICE("ice-candidate", candidate.ToJSON())); err != nil {
+				if err = sig.send(&signalingMessage{Type: signalICE, Candidate: candidate.ToJSON()}); err != nil {
 					slog.Error("Failed to send ICE candidate message for requested stream", "room", roomName, "err", err)
 					return
 				}
@@ -192,36 +257,39 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 			offer, err := pc.CreateOffer(nil)
 			if err != nil {
 				slog.Error("Failed to create offer for requested stream", "room", roomName, "err", err)
+				rejectSession(sig, roomName, pc, "failed to create offer")
 				continue
 			}
 			if err = pc.SetLocalDescription(offer); err != nil {
 				slog.Error("Failed to set local description for requested stream", "room", roomName, "err", err)
+				rejectSession(sig, roomName, pc, "failed to set local description")
 				continue
 			}
-			if err = safeBRW.SendJSON(connections.NewMessageSDP("offer", offer)); err != nil {
+			if err = sig.send(&signalingMessage{Type: signalOffer, SDP: offer}); err != nil {
 				slog.Error("Failed to send offer for requested stream", "room", roomName, "err", err)
+				_ = pc.Close()
 				continue
 			}
+			watchNegotiation(sig, roomName, pc)
 
-			// Store the connection
-			sp.servedConns.Set(stream.Conn().RemotePeer(), &StreamConnection{
+			// Store the connection and participant
+			sp.servedConns.Set(newParticipant.ID, &StreamConnection{
 				pc:  pc,
 				ndc: ndc,
+				sig: sig,
 			})
-
-			slog.Debug("Sent offer for requested stream")
-		case "ice-candidate":
-			var iceMsg connections.MessageICE
-			if err := json.Unmarshal(data, &iceMsg); err != nil {
-				slog.Error("Failed to unmarshal ICE message", "err", err)
-				continue
-			}
-			if conn, ok := sp.servedConns.Get(stream.Conn().RemotePeer()); ok && conn.pc.RemoteDescription() != nil {
-				if err := conn.pc.AddICECandidate(iceMsg.Candidate); err != nil {
+			room.AddParticipant(newParticipant)
+			participant = newParticipant
+			iceHolder = make([]webrtc.ICECandidateInit, 0)
+
+			slog.Debug("Sent offer for requested stream", "room", roomName, "participant", participant.ID)
+		case signalICE:
+			if participant != nil && participant.PeerConnection.RemoteDescription() != nil {
+				if err := participant.PeerConnection.AddICECandidate(msg.Candidate); err != nil {
 					slog.Error("Failed to add ICE candidate", "err", err)
 				}
 				for _, heldIce := range iceHolder {
-					if err := conn.pc.AddICECandidate(heldIce); err != nil {
+					if err := participant.PeerConnection.AddICECandidate(heldIce); err != nil {
 						slog.Error("Failed to add held ICE candidate", "err", err)
 					}
 				}
@@ -229,66 +297,85 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 				iceHolder = make([]webrtc.ICECandidateInit, 0)
 			} else {
 				// Hold the candidate until remote description is set
-				iceHolder = append(iceHolder, iceMsg.Candidate)
-			}
-		case "answer":
-			var answerMsg connections.MessageSDP
-			if err := json.Unmarshal(data, &answerMsg); err != nil {
-				slog.Error("Failed to unmarshal answer from signaling message", "err", err)
-				continue
+				iceHolder = append(iceHolder, msg.Candidate)
 			}
-			if conn, ok := sp.servedConns.Get(stream.Conn().RemotePeer()); ok {
-				if err := conn.pc.SetRemoteDescription(answerMsg.SDP); err != nil {
+		case signalAnswer:
+			// Answers belong to the session with an outstanding offer, the latest one or one restarting ICE
+			if pc := sp.offeringConn(sig); pc != nil {
+				if err := pc.SetRemoteDescription(msg.SDP); err != nil {
 					slog.Error("Failed to set remote description for answer", "err", err)
+					rejectSession(sig, msg.RoomName, pc, "failed to set remote description")
 					continue
 				}
 				slog.Debug("Set remote description for answer")
 			} else {
 				slog.Warn("Received answer without active PeerConnection")
+				sendSignalingError(sig, msg.RoomName, signalErrorBadRequest, "answer without requested stream")
 			}
+		case signalError:
+			slog.Warn("Stream requester reported signaling error", "room", msg.RoomName, "code", msg.ErrorCode, "message", msg.ErrorMsg)
+			if participant != nil {
+				if err := participant.PeerConnection.Close(); err != nil {
+					slog.Error("Failed to close PeerConnection after signaling error", "participant", participant.ID, "err", err)
+				}
+				participant = nil
+			}
+		default:
+			slog.Warn("Unexpected signaling message type for stream request", "type", msg.Type)
 		}
 	}
 }
 
 // requestStream manages the internals of the stream request
 func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room) error {
-	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	safeBRW := common.NewSafeBufioRW(brw)
+	sig := newSignalingChannel(stream)
 
-	slog.Debug("Requesting room stream from peer", "room", room.Name, "peer", stream.Conn().RemotePeer())
+	slog.Debug("Requesting room stream from peer", "room", room.Name, "peer", stream.Conn().RemotePeer(), "protocol", stream.Protocol())
 
 	// Send room name to the remote peer
-	roomData, err := json.Marshal(room.Name)
+	err := sig.send(&signalingMessage{Type: signalRequestRoom, RoomName: room.Name})
 	if err != nil {
-		_ = stream.Close()
-		return fmt.Errorf("failed to marshal room name: %w", err)
-	}
-	if err = safeBRW.SendJSON(connections.NewMessageRaw(
-		"request-stream-room",
-		roomData,
-	)); err != nil {
 		_ = stream.Close()
 		return fmt.Errorf("failed to send room request: %w", err)
 	}
 
-	pc, err := common.CreatePeerConnection(func() {
+	upstream := stream.Conn().RemotePeer()
+	var pc *webrtc.PeerConnection
+	pc, err = common.CreatePeerConnection(func() {
 		slog.Info("Relay PeerConnection closed for requested stream", "room", room.Name)
 		_ = stream.Close() // ignore error as may be closed already
-		// Cleanup the stream connection
-		if ok := sp.requestedConns.Has(room.Name); ok {
+		// Cleanup the stream connection, unless already replaced by another one
+		if conn, ok := sp.requestedConns.Get(room.Name); ok && conn.pc == pc {
 			sp.requestedConns.Delete(room.Name)
 		}
-	})
+		// Pull the stream from elsewhere if this was our established upstream
+		if current, ok := sp.upstreams.Get(room.Name); ok && current == upstream {
+			sp.upstreams.Delete(room.Name)
+			go sp.relay.failoverStream(room.Name, upstream)
+		}
+	}, nil) // Upstream relay is the offering side and restarts ICE on disconnects
 	if err != nil {
+		sendSignalingError(sig, room.Name, signalErrorInternal, "failed to create PeerConnection")
 		_ = stream.Close()
 		return fmt.Errorf("failed to create PeerConnection: %w", err)
 	}
+	// Tear down if no offer arrives or the connection does not come up in time
+	watchNegotiation(sig, room.Name, pc)
 
 	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		localTrack, _ := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), "relay-"+room.Name+"-"+track.Kind().String())
-		slog.Debug("Received track for requested stream", "room", room.Name, "track_kind", track.Kind().String())
+		localTrack, encoding, err := sp.requestedRoomTrack(room, track)
+		if err != nil {
+			slog.Error("Failed to create local track for requested stream", "room", room.Name, "track_kind", track.Kind().String(), "err", err)
+			return
+		}
+		slog.Debug("Received track for requested stream", "room", room.Name, "track_kind", track.Kind().String(), "rid", track.RID())
 
-		room.SetTrack(track.Kind(), localTrack)
+		// Splice this upstream after the previous one in the same sequence number and timestamp space
+		rewriter := sp.getRewriter(room.Name, track.Kind(), track.RID(), track.Codec().ClockRate)
+		rewriter.switchSource()
+		counters := sp.getIngressStats(room.Name, track.Kind())
+		// Upstream relays send all layers, selected here for our own participants
+		parser := shared.NewLayerParser(track.Codec().MimeType, dependencyDescriptorID(receiver))
 
 		go func() {
 			for {
@@ -300,12 +387,24 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 					break
 				}
 
-				err = localTrack.WriteRTP(rtpPacket)
+				rewriter.rewrite(rtpPacket)
+				if localTrack.Primary() == encoding {
+					counters.onPacket(rtpPacket, track.Codec().ClockRate)
+					sp.relay.recordPacket(room.Name, track.Kind(), track.Codec().RTPCodecCapability, rtpPacket)
+				}
+				err = localTrack.WriteLayerRTP(rtpPacket, encoding, parser.Parse(rtpPacket))
 				if err != nil && !errors.Is(err, io.ErrClosedPipe) {
 					slog.Error("Failed to write RTP to local track for requested stream room", "room", room.Name, "err", err)
 					break
 				}
 			}
+
+			// Local track stays for failover, only the ended simulcast encoding goes
+			if rid := track.RID(); len(rid) > 0 {
+				sp.ingestMutex.Lock()
+				localTrack.RemoveEncoding(rid)
+				sp.ingestMutex.Unlock()
+			}
 		}()
 	})
 
@@ -327,8 +426,9 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 				ndc: ndc,
 			})
 		}
-
-		// We do not handle any messages from upstream here
+		ndc.RegisterMessageCallback(clipResultMessageType, func(data []byte) {
+			sp.handleClipResult(room.Name, data)
+		})
 	})
 
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
@@ -336,10 +436,7 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 			return
 		}
 
-		if err = safeBRW.SendJSON(connections.NewMessageICE(
-			"ice-candidate",
-			candidate.ToJSON(),
-		)); err != nil {
+		if err = sig.send(&signalingMessage{Type: signalICE, Candidate: candidate.ToJSON()}); err != nil {
 			slog.Error("Failed to send ICE candidate message for requested stream", "room", room.Name, "err", err)
 			return
 		}
@@ -350,8 +447,12 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 		iceHolder := make([]webrtc.ICECandidateInit, 0)
 
 		for {
-			data, err := safeBRW.Receive()
+			msg, err := sig.receive()
 			if err != nil {
+				if errors.Is(err, errInvalidSignaling) {
+					slog.Error("Failed to decode signaling message for requested stream", "room", room.Name, "err", err)
+					continue
+				}
 				if errors.Is(err, io.EOF) || errors.Is(err, network.ErrReset) {
 					slog.Debug("Connection for requested stream closed by peer", "room", room.Name)
 					return
@@ -363,21 +464,10 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 				return
 			}
 
-			var baseMsg connections.MessageBase
-			if err = json.Unmarshal(data, &baseMsg); err != nil {
-				slog.Error("Failed to unmarshal base message for requested stream", "room", room.Name, "err", err)
-				return
-			}
-
-			switch baseMsg.Type {
-			case "ice-candidate":
-				var iceMsg connections.MessageICE
-				if err = json.Unmarshal(data, &iceMsg); err != nil {
-					slog.Error("Failed to unmarshal ICE candidate for requested stream", "room", room.Name, "err", err)
-					continue
-				}
+			switch msg.Type {
+			case signalICE:
 				if conn, ok := sp.requestedConns.Get(room.Name); ok && conn.pc.RemoteDescription() != nil {
-					if err = conn.pc.AddICECandidate(iceMsg.Candidate); err != nil {
+					if err = conn.pc.AddICECandidate(msg.Candidate); err != nil {
 						slog.Error("Failed to add ICE candidate for requested stream", "room", room.Name, "err", err)
 					}
 					// Add held candidates
@@ -390,50 +480,56 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 					iceHolder = make([]webrtc.ICECandidateInit, 0)
 				} else {
 					// Hold the candidate until remote description is set
-					iceHolder = append(iceHolder, iceMsg.Candidate)
-				}
-			case "offer":
-				var offerMsg connections.MessageSDP
-				if err = json.Unmarshal(data, &offerMsg); err != nil {
-					slog.Error("Failed to unmarshal offer for requested stream", "room", room.Name, "err", err)
-					continue
+					iceHolder = append(iceHolder, msg.Candidate)
 				}
-				if err = pc.SetRemoteDescription(offerMsg.SDP); err != nil {
-					slog.Error("Failed to set remote description for requested stream", "room", room.Name, "err", err)
-					continue
-				}
-				answer, err := pc.CreateAnswer(nil)
+			case signalOffer:
+				// Later offers renegotiate the same PeerConnection, e.g. to restart ICE
+				answer, err := answerOffer(pc, msg.SDP)
 				if err != nil {
-					slog.Error("Failed to create answer for requested stream", "room", room.Name, "err", err)
-					if err = stream.Reset(); err != nil {
-						slog.Error("Failed to reset stream for requested stream", "err", err)
-					}
+					slog.Error("Failed to answer offer for requested stream", "room", room.Name, "err", err)
+					rejectSession(sig, room.Name, pc, "failed to answer offer")
 					return
 				}
-				if err = pc.SetLocalDescription(answer); err != nil {
-					slog.Error("Failed to set local description for requested stream", "room", room.Name, "err", err)
-					if err = stream.Reset(); err != nil {
-						slog.Error("Failed to reset stream for requested stream", "err", err)
-					}
-					return
-				}
-				if err = safeBRW.SendJSON(connections.NewMessageSDP(
-					"answer",
-					answer,
-				)); err != nil {
+				if err = sig.send(&signalingMessage{Type: signalAnswer, SDP: answer}); err != nil {
 					slog.Error("Failed to send answer for requested stream", "room", room.Name, "err", err)
-					continue
+					_ = pc.Close()
+					return
 				}
 
-				// Store the connection
-				sp.requestedConns.Set(room.Name, &StreamConnection{
-					pc:  pc,
-					ndc: nil,
-				})
+				// Store the connection, keeping the DataChannel of a renegotiated one
+				if conn, ok := sp.requestedConns.Get(room.Name); !ok || conn.pc != pc {
+					sp.requestedConns.Set(room.Name, &StreamConnection{
+						pc:  pc,
+						ndc: nil,
+					})
+				}
+				sp.upstreams.Set(room.Name, upstream)
 
 				slog.Debug("Sent answer for requested stream", "room", room.Name)
+			case signalOffline:
+				if current, ok := sp.upstreams.Get(room.Name); ok && current == upstream {
+					// Upstream room went offline, take our copy offline too instead of failing over
+					slog.Info("Requested stream went offline upstream", "room", room.Name, "peer", upstream)
+					sp.upstreams.Delete(room.Name)
+					room.SetTrack(webrtc.RTPCodecTypeAudio, nil)
+					room.SetTrack(webrtc.RTPCodecTypeVideo, nil)
+				} else {
+					slog.Warn("Relay cannot provide requested stream", "room", room.Name, "peer", upstream)
+				}
+				if err = pc.Close(); err != nil {
+					slog.Error("Failed to close PeerConnection for offline requested stream", "room", room.Name, "err", err)
+				}
+				_ = stream.Close()
+				return
+			case signalError:
+				slog.Warn("Relay rejected requested stream", "room", room.Name, "peer", upstream, "code", msg.ErrorCode, "message", msg.ErrorMsg)
+				if err = pc.Close(); err != nil {
+					slog.Error("Failed to close PeerConnection for rejected requested stream", "room", room.Name, "err", err)
+				}
+				_ = stream.Close()
+				return
 			default:
-				slog.Warn("Unknown signaling message type", "room", room.Name, "type", baseMsg.Type)
+				slog.Warn("Unknown signaling message type", "room", room.Name, "type", msg.Type)
 			}
 		}
 	}()
@@ -443,14 +539,21 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 
 // handleStreamPush manages a stream push from a node (nestri-server)
 func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
-	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	safeBRW := common.NewSafeBufioRW(brw)
+	sig := newSignalingChannel(stream)
 
 	var room *shared.Room
+	var claim *pushClaim // held until the connection of the push is stored
+	defer func() {
+		sp.releasePushClaim(claim)
+	}()
 	iceHolder := make([]webrtc.ICECandidateInit, 0)
 	for {
-		data, err := safeBRW.Receive()
+		msg, err := sig.receive()
 		if err != nil {
+			if errors.Is(err, errInvalidSignaling) {
+				slog.Error("Failed to decode signaling message for stream push", "err", err)
+				continue
+			}
 			if errors.Is(err, io.EOF) || errors.Is(err, network.ErrReset) {
 				slog.Debug("Stream push connection closed by peer", "peer", stream.Conn().RemotePeer())
 				return
@@ -462,64 +565,48 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 			return
 		}
 
-		var baseMsg connections.MessageBase
-		if err = json.Unmarshal(data, &baseMsg); err != nil {
-			slog.Error("Failed to unmarshal base message from base message", "err", err)
-			continue
-		}
+		switch msg.Type {
+		case signalPushRoom:
+			roomName := msg.RoomName
+			slog.Info("Received stream push request for room", "room", roomName)
 
-		switch baseMsg.Type {
-		case "push-stream-room":
-			var rawMsg connections.MessageRaw
-			if err = json.Unmarshal(data, &rawMsg); err != nil {
-				slog.Error("Failed to unmarshal room name from data", "err", err)
+			// Rejected pushes leave no room set, so following offers are rejected too
+			room = nil
+			sp.releasePushClaim(claim)
+			pushRoom, roomClaim, code, err := sp.claimPushRoom(roomName)
+			claim = roomClaim
+			if err != nil {
+				slog.Error("Cannot push a stream to room", "room", roomName, "err", err)
+				sendSignalingError(sig, roomName, code, err.Error())
 				continue
 			}
 
-			var roomName string
-			if err = json.Unmarshal(rawMsg.Data, &roomName); err != nil {
-				slog.Error("Failed to unmarshal room name from raw message", "err", err)
+			// Respond with an OK with the room name
+			if err = sig.send(&signalingMessage{Type: signalPushOK, RoomName: pushRoom.Name}); err != nil {
+				slog.Error("Failed to send push stream OK response", "room", pushRoom.Name, "err", err)
 				continue
 			}
+			room = pushRoom
 
-			slog.Info("Received stream push request for room", "room", roomName)
-
-			room = sp.relay.GetRoomByName(roomName)
-			if room != nil {
-				if room.OwnerID != sp.relay.ID {
-					slog.Error("Cannot push a stream to non-owned room", "room", room.Name, "owner_id", room.OwnerID)
-					continue
-				}
-				if room.IsOnline() {
-					slog.Error("Cannot push a stream to already online room", "room", room.Name)
-					continue
+			// Give up the push if no offer follows in time
+			time.AfterFunc(signalingTimeout, func() {
+				sp.releasePushClaim(roomClaim)
+				if sp.incomingConns.Has(pushRoom.Name) {
+					return
 				}
-			} else {
-				// Create a new room if it doesn't exist
-				room = sp.relay.CreateRoom(roomName)
-			}
-
-			// Respond with an OK with the room name
-			roomData, err := json.Marshal(room.Name)
-			if err != nil {
-				slog.Error("Failed to marshal room name for push stream response", "err", err)
-				continue
-			}
-			if err = safeBRW.SendJSON(connections.NewMessageRaw(
-				"push-stream-ok",
-				roomData,
-			)); err != nil {
-				slog.Error("Failed to send push stream OK response", "room", room.Name, "err", err)
-				continue
-			}
-		case "ice-candidate":
-			var iceMsg connections.MessageICE
-			if err = json.Unmarshal(data, &iceMsg); err != nil {
-				slog.Error("Failed to unmarshal ICE candidate from data", "err", err)
+				slog.Warn("Stream push timed out waiting for offer", "room", pushRoom.Name)
+				sendSignalingError(sig, pushRoom.Name, signalErrorTimeout, "no offer received")
+				_ = stream.Reset()
+				sp.relay.DeleteRoomIfEmpty(pushRoom)
+			})
+		case signalICE:
+			if room == nil {
+				slog.Error("Received ICE candidate without room set for stream push")
+				sendSignalingError(sig, msg.RoomName, signalErrorBadRequest, "ICE candidate without pushed room")
 				continue
 			}
 			if conn, ok := sp.incomingConns.Get(room.Name); ok && conn.pc.RemoteDescription() != nil {
-				if err = conn.pc.AddICECandidate(iceMsg.Candidate); err != nil {
+				if err = conn.pc.AddICECandidate(msg.Candidate); err != nil {
 					slog.Error("Failed to add ICE candidate for pushed stream", "err", err)
 				}
 				for _, heldIce := range iceHolder {
@@ -531,31 +618,44 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 				iceHolder = make([]webrtc.ICECandidateInit, 0)
 			} else {
 				// Hold the candidate until remote description is set
-				iceHolder = append(iceHolder, iceMsg.Candidate)
+				iceHolder = append(iceHolder, msg.Candidate)
 			}
-		case "offer":
+		case signalOffer:
 			// Make sure we have room set to push to (set by "push-stream-room")
 			if room == nil {
 				slog.Error("Received offer without room set for stream push")
+				sendSignalingError(sig, msg.RoomName, signalErrorBadRequest, "offer without pushed room")
 				continue
 			}
 
-			var offerMsg connections.MessageSDP
-			if err = json.Unmarshal(data, &offerMsg); err != nil {
-				slog.Error("Failed to unmarshal offer from data", "err", err)
+			// Offers on an established push renegotiate it, e.g. to restart ICE
+			if conn, ok := sp.incomingConns.Get(room.Name); ok && conn.sig == sig && conn.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+				answer, err := answerOffer(conn.pc, msg.SDP)
+				if err != nil {
+					slog.Error("Failed to answer renegotiation of pushed stream", "room", room.Name, "err", err)
+					sendSignalingError(sig, room.Name, signalErrorInternal, "failed to answer offer")
+					continue
+				}
+				if err = sig.send(&signalingMessage{Type: signalAnswer, SDP: answer}); err != nil {
+					slog.Error("Failed to send answer for pushed stream", "room", room.Name, "err", err)
+					continue
+				}
+				slog.Debug("Renegotiated pushed stream", "room", room.Name)
 				continue
 			}
 
 			// Create PeerConnection for the incoming stream
 			pc, err := common.CreatePeerConnection(func() {
 				slog.Info("PeerConnection closed for pushed stream", "room", room.Name)
-				// Cleanup the stream connection
+				// Cleanup the stream connection, room goes away too if nobody is watching
 				if ok := sp.incomingConns.Has(room.Name); ok {
 					sp.incomingConns.Delete(room.Name)
 				}
-			})
+				sp.relay.DeleteRoomIfEmpty(room)
+			}, nil) // Pushing node is the offering side and restarts ICE on disconnects
 			if err != nil {
 				slog.Error("Failed to create PeerConnection for pushed stream", "room", room.Name, "err", err)
+				sendSignalingError(sig, room.Name, signalErrorInternal, "failed to create PeerConnection")
 				continue
 			}
 
@@ -576,6 +676,7 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 					sp.incomingConns.Set(room.Name, &StreamConnection{
 						pc:  pc,
 						ndc: room.DataChannel,
+						sig: sig,
 					})
 				}
 			})
@@ -585,71 +686,20 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 					return
 				}
 
-				if err = safeBRW.SendJSON(connections.NewMessageICE(
-					"ice-candidate",
-					candidate.ToJSON(),
-				)); err != nil {
+				if err = sig.send(&signalingMessage{Type: signalICE, Candidate: candidate.ToJSON()}); err != nil {
 					slog.Error("Failed to send ICE candidate message for pushed stream", "room", room.Name, "err", err)
 					return
 				}
 			})
 
 			pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-				localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.Kind().String(), fmt.Sprintf("nestri-%s-%s", room.Name, remoteTrack.Kind().String()))
-				if err != nil {
-					slog.Error("Failed to create local track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String(), "err", err)
-					return
-				}
-
-				slog.Debug("Received track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String())
-
-				// Set track for Room
-				room.SetTrack(remoteTrack.Kind(), localTrack)
-
-				// Prepare PlayoutDelayExtension so we don't need to recreate it for each packet
-				playoutExt := &rtp.PlayoutDelayExtension{
-					MinDelay: 0,
-					MaxDelay: 0,
-				}
-				playoutPayload, err := playoutExt.Marshal()
-				if err != nil {
-					slog.Error("Failed to marshal PlayoutDelayExtension for room", "room", room.Name, "err", err)
-					return
-				}
-
-				for {
-					rtpPacket, _, err := remoteTrack.ReadRTP()
-					if err != nil {
-						if !errors.Is(err, io.EOF) {
-							slog.Error("Failed to read RTP from remote track for room", "room", room.Name, "err", err)
-						}
-						break
-					}
-
-					// Use PlayoutDelayExtension for low latency, if set for this track kind
-					if extID, ok := common.GetExtension(remoteTrack.Kind(), common.ExtensionPlayoutDelay); ok {
-						if err := rtpPacket.SetExtension(extID, playoutPayload); err != nil {
-							slog.Error("Failed to set PlayoutDelayExtension for room", "room", room.Name, "err", err)
-							continue
-						}
-					}
-
-					err = localTrack.WriteRTP(rtpPacket)
-					if err != nil && !errors.Is(err, io.ErrClosedPipe) {
-						slog.Error("Failed to write RTP to local track for room", "room", room.Name, "err", err)
-						break
-					}
-				}
-
-				slog.Debug("Track closed for room", "room", room.Name, "track_kind", remoteTrack.Kind().String())
-
-				// Cleanup the track from the room
-				room.SetTrack(remoteTrack.Kind(), nil)
+				sp.ingestTrack(room, remoteTrack, receiver)
 			})
 
 			// Set the remote description
-			if err = pc.SetRemoteDescription(offerMsg.SDP); err != nil {
+			if err = pc.SetRemoteDescription(msg.SDP); err != nil {
 				slog.Error("Failed to set remote description for pushed stream", "room", room.Name, "err", err)
+				rejectSession(sig, room.Name, pc, "failed to set remote description")
 				continue
 			}
 			slog.Debug("Set remote description for pushed stream", "room", room.Name)
@@ -658,25 +708,429 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 			answer, err := pc.CreateAnswer(nil)
 			if err != nil {
 				slog.Error("Failed to create answer for pushed stream", "room", room.Name, "err", err)
+				rejectSession(sig, room.Name, pc, "failed to create answer")
 				continue
 			}
 			if err = pc.SetLocalDescription(answer); err != nil {
 				slog.Error("Failed to set local description for pushed stream", "room", room.Name, "err", err)
+				rejectSession(sig, room.Name, pc, "failed to set local description")
 				continue
 			}
-			if err = safeBRW.SendJSON(connections.NewMessageSDP(
-				"answer",
-				answer,
-			)); err != nil {
+			if err = sig.send(&signalingMessage{Type: signalAnswer, SDP: answer}); err != nil {
+				// Pusher never gets the answer, give the room up for another push
 				slog.Error("Failed to send answer for pushed stream", "room", room.Name, "err", err)
+				if err = pc.Close(); err != nil {
+					slog.Error("Failed to close PeerConnection of unanswered pushed stream", "room", room.Name, "err", err)
+				}
+				sp.releasePushClaim(claim)
+				claim = nil
+				room = nil
+				continue
 			}
+			watchNegotiation(sig, room.Name, pc)
 
 			// Store the connection
 			sp.incomingConns.Set(room.Name, &StreamConnection{
 				pc:  pc,
 				ndc: room.DataChannel, // if it exists, if not it will be set later
+				sig: sig,
 			})
+			sp.releasePushClaim(claim)
+			claim = nil
 			slog.Debug("Sent answer for pushed stream", "room", room.Name)
+		case signalError:
+			slog.Warn("Stream pusher reported signaling error", "room", msg.RoomName, "code", msg.ErrorCode, "message", msg.ErrorMsg)
+			if room != nil {
+				sp.closeIncoming(room.Name)
+			}
+		default:
+			slog.Warn("Unexpected signaling message type for stream push", "type", msg.Type)
+		}
+	}
+}
+
+// --- Ingest ---
+
+// claimPushRoom returns the owned room a stream is pushed to, creating it if needed, and the claim on it that has
+// to be released once the push connection is stored or given up. Otherwise the signaling error code and reason
+// the push is rejected with
+func (sp *StreamProtocol) claimPushRoom(roomName string) (*shared.Room, *pushClaim, string, error) {
+	if len(roomName) == 0 {
+		return nil, nil, signalErrorBadRequest, errors.New("room name is empty")
+	}
+	sp.pushMutex.Lock()
+	defer sp.pushMutex.Unlock()
+	if _, ok := sp.pushClaims[roomName]; ok || sp.incomingConns.Has(roomName) {
+		return nil, nil, signalErrorRoomTaken, errors.New("room is already being pushed to")
+	}
+	room := sp.relay.GetRoomByName(roomName)
+	if room != nil {
+		if room.OwnerID != sp.relay.ID {
+			return nil, nil, signalErrorNotOwner, fmt.Errorf("room is owned by relay %s", room.OwnerID)
+		}
+		if room.IsOnline() {
+			return nil, nil, signalErrorRoomTaken, errors.New("room is already online")
+		}
+	} else {
+		if remoteRoom, ok := sp.relay.MeshRooms.Get(roomName); ok && remoteRoom.OwnerID != sp.relay.ID {
+			return nil, nil, signalErrorNotOwner, fmt.Errorf("room is owned by relay %s", remoteRoom.OwnerID)
+		}
+		// Create a new room if it doesn't exist
+		room = sp.relay.CreateRoom(roomName)
+	}
+	claim := &pushClaim{roomName: roomName}
+	sp.pushClaims[roomName] = claim
+	return room, claim, "", nil
+}
+
+// releasePushClaim gives up a claim on a room to push to, if it's still held
+func (sp *StreamProtocol) releasePushClaim(claim *pushClaim) {
+	if claim == nil {
+		return
+	}
+	sp.pushMutex.Lock()
+	defer sp.pushMutex.Unlock()
+	if sp.pushClaims[claim.roomName] == claim {
+		delete(sp.pushClaims, claim.roomName)
+	}
+}
+
+// ingestTrack feeds a pushed remote track into its room until the track ends
+func (sp *StreamProtocol) ingestTrack(room *shared.Room, remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	localTrack, encoding, created, err := sp.ingestRoomTrack(room, remoteTrack)
+	if err != nil {
+		slog.Error("Failed to create local track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String(), "err", err)
+		return
+	}
+
+	slog.Debug("Received track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String(), "rid", remoteTrack.RID())
+
+	// Viewers falling behind or switching layers wait for the next keyframe, ask for one
+	if created {
+		localTrack.OnKeyframeNeeded(func() {
+			sp.getFeedback(room.Name).requestKeyframe()
+		})
+	}
+
+	// Prepare PlayoutDelayExtension so we don't need to recreate it for each packet
+	playoutExt := &rtp.PlayoutDelayExtension{
+		MinDelay: 0,
+		MaxDelay: 0,
+	}
+	playoutPayload, err := playoutExt.Marshal()
+	if err != nil {
+		slog.Error("Failed to marshal PlayoutDelayExtension for room", "room", room.Name, "err", err)
+		return
+	}
+
+	parser := shared.NewLayerParser(remoteTrack.Codec().MimeType, dependencyDescriptorID(receiver))
+	counters := sp.getIngressStats(room.Name, remoteTrack.Kind())
+	for {
+		rtpPacket, _, err := remoteTrack.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Error("Failed to read RTP from remote track for room", "room", room.Name, "err", err)
+			}
+			break
+		}
+		// Of simulcast encodings, only the primary one stands for the stream in statistics, recordings and clips
+		if localTrack.Primary() == encoding {
+			counters.onPacket(rtpPacket, remoteTrack.Codec().ClockRate)
+			sp.relay.recordPacket(room.Name, remoteTrack.Kind(), remoteTrack.Codec().RTPCodecCapability, rtpPacket)
+			sp.bufferPacket(room.Name, remoteTrack.Kind(), remoteTrack.Codec().RTPCodecCapability, rtpPacket)
+		}
+
+		// Use PlayoutDelayExtension for low latency, if set for this track kind
+		if extID, ok := common.GetExtension(remoteTrack.Kind(), common.ExtensionPlayoutDelay); ok {
+			if err := rtpPacket.SetExtension(extID, playoutPayload); err != nil {
+				slog.Error("Failed to set PlayoutDelayExtension for room", "room", room.Name, "err", err)
+				continue
+			}
+		}
+
+		err = localTrack.WriteLayerRTP(rtpPacket, encoding, parser.Parse(rtpPacket))
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			slog.Error("Failed to write RTP to local track for room", "room", room.Name, "err", err)
+			break
+		}
+	}
+
+	slog.Debug("Track closed for room", "room", room.Name, "track_kind", remoteTrack.Kind().String(), "rid", remoteTrack.RID())
+
+	// Cleanup the track from the room once its last encoding ended
+	sp.ingestMutex.Lock()
+	if localTrack.RemoveEncoding(remoteTrack.RID()) == 0 && room.GetTrack(remoteTrack.Kind()) == localTrack {
+		room.SetTrack(remoteTrack.Kind(), nil)
+	}
+	sp.ingestMutex.Unlock()
+}
+
+// rejectSession tells the other side a stream negotiation failed on our end and closes its PeerConnection
+func rejectSession(sig signalingChannel, roomName string, pc *webrtc.PeerConnection, reason string) {
+	sendSignalingError(sig, roomName, signalErrorInternal, reason)
+	if err := pc.Close(); err != nil {
+		slog.Error("Failed to close PeerConnection of rejected session", "room", roomName, "err", err)
+	}
+}
+
+// offeringConn returns the PeerConnection of a served session awaiting an answer over a signaling stream
+func (sp *StreamProtocol) offeringConn(sig signalingChannel) *webrtc.PeerConnection {
+	var pc *webrtc.PeerConnection
+	sp.servedConns.Range(func(_ ulid.ULID, conn *StreamConnection) bool {
+		if conn.sig == sig && conn.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			pc = conn.pc
+			return false
+		}
+		return true
+	})
+	return pc
+}
+
+// answerOffer applies a remote offer to a PeerConnection and returns the local answer
+func answerOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to set remote description: %w", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("failed to set local description: %w", err)
+	}
+	return answer, nil
+}
+
+// restartICE sends an ICE restart offer for a disconnected PeerConnection we offered, fresh candidates follow
+// as they are gathered
+func restartICE(sig signalingChannel, roomName string, pc *webrtc.PeerConnection) {
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		slog.Debug("Skipping ICE restart during ongoing negotiation", "room", roomName)
+		return
+	}
+	if err := sendOffer(sig, pc, &webrtc.OfferOptions{ICERestart: true}); err != nil {
+		slog.Error("Failed to restart ICE", "room", roomName, "err", err)
+		return
+	}
+	slog.Info("Restarting ICE of disconnected PeerConnection", "room", roomName)
+}
+
+// sendOffer creates, applies and sends a new offer of a PeerConnection we offered before
+func sendOffer(sig signalingChannel, pc *webrtc.PeerConnection, options *webrtc.OfferOptions) error {
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	if err = sig.send(&signalingMessage{Type: signalOffer, SDP: offer}); err != nil {
+		return fmt.Errorf("failed to send offer: %w", err)
+	}
+	return nil
+}
+
+// --- Track Updates ---
+
+// updateServedTracks brings the current track of a kind to all participants of a room, relays and viewers alike
+func (sp *StreamProtocol) updateServedTracks(room *shared.Room, kind webrtc.RTPCodecType) {
+	track := room.GetTrack(kind)
+	for id, participant := range room.Participants.Copy() {
+		conn, ok := sp.servedConns.Get(id)
+		if !ok {
+			continue
+		}
+		// Renegotiation may wait for an ongoing one, don't hold up other participants
+		go func() {
+			if err := sp.updateSessionTrack(conn, participant, room.Name, kind, track); err != nil {
+				slog.Error("Failed to update track of participant", "room", room.Name, "participant", id, "track_kind", kind.String(), "err", err)
+			}
+		}()
+	}
+}
+
+// updateSessionTrack swaps the track of a kind on the existing sender of a served session, or adds it
+// and renegotiates over the signaling stream if the session has no sender of that kind or the codec changed.
+// Sessions without signaling stream (WHEP) are closed instead, their viewers have to reconnect
+func (sp *StreamProtocol) updateSessionTrack(conn *StreamConnection, participant *shared.Participant, roomName string, kind webrtc.RTPCodecType, track *shared.RoomTrack) error {
+	conn.negotiationMutex.Lock()
+	defer conn.negotiationMutex.Unlock()
+
+	for _, transceiver := range conn.pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if transceiver.Kind() != kind || sender == nil {
+			continue
+		}
+		if track == nil {
+			return sender.ReplaceTrack(nil)
+		}
+		if participant.Sends(sender, track) {
+			return nil
+		}
+		// Relays are sent video per simulcast encoding, which takes a sender of its own
+		if !participant.Relay || kind != webrtc.RTPCodecTypeVideo {
+			if err := sender.ReplaceTrack(track); err == nil {
+				slog.Debug("Replaced track of participant", "room", roomName, "participant", participant.ID, "track_kind", kind.String())
+				return nil
+			}
+		}
+		// Codec changed, the new track needs a sender of its own
+		if err := conn.pc.RemoveTrack(sender); err != nil {
+			return fmt.Errorf("failed to remove sender of old track: %w", err)
+		}
+		break
+	}
+	if track == nil {
+		return nil
+	}
+
+	if conn.sig == nil {
+		// WHEP viewers have no signaling stream, closing the session makes the player reconnect with a new offer
+		slog.Info("Closing session without signaling stream for new track, viewer has to reconnect", "room", roomName, "participant", participant.ID, "track_kind", kind.String())
+		if err := conn.pc.Close(); err != nil {
+			return fmt.Errorf("failed to close session for new track: %w", err)
+		}
+		return nil
+	}
+	if err := participant.AddTrack(track); err != nil {
+		return fmt.Errorf("failed to add track: %w", err)
+	}
+	if err := awaitStableSignaling(conn.pc); err != nil {
+		return err
+	}
+	if err := sendOffer(conn.sig, conn.pc, nil); err != nil {
+		return fmt.Errorf("failed to renegotiate: %w", err)
+	}
+	slog.Debug("Renegotiating participant for new track", "room", roomName, "participant", participant.ID, "track_kind", kind.String())
+	return nil
+}
+
+// awaitStableSignaling waits for an ongoing negotiation of a PeerConnection to settle
+func awaitStableSignaling(pc *webrtc.PeerConnection) error {
+	if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return errors.New("PeerConnection is closed")
+	}
+	stable := make(chan struct{}, 1)
+	pc.OnSignalingStateChange(func(state webrtc.SignalingState) {
+		if state == webrtc.SignalingStateStable {
+			select {
+			case stable <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer pc.OnSignalingStateChange(nil)
+	// Checked after registering, so settling in between isn't missed
+	if pc.SignalingState() == webrtc.SignalingStateStable {
+		return nil
+	}
+	select {
+	case <-stable:
+		return nil
+	case <-time.After(renegotiationTimeout):
+		return errors.New("ongoing negotiation did not settle")
+	}
+}
+
+// watchNegotiation closes a PeerConnection which did not connect within the signaling timeout, telling the other side
+func watchNegotiation(sig signalingChannel, roomName string, pc *webrtc.PeerConnection) {
+	time.AfterFunc(signalingTimeout, func() {
+		switch pc.ConnectionState() {
+		case webrtc.PeerConnectionStateConnected, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
+			return // Negotiation finished, later connection changes are handled by the close callback
+		}
+		slog.Warn("Stream negotiation timed out", "room", roomName, "state", pc.ConnectionState().String())
+		sendSignalingError(sig, roomName, signalErrorTimeout, "PeerConnection did not connect in time")
+		if err := pc.Close(); err != nil {
+			slog.Error("Failed to close PeerConnection of timed out negotiation", "room", roomName, "err", err)
+		}
+	})
+}
+
+// closeIncoming closes the incoming pushed stream of a room, if any
+func (sp *StreamProtocol) closeIncoming(roomName string) {
+	if conn, ok := sp.incomingConns.Get(roomName); ok {
+		if err := conn.pc.Close(); err != nil {
+			slog.Error("Failed to close PeerConnection for pushed stream", "room", roomName, "err", err)
+		}
+		sp.incomingConns.Delete(roomName)
+	}
+}
+
+// signalOffline tells served participants of a room that it went offline, closing their PeerConnections
+// and keeping them waiting for the room to come back online
+func (sp *StreamProtocol) signalOffline(room *shared.Room) {
+	for id, participant := range room.Participants.Copy() {
+		conn, ok := sp.servedConns.Get(id)
+		if !ok {
+			continue
+		}
+		if conn.sig != nil {
+			if err := conn.sig.send(&signalingMessage{Type: signalOffline, RoomName: room.Name}); err != nil {
+				slog.Error("Failed to signal participant offline", "room", room.Name, "participant", id, "err", err)
+			} else {
+				sp.waiting.add(room.Name, conn.sig, participant.PeerID)
+			}
+		}
+		if err := conn.pc.Close(); err != nil {
+			slog.Error("Failed to close PeerConnection of offline participant", "room", room.Name, "participant", id, "err", err)
+		}
+	}
+}
+
+// getRewriter returns the RTP rewriter of a requested stream track or its simulcast encoding of given RID,
+// kept across upstream changes
+func (sp *StreamProtocol) getRewriter(roomName string, kind webrtc.RTPCodecType, rid string, clockRate uint32) *rtpRewriter {
+	return sp.rewriters.GetOrCreate(roomName+"/"+kind.String()+"/"+rid, func() *rtpRewriter {
+		return newRTPRewriter(clockRate)
+	})
+}
+
+// awaitUpstream waits until a requested room stream is established, false on timeout
+func (sp *StreamProtocol) awaitUpstream(roomName string, timeout time.Duration) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-deadline:
+			return false
+		case <-ticker.C:
+			if sp.upstreams.Has(roomName) {
+				return true
+			}
+		}
+	}
+}
+
+// closeRequested stops pulling a requested room stream, without failing it over
+func (sp *StreamProtocol) closeRequested(roomName string) {
+	if sp.upstreams.Has(roomName) {
+		sp.upstreams.Delete(roomName)
+	}
+	for key := range sp.rewriters.Copy() {
+		if strings.HasPrefix(key, roomName+"/") {
+			sp.rewriters.Delete(key)
+		}
+	}
+	if conn, ok := sp.requestedConns.Get(roomName); ok {
+		if err := conn.pc.Close(); err != nil {
+			slog.Error("Failed to close PeerConnection for requested stream", "room", roomName, "err", err)
+		}
+		sp.requestedConns.Delete(roomName)
+	}
+}
+
+// closeUpstream closes requested streams pulled from given relay, failing them over elsewhere
+func (sp *StreamProtocol) closeUpstream(peerID peer.ID) {
+	for roomName, upstream := range sp.upstreams.Copy() {
+		if upstream != peerID {
+			continue
+		}
+		if conn, ok := sp.requestedConns.Get(roomName); ok {
+			if err := conn.pc.Close(); err != nil {
+				slog.Error("Failed to close PeerConnection for requested stream", "room", roomName, "err", err)
+			}
 		}
 	}
 }
@@ -685,7 +1139,8 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 
 // RequestStream sends a request to get room stream from another relay
 func (sp *StreamProtocol) RequestStream(ctx context.Context, room *shared.Room, peerID peer.ID) error {
-	stream, err := sp.relay.Host.NewStream(ctx, peerID, protocolStreamRequest)
+	// Prefer protobuf signaling, falling back to JSON for relays not supporting it yet
+	stream, err := sp.relay.Host.NewStream(ctx, peerID, protocolStreamRequestV2, protocolStreamRequest)
 	if err != nil {
 		return fmt.Errorf("failed to create stream request: %w", err)
 	}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"relay/internal/shared"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pion/webrtc/v4"
+)
+
+// TestAwaitStableSignaling waits for an offer to be answered, and gives up on a closed PeerConnection
+func TestAwaitStableSignaling(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = offerer.Close() }()
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = answerer.Close() }()
+	if _, err = offerer.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = awaitStableSignaling(offerer); err != nil {
+		t.Fatalf("waiting without a negotiation: %v", err)
+	}
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := answerer.SetRemoteDescription(offer); err != nil {
+			t.Error(err)
+			return
+		}
+		answer, err := answerer.CreateAnswer(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = answerer.SetLocalDescription(answer); err != nil {
+			t.Error(err)
+			return
+		}
+		if err = offerer.SetRemoteDescription(answer); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err = awaitStableSignaling(offerer); err != nil {
+		t.Fatalf("waiting for the answer: %v", err)
+	}
+	if state := offerer.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Errorf("signaling state %s after waiting, want stable", state)
+	}
+
+	if err = offerer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = awaitStableSignaling(offerer); err == nil {
+		t.Error("waiting on a closed PeerConnection succeeded")
+	}
+}
+
+// TestStreamRequestErrors requests streams which can't be served, each one has to be rejected with its error code
+func TestStreamRequestErrors(t *testing.T) {
+	r := newTestRelay(t)
+	enableAdmission(t, r)
+	requester, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = requester.Close() })
+	if err = requester.Connect(context.Background(), peer.AddrInfo{ID: r.ID, Addrs: r.Host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := requester.NewStream(context.Background(), r.ID, protocolStreamRequestV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = stream.Reset() })
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	sig := newSignalingChannel(stream)
+
+	expectError := func(request *signalingMessage, code string) {
+		t.Helper()
+		if err := sig.send(request); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := sig.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != signalError || msg.ErrorCode != code || msg.RoomName != request.RoomName {
+			t.Errorf("%s of room %s answered with %+v, want %s error", request.Type, request.RoomName, msg, code)
+		}
+	}
+
+	expectError(&signalingMessage{Type: signalRequestRoom, RoomName: "room"}, signalErrorUnauthorized)
+
+	r.ApproveRelay(requester.ID())
+	addOnlineRoom(r, "room", "owner")
+	setUpstream(r, "room", requester.ID(), "owner")
+	expectError(&signalingMessage{Type: signalRequestRoom, RoomName: "room"}, signalErrorUnavailable)
+	expectError(&signalingMessage{Type: signalAnswer, SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\n"}}, signalErrorBadRequest)
+}
+
+func TestClaimPushRoom(t *testing.T) {
+	r := newTestRelay(t)
+	sp := r.StreamProtocol
+	addOnlineRoom(r, "online", r.ID)
+	addOnlineRoom(r, "copy", "owner")
+	r.MeshRooms.Merge(shared.RoomInfo{Name: "remote", OwnerID: "owner", Version: 1}, false)
+
+	room, claim, code, err := sp.claimPushRoom("new")
+	if err != nil || room == nil || room.OwnerID != r.ID {
+		t.Fatalf("claiming a new room failed with %s: %v", code, err)
+	}
+	for _, test := range []struct {
+		room string
+		code string
+	}{
+		{"", signalErrorBadRequest},
+		{"new", signalErrorRoomTaken}, // Claimed above
+		{"online", signalErrorRoomTaken},
+		{"copy", signalErrorNotOwner},
+		{"remote", signalErrorNotOwner},
+	} {
+		if _, _, code, err = sp.claimPushRoom(test.room); err == nil || code != test.code {
+			t.Errorf("claiming room %q rejected with %q (%v), want %q", test.room, code, err, test.code)
+		}
+	}
+
+	sp.releasePushClaim(claim)
+	if _, claim, _, err = sp.claimPushRoom("new"); err != nil {
+		t.Errorf("claiming a released room failed: %v", err)
+	}
+	sp.releasePushClaim(claim)
+}
@@ -2,12 +2,18 @@ package core
 
 // ProtocolRegistry is a type holding all protocols to split away the bloat
 type ProtocolRegistry struct {
-	StreamProtocol *StreamProtocol
+	StreamProtocol    *StreamProtocol
+	StateProtocol     *StateProtocol
+	HealthProtocol    *HealthProtocol
+	HandshakeProtocol *HandshakeProtocol
 }
 
 // NewProtocolRegistry initializes and returns a new protocol registry
 func NewProtocolRegistry(relay *Relay) ProtocolRegistry {
 	return ProtocolRegistry{
-		StreamProtocol: NewStreamProtocol(relay),
+		StreamProtocol:    NewStreamProtocol(relay),
+		StateProtocol:     NewStateProtocol(relay),
+		HealthProtocol:    NewHealthProtocol(relay),
+		HandshakeProtocol: NewHandshakeProtocol(relay),
 	}
 }
@@ -0,0 +1,362 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"relay/internal/common"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// errRecordingUnsupported is returned when a track of a room is of a codec that cannot be recorded
+var errRecordingUnsupported = errors.New("codec cannot be recorded")
+
+// --- Structs ---
+
+// RecordingOptions controls when recording files are rotated, zero values fall back to the flags
+type RecordingOptions struct {
+	MaxDuration time.Duration // Rotate files after this long, 0 for flag default
+	MaxSize     int64         // Rotate files after this many bytes, 0 for flag default
+}
+
+// roomRecording writes the tracks of a room to files under the persist directory
+type roomRecording struct {
+	mutex     sync.Mutex
+	roomName  string
+	dir       string
+	id        ulid.ULID // tells apart the files of recordings started within the same second
+	startedAt time.Time
+	options   RecordingOptions
+	tracks    map[webrtc.RTPCodecType]*trackRecorder
+	segments  map[webrtc.RTPCodecType]int    // track kind -> number of file segments started
+	skipped   map[webrtc.RTPCodecType]string // track kind -> codec that cannot be recorded
+	stopped   bool
+	// requestKeyframe asks upstream for a keyframe so video can be rotated without waiting long
+	requestKeyframe func()
+}
+
+// trackRecorder writes a track to its current file segment
+type trackRecorder struct {
+	codec       webrtc.RTPCodecCapability
+	ssrc        uint32 // of the recorded packets, changes when another simulcast encoding becomes primary
+	writer      media.Writer
+	path        string
+	openedAt    time.Time
+	written     int64 // payload bytes written to the segment, close to its file size
+	rotationDue bool  // whether a video keyframe is awaited to rotate
+}
+
+// --- Writers ---
+
+// recordingFormat returns the file extension recordings of a codec are written with, false if not supported
+func recordingFormat(mimeType string) (string, bool) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		return "ivf", true
+	case strings.ToLower(webrtc.MimeTypeH264), strings.ToLower(webrtc.MimeTypeH265):
+		return "mkv", true // Raw streams lose the frame timestamps, so written into Matroska
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return "ogg", true
+	default:
+		return "", false
+	}
+}
+
+func newMediaWriter(path string, codec webrtc.RTPCodecCapability) (media.Writer, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264), strings.ToLower(webrtc.MimeTypeH265):
+		return newMatroskaWriter(path, codec)
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		return oggwriter.New(path, codec.ClockRate, channels)
+	default:
+		return ivfwriter.New(path, ivfwriter.WithCodec(codec.MimeType))
+	}
+}
+
+// --- Recording ---
+
+// open starts a new file segment for a track, must hold rec.mutex
+func (rec *roomRecording) open(kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) (*trackRecorder, error) {
+	extension, _ := recordingFormat(codec.MimeType)
+	segment := rec.segments[kind]
+	rec.segments[kind]++
+	path := filepath.Join(rec.dir, fmt.Sprintf("%s-%s-%s-%03d.%s", rec.startedAt.UTC().Format("20060102-150405"), rec.id, kind.String(), segment, extension))
+	writer, err := newMediaWriter(path, codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+	slog.Debug("Recording track to file", "room", rec.roomName, "track_kind", kind.String(), "path", path)
+	return &trackRecorder{
+		codec:    codec,
+		writer:   writer,
+		path:     path,
+		openedAt: time.Now(),
+	}, nil
+}
+
+// closeTrack finalizes the file of a track, must hold rec.mutex
+func (rec *roomRecording) closeTrack(kind webrtc.RTPCodecType) {
+	tr, ok := rec.tracks[kind]
+	if !ok {
+		return
+	}
+	delete(rec.tracks, kind)
+	if err := tr.writer.Close(); err != nil {
+		slog.Error("Failed to finalize recording file", "room", rec.roomName, "path", tr.path, "err", err)
+	}
+}
+
+// writeRTP records a packet of a track, rotating its file when the codec or encoding changed or a limit is reached
+func (rec *roomRecording) writeRTP(kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability, packet *rtp.Packet) error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.stopped {
+		return nil
+	}
+
+	if rec.skipped[kind] == codec.MimeType {
+		return nil
+	}
+	if _, ok := recordingFormat(codec.MimeType); !ok {
+		slog.Warn("Not recording track of unsupported codec", "room", rec.roomName, "track_kind", kind.String(), "codec", codec.MimeType)
+		rec.closeTrack(kind)
+		rec.skipped[kind] = codec.MimeType
+		return nil
+	}
+
+	tr, ok := rec.tracks[kind]
+	if ok {
+		rotate := !strings.EqualFold(tr.codec.MimeType, codec.MimeType) || tr.ssrc != packet.SSRC
+		if !rotate && rec.segmentFull(tr) {
+			if kind != webrtc.RTPCodecTypeVideo {
+				rotate = true
+			} else if common.IsKeyframeStart(codec.MimeType, packet.Payload) {
+				rotate = true // New segment starts decodable
+			} else if !tr.rotationDue {
+				tr.rotationDue = true
+				if rec.requestKeyframe != nil {
+					go rec.requestKeyframe()
+				}
+			}
+		}
+		if rotate {
+			rec.closeTrack(kind)
+			ok = false
+		}
+	}
+	if !ok {
+		var err error
+		if tr, err = rec.open(kind, codec); err != nil {
+			return err
+		}
+		tr.ssrc = packet.SSRC
+		rec.tracks[kind] = tr
+	}
+
+	if err := tr.writer.WriteRTP(packet); err != nil {
+		return fmt.Errorf("failed to write to recording file: %w", err)
+	}
+	tr.written += int64(len(packet.Payload))
+	return nil
+}
+
+// segmentFull reports whether the current segment of a track reached a rotation limit
+func (rec *roomRecording) segmentFull(tr *trackRecorder) bool {
+	return (rec.options.MaxDuration > 0 && time.Since(tr.openedAt) >= rec.options.MaxDuration) ||
+		(rec.options.MaxSize > 0 && tr.written >= rec.options.MaxSize)
+}
+
+// stop finalizes the files of all tracks, later packets are ignored
+func (rec *roomRecording) stop() {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.stopped = true
+	for kind := range rec.tracks {
+		rec.closeTrack(kind)
+	}
+}
+
+// --- Relay API ---
+
+// StartRecording starts recording the tracks of a local room to files under the persist directory
+func (r *Relay) StartRecording(roomName string, options RecordingOptions) error {
+	room := r.GetRoomByName(roomName)
+	if room == nil {
+		return fmt.Errorf("room %s is not hosted by this relay", roomName)
+	}
+	if r.recordings.Has(roomName) {
+		return fmt.Errorf("room %s is already being recorded", roomName)
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if track := room.GetTrack(kind); track != nil {
+			if _, ok := recordingFormat(track.Codec().MimeType); !ok {
+				return fmt.Errorf("%s track of room %s is %s: %w", kind.String(), roomName, track.Codec().MimeType, errRecordingUnsupported)
+			}
+		}
+	}
+	flags := common.GetFlags()
+	if len(flags.PersistDir) == 0 {
+		return errors.New("no persist directory to record to")
+	}
+	if options.MaxDuration <= 0 {
+		options.MaxDuration = time.Duration(flags.RecordRotateS) * time.Second
+	}
+	if options.MaxSize <= 0 {
+		options.MaxSize = int64(flags.RecordRotateMB) * 1024 * 1024
+	}
+
+	// Room names may contain anything, keep them from escaping the recordings directory
+	dir := filepath.Join(flags.PersistDir, recordingsDirName, sanitizeFileName(roomName))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	id, err := common.NewULID()
+	if err != nil {
+		return fmt.Errorf("failed to create recording ID: %w", err)
+	}
+
+	rec := &roomRecording{
+		roomName:  roomName,
+		dir:       dir,
+		id:        id,
+		startedAt: time.Now(),
+		options:   options,
+		tracks:    make(map[webrtc.RTPCodecType]*trackRecorder),
+		segments:  make(map[webrtc.RTPCodecType]int),
+		skipped:   make(map[webrtc.RTPCodecType]string),
+		requestKeyframe: func() {
+			r.StreamProtocol.getFeedback(roomName).requestKeyframe()
+		},
+	}
+	r.recordings.Set(roomName, rec)
+	// Recording should start with a keyframe rather than wait for the next one
+	go rec.requestKeyframe()
+	slog.Info("Started recording room", "room", roomName, "dir", dir, "max_duration", options.MaxDuration, "max_size", options.MaxSize)
+	return nil
+}
+
+// StopRecording stops recording a room, finalizing its files
+func (r *Relay) StopRecording(roomName string) error {
+	rec, ok := r.recordings.Get(roomName)
+	if !ok {
+		return fmt.Errorf("room %s is not being recorded", roomName)
+	}
+	r.recordings.Delete(roomName)
+	rec.stop()
+	slog.Info("Stopped recording room", "room", roomName)
+	return nil
+}
+
+// IsRecording reports whether a room is being recorded
+func (r *Relay) IsRecording(roomName string) bool {
+	return r.recordings.Has(roomName)
+}
+
+// recordPacket records a packet received for a room track, if the room is being recorded
+func (r *Relay) recordPacket(roomName string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability, packet *rtp.Packet) {
+	rec, ok := r.recordings.Get(roomName)
+	if !ok {
+		return
+	}
+	if err := rec.writeRTP(kind, codec, packet); err != nil {
+		slog.Error("Stopping recording of room after failure", "room", roomName, "track_kind", kind.String(), "err", err)
+		_ = r.StopRecording(roomName)
+	}
+}
+
+// onRecordedTrackCleared finalizes the file of a track that ended, a new one is started if it comes back
+func (r *Relay) onRecordedTrackCleared(roomName string, kind webrtc.RTPCodecType) {
+	if rec, ok := r.recordings.Get(roomName); ok {
+		rec.mutex.Lock()
+		rec.closeTrack(kind)
+		rec.mutex.Unlock()
+	}
+}
+
+// sanitizeFileName replaces characters not safe in file names
+func sanitizeFileName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// --- Admin Endpoint ---
+
+// recordingRequest is the optional body of a request to start recording
+type recordingRequest struct {
+	MaxDurationSeconds int `json:"max_duration_s"`
+	MaxSizeMB          int `json:"max_size_mb"`
+}
+
+// authorizeAdmin checks the bearer token of an admin request, admin endpoints require a token to be configured
+func (he *httpEndpoint) authorizeAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if len(common.GetFlags().HTTPToken) == 0 {
+		http.Error(w, "admin endpoints require a token to be configured", http.StatusForbidden)
+		return false
+	}
+	return he.authorize(w, req)
+}
+
+// handleStartRecording starts recording the room named in the URL
+func (he *httpEndpoint) handleStartRecording(w http.ResponseWriter, req *http.Request) {
+	if !he.authorizeAdmin(w, req) {
+		return
+	}
+	roomName := req.PathValue("room")
+	if he.relay.GetRoomByName(roomName) == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	var body recordingRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "invalid recording request", http.StatusBadRequest)
+			return
+		}
+	}
+	options := RecordingOptions{
+		MaxDuration: time.Duration(body.MaxDurationSeconds) * time.Second,
+		MaxSize:     int64(body.MaxSizeMB) * 1024 * 1024,
+	}
+	if err := he.relay.StartRecording(roomName, options); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, errRecordingUnsupported) {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleStopRecording stops recording the room named in the URL
+func (he *httpEndpoint) handleStopRecording(w http.ResponseWriter, req *http.Request) {
+	if !he.authorizeAdmin(w, req) {
+		return
+	}
+	if err := he.relay.StopRecording(req.PathValue("room")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	testOpusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	testVP8Codec  = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+)
+
+// newTestRecording records into a temporary directory, counting keyframe requests
+func newTestRecording(t *testing.T, options RecordingOptions) (*roomRecording, *atomic.Int32) {
+	t.Helper()
+	requests := &atomic.Int32{}
+	rec := &roomRecording{
+		roomName:        "room",
+		dir:             t.TempDir(),
+		id:              ulid.Make(),
+		startedAt:       time.Now(),
+		options:         options,
+		tracks:          make(map[webrtc.RTPCodecType]*trackRecorder),
+		segments:        make(map[webrtc.RTPCodecType]int),
+		skipped:         make(map[webrtc.RTPCodecType]string),
+		requestKeyframe: func() { requests.Add(1) },
+	}
+	t.Cleanup(rec.stop)
+	return rec, requests
+}
+
+// recordingFiles returns the files written for a track kind
+func recordingFiles(t *testing.T, rec *roomRecording, kind webrtc.RTPCodecType, extension string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(rec.dir, "*-"+kind.String()+"-*."+extension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func writeTestPacket(t *testing.T, rec *roomRecording, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability, seq uint16, payload []byte) {
+	t.Helper()
+	packet := &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: seq, Timestamp: uint32(seq) * 960, Marker: true}, Payload: payload}
+	if err := rec.writeRTP(kind, codec, packet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordingRotatesBySize(t *testing.T) {
+	rec, _ := newTestRecording(t, RecordingOptions{MaxSize: 100})
+	payload := make([]byte, 40)
+	for seq := range uint16(7) {
+		writeTestPacket(t, rec, webrtc.RTPCodecTypeAudio, testOpusCodec, seq, payload)
+	}
+	// Segments fill up with the third packet, the next one starts a new segment
+	if files := recordingFiles(t, rec, webrtc.RTPCodecTypeAudio, "ogg"); len(files) != 3 {
+		t.Errorf("wrote %d audio segments, want 3: %v", len(files), files)
+	}
+}
+
+func TestRecordingRotatesByTime(t *testing.T) {
+	rec, _ := newTestRecording(t, RecordingOptions{MaxDuration: time.Minute})
+	payload := []byte{0xfc, 0xff, 0xfe}
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeAudio, testOpusCodec, 1, payload)
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeAudio, testOpusCodec, 2, payload)
+	if files := recordingFiles(t, rec, webrtc.RTPCodecTypeAudio, "ogg"); len(files) != 1 {
+		t.Fatalf("wrote %d audio segments within the duration, want 1", len(files))
+	}
+
+	rec.mutex.Lock()
+	rec.tracks[webrtc.RTPCodecTypeAudio].openedAt = time.Now().Add(-time.Minute)
+	rec.mutex.Unlock()
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeAudio, testOpusCodec, 3, payload)
+	if files := recordingFiles(t, rec, webrtc.RTPCodecTypeAudio, "ogg"); len(files) != 2 {
+		t.Errorf("wrote %d audio segments after the duration, want 2", len(files))
+	}
+}
+
+// TestRecordingRotatesVideoAtKeyframe fills a video segment, it must be rotated at the next keyframe
+// which is requested once
+func TestRecordingRotatesVideoAtKeyframe(t *testing.T) {
+	rec, requests := newTestRecording(t, RecordingOptions{MaxDuration: time.Minute})
+	keyframe := []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a}
+	interframe := []byte{0x10, 0x01}
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeVideo, testVP8Codec, 1, keyframe)
+
+	rec.mutex.Lock()
+	rec.tracks[webrtc.RTPCodecTypeVideo].openedAt = time.Now().Add(-time.Minute)
+	rec.mutex.Unlock()
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeVideo, testVP8Codec, 2, interframe)
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeVideo, testVP8Codec, 3, interframe)
+	if files := recordingFiles(t, rec, webrtc.RTPCodecTypeVideo, "ivf"); len(files) != 1 {
+		t.Fatalf("wrote %d video segments before a keyframe, want 1", len(files))
+	}
+	deadline := time.Now().Add(time.Second)
+	for requests.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if count := requests.Load(); count != 1 {
+		t.Errorf("requested %d keyframes for rotation, want 1", count)
+	}
+
+	writeTestPacket(t, rec, webrtc.RTPCodecTypeVideo, testVP8Codec, 4, keyframe)
+	if files := recordingFiles(t, rec, webrtc.RTPCodecTypeVideo, "ivf"); len(files) != 2 {
+		t.Errorf("wrote %d video segments after the keyframe, want 2", len(files))
+	}
+}
+
+func TestRecordingFormat(t *testing.T) {
+	for _, test := range []struct {
+		mimeType  string
+		extension string
+	}{
+		{webrtc.MimeTypeH264, "mkv"},
+		{webrtc.MimeTypeH265, "mkv"},
+		{webrtc.MimeTypeVP8, "ivf"},
+		{webrtc.MimeTypeAV1, "ivf"},
+		{webrtc.MimeTypeOpus, "ogg"},
+		{webrtc.MimeTypeG722, ""},
+	} {
+		if extension, _ := recordingFormat(test.mimeType); extension != test.extension {
+			t.Errorf("%s recorded as %q, want %q", test.mimeType, extension, test.extension)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"relay/internal/shared"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Structs ---
+
+// roomEntry is a versioned room in the registry, deleted entries are kept as tombstones
+type roomEntry struct {
+	info      shared.RoomInfo
+	deleted   bool
+	deletedAt time.Time
+}
+
+// RoomRegistry is a conflict-free registry of rooms in the mesh, merged by last-writer-wins
+type RoomRegistry struct {
+	mutex sync.RWMutex
+	clock uint64                // Lamport clock, advanced by local changes and observed remote versions
+	rooms map[string]*roomEntry // room name -> latest known entry
+}
+
+func NewRoomRegistry() *RoomRegistry {
+	return &RoomRegistry{
+		rooms: make(map[string]*roomEntry),
+	}
+}
+
+// --- Clock ---
+
+// Tick advances the clock for a local change and returns the new version
+func (rr *RoomRegistry) Tick() uint64 {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	rr.clock++
+	return rr.clock
+}
+
+// --- Merging ---
+
+// Merge applies a room change if it wins over the known entry, returning whether it was applied,
+// the previous room info and whether that previous room was live
+func (rr *RoomRegistry) Merge(info shared.RoomInfo, deleted bool) (bool, shared.RoomInfo, bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if info.Version > rr.clock {
+		rr.clock = info.Version
+	}
+
+	existing, ok := rr.rooms[info.Name]
+	if ok && !wins(info, deleted, existing) {
+		return false, existing.info, !existing.deleted
+	}
+
+	entry := &roomEntry{
+		info:    info,
+		deleted: deleted,
+	}
+	if deleted {
+		entry.deletedAt = time.Now()
+	}
+	rr.rooms[info.Name] = entry
+
+	if !ok {
+		return true, shared.RoomInfo{}, false
+	}
+	return true, existing.info, !existing.deleted
+}
+
+// wins decides whether an incoming change replaces an existing entry
+func wins(info shared.RoomInfo, deleted bool, existing *roomEntry) bool {
+	sameOwner := info.OwnerID == existing.info.OwnerID
+	if deleted {
+		// Owners can only delete their own claim, tombstones never beat another owner's room
+		return sameOwner && info.Version >= existing.info.Version
+	}
+	if existing.deleted && !sameOwner {
+		// Tombstone of another owner doesn't block a new claim
+		return true
+	}
+	if sameOwner {
+		return info.Version >= existing.info.Version
+	}
+	return info.Supersedes(&existing.info)
+}
+
+// --- Lookup ---
+
+// Get returns a live room by name
+func (rr *RoomRegistry) Get(name string) (shared.RoomInfo, bool) {
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+	entry, ok := rr.rooms[name]
+	if !ok || entry.deleted {
+		return shared.RoomInfo{}, false
+	}
+	return entry.info, true
+}
+
+// Has checks if a live room exists by name
+func (rr *RoomRegistry) Has(name string) bool {
+	_, ok := rr.Get(name)
+	return ok
+}
+
+// Copy returns a copy of all live rooms
+func (rr *RoomRegistry) Copy() map[string]shared.RoomInfo {
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+	copied := make(map[string]shared.RoomInfo, len(rr.rooms))
+	for name, entry := range rr.rooms {
+		if !entry.deleted {
+			copied[name] = entry.info
+		}
+	}
+	return copied
+}
+
+// Tombstones returns a copy of all deleted rooms not yet garbage collected
+func (rr *RoomRegistry) Tombstones() map[string]shared.RoomInfo {
+	rr.mutex.RLock()
+	defer rr.mutex.RUnlock()
+	copied := make(map[string]shared.RoomInfo)
+	for name, entry := range rr.rooms {
+		if entry.deleted {
+			copied[name] = entry.info
+		}
+	}
+	return copied
+}
+
+// --- Cleanup ---
+
+// RemoveOwnedBy drops all entries, live or deleted, owned by given peer
+func (rr *RoomRegistry) RemoveOwnedBy(peerID peer.ID) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	for name, entry := range rr.rooms {
+		if entry.info.OwnerID == peerID {
+			delete(rr.rooms, name)
+		}
+	}
+}
+
+// CollectTombstones drops tombstones older than ttl, returning how many were dropped
+func (rr *RoomRegistry) CollectTombstones(ttl time.Duration) int {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	collected := 0
+	for name, entry := range rr.rooms {
+		if entry.deleted && time.Since(entry.deletedAt) > ttl {
+			delete(rr.rooms, name)
+			collected++
+		}
+	}
+	return collected
+}
+
+// --- Serialization ---
+
+// MarshalJSON serializes the live rooms, tombstones are local bookkeeping only
+func (rr *RoomRegistry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rr.Copy())
+}
+
+func (rr *RoomRegistry) UnmarshalJSON(data []byte) error {
+	var rooms map[string]shared.RoomInfo
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return err
+	}
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	rr.rooms = make(map[string]*roomEntry, len(rooms))
+	for name, info := range rooms {
+		rr.rooms[name] = &roomEntry{info: info}
+	}
+	return nil
+}
+
+func (rr *RoomRegistry) String() string {
+	return fmt.Sprintf("%+v", rr.Copy())
+}
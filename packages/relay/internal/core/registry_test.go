@@ -0,0 +1,155 @@
+package core
+
+import (
+	"relay/internal/shared"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestWins(t *testing.T) {
+	claim := func(owner string, version uint64) shared.RoomInfo {
+		return shared.RoomInfo{Name: "room", OwnerID: peer.ID(owner), Version: version}
+	}
+	tests := []struct {
+		name     string
+		info     shared.RoomInfo
+		deleted  bool
+		existing roomEntry
+		want     bool
+	}{
+		{"own newer claim", claim("a", 6), false, roomEntry{info: claim("a", 5)}, true},
+		{"own repeated claim", claim("a", 5), false, roomEntry{info: claim("a", 5)}, true},
+		{"own older claim", claim("a", 4), false, roomEntry{info: claim("a", 5)}, false},
+		{"newer claim of other owner", claim("a", 6), false, roomEntry{info: claim("b", 5)}, true},
+		{"older claim of other owner", claim("b", 4), false, roomEntry{info: claim("a", 5)}, false},
+		{"concurrent claim of higher owner", claim("b", 5), false, roomEntry{info: claim("a", 5)}, true},
+		{"concurrent claim of lower owner", claim("a", 5), false, roomEntry{info: claim("b", 5)}, false},
+		{"own tombstone", claim("a", 5), true, roomEntry{info: claim("a", 5)}, true},
+		{"own older tombstone", claim("a", 4), true, roomEntry{info: claim("a", 5)}, false},
+		{"tombstone of other owner", claim("b", 9), true, roomEntry{info: claim("a", 5)}, false},
+		{"claim over tombstone of other owner", claim("b", 1), false, roomEntry{info: claim("a", 5), deleted: true}, true},
+		{"own claim over own newer tombstone", claim("a", 4), false, roomEntry{info: claim("a", 5), deleted: true}, false},
+		{"own claim over own tombstone", claim("a", 6), false, roomEntry{info: claim("a", 5), deleted: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wins(tt.info, tt.deleted, &tt.existing); got != tt.want {
+				t.Errorf("wins(%+v, %v, %+v) = %v, want %v", tt.info, tt.deleted, tt.existing, got, tt.want)
+			}
+		})
+	}
+}
+
+// registryChange is a room change merged into a registry
+type registryChange struct {
+	info    shared.RoomInfo
+	deleted bool
+}
+
+// TestMergeConverges merges the same changes in every order, registries must agree on the result regardless
+func TestMergeConverges(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  []registryChange
+		wantLive bool
+		want     shared.RoomInfo
+	}{
+		{
+			name: "concurrent claims",
+			changes: []registryChange{
+				{info: shared.RoomInfo{Name: "room", OwnerID: "a", Version: 5}},
+				{info: shared.RoomInfo{Name: "room", OwnerID: "b", Version: 5}},
+				{info: shared.RoomInfo{Name: "room", OwnerID: "c", Version: 4}},
+			},
+			wantLive: true,
+			want:     shared.RoomInfo{Name: "room", OwnerID: "b", Version: 5},
+		},
+		{
+			name: "tombstone after own claim",
+			changes: []registryChange{
+				{info: shared.RoomInfo{Name: "room", OwnerID: "a", Version: 5}},
+				{info: shared.RoomInfo{Name: "room", OwnerID: "a", Version: 7}, deleted: true},
+			},
+			wantLive: false,
+		},
+		{
+			name: "tombstone of losing owner",
+			changes: []registryChange{
+				{info: shared.RoomInfo{Name: "room", OwnerID: "a", Version: 5}},
+				{info: shared.RoomInfo{Name: "room", OwnerID: "b", Version: 6}},
+				{info: shared.RoomInfo{Name: "room", OwnerID: "a", Version: 7}, deleted: true},
+			},
+			wantLive: true,
+			want:     shared.RoomInfo{Name: "room", OwnerID: "b", Version: 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, order := range permutations(len(tt.changes)) {
+				rr := NewRoomRegistry()
+				for _, i := range order {
+					rr.Merge(tt.changes[i].info, tt.changes[i].deleted)
+				}
+				got, live := rr.Get("room")
+				if live != tt.wantLive || got != tt.want {
+					t.Errorf("merged in order %v: got %+v, live %v, want %+v, live %v", order, got, live, tt.want, tt.wantLive)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	rr := NewRoomRegistry()
+	first := shared.RoomInfo{Name: "room", OwnerID: "a", Version: 5}
+	if applied, prev, prevLive := rr.Merge(first, false); !applied || prev != (shared.RoomInfo{}) || prevLive {
+		t.Errorf("first claim: applied %v, previous %+v, live %v, want applied without previous", applied, prev, prevLive)
+	}
+	if clock := rr.Tick(); clock != 6 {
+		t.Errorf("clock ticked to %d after observing version 5, want 6", clock)
+	}
+
+	loser := shared.RoomInfo{Name: "room", OwnerID: "0", Version: 5}
+	if applied, prev, prevLive := rr.Merge(loser, false); applied || prev != first || !prevLive {
+		t.Errorf("losing claim: applied %v, previous %+v, live %v, want rejected by live %+v", applied, prev, prevLive, first)
+	}
+
+	tombstone := shared.RoomInfo{Name: "room", OwnerID: "a", Version: 8}
+	if applied, prev, prevLive := rr.Merge(tombstone, true); !applied || prev != first || !prevLive {
+		t.Errorf("tombstone: applied %v, previous %+v, live %v, want applied over live %+v", applied, prev, prevLive, first)
+	}
+	if rr.Has("room") {
+		t.Error("deleted room is live")
+	}
+	if tombstones := rr.Tombstones(); tombstones["room"] != tombstone {
+		t.Errorf("tombstones are %+v, want %+v", tombstones, tombstone)
+	}
+
+	// A stale claim of the deleting owner does not resurrect the room, another owner's does
+	if applied, _, _ := rr.Merge(first, false); applied {
+		t.Error("stale claim of deleting owner applied over its tombstone")
+	}
+	other := shared.RoomInfo{Name: "room", OwnerID: "b", Version: 2}
+	if applied, prev, prevLive := rr.Merge(other, false); !applied || prev != tombstone || prevLive {
+		t.Errorf("claim over tombstone: applied %v, previous %+v, live %v, want applied over deleted %+v", applied, prev, prevLive, tombstone)
+	}
+	if got, ok := rr.Get("room"); !ok || got != other {
+		t.Errorf("room is %+v, live %v, want %+v", got, ok, other)
+	}
+}
+
+// permutations returns all orders of n indices
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var orders [][]int
+	for _, order := range permutations(n - 1) {
+		for i := 0; i <= len(order); i++ {
+			permuted := append(append(append([]int{}, order[:i]...), n-1), order[i:]...)
+			orders = append(orders, permuted)
+		}
+	}
+	return orders
+}
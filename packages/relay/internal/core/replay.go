@@ -0,0 +1,396 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"relay/internal/common"
+	"relay/internal/connections"
+	gen "relay/internal/proto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Structs ---
+
+// replayPacket is a buffered packet with its arrival time
+type replayPacket struct {
+	packet   *rtp.Packet
+	at       time.Time
+	keyframe bool // whether the packet starts a keyframe
+}
+
+// replayBuffer keeps the last seconds of a track received for a room, video starts on a keyframe
+type replayBuffer struct {
+	mutex   sync.Mutex
+	kind    webrtc.RTPCodecType
+	codec   webrtc.RTPCodecCapability
+	ssrc    uint32 // of the buffered packets, changes when another simulcast encoding becomes primary
+	packets []replayPacket
+	size    int // payload bytes buffered
+	// requestKeyframe asks upstream for a keyframe when trimming left video without one
+	requestKeyframe func()
+}
+
+// --- Buffering ---
+
+// add buffers a packet, trimming what falls out of the time and size limits
+func (rb *replayBuffer) add(codec webrtc.RTPCodecCapability, packet *rtp.Packet, maxAge time.Duration, maxSize int) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if !strings.EqualFold(rb.codec.MimeType, codec.MimeType) || rb.ssrc != packet.SSRC {
+		// Buffered packets can't be written together with ones of another codec or encoding
+		rb.codec = codec
+		rb.ssrc = packet.SSRC
+		rb.packets = nil
+		rb.size = 0
+	}
+	keyframe := rb.kind == webrtc.RTPCodecTypeVideo && common.IsKeyframeStart(codec.MimeType, packet.Payload)
+	if rb.kind == webrtc.RTPCodecTypeVideo && len(rb.packets) == 0 && !keyframe {
+		return // Nothing decodable before a keyframe
+	}
+
+	now := time.Now()
+	rb.packets = append(rb.packets, replayPacket{packet: packet.Clone(), at: now, keyframe: keyframe})
+	rb.size += len(packet.Payload)
+
+	trimmed := 0
+	for trimmed < len(rb.packets) && (now.Sub(rb.packets[trimmed].at) > maxAge || rb.size > maxSize) {
+		rb.size -= len(rb.packets[trimmed].packet.Payload)
+		trimmed++
+	}
+	if trimmed == 0 {
+		return
+	}
+	if rb.kind == webrtc.RTPCodecTypeVideo {
+		// Keep starting on a keyframe
+		for trimmed < len(rb.packets) && !rb.packets[trimmed].keyframe {
+			rb.size -= len(rb.packets[trimmed].packet.Payload)
+			trimmed++
+		}
+		if trimmed == len(rb.packets) && rb.requestKeyframe != nil {
+			go rb.requestKeyframe() // GOP is longer than the buffer
+		}
+	}
+	rb.packets = rb.packets[trimmed:]
+}
+
+// since returns the codec and the packets buffered since given time, video from the last keyframe before it
+func (rb *replayBuffer) since(from time.Time) (webrtc.RTPCodecCapability, []replayPacket) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if rb.kind != webrtc.RTPCodecTypeVideo {
+		start := len(rb.packets)
+		for i, buffered := range rb.packets {
+			if !buffered.at.Before(from) {
+				start = i
+				break
+			}
+		}
+		return rb.codec, append([]replayPacket(nil), rb.packets[start:]...)
+	}
+
+	start := 0 // Buffered video starts on a keyframe
+	for i, buffered := range rb.packets {
+		if buffered.at.After(from) {
+			break
+		}
+		if buffered.keyframe {
+			start = i
+		}
+	}
+	return rb.codec, append([]replayPacket(nil), rb.packets[start:]...)
+}
+
+// getReplayBuffer returns the replay buffer of the track of a kind received for a room, nil if disabled
+func (sp *StreamProtocol) getReplayBuffer(roomName string, kind webrtc.RTPCodecType) *replayBuffer {
+	if common.GetFlags().ReplayBufferS <= 0 {
+		return nil
+	}
+	return sp.replayBuffers.GetOrCreate(roomName+"/"+kind.String(), func() *replayBuffer {
+		return &replayBuffer{
+			kind: kind,
+			requestKeyframe: func() {
+				sp.getFeedback(roomName).requestKeyframe()
+			},
+		}
+	})
+}
+
+// bufferPacket adds a packet received for a room track to its replay buffer, if enabled. Only called where
+// the room is pushed to, so clips are kept once, by the owner relay
+func (sp *StreamProtocol) bufferPacket(roomName string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability, packet *rtp.Packet) {
+	rb := sp.getReplayBuffer(roomName, kind)
+	if rb == nil {
+		return
+	}
+	flags := common.GetFlags()
+	rb.add(codec, packet, time.Duration(flags.ReplayBufferS)*time.Second, flags.ReplayBufferMB*1024*1024)
+}
+
+// forgetReplayBuffers drops the replay buffers of the tracks received for a room, along with its clip rate limit
+func (sp *StreamProtocol) forgetReplayBuffers(roomName string) {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		sp.replayBuffers.Delete(roomName + "/" + kind.String())
+	}
+	sp.lastClips.Delete(roomName)
+}
+
+// --- Relay API ---
+
+// SaveClip writes the last seconds of a local room's replay buffer to files under the persist directory,
+// a duration of 0 saves everything buffered. Returns the paths of the written files
+func (r *Relay) SaveClip(roomName string, duration time.Duration) ([]string, error) {
+	flags := common.GetFlags()
+	if len(flags.PersistDir) == 0 {
+		return nil, errors.New("no persist directory to save clips to")
+	}
+	sp := r.StreamProtocol
+	video, hasVideo := sp.replayBuffers.Get(roomName + "/" + webrtc.RTPCodecTypeVideo.String())
+	audio, hasAudio := sp.replayBuffers.Get(roomName + "/" + webrtc.RTPCodecTypeAudio.String())
+	if !hasVideo && !hasAudio {
+		return nil, fmt.Errorf("room %s has no replay buffer", roomName)
+	}
+
+	from := time.Time{}
+	if duration > 0 {
+		from = time.Now().Add(-duration)
+	}
+	clips := make(map[webrtc.RTPCodecType][]replayPacket)
+	codecs := make(map[webrtc.RTPCodecType]webrtc.RTPCodecCapability)
+	if hasVideo {
+		codecs[webrtc.RTPCodecTypeVideo], clips[webrtc.RTPCodecTypeVideo] = video.since(from)
+		if packets := clips[webrtc.RTPCodecTypeVideo]; len(packets) > 0 {
+			from = packets[0].at // Audio starts along with the keyframe video starts on
+		}
+	}
+	if hasAudio {
+		codecs[webrtc.RTPCodecTypeAudio], clips[webrtc.RTPCodecTypeAudio] = audio.since(from)
+	}
+
+	// Room names may contain anything, keep them from escaping the clips directory
+	dir := filepath.Join(flags.PersistDir, clipsDirName, sanitizeFileName(roomName))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create clip directory: %w", err)
+	}
+	prefix := time.Now().UTC().Format("20060102-150405.000")
+
+	var paths []string
+	for kind, packets := range clips {
+		if len(packets) == 0 {
+			continue
+		}
+		extension, ok := recordingFormat(codecs[kind].MimeType)
+		if !ok {
+			slog.Warn("Not saving clip of track with unsupported codec", "room", roomName, "track_kind", kind.String(), "codec", codecs[kind].MimeType)
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s.%s", prefix, kind.String(), extension))
+		if err := writeClip(path, codecs[kind], packets); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("nothing buffered for room %s yet", roomName)
+	}
+	if flags.ClipsMaxMB > 0 {
+		if err := pruneClips(dir, int64(flags.ClipsMaxMB)*1024*1024); err != nil {
+			slog.Warn("Failed to prune clips of room", "room", roomName, "err", err)
+		}
+	}
+	slog.Info("Saved clip of room", "room", roomName, "files", paths)
+	return paths, nil
+}
+
+// writeClip writes buffered packets to a file
+func writeClip(path string, codec webrtc.RTPCodecCapability, packets []replayPacket) error {
+	writer, err := newMediaWriter(path, codec)
+	if err != nil {
+		return fmt.Errorf("failed to create clip file: %w", err)
+	}
+	for _, buffered := range packets {
+		if err = writer.WriteRTP(buffered.packet); err != nil {
+			_ = writer.Close()
+			return fmt.Errorf("failed to write clip file: %w", err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("failed to finalize clip file: %w", err)
+	}
+	return nil
+}
+
+// pruneClips deletes the oldest clip files of a directory until the rest fit in given size
+func pruneClips(dir string, maxSize int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list clips: %w", err)
+	}
+	type clipFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []clipFile
+	var total int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Deleted meanwhile
+		}
+		files = append(files, clipFile{path: filepath.Join(dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete clip: %w", err)
+		}
+		total -= file.size
+		slog.Debug("Deleted clip over size limit", "path", file.path)
+	}
+	return nil
+}
+
+// --- DataChannel Command ---
+
+// clipForward is a clip request of a participant forwarded to the upstream relay of its room
+type clipForward struct {
+	roomName      string
+	participantID ulid.ULID
+	ndc           *connections.NestriDataChannel
+	requestID     uint32 // of the participant's own request
+	timeout       *time.Timer
+}
+
+// handleClipRequest saves a clip for a participant asking over its DataChannel and tells it the result.
+// Only the owner relay buffers rooms, elsewhere the request is passed on upstream
+func (sp *StreamProtocol) handleClipRequest(roomName string, participantID ulid.ULID, ndc *connections.NestriDataChannel, data []byte) {
+	var request gen.ProtoMessageClip
+	if err := proto.Unmarshal(data, &request); err != nil {
+		slog.Error("Failed to decode clip request", "room", roomName, "participant", participantID, "err", err)
+		return
+	}
+	if !sp.incomingConns.Has(roomName) {
+		if conn, ok := sp.requestedConns.Get(roomName); ok && conn.ndc != nil {
+			sp.forwardClipRequest(roomName, participantID, ndc, conn.ndc, &request)
+			return
+		}
+	}
+
+	result := &gen.ProtoClipResult{RequestId: request.GetData().GetRequestId()}
+	if last, ok := sp.lastClips.Get(roomName); ok && time.Since(last) < clipRequestInterval {
+		result.Error = "clips are saved at most every " + clipRequestInterval.String()
+	} else {
+		sp.lastClips.Set(roomName, time.Now())
+		duration := time.Duration(request.GetData().GetDurationSeconds()) * time.Second
+		paths, err := sp.relay.SaveClip(roomName, duration)
+		if err != nil {
+			slog.Error("Failed to save clip for participant", "room", roomName, "participant", participantID, "err", err)
+			result.Error = err.Error()
+		}
+		for _, path := range paths {
+			result.Files = append(result.Files, filepath.Base(path))
+		}
+	}
+	sendClipResult(roomName, participantID, ndc, result)
+}
+
+// forwardClipRequest passes a clip request on to the upstream relay of a room under an ID of its own,
+// the participant is answered once the result comes back or the request times out
+func (sp *StreamProtocol) forwardClipRequest(roomName string, participantID ulid.ULID, ndc, upstream *connections.NestriDataChannel, request *gen.ProtoMessageClip) {
+	forward := &clipForward{
+		roomName:      roomName,
+		participantID: participantID,
+		ndc:           ndc,
+		requestID:     request.GetData().GetRequestId(),
+	}
+	id := sp.lastClipID.Add(1)
+	forward.timeout = time.AfterFunc(clipForwardTimeout, func() {
+		if _, ok := sp.clipForwards.Take(id); ok {
+			slog.Warn("Clip request forwarded upstream timed out", "room", roomName, "participant", participantID)
+			sendClipResult(roomName, participantID, ndc, &gen.ProtoClipResult{
+				RequestId: forward.requestID,
+				Error:     "clip request timed out upstream",
+			})
+		}
+	})
+	sp.clipForwards.Set(id, forward)
+
+	data, err := proto.Marshal(&gen.ProtoMessageClip{
+		MessageBase: request.GetMessageBase(),
+		Data: &gen.ProtoClipRequest{
+			DurationSeconds: request.GetData().GetDurationSeconds(),
+			RequestId:       id,
+		},
+	})
+	if err == nil {
+		err = upstream.SendBinary(data)
+	}
+	if err != nil {
+		slog.Error("Failed to forward clip request upstream", "room", roomName, "participant", participantID, "err", err)
+		if _, ok := sp.clipForwards.Take(id); ok {
+			forward.timeout.Stop()
+			sendClipResult(roomName, participantID, ndc, &gen.ProtoClipResult{
+				RequestId: forward.requestID,
+				Error:     "failed to forward clip request to the room owner",
+			})
+		}
+		return
+	}
+	slog.Debug("Forwarded clip request upstream", "room", roomName, "participant", participantID, "request_id", id)
+}
+
+// handleClipResult passes the result of a clip request forwarded upstream back to the participant that asked
+func (sp *StreamProtocol) handleClipResult(roomName string, data []byte) {
+	var message gen.ProtoMessageClipResult
+	if err := proto.Unmarshal(data, &message); err != nil {
+		slog.Error("Failed to decode clip result from upstream", "room", roomName, "err", err)
+		return
+	}
+	result := message.GetData()
+	forward, ok := sp.clipForwards.Take(result.GetRequestId())
+	if !ok {
+		slog.Debug("Dropping clip result of unknown or timed out request", "room", roomName, "request_id", result.GetRequestId())
+		return
+	}
+	forward.timeout.Stop()
+	sendClipResult(forward.roomName, forward.participantID, forward.ndc, &gen.ProtoClipResult{
+		Files:     result.GetFiles(),
+		Error:     result.GetError(),
+		RequestId: forward.requestID,
+	})
+}
+
+// sendClipResult tells a participant the result of its clip request
+func sendClipResult(roomName string, participantID ulid.ULID, ndc *connections.NestriDataChannel, result *gen.ProtoClipResult) {
+	response, err := proto.Marshal(&gen.ProtoMessageClipResult{
+		MessageBase: &gen.ProtoMessageBase{PayloadType: clipResultMessageType},
+		Data:        result,
+	})
+	if err != nil {
+		slog.Error("Failed to encode clip result", "room", roomName, "err", err)
+		return
+	}
+	if err = ndc.SendBinary(response); err != nil {
+		slog.Error("Failed to send clip result to participant", "room", roomName, "participant", participantID, "err", err)
+	}
+}
@@ -0,0 +1,304 @@
+package core
+
+import (
+	"relay/internal/connections"
+	gen "relay/internal/proto"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// Buffered size limit large enough to not trim anything
+const testReplaySize = 1 << 20
+
+var (
+	testVP8Keyframe   = []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a}
+	testVP8Interframe = []byte{0x10, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}
+)
+
+func replayTestPacket(ssrc uint32, seq uint16, payload []byte) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq}, Payload: payload}
+}
+
+// bufferedSequence returns the sequence numbers of buffered packets
+func bufferedSequence(packets []replayPacket) []uint16 {
+	sequence := make([]uint16, 0, len(packets))
+	for _, buffered := range packets {
+		sequence = append(sequence, buffered.packet.SequenceNumber)
+	}
+	return sequence
+}
+
+func equalSequence(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ageBuffered makes the buffered packets an age older
+func ageBuffered(rb *replayBuffer, age time.Duration) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	for i := range rb.packets {
+		rb.packets[i].at = rb.packets[i].at.Add(-age)
+	}
+}
+
+func TestReplayBufferTrimsAudio(t *testing.T) {
+	rb := &replayBuffer{kind: webrtc.RTPCodecTypeAudio}
+	payload := make([]byte, 10)
+	for seq := range uint16(3) {
+		rb.add(testOpusCodec, replayTestPacket(1, seq, payload), time.Minute, testReplaySize)
+	}
+	ageBuffered(rb, 2*time.Minute)
+	rb.add(testOpusCodec, replayTestPacket(1, 3, payload), time.Minute, testReplaySize)
+	if _, packets := rb.since(time.Time{}); !equalSequence(bufferedSequence(packets), []uint16{3}) {
+		t.Errorf("buffered %v after older packets aged out, want [3]", bufferedSequence(packets))
+	}
+
+	for seq := uint16(4); seq < 8; seq++ {
+		rb.add(testOpusCodec, replayTestPacket(1, seq, payload), time.Minute, 25)
+	}
+	if _, packets := rb.since(time.Time{}); !equalSequence(bufferedSequence(packets), []uint16{6, 7}) {
+		t.Errorf("buffered %v within 25 bytes, want [6 7]", bufferedSequence(packets))
+	}
+	if rb.size != 20 {
+		t.Errorf("buffered size %d, want 20", rb.size)
+	}
+}
+
+func TestReplayBufferStartsOnKeyframe(t *testing.T) {
+	requests := &atomic.Int32{}
+	rb := &replayBuffer{kind: webrtc.RTPCodecTypeVideo, requestKeyframe: func() { requests.Add(1) }}
+	add := func(seq uint16, payload []byte, maxSize int) {
+		rb.add(testVP8Codec, replayTestPacket(1, seq, payload), time.Minute, maxSize)
+	}
+
+	add(0, testVP8Interframe, testReplaySize) // Undecodable without a keyframe before
+	add(1, testVP8Keyframe, testReplaySize)
+	add(2, testVP8Interframe, testReplaySize)
+	add(3, testVP8Keyframe, testReplaySize)
+	add(4, testVP8Interframe, testReplaySize)
+	if _, packets := rb.since(time.Time{}); !equalSequence(bufferedSequence(packets), []uint16{1, 2, 3, 4}) {
+		t.Fatalf("buffered %v, want [1 2 3 4] starting at the first keyframe", bufferedSequence(packets))
+	}
+
+	// Trimming the first keyframe takes its frame along, up to the next keyframe
+	add(5, testVP8Interframe, 30)
+	if _, packets := rb.since(time.Time{}); !equalSequence(bufferedSequence(packets), []uint16{3, 4, 5}) {
+		t.Errorf("buffered %v after trimming by size, want [3 4 5]", bufferedSequence(packets))
+	}
+
+	// Aging out every keyframe leaves nothing decodable, so a keyframe is asked for
+	ageBuffered(rb, 2*time.Minute)
+	add(6, testVP8Interframe, testReplaySize)
+	if _, packets := rb.since(time.Time{}); len(packets) != 0 {
+		t.Errorf("buffered %v without a keyframe, want nothing", bufferedSequence(packets))
+	}
+	deadline := time.Now().Add(time.Second)
+	for requests.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("requested %d keyframes, want 1", requests.Load())
+	}
+}
+
+func TestReplayBufferResets(t *testing.T) {
+	rb := &replayBuffer{kind: webrtc.RTPCodecTypeVideo}
+	rb.add(testVP8Codec, replayTestPacket(1, 1, testVP8Keyframe), time.Minute, testReplaySize)
+	rb.add(testVP8Codec, replayTestPacket(1, 2, testVP8Interframe), time.Minute, testReplaySize)
+
+	// Another simulcast encoding became primary
+	rb.add(testVP8Codec, replayTestPacket(2, 10, testVP8Interframe), time.Minute, testReplaySize)
+	if _, packets := rb.since(time.Time{}); len(packets) != 0 || rb.size != 0 {
+		t.Errorf("buffered %v of %d bytes after an SSRC change without keyframe, want nothing", bufferedSequence(packets), rb.size)
+	}
+	rb.add(testVP8Codec, replayTestPacket(2, 11, testVP8Keyframe), time.Minute, testReplaySize)
+	if _, packets := rb.since(time.Time{}); !equalSequence(bufferedSequence(packets), []uint16{11}) {
+		t.Errorf("buffered %v after a keyframe of the new SSRC, want [11]", bufferedSequence(packets))
+	}
+
+	// Codec changed on the same SSRC
+	vp9 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}
+	rb.add(vp9, replayTestPacket(2, 12, []byte{0x8c}), time.Minute, testReplaySize)
+	codec, packets := rb.since(time.Time{})
+	if codec.MimeType != webrtc.MimeTypeVP9 || !equalSequence(bufferedSequence(packets), []uint16{12}) {
+		t.Errorf("buffered %s %v after a codec change, want VP9 [12]", codec.MimeType, bufferedSequence(packets))
+	}
+}
+
+func TestReplayBufferSince(t *testing.T) {
+	video := &replayBuffer{kind: webrtc.RTPCodecTypeVideo}
+	audio := &replayBuffer{kind: webrtc.RTPCodecTypeAudio}
+	for seq, payload := range [][]byte{testVP8Keyframe, testVP8Interframe, testVP8Keyframe, testVP8Interframe} {
+		video.add(testVP8Codec, replayTestPacket(1, uint16(seq), payload), time.Minute, testReplaySize)
+		audio.add(testOpusCodec, replayTestPacket(1, uint16(seq), []byte{0xfc}), time.Minute, testReplaySize)
+	}
+	// Packets arrived 40, 30, 20 and 10 seconds ago
+	for _, rb := range []*replayBuffer{video, audio} {
+		for i := range rb.packets {
+			rb.packets[i].at = time.Now().Add(-time.Duration(40-10*i) * time.Second)
+		}
+	}
+
+	from := time.Now().Add(-15 * time.Second)
+	if _, packets := audio.since(from); !equalSequence(bufferedSequence(packets), []uint16{3}) {
+		t.Errorf("audio since 15 seconds ago %v, want [3]", bufferedSequence(packets))
+	}
+	if _, packets := video.since(from); !equalSequence(bufferedSequence(packets), []uint16{2, 3}) {
+		t.Errorf("video since 15 seconds ago %v, want [2 3] from the keyframe before", bufferedSequence(packets))
+	}
+	if _, packets := video.since(time.Now().Add(-35 * time.Second)); !equalSequence(bufferedSequence(packets), []uint16{0, 1, 2, 3}) {
+		t.Errorf("video since 35 seconds ago %v, want everything from the first keyframe", bufferedSequence(packets))
+	}
+}
+
+// newTestDataChannels connects two DataChannels over loopback
+func newTestDataChannels(t *testing.T) (*connections.NestriDataChannel, *connections.NestriDataChannel) {
+	t.Helper()
+	settings := webrtc.SettingEngine{}
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+
+	offerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = offerer.Close() })
+	answerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = answerer.Close() })
+
+	localDC, err := offerer.CreateDataChannel("data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{}, 2)
+	localDC.OnOpen(func() { opened <- struct{}{} })
+	remote := make(chan *connections.NestriDataChannel, 1)
+	answerer.OnDataChannel(func(dc *webrtc.DataChannel) {
+		ndc := connections.NewNestriDataChannel(dc)
+		remote <- ndc
+		dc.OnOpen(func() { opened <- struct{}{} })
+	})
+	local := connections.NewNestriDataChannel(localDC)
+
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err = answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err = offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		select {
+		case <-opened:
+		case <-time.After(10 * time.Second):
+			t.Fatal("DataChannels did not open")
+		}
+	}
+	return local, <-remote
+}
+
+func marshalClipRequest(t *testing.T, durationSeconds, requestID uint32) []byte {
+	t.Helper()
+	data, err := proto.Marshal(&gen.ProtoMessageClip{
+		MessageBase: &gen.ProtoMessageBase{PayloadType: clipMessageType},
+		Data:        &gen.ProtoClipRequest{DurationSeconds: durationSeconds, RequestId: requestID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestForwardClipRequest asks a relay not owning a room for a clip, the request must be passed on upstream
+// and its result come back to the participant under the participant's request ID
+func TestForwardClipRequest(t *testing.T) {
+	r := newTestRelay(t)
+	sp := r.StreamProtocol
+	participantEnd, participantSide := newTestDataChannels(t)
+	upstreamSide, upstreamEnd := newTestDataChannels(t)
+	sp.requestedConns.Set("room", &StreamConnection{ndc: upstreamSide})
+	upstreamSide.RegisterMessageCallback(clipResultMessageType, func(data []byte) {
+		sp.handleClipResult("room", data)
+	})
+
+	// Upstream relay saves the clip
+	forwarded := make(chan *gen.ProtoClipRequest, 1)
+	upstreamEnd.RegisterMessageCallback(clipMessageType, func(data []byte) {
+		var request gen.ProtoMessageClip
+		if err := proto.Unmarshal(data, &request); err != nil {
+			t.Error(err)
+			return
+		}
+		forwarded <- request.GetData()
+		sendClipResult("room", ulid.ULID{}, upstreamEnd, &gen.ProtoClipResult{
+			Files:     []string{"clip-video.mkv"},
+			RequestId: request.GetData().GetRequestId(),
+		})
+	})
+	results := make(chan *gen.ProtoClipResult, 1)
+	participantEnd.RegisterMessageCallback(clipResultMessageType, func(data []byte) {
+		var result gen.ProtoMessageClipResult
+		if err := proto.Unmarshal(data, &result); err != nil {
+			t.Error(err)
+			return
+		}
+		results <- result.GetData()
+	})
+
+	sp.handleClipRequest("room", ulid.Make(), participantSide, marshalClipRequest(t, 30, 7))
+	select {
+	case request := <-forwarded:
+		if request.GetDurationSeconds() != 30 {
+			t.Errorf("forwarded request for %d seconds, want 30", request.GetDurationSeconds())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clip request was not forwarded upstream")
+	}
+	select {
+	case result := <-results:
+		if result.GetRequestId() != 7 || len(result.GetFiles()) != 1 || result.GetFiles()[0] != "clip-video.mkv" || result.GetError() != "" {
+			t.Errorf("participant got result %v, want the upstream files for request 7", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clip result did not come back to the participant")
+	}
+	if count := sp.clipForwards.Len(); count != 0 {
+		t.Errorf("%d forwarded clip requests still pending, want 0", count)
+	}
+}
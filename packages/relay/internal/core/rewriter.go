@@ -0,0 +1,64 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// --- Structs ---
+
+// rtpRewriter keeps RTP sequence numbers and timestamps of a local track continuous
+// when the upstream writing to it changes, so decoders of viewers don't break
+type rtpRewriter struct {
+	mutex     sync.Mutex
+	clockRate uint32
+	started   bool // whether any packet was written yet
+	resync    bool // whether next packet comes from a new upstream
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+}
+
+func newRTPRewriter(clockRate uint32) *rtpRewriter {
+	return &rtpRewriter{
+		clockRate: clockRate,
+	}
+}
+
+// switchSource marks the start of a new upstream, next packet is spliced after the last written one
+func (rw *rtpRewriter) switchSource() {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	rw.resync = true
+}
+
+// rewrite shifts sequence number and timestamp of a packet into the output space of the track
+func (rw *rtpRewriter) rewrite(packet *rtp.Packet) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	if rw.resync {
+		if rw.started {
+			// Continue right after the last packet, advancing timestamp by the time the switch took
+			elapsed := uint32(time.Since(rw.lastAt).Seconds() * float64(rw.clockRate))
+			rw.seqOffset = rw.lastSeq + 1 - packet.SequenceNumber
+			rw.tsOffset = rw.lastTS + max(elapsed, 1) - packet.Timestamp
+		}
+		rw.resync = false
+	}
+
+	packet.SequenceNumber += rw.seqOffset
+	packet.Timestamp += rw.tsOffset
+
+	// Only move forward, reordered packets keep their place
+	if !rw.started || int16(packet.SequenceNumber-rw.lastSeq) > 0 {
+		rw.lastSeq = packet.SequenceNumber
+		rw.lastTS = packet.Timestamp
+		rw.lastAt = time.Now()
+	}
+	rw.started = true
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPRewriterSwitchSource(t *testing.T) {
+	rw := newRTPRewriter(90000)
+	rewrite := func(sequenceNumber uint16, timestamp uint32) rtp.Header {
+		packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: sequenceNumber, Timestamp: timestamp}}
+		rw.rewrite(packet)
+		return packet.Header
+	}
+
+	// The first upstream is passed through, switching before anything was written changes nothing
+	rw.switchSource()
+	for i := uint16(0); i < 3; i++ {
+		if header := rewrite(65534+i, 1000+uint32(i)*3000); header.SequenceNumber != 65534+i || header.Timestamp != 1000+uint32(i)*3000 {
+			t.Errorf("first upstream packet %d rewritten to %d/%d, want it unchanged", i, header.SequenceNumber, header.Timestamp)
+		}
+	}
+	lastTS := uint32(1000 + 2*3000)
+
+	// The new upstream continues right after the last packet, its timestamp advanced by the time the switch took
+	rw.mutex.Lock()
+	rw.lastAt = time.Now().Add(-100 * time.Millisecond)
+	rw.mutex.Unlock()
+	rw.switchSource()
+	header := rewrite(500, 70000)
+	if header.SequenceNumber != 1 {
+		t.Errorf("first packet of new upstream has sequence number %d, want 1", header.SequenceNumber)
+	}
+	if elapsed := header.Timestamp - lastTS; elapsed < 9000 || elapsed > 90000 {
+		t.Errorf("first packet of new upstream advanced timestamp by %d, want about 100ms worth", elapsed)
+	}
+	spliced := header.Timestamp
+
+	// Following packets keep their spacing, reordered ones their place
+	if header = rewrite(502, 76000); header.SequenceNumber != 3 || header.Timestamp != spliced+6000 {
+		t.Errorf("packet of new upstream rewritten to %d/%d, want 3/%d", header.SequenceNumber, header.Timestamp, spliced+6000)
+	}
+	if header = rewrite(501, 73000); header.SequenceNumber != 2 || header.Timestamp != spliced+3000 {
+		t.Errorf("reordered packet of new upstream rewritten to %d/%d, want 2/%d", header.SequenceNumber, header.Timestamp, spliced+3000)
+	}
+	rw.switchSource()
+	if header = rewrite(9, 5); header.SequenceNumber != 4 {
+		t.Errorf("next upstream after reordering starts at %d, want 4", header.SequenceNumber)
+	}
+}
@@ -2,13 +2,15 @@ package core
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
+	gen "relay/internal/proto"
 	"relay/internal/shared"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
 )
 
 // --- Room Management ---
@@ -21,6 +23,12 @@ func (r *Relay) GetRoomByID(id ulid.ULID) *shared.Room {
 	return nil
 }
 
+// addLocalRoom registers a local room, hooking up its events
+func (r *Relay) addLocalRoom(room *shared.Room) {
+	room.OnEvent(r.onRoomEvent)
+	r.LocalRooms.Set(room.ID, room)
+}
+
 // GetRoomByName retrieves a local Room struct by its name
 func (r *Relay) GetRoomByName(name string) *shared.Room {
 	for _, room := range r.LocalRooms.Copy() {
@@ -35,8 +43,15 @@ func (r *Relay) GetRoomByName(name string) *shared.Room {
 func (r *Relay) CreateRoom(name string) *shared.Room {
 	roomID := ulid.Make()
 	room := shared.NewRoom(name, roomID, r.ID)
-	r.LocalRooms.Set(room.ID, room)
-	slog.Debug("Created new local room", "room", name, "id", room.ID)
+	room.Version = r.MeshRooms.Tick()
+	if applied, winner, _ := r.MeshRooms.Merge(room.RoomInfo, false); !applied {
+		slog.Warn("Created local room is superseded by another relay", "room", name, "owner", winner.OwnerID)
+		room.OwnerID = winner.OwnerID
+		room.Version = winner.Version
+	}
+	r.addLocalRoom(room)
+	slog.Debug("Created new local room", "room", name, "id", room.ID, "version", room.Version)
+	r.publishRoomStatesAsync()
 	return room
 }
 
@@ -45,27 +60,96 @@ func (r *Relay) DeleteRoomIfEmpty(room *shared.Room) {
 	if room == nil {
 		return
 	}
+	// Owned rooms are kept while their stream is being pushed
+	if room.OwnerID == r.ID && r.StreamProtocol.incomingConns.Has(room.Name) {
+		return
+	}
 	if room.Participants.Len() == 0 && r.LocalRooms.Has(room.ID) {
 		slog.Debug("Deleting empty room without participants", "room", room.Name)
 		r.LocalRooms.Delete(room.ID)
-		err := room.PeerConnection.Close()
-		if err != nil {
-			slog.Error("Failed to close Room PeerConnection", "room", room.Name, "err", err)
+		if copied, ok := r.roomCopies.Get(room.Name); ok && copied == room {
+			r.roomCopies.Delete(room.Name)
+		}
+		if r.StreamProtocol.feedback.Has(room.Name) {
+			r.StreamProtocol.feedback.Delete(room.Name)
+		}
+		r.StreamProtocol.forgetIngressStats(room.Name)
+		r.StreamProtocol.forgetReplayBuffers(room.Name)
+		if room.OwnerID == r.ID {
+			// Leave a tombstone so the deletion wins over our older claim everywhere
+			tombstone := room.RoomInfo
+			tombstone.Version = r.MeshRooms.Tick()
+			r.MeshRooms.Merge(tombstone, true)
+			r.publishRoomStatesAsync()
+		} else {
+			// Nobody watches our copy of the remote room anymore
+			r.StreamProtocol.closeRequested(room.Name)
+		}
+		if room.PeerConnection != nil {
+			if err := room.PeerConnection.Close(); err != nil {
+				slog.Error("Failed to close Room PeerConnection", "room", room.Name, "err", err)
+			}
+		}
+	}
+}
+
+// --- Room Events ---
+
+// onRoomEvent reacts to track and availability changes of local rooms
+func (r *Relay) onRoomEvent(room *shared.Room, event shared.RoomEvent, trackType webrtc.RTPCodecType) {
+	slog.Debug("Room event", "room", room.Name, "event", event.String(), "track_kind", trackType.String())
+	switch event {
+	case shared.RoomEventTrackSet:
+		r.StreamProtocol.updateServedTracks(room, trackType)
+	case shared.RoomEventTrackCleared:
+		r.StreamProtocol.updateServedTracks(room, trackType)
+		r.onRecordedTrackCleared(room.Name, trackType)
+	case shared.RoomEventOnline:
+		if room.OwnerID == r.ID {
+			r.reclaimRoom(room)
+		}
+		r.onRoomOnline(room)
+	case shared.RoomEventOffline:
+		r.StreamProtocol.signalOffline(room)
+		if r.IsRecording(room.Name) {
+			_ = r.StopRecording(room.Name)
 		}
+		if room.OwnerID == r.ID {
+			// Ingest ended, stop advertising the room in mesh
+			tombstone := room.RoomInfo
+			tombstone.Version = r.MeshRooms.Tick()
+			r.MeshRooms.Merge(tombstone, true)
+			room.Version = tombstone.Version
+			r.publishRoomStatesAsync()
+		}
+	default:
+	}
+}
+
+// reclaimRoom advertises an owned room again after its ingest came back
+func (r *Relay) reclaimRoom(room *shared.Room) {
+	if current, ok := r.MeshRooms.Get(room.Name); ok && current.OwnerID == r.ID {
+		return // Still advertised
 	}
+	info := room.RoomInfo
+	info.Version = r.MeshRooms.Tick()
+	if applied, winner, _ := r.MeshRooms.Merge(info, false); !applied {
+		slog.Warn("Reclaimed room is superseded by another relay", "room", room.Name, "owner", winner.OwnerID)
+		return
+	}
+	room.Version = info.Version
+	r.publishRoomStatesAsync()
 }
 
 // GetRemoteRoomByName returns room from mesh by name
 func (r *Relay) GetRemoteRoomByName(roomName string) *shared.RoomInfo {
-	for _, room := range r.MeshRooms.Copy() {
-		if room.Name == roomName && room.OwnerID != r.ID {
-			// Make sure connection is alive
-			if r.Host.Network().Connectedness(room.OwnerID) == network.Connected {
-				return &room
-			} else {
-				slog.Debug("Removing stale peer, owns a room without connection", "room", roomName, "peer", room.OwnerID)
-				r.onPeerDisconnected(room.OwnerID)
-			}
+	if room, ok := r.MeshRooms.Get(roomName); ok && room.OwnerID != r.ID {
+		// Make sure connection is alive
+		if r.Host.Network().Connectedness(room.OwnerID) == network.Connected {
+			return &room
+		} else {
+			slog.Debug("Removing stale peer, owns a room without connection", "room", roomName, "peer", room.OwnerID)
+			r.onPeerDisconnected(room.OwnerID)
 		}
 	}
 	return nil
@@ -73,36 +157,67 @@ func (r *Relay) GetRemoteRoomByName(roomName string) *shared.RoomInfo {
 
 // --- State Publishing ---
 
-// publishRoomStates publishes the state of all rooms currently owned by *this* relay
+// publishRoomStates publishes changes to the state of rooms currently owned by *this* relay as a sequenced update
 func (r *Relay) publishRoomStates(ctx context.Context) error {
 	if r.pubTopicState == nil {
 		slog.Warn("Cannot publish room states: topic is nil")
 		return nil
 	}
 
-	var statesToPublish []shared.RoomInfo
+	statesToPublish := make(map[string]*gen.EntityState)
 	r.LocalRooms.Range(func(id ulid.ULID, room *shared.Room) bool {
-		// Only publish state for rooms owned by this relay
-		if room.OwnerID == r.ID {
-			statesToPublish = append(statesToPublish, shared.RoomInfo{
-				ID:      room.ID,
-				Name:    room.Name,
-				OwnerID: r.ID,
-			})
+		// Only publish state for rooms owned and advertised by this relay
+		if current, ok := r.MeshRooms.Get(room.Name); ok && current.OwnerID == r.ID && room.OwnerID == r.ID {
+			statesToPublish[room.Name] = &gen.EntityState{
+				EntityType:   entityTypeRoom,
+				EntityId:     room.Name,
+				Active:       true,
+				OwnerRelayId: r.ID.String(),
+				Version:      room.Version,
+			}
 		}
 		return true // Continue iteration
 	})
+	// Include tombstones of our deleted rooms, until garbage collected
+	for name, tombstone := range r.MeshRooms.Tombstones() {
+		if _, ok := statesToPublish[name]; !ok && tombstone.OwnerID == r.ID {
+			statesToPublish[name] = &gen.EntityState{
+				EntityType:   entityTypeRoom,
+				EntityId:     name,
+				Active:       false,
+				OwnerRelayId: r.ID.String(),
+				Version:      tombstone.Version,
+			}
+		}
+	}
 
-	if len(statesToPublish) == 0 {
-		return nil
+	update := r.stateHistory.next(statesToPublish)
+	if update == nil {
+		// Nothing changed, announce latest sequence number so peers can detect missed updates
+		update = &gen.StateUpdate{
+			SequenceNumber: r.stateHistory.latest(),
+		}
 	}
 
-	data, err := json.Marshal(statesToPublish)
+	data, err := proto.Marshal(&gen.MeshMessage{
+		Type: &gen.MeshMessage_StateUpdate{
+			StateUpdate: update,
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal local room states: %w", err)
+		return fmt.Errorf("failed to marshal room state update: %w", err)
 	}
 	if pubErr := r.pubTopicState.Publish(ctx, data); pubErr != nil {
-		slog.Error("Failed to publish room states message", "err", pubErr)
+		slog.Error("Failed to publish room states message", "sequence", update.GetSequenceNumber(), "err", pubErr)
 	}
 	return nil
 }
+
+// publishRoomStatesAsync publishes room states in background, logging any errors
+func (r *Relay) publishRoomStatesAsync() {
+	go func() {
+		if err := r.publishRoomStates(context.Background()); err != nil {
+			slog.Error("Failed to publish room states on change", "err", err)
+		}
+	}()
+}
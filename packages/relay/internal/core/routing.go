@@ -0,0 +1,213 @@
+package core
+
+import (
+	"container/heap"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// unknownRouteCost is the cost of routes over unmeasured links
+const unknownRouteCost = time.Duration(math.MaxInt64)
+
+// --- Structs ---
+
+// StreamRoute is a chosen path for a room stream, from the room owner to this relay
+type StreamRoute struct {
+	Room     string        `json:"room"`
+	Source   peer.ID       `json:"source"`    // relay the stream is requested from
+	Path     []peer.ID     `json:"path"`      // relays the stream passes through, owner first and this relay last
+	Cost     time.Duration `json:"cost"`      // total latency along the path
+	ChosenAt time.Time     `json:"chosen_at"` // when the route was chosen
+}
+
+func (sr *StreamRoute) String() string {
+	hops := make([]string, len(sr.Path))
+	for i, id := range sr.Path {
+		hops[i] = id.String()
+	}
+	if sr.Cost == unknownRouteCost {
+		return fmt.Sprintf("%s (unmeasured)", strings.Join(hops, " -> "))
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(hops, " -> "), sr.Cost)
+}
+
+// latencyGraph is a snapshot of measured latencies between mesh relays
+type latencyGraph struct {
+	edges map[peer.ID]map[peer.ID]time.Duration
+}
+
+// buildLatencyGraph assembles the mesh latency graph from our own and all known peers' measured latencies
+func (r *Relay) buildLatencyGraph() *latencyGraph {
+	g := &latencyGraph{
+		edges: make(map[peer.ID]map[peer.ID]time.Duration),
+	}
+	g.addLatencies(r.ID, r.MeshLatencies.Copy())
+	r.LocalMeshPeers.Range(func(peerID peer.ID, info *RelayInfo) bool {
+		if info.MeshLatencies != nil {
+			g.addLatencies(peerID, info.MeshLatencies.Copy())
+		}
+		return true
+	})
+	return g
+}
+
+// addLatencies adds measured latencies of a relay, latencies are assumed symmetric
+// unless the other side measured its own
+func (g *latencyGraph) addLatencies(from peer.ID, latencies map[string]time.Duration) {
+	for id, latency := range latencies {
+		to, err := peer.Decode(id)
+		if err != nil || to == from {
+			continue
+		}
+		g.setEdge(from, to, latency, true)
+		g.setEdge(to, from, latency, false)
+	}
+}
+
+func (g *latencyGraph) setEdge(from, to peer.ID, latency time.Duration, measured bool) {
+	if _, ok := g.edges[from]; !ok {
+		g.edges[from] = make(map[peer.ID]time.Duration)
+	}
+	if _, ok := g.edges[from][to]; ok && !measured {
+		return
+	}
+	g.edges[from][to] = latency
+}
+
+// shortestPaths runs Dijkstra from a relay, returning distances to reachable relays
+func (g *latencyGraph) shortestPaths(from peer.ID) map[peer.ID]time.Duration {
+	dist := map[peer.ID]time.Duration{from: 0}
+	queue := &routeQueue{{id: from}}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(routeItem)
+		if item.cost > dist[item.id] {
+			continue // Stale entry
+		}
+		for to, latency := range g.edges[item.id] {
+			cost := item.cost + latency
+			if known, ok := dist[to]; !ok || cost < known {
+				dist[to] = cost
+				heap.Push(queue, routeItem{id: to, cost: cost})
+			}
+		}
+	}
+	return dist
+}
+
+// pathCost sums the latencies along a path, using the shortest known distance for unmeasured hops,
+// false if any hop is unreachable
+func (g *latencyGraph) pathCost(path []peer.ID) (time.Duration, bool) {
+	var cost time.Duration
+	for i := 1; i < len(path); i++ {
+		latency, ok := g.edges[path[i-1]][path[i]]
+		if !ok {
+			if latency, ok = g.shortestPaths(path[i-1])[path[i]]; !ok {
+				return 0, false
+			}
+		}
+		cost += latency
+	}
+	return cost, true
+}
+
+// routeItem and routeQueue implement the priority queue for Dijkstra
+type routeItem struct {
+	id   peer.ID
+	cost time.Duration
+}
+
+type routeQueue []routeItem
+
+func (q routeQueue) Len() int           { return len(q) }
+func (q routeQueue) Less(i, j int) bool { return q[i].cost < q[j].cost }
+func (q routeQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *routeQueue) Push(x any)        { *q = append(*q, x.(routeItem)) }
+func (q *routeQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// --- Route Selection ---
+
+// routeStream picks the lowest latency route for a room stream over the mesh latency graph,
+// either from its owner or a relay forwarding it, skipping sources which would make a loop or exceed the hop limit
+func (r *Relay) routeStream(roomName string, exclude peer.ID) (*StreamRoute, error) {
+	roomInfo, ok := r.MeshRooms.Get(roomName)
+	if !ok || roomInfo.OwnerID == r.ID {
+		return nil, fmt.Errorf("no remote room '%s' in mesh", roomName)
+	}
+
+	// Candidate sources with their stream path, owner first
+	candidates := map[peer.ID][]peer.ID{
+		roomInfo.OwnerID: {roomInfo.OwnerID},
+	}
+	r.LocalMeshPeers.Range(func(peerID peer.ID, _ *RelayInfo) bool {
+		path, ok := r.peerStreamPath(peerID, roomName)
+		if !ok || peerID == roomInfo.OwnerID {
+			return true
+		}
+		// Pulling from a relay downstream of us would make a loop
+		if slices.Contains(path, r.ID) || len(path)+1 > maxStreamHops {
+			return true
+		}
+		streamPath := slices.Clone(path)
+		slices.Reverse(streamPath)
+		candidates[peerID] = append(streamPath, peerID)
+		return true
+	})
+
+	graph := r.buildLatencyGraph()
+
+	var best *StreamRoute
+	for source, streamPath := range candidates {
+		if source == exclude || source == r.ID || r.Host.Network().Connectedness(source) != network.Connected {
+			continue
+		}
+		path := append(slices.Clone(streamPath), r.ID)
+		cost, ok := graph.pathCost(path)
+		if !ok {
+			cost = unknownRouteCost // Not measured yet, only picked if nothing better is known
+		}
+		route := &StreamRoute{
+			Room:     roomName,
+			Source:   source,
+			Path:     path,
+			Cost:     cost,
+			ChosenAt: time.Now(),
+		}
+		if best == nil || route.Cost < best.Cost || (route.Cost == best.Cost && len(route.Path) < len(best.Path)) {
+			best = route
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no reachable source for room '%s'", roomName)
+	}
+
+	r.streamRoutes.Set(roomName, best)
+	slog.Info("Selected stream route for room", "room", roomName, "source", best.Source, "route", best.String())
+	return best, nil
+}
+
+// --- Public Usable Methods ---
+
+// GetStreamRoute returns the last chosen route of a room stream, nil if none was chosen
+func (r *Relay) GetStreamRoute(roomName string) *StreamRoute {
+	if route, ok := r.streamRoutes.Get(roomName); ok {
+		return route
+	}
+	return nil
+}
+
+// GetStreamRoutes returns the last chosen routes of all requested room streams
+func (r *Relay) GetStreamRoutes() map[string]*StreamRoute {
+	return r.streamRoutes.Copy()
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"context"
+	"relay/internal/common"
+	"relay/internal/shared"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// addMeshPeer connects a relay to a new mesh peer publishing given latencies and carried stream paths
+func addMeshPeer(t *testing.T, r *Relay, latencies map[peer.ID]time.Duration, streams map[string][]peer.ID) peer.ID {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	if err = r.Host.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	info := &RelayInfo{
+		ID:            h.ID(),
+		MeshLatencies: common.NewSafeMap[string, time.Duration](),
+		MeshStreams:   common.NewSafeMap[string, []peer.ID](),
+	}
+	for id, latency := range latencies {
+		info.MeshLatencies.Set(id.String(), latency)
+	}
+	for name, path := range streams {
+		info.MeshStreams.Set(name, path)
+	}
+	r.LocalMeshPeers.Set(h.ID(), info)
+	return h.ID()
+}
+
+func TestShortestPaths(t *testing.T) {
+	a, b, c, d, e := newTestIdentity(t).id, newTestIdentity(t).id, newTestIdentity(t).id, newTestIdentity(t).id, newTestIdentity(t).id
+	g := &latencyGraph{edges: make(map[peer.ID]map[peer.ID]time.Duration)}
+	g.addLatencies(a, map[string]time.Duration{b.String(): 10 * time.Millisecond, c.String(): 50 * time.Millisecond, "invalid": time.Millisecond})
+	g.addLatencies(b, map[string]time.Duration{c.String(): 15 * time.Millisecond})
+	g.addLatencies(c, map[string]time.Duration{a.String(): 40 * time.Millisecond}) // Measured by c itself, overrides a's measurement
+	g.setEdge(d, a, time.Millisecond, true)                                        // Only reachable towards a
+	g.setEdge(b, e, 5*time.Millisecond, true)                                      // Only reachable over b
+
+	dist := g.shortestPaths(a)
+	for id, want := range map[peer.ID]time.Duration{a: 0, b: 10 * time.Millisecond, c: 25 * time.Millisecond} {
+		if got, ok := dist[id]; !ok || got != want {
+			t.Errorf("distance from a to %s is %v (reachable %v), want %v", id, got, ok, want)
+		}
+	}
+	if _, ok := dist[d]; ok {
+		t.Error("relay without a link from a is reachable")
+	}
+	if latency := g.edges[c][a]; latency != 40*time.Millisecond {
+		t.Errorf("latency from c to a is %v, want its own measurement of 40ms", latency)
+	}
+	if latency := g.edges[a][c]; latency != 50*time.Millisecond {
+		t.Errorf("latency from a to c is %v, want its own measurement of 50ms", latency)
+	}
+
+	// Unmeasured hops cost their shortest distance, unreachable ones make the path unusable
+	if cost, ok := g.pathCost([]peer.ID{c, a, d}); ok {
+		t.Errorf("path over unreachable hop costs %v, want it unusable", cost)
+	}
+	if cost, ok := g.pathCost([]peer.ID{c, a, e}); !ok || cost != 55*time.Millisecond {
+		t.Errorf("path c, a, e costs %v (usable %v), want 55ms with the unmeasured hop over b", cost, ok)
+	}
+}
+
+// TestRouteStream routes a room stream either from its owner or a relay forwarding it, over measured and
+// unmeasured links
+func TestRouteStream(t *testing.T) {
+	r := newTestRelay(t)
+	owner := addMeshPeer(t, r, nil, nil)
+	forwarder := addMeshPeer(t, r, map[peer.ID]time.Duration{owner: 20 * time.Millisecond}, map[string][]peer.ID{"room": {owner}})
+	downstream := addMeshPeer(t, r, nil, map[string][]peer.ID{"room": {r.ID, owner}})
+	r.MeshRooms.Merge(shared.RoomInfo{Name: "room", OwnerID: owner, Version: 1}, false)
+
+	routeOf := func(exclude peer.ID) *StreamRoute {
+		t.Helper()
+		route, err := r.routeStream("room", exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return route
+	}
+
+	// Nothing measured from here, every route costs the same and the shortest is preferred
+	if route := routeOf(""); route.Source != owner || route.Cost != unknownRouteCost || !slices.Equal(route.Path, []peer.ID{owner, r.ID}) {
+		t.Errorf("unmeasured route %s from %s, want directly from the owner", route, route.Source)
+	}
+
+	// The unmeasured link to the owner costs its shortest distance over the forwarder, the shorter path wins the tie
+	r.MeshLatencies.Set(forwarder.String(), 10*time.Millisecond)
+	if route := routeOf(""); route.Source != owner || route.Cost != 30*time.Millisecond {
+		t.Errorf("route %s from %s, want directly from the owner at the cost over the forwarder", route, route.Source)
+	}
+
+	// Lowest latency wins once both are measured
+	r.MeshLatencies.Set(owner.String(), 100*time.Millisecond)
+	if route := routeOf(""); route.Source != forwarder || route.Cost != 30*time.Millisecond || !slices.Equal(route.Path, []peer.ID{owner, forwarder, r.ID}) {
+		t.Errorf("route %s from %s, want the faster one over the forwarder", route, route.Source)
+	}
+	r.MeshLatencies.Set(owner.String(), 25*time.Millisecond)
+	if route := routeOf(""); route.Source != owner || route.Cost != 25*time.Millisecond {
+		t.Errorf("route %s from %s, want the faster one from the owner", route, route.Source)
+	}
+	if route := routeOf(owner); route.Source != forwarder {
+		t.Errorf("route %s from %s with the owner excluded, want over the forwarder", route, route.Source)
+	}
+	if route := r.GetStreamRoute("room"); route == nil || route.Source != forwarder {
+		t.Errorf("kept route %v, want the last chosen one", route)
+	}
+
+	// Relays downstream of us or too far from the owner are never picked
+	r.MeshLatencies.Set(downstream.String(), time.Millisecond)
+	far := addMeshPeer(t, r, nil, map[string][]peer.ID{"room": {"x", "y", "z", owner}})
+	r.MeshLatencies.Set(far.String(), time.Millisecond)
+	if route := routeOf(owner); route.Source != forwarder {
+		t.Errorf("route %s from %s, want over the forwarder instead of making a loop or exceeding the hop limit", route, route.Source)
+	}
+
+	if _, err := r.routeStream("unknown", ""); err == nil {
+		t.Error("routed stream of a room not in the mesh")
+	}
+	r.LocalMeshPeers.Delete(forwarder)
+	if _, err := r.routeStream("room", owner); err == nil {
+		t.Error("routed stream without any source left")
+	}
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/connections"
+	gen "relay/internal/proto"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Signaling Message Types ---
+const (
+	signalRequestRoom = "request-stream-room"    // Request of a room stream
+	signalPushRoom    = "push-stream-room"       // Push of a room stream
+	signalPushOK      = "push-stream-ok"         // Push accepted
+	signalOffer       = "offer"                  // SDP offer
+	signalAnswer      = "answer"                 // SDP answer
+	signalICE         = "ice-candidate"          // ICE candidate
+	signalOnline      = "request-stream-online"  // Requested room came online
+	signalOffline     = "request-stream-offline" // Requested room is offline
+	signalError       = "error"                  // Request rejected or negotiation failed
+)
+
+// --- Signaling Error Codes ---
+const (
+	signalErrorRoomTaken    = "room-taken"   // Room is already online with another stream
+	signalErrorNotOwner     = "not-owner"    // Room is owned by another relay
+	signalErrorUnavailable  = "unavailable"  // Room stream cannot be served without a loop or exceeding the hop limit
+	signalErrorUnauthorized = "unauthorized" // Requesting relay is not admitted to the mesh
+	signalErrorBadRequest   = "bad-request"  // Message is not valid in the current negotiation state
+	signalErrorTimeout      = "timeout"      // Negotiation did not finish in time
+	signalErrorInternal     = "internal"     // Relay failed to handle the request
+)
+
+// errInvalidSignaling is returned for received signaling messages that could not be decoded
+var errInvalidSignaling = errors.New("invalid signaling message")
+
+// --- Structs ---
+
+// signalingMessage is a stream signaling message independent of its wire format
+type signalingMessage struct {
+	Type      string
+	RoomName  string
+	SDP       webrtc.SessionDescription
+	Candidate webrtc.ICECandidateInit
+	ErrorCode string // set for error messages
+	ErrorMsg  string // human readable reason of error messages
+}
+
+// newSignalingError creates an error message for a room
+func newSignalingError(roomName, code, message string) *signalingMessage {
+	return &signalingMessage{Type: signalError, RoomName: roomName, ErrorCode: code, ErrorMsg: message}
+}
+
+// sendSignalingError replies an error over a signaling channel, only logging if that fails as the peer is likely gone
+func sendSignalingError(sig signalingChannel, roomName, code, message string) {
+	if sig == nil {
+		return // Session is not signaled over a libp2p stream
+	}
+	if err := sig.send(newSignalingError(roomName, code, message)); err != nil {
+		slog.Error("Failed to send signaling error", "room", roomName, "code", code, "err", err)
+	}
+}
+
+// signalingChannel sends and receives signaling messages over a libp2p stream
+type signalingChannel interface {
+	send(msg *signalingMessage) error
+	receive() (*signalingMessage, error)
+}
+
+// newSignalingChannel picks the wire format matching the protocol version negotiated for the stream
+func newSignalingChannel(stream network.Stream) signalingChannel {
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	switch stream.Protocol() {
+	case protocolStreamRequestV2:
+		return &protoSignaling{brw: safeBRW, roomRequestType: signalRequestRoom}
+	case protocolStreamPushV2:
+		return &protoSignaling{brw: safeBRW, roomRequestType: signalPushRoom}
+	default:
+		return &jsonSignaling{brw: safeBRW}
+	}
+}
+
+// --- JSON Signaling (1.0.0) ---
+
+// jsonSignaling is the JSON signaling of 1.0.0 protocols, kept for older clients
+type jsonSignaling struct {
+	brw *common.SafeBufioRW
+}
+
+func (js *jsonSignaling) send(msg *signalingMessage) error {
+	switch msg.Type {
+	case signalOffer, signalAnswer:
+		return js.brw.SendJSON(connections.NewMessageSDP(msg.Type, msg.SDP))
+	case signalICE:
+		return js.brw.SendJSON(connections.NewMessageICE(msg.Type, msg.Candidate))
+	case signalError:
+		return js.brw.SendJSON(connections.NewMessageError(msg.Type, msg.ErrorCode, msg.ErrorMsg, msg.RoomName))
+	default:
+		roomData, err := json.Marshal(msg.RoomName)
+		if err != nil {
+			return fmt.Errorf("failed to marshal room name: %w", err)
+		}
+		return js.brw.SendJSON(connections.NewMessageRaw(msg.Type, roomData))
+	}
+}
+
+func (js *jsonSignaling) receive() (*signalingMessage, error) {
+	data, err := js.brw.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	var baseMsg connections.MessageBase
+	if err = json.Unmarshal(data, &baseMsg); err != nil {
+		return nil, fmt.Errorf("%w: failed to unmarshal base message: %v", errInvalidSignaling, err)
+	}
+
+	msg := &signalingMessage{Type: baseMsg.Type}
+	switch baseMsg.Type {
+	case signalOffer, signalAnswer:
+		var sdpMsg connections.MessageSDP
+		if err = json.Unmarshal(data, &sdpMsg); err != nil {
+			return nil, fmt.Errorf("%w: failed to unmarshal SDP message: %v", errInvalidSignaling, err)
+		}
+		msg.SDP = sdpMsg.SDP
+	case signalICE:
+		var iceMsg connections.MessageICE
+		if err = json.Unmarshal(data, &iceMsg); err != nil {
+			return nil, fmt.Errorf("%w: failed to unmarshal ICE message: %v", errInvalidSignaling, err)
+		}
+		msg.Candidate = iceMsg.Candidate
+	case signalError:
+		var errorMsg connections.MessageError
+		if err = json.Unmarshal(data, &errorMsg); err != nil {
+			return nil, fmt.Errorf("%w: failed to unmarshal error message: %v", errInvalidSignaling, err)
+		}
+		msg.RoomName = errorMsg.RoomName
+		msg.ErrorCode = errorMsg.Code
+		msg.ErrorMsg = errorMsg.Message
+	default:
+		var rawMsg connections.MessageRaw
+		if err = json.Unmarshal(data, &rawMsg); err != nil {
+			return nil, fmt.Errorf("%w: failed to unmarshal raw message: %v", errInvalidSignaling, err)
+		}
+		if len(rawMsg.Data) > 0 {
+			if err = json.Unmarshal(rawMsg.Data, &msg.RoomName); err != nil {
+				return nil, fmt.Errorf("%w: failed to unmarshal room name: %v", errInvalidSignaling, err)
+			}
+		}
+	}
+	return msg, nil
+}
+
+// --- Protobuf Signaling (2.0.0) ---
+
+// protoSignaling is the protobuf signaling of 2.0.0 protocols
+type protoSignaling struct {
+	brw             *common.SafeBufioRW
+	roomRequestType string // message type room requests stand for, request or push
+}
+
+func (ps *protoSignaling) send(msg *signalingMessage) error {
+	envelope := &gen.SignalingMessage{}
+	switch msg.Type {
+	case signalRequestRoom, signalPushRoom:
+		envelope.Type = &gen.SignalingMessage_RoomRequest{RoomRequest: &gen.RoomRequest{RoomName: msg.RoomName}}
+	case signalPushOK:
+		envelope.Type = &gen.SignalingMessage_Accepted{Accepted: &gen.RoomStatus{RoomName: msg.RoomName}}
+	case signalOffer:
+		envelope.Type = &gen.SignalingMessage_Offer{Offer: &gen.SessionDescription{Sdp: msg.SDP.SDP}}
+	case signalAnswer:
+		envelope.Type = &gen.SignalingMessage_Answer{Answer: &gen.SessionDescription{Sdp: msg.SDP.SDP}}
+	case signalICE:
+		candidate := &gen.ICECandidateInit{
+			Candidate:        msg.Candidate.Candidate,
+			SdpMid:           msg.Candidate.SDPMid,
+			UsernameFragment: msg.Candidate.UsernameFragment,
+		}
+		if msg.Candidate.SDPMLineIndex != nil {
+			index := uint32(*msg.Candidate.SDPMLineIndex)
+			candidate.SdpMLineIndex = &index
+		}
+		envelope.Type = &gen.SignalingMessage_IceCandidate{IceCandidate: candidate}
+	case signalOnline:
+		envelope.Type = &gen.SignalingMessage_Online{Online: &gen.RoomStatus{RoomName: msg.RoomName}}
+	case signalOffline:
+		envelope.Type = &gen.SignalingMessage_Offline{Offline: &gen.RoomStatus{RoomName: msg.RoomName}}
+	case signalError:
+		envelope.Type = &gen.SignalingMessage_Error{Error: &gen.SignalingError{
+			Code:     msg.ErrorCode,
+			Message:  msg.ErrorMsg,
+			RoomName: msg.RoomName,
+		}}
+	default:
+		return fmt.Errorf("unknown signaling message type '%s'", msg.Type)
+	}
+	return ps.brw.SendProto(envelope)
+}
+
+func (ps *protoSignaling) receive() (*signalingMessage, error) {
+	var envelope gen.SignalingMessage
+	if err := ps.brw.ReceiveProto(&envelope); err != nil {
+		return nil, err
+	}
+
+	switch envelopeType := envelope.GetType().(type) {
+	case *gen.SignalingMessage_RoomRequest:
+		return &signalingMessage{Type: ps.roomRequestType, RoomName: envelopeType.RoomRequest.GetRoomName()}, nil
+	case *gen.SignalingMessage_Accepted:
+		return &signalingMessage{Type: signalPushOK, RoomName: envelopeType.Accepted.GetRoomName()}, nil
+	case *gen.SignalingMessage_Offer:
+		return &signalingMessage{Type: signalOffer, SDP: webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  envelopeType.Offer.GetSdp(),
+		}}, nil
+	case *gen.SignalingMessage_Answer:
+		return &signalingMessage{Type: signalAnswer, SDP: webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  envelopeType.Answer.GetSdp(),
+		}}, nil
+	case *gen.SignalingMessage_IceCandidate:
+		candidate := webrtc.ICECandidateInit{
+			Candidate:        envelopeType.IceCandidate.GetCandidate(),
+			SDPMid:           envelopeType.IceCandidate.SdpMid,
+			UsernameFragment: envelopeType.IceCandidate.UsernameFragment,
+		}
+		if envelopeType.IceCandidate.SdpMLineIndex != nil {
+			index := uint16(envelopeType.IceCandidate.GetSdpMLineIndex())
+			candidate.SDPMLineIndex = &index
+		}
+		return &signalingMessage{Type: signalICE, Candidate: candidate}, nil
+	case *gen.SignalingMessage_Online:
+		return &signalingMessage{Type: signalOnline, RoomName: envelopeType.Online.GetRoomName()}, nil
+	case *gen.SignalingMessage_Offline:
+		return &signalingMessage{Type: signalOffline, RoomName: envelopeType.Offline.GetRoomName()}, nil
+	case *gen.SignalingMessage_Error:
+		return newSignalingError(
+			envelopeType.Error.GetRoomName(),
+			envelopeType.Error.GetCode(),
+			envelopeType.Error.GetMessage(),
+		), nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected signaling message type", errInvalidSignaling)
+	}
+}
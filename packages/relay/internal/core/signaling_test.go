@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newBufferSignaling returns a signaling channel of given wire format which receives what it sent
+func newBufferSignaling(format, roomRequestType string) (signalingChannel, *common.SafeBufioRW) {
+	buf := &bytes.Buffer{}
+	brw := common.NewSafeBufioRW(bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf)))
+	if format == "json" {
+		return &jsonSignaling{brw: brw}, brw
+	}
+	return &protoSignaling{brw: brw, roomRequestType: roomRequestType}, brw
+}
+
+func TestSignalingRoundTrip(t *testing.T) {
+	mid, ufrag, index := "0", "abcd", uint16(1)
+	candidate := webrtc.ICECandidateInit{
+		Candidate:        "candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host",
+		SDPMid:           &mid,
+		SDPMLineIndex:    &index,
+		UsernameFragment: &ufrag,
+	}
+	messages := []*signalingMessage{
+		{Type: signalRequestRoom, RoomName: "room"},
+		{Type: signalPushOK, RoomName: "room"},
+		{Type: signalOffer, SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\n"}},
+		{Type: signalAnswer, SDP: webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\n"}},
+		{Type: signalICE, Candidate: candidate},
+		{Type: signalICE, Candidate: webrtc.ICECandidateInit{Candidate: candidate.Candidate}},
+		{Type: signalOnline, RoomName: "room"},
+		{Type: signalOffline, RoomName: "room"},
+		newSignalingError("room", signalErrorRoomTaken, "room is already online"),
+	}
+	for _, format := range []string{"json", "protobuf"} {
+		t.Run(format, func(t *testing.T) {
+			sig, _ := newBufferSignaling(format, signalRequestRoom)
+			for _, msg := range messages {
+				if err := sig.send(msg); err != nil {
+					t.Fatalf("sending %s: %v", msg.Type, err)
+				}
+				got, err := sig.receive()
+				if err != nil {
+					t.Fatalf("receiving %s: %v", msg.Type, err)
+				}
+				if !reflect.DeepEqual(got, msg) {
+					t.Errorf("received %+v, want %+v", got, msg)
+				}
+			}
+		})
+	}
+}
+
+// TestProtoSignalingRoomRequest receives room requests as the request or push the protocol stands for
+func TestProtoSignalingRoomRequest(t *testing.T) {
+	for _, roomRequestType := range []string{signalRequestRoom, signalPushRoom} {
+		sig, _ := newBufferSignaling("protobuf", roomRequestType)
+		for _, sent := range []string{signalRequestRoom, signalPushRoom} {
+			if err := sig.send(&signalingMessage{Type: sent, RoomName: "room"}); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := sig.receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != roomRequestType || msg.RoomName != "room" {
+				t.Errorf("sent %s received as %+v, want %s of room", sent, msg, roomRequestType)
+			}
+		}
+	}
+}
+
+func TestSignalingInvalid(t *testing.T) {
+	sig, brw := newBufferSignaling("json", "")
+	for _, data := range []string{`not json`, `{"payload_type":"offer","sdp":5}`, `{"payload_type":"push-stream-room","data":5}`} {
+		frame := append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+		if _, err := brw.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sig.receive(); !errors.Is(err, errInvalidSignaling) {
+			t.Errorf("receiving %s: %v, want invalid signaling", data, err)
+		}
+	}
+
+	sig, brw = newBufferSignaling("protobuf", signalRequestRoom)
+	if err := sig.send(&signalingMessage{Type: "unknown"}); err == nil {
+		t.Error("sent message of unknown type")
+	}
+	if err := brw.SendProto(&gen.SignalingMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sig.receive(); !errors.Is(err, errInvalidSignaling) {
+		t.Errorf("receiving message without type: %v, want invalid signaling", err)
+	}
+}
+
+func TestSendSignalingError(t *testing.T) {
+	sendSignalingError(nil, "room", signalErrorInternal, "no signaling") // Sessions signaled over HTTP have none
+	sendSignalingError(&recordSignaling{err: errors.New("stream reset")}, "room", signalErrorInternal, "peer gone")
+
+	sig := &recordSignaling{}
+	sendSignalingError(sig, "room", signalErrorTimeout, "no offer received")
+	want := []*signalingMessage{{Type: signalError, RoomName: "room", ErrorCode: signalErrorTimeout, ErrorMsg: "no offer received"}}
+	if messages := sig.messages(); !reflect.DeepEqual(messages, want) {
+		t.Errorf("sent %+v, want %+v", messages, want)
+	}
+}
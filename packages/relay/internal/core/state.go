@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"log/slog"
+	gen "relay/internal/proto"
 	"relay/internal/shared"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multistream"
+	"google.golang.org/protobuf/proto"
 )
 
 // --- PubSub Message Handlers ---
@@ -37,14 +41,23 @@ func (r *Relay) handleRoomStateMessages(ctx context.Context, sub *pubsub.Subscri
 			if msg.GetFrom() == r.Host.ID() {
 				continue
 			}
+			if !r.isRelayAdmitted(msg.GetFrom()) {
+				slog.Debug("Ignoring room state from relay not admitted to mesh", "from", msg.GetFrom())
+				continue
+			}
 
-			var states []shared.RoomInfo
-			if err := json.Unmarshal(msg.Data, &states); err != nil {
-				slog.Error("Failed to unmarshal room states", "from", msg.GetFrom(), "data_len", len(msg.Data), "err", err)
+			var meshMsg gen.MeshMessage
+			if err := proto.Unmarshal(msg.Data, &meshMsg); err != nil {
+				slog.Error("Failed to unmarshal room state message", "from", msg.GetFrom(), "data_len", len(msg.Data), "err", err)
 				continue
 			}
 
-			r.updateMeshRoomStates(msg.GetFrom(), states)
+			switch meshMsgType := meshMsg.GetType().(type) {
+			case *gen.MeshMessage_StateUpdate:
+				r.onStateUpdate(msg.GetFrom(), meshMsgType.StateUpdate)
+			default:
+				slog.Warn("Unexpected message type on room state topic", "from", msg.GetFrom(), "type", meshMsgType)
+			}
 		}
 	}
 }
@@ -81,6 +94,14 @@ func (r *Relay) handleRelayMetricsMessages(ctx context.Context, sub *pubsub.Subs
 				slog.Error("Peer ID mismatch in relay status", "expected", info.ID, "actual", msg.GetFrom())
 				continue
 			}
+			var approvals map[string]string
+			if info.Approvals != nil {
+				approvals = info.Approvals.Copy()
+			}
+			if err := r.admitRelay(info.ID, approvals); err != nil {
+				slog.Debug("Ignoring relay status from relay not admitted to mesh", "from", msg.GetFrom(), "err", err)
+				continue
+			}
 			r.onPeerStatus(info)
 		}
 	}
@@ -106,25 +127,31 @@ func (r *Relay) onPeerStatus(recvInfo RelayInfo) {
 	r.LocalMeshPeers.Set(recvInfo.ID, &recvInfo)
 }
 
-// onPeerConnected is called when a new peer connects to the relay
+// onPeerConnected is called when a new peer connects to the relay, joining the mesh through it
 func (r *Relay) onPeerConnected(peerID peer.ID) {
-	// Add to local peer map
-	r.LocalMeshPeers.Set(peerID, &RelayInfo{
-		ID: peerID,
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	err := r.HandshakeProtocol.Handshake(ctx, peerID)
+	cancel()
+	if err != nil {
+		// Peers not speaking the handshake protocol are clients, not relays
+		var protoErr multistream.ErrNotSupported[protocol.ID]
+		if errors.As(err, &protoErr) {
+			return
+		}
+		slog.Warn("Mesh handshake with peer failed", "peer", peerID, "err", err)
+		return
+	}
 
 	slog.Info("Peer connected", "peer", peerID)
 
 	// Trigger immediate state exchange
-	go func() {
-		if err := r.publishRelayMetrics(context.Background()); err != nil {
-			slog.Error("Failed to publish relay metrics on connect", "err", err)
-		} else {
-			if err = r.publishRoomStates(context.Background()); err != nil {
-				slog.Error("Failed to publish room states on connect", "err", err)
-			}
+	if err = r.publishRelayMetrics(context.Background()); err != nil {
+		slog.Error("Failed to publish relay metrics on connect", "err", err)
+	} else {
+		if err = r.publishRoomStates(context.Background()); err != nil {
+			slog.Error("Failed to publish room states on connect", "err", err)
 		}
-	}()
+	}
 }
 
 // onPeerDisconnected marks a peer as disconnected in our status view and removes latency info
@@ -135,39 +162,96 @@ func (r *Relay) onPeerDisconnected(peerID peer.ID) {
 		r.LocalMeshPeers.Delete(peerID)
 	}
 	// Remove any rooms associated with this peer
-	if r.MeshRooms.Has(peerID.String()) {
-		r.MeshRooms.Delete(peerID.String())
+	r.MeshRooms.RemoveOwnedBy(peerID)
+	// Pull streams we received through this peer from elsewhere
+	r.StreamProtocol.closeUpstream(peerID)
+	// Peer has to present its credentials again on reconnect
+	r.forgetRelay(peerID)
+	// Forget state sequence of this peer, it starts over on reconnect
+	if r.peerStateSequences.Has(peerID) {
+		r.peerStateSequences.Delete(peerID)
 	}
 	// Remove any latencies associated with this peer
-	if r.LocalMeshPeers.Has(peerID) {
-		r.LocalMeshPeers.Delete(peerID)
-	}
+	r.MeshLatencies.Delete(peerID.String())
 
 	// TODO: If any rooms were routed through this peer, handle that case
 }
 
-// updateMeshRoomStates merges received room states into the MeshRooms map
-// TODO: Wrap in another type with timestamp or another mechanism to avoid conflicts
-func (r *Relay) updateMeshRoomStates(peerID peer.ID, states []shared.RoomInfo) {
-	for _, state := range states {
-		if state.OwnerID == r.ID {
+// updateMeshRoomStates merges received room entity states into the MeshRooms registry
+func (r *Relay) updateMeshRoomStates(peerID peer.ID, entities map[string]*gen.EntityState) {
+	for _, entity := range entities {
+		if entity.GetEntityType() != entityTypeRoom {
+			continue
+		}
+		ownerID, err := peer.Decode(entity.GetOwnerRelayId())
+		if err != nil {
+			slog.Error("Failed to decode room owner ID from state", "room_name", entity.GetEntityId(), "peer", peerID, "err", err)
+			continue
+		}
+		if ownerID == r.ID {
+			continue
+		}
+
+		state := shared.RoomInfo{
+			Name:    entity.GetEntityId(),
+			OwnerID: ownerID,
+			Version: entity.GetVersion(),
+		}
+
+		applied, prev, prevLive := r.MeshRooms.Merge(state, !entity.GetActive())
+		if !applied {
+			slog.Debug("Ignoring superseded room state", "room_name", state.Name, "owner", ownerID, "version", state.Version, "current_owner", prev.OwnerID, "current_version", prev.Version)
+			continue
+		}
+		if !entity.GetActive() {
+			continue
+		}
+
+		// Our own claim on this room lost to another relay
+		if prevLive && prev.OwnerID == r.ID {
+			r.onRoomOwnershipLost(state)
+		}
+
+		// Viewers are waiting for this room, start pulling it
+		if r.StreamProtocol.waiting.has(state.Name) {
+			r.pullRoomForWaiting(state.Name)
 			continue
 		}
 
 		// If previously did not exist, but does now, request a connection if participants exist for our room
-		existed := r.MeshRooms.Has(state.ID.String())
-		if !existed {
-			// Request connection to this peer if we have participants in our local room
-			if room, ok := r.LocalRooms.Get(state.ID); ok {
+		if !prevLive || prev.OwnerID != ownerID {
+			// Request connection to nearest relay carrying the stream if we have participants in our local room
+			if room := r.GetRoomByName(state.Name); room != nil {
 				if room.Participants.Len() > 0 {
-					slog.Debug("Got new remote room state, we locally have participants for, requesting stream", "room_name", room.Name, "peer", peerID)
-					if err := r.StreamProtocol.RequestStream(context.Background(), room, peerID); err != nil {
-						slog.Error("Failed to request stream for new remote room state", "room_name", room.Name, "peer", peerID, "err", err)
+					route, err := r.routeStream(room.Name, "")
+					if err != nil {
+						slog.Error("Failed to route stream for new remote room state", "room_name", room.Name, "err", err)
+						continue
 					}
+					slog.Debug("Got new remote room state, we locally have participants for, requesting stream", "room_name", room.Name, "peer", peerID, "source", route.Source)
+					go func() {
+						if err := r.StreamProtocol.RequestStream(context.Background(), room, route.Source); err != nil {
+							slog.Error("Failed to request stream for new remote room state", "room_name", room.Name, "peer", route.Source, "err", err)
+						}
+					}()
 				}
 			}
 		}
+	}
+}
 
-		r.MeshRooms.Set(state.ID.String(), state)
+// onRoomOwnershipLost demotes our local room after a conflicting claim from another relay won
+func (r *Relay) onRoomOwnershipLost(winner shared.RoomInfo) {
+	room := r.GetRoomByName(winner.Name)
+	if room == nil || room.OwnerID != r.ID {
+		return
 	}
+
+	slog.Warn("Lost room ownership conflict to another relay", "room", room.Name, "owner", winner.OwnerID, "version", winner.Version, "local_version", room.Version)
+	room.OwnerID = winner.OwnerID
+	room.Version = winner.Version
+
+	// Our ingest for this room is no longer authoritative
+	r.StreamProtocol.closeIncoming(room.Name)
+	r.publishRoomStatesAsync()
 }
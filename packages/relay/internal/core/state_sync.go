@@ -0,0 +1,278 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	gen "relay/internal/proto"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Structs ---
+
+// stateHistory keeps the sequenced StateUpdates sent by this relay, bounded to a fixed size
+type stateHistory struct {
+	mutex    sync.RWMutex
+	sequence uint64                      // Sequence number of the latest sent update
+	updates  []*gen.StateUpdate          // Ring buffer of sent updates, indexed by sequence number
+	entities map[string]*gen.EntityState // Last published state of each entity, for deltas and snapshots
+}
+
+func newStateHistory(size int) *stateHistory {
+	return &stateHistory{
+		updates:  make([]*gen.StateUpdate, size),
+		entities: make(map[string]*gen.EntityState),
+	}
+}
+
+// next diffs current entities against last published ones and returns the next sequenced update, nil if nothing changed
+func (sh *stateHistory) next(current map[string]*gen.EntityState) *gen.StateUpdate {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	delta := make(map[string]*gen.EntityState)
+	for id, entity := range current {
+		if prev, ok := sh.entities[id]; !ok || !proto.Equal(prev, entity) {
+			delta[id] = entity
+		}
+	}
+	for id, prev := range sh.entities {
+		if _, ok := current[id]; !ok {
+			// Entity is gone, publish it as inactive so peers can drop it
+			removed := proto.Clone(prev).(*gen.EntityState)
+			removed.Active = false
+			delta[id] = removed
+		}
+	}
+	if len(delta) == 0 {
+		return nil
+	}
+
+	sh.sequence++
+	update := &gen.StateUpdate{
+		SequenceNumber: sh.sequence,
+		Entities:       delta,
+	}
+	sh.updates[sh.sequence%uint64(len(sh.updates))] = update
+
+	sh.entities = make(map[string]*gen.EntityState, len(current))
+	for id, entity := range current {
+		sh.entities[id] = entity
+	}
+
+	return update
+}
+
+// get returns a sent update by its sequence number, if it's still kept in history
+func (sh *stateHistory) get(sequence uint64) (*gen.StateUpdate, bool) {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	if sequence == 0 || sequence > sh.sequence {
+		return nil, false
+	}
+	update := sh.updates[sequence%uint64(len(sh.updates))]
+	if update == nil || update.GetSequenceNumber() != sequence {
+		return nil, false
+	}
+	return update, true
+}
+
+// latest returns the sequence number of the latest sent update
+func (sh *stateHistory) latest() uint64 {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	return sh.sequence
+}
+
+// snapshot returns the full published state at the latest sequence number
+func (sh *stateHistory) snapshot() *gen.StateUpdate {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	entities := make(map[string]*gen.EntityState, len(sh.entities))
+	for id, entity := range sh.entities {
+		entities[id] = entity
+	}
+	return &gen.StateUpdate{
+		SequenceNumber: sh.sequence,
+		Entities:       entities,
+	}
+}
+
+// peerStateSequence tracks the state updates applied from a single mesh peer
+type peerStateSequence struct {
+	mutex       sync.Mutex
+	synced      bool                        // Whether a baseline state has been received from the peer
+	lastApplied uint64                      // Sequence number of the latest applied update
+	pending     map[uint64]*gen.StateUpdate // Out-of-order updates waiting for a gap to be filled
+	requesting  bool                        // Whether a retransmission request is in flight
+}
+
+func newPeerStateSequence() *peerStateSequence {
+	return &peerStateSequence{
+		pending: make(map[uint64]*gen.StateUpdate),
+	}
+}
+
+// --- State Sequencing ---
+
+// getPeerStateSequence returns the sequence tracker of a peer, creating it if needed
+func (r *Relay) getPeerStateSequence(peerID peer.ID) *peerStateSequence {
+	return r.peerStateSequences.GetOrCreate(peerID, newPeerStateSequence)
+}
+
+// onStateUpdate applies a sequenced StateUpdate from a peer, requesting retransmission if updates were missed
+func (r *Relay) onStateUpdate(peerID peer.ID, update *gen.StateUpdate) {
+	seqState := r.getPeerStateSequence(peerID)
+	seqState.mutex.Lock()
+	defer seqState.mutex.Unlock()
+
+	sequence := update.GetSequenceNumber()
+	isAnnounce := len(update.GetEntities()) == 0
+
+	if !seqState.synced {
+		if sequence == 0 {
+			// Peer has not published anything yet, which is our baseline
+			seqState.synced = true
+			return
+		}
+		if !isAnnounce {
+			seqState.pending[sequence] = update
+		}
+		r.requestStateRetransmission(peerID, seqState, nil)
+		return
+	}
+
+	if sequence <= seqState.lastApplied {
+		return // Duplicate, old or announce of already applied update
+	}
+	if !isAnnounce {
+		seqState.pending[sequence] = update
+	}
+	r.applyPendingStateUpdates(peerID, seqState)
+
+	// Anything still missing up to this sequence number was lost on the way
+	var missing []uint64
+	for seq := seqState.lastApplied + 1; seq <= sequence; seq++ {
+		if _, ok := seqState.pending[seq]; !ok {
+			missing = append(missing, seq)
+		}
+	}
+	if len(missing) > 0 {
+		slog.Debug("Detected missed state updates from peer", "peer", peerID, "last_applied", seqState.lastApplied, "missing", len(missing))
+		if len(missing) > maxStateGap {
+			missing = nil // Too far behind, ask for a snapshot instead
+		}
+		r.requestStateRetransmission(peerID, seqState, missing)
+	}
+}
+
+// applyPendingStateUpdates applies consecutive pending updates in order, must hold seqState.mutex
+func (r *Relay) applyPendingStateUpdates(peerID peer.ID, seqState *peerStateSequence) {
+	for {
+		update, ok := seqState.pending[seqState.lastApplied+1]
+		if !ok {
+			return
+		}
+		delete(seqState.pending, update.GetSequenceNumber())
+		r.updateMeshRoomStates(peerID, update.GetEntities())
+		seqState.lastApplied = update.GetSequenceNumber()
+	}
+}
+
+// applyStateSnapshot replaces all state known from a peer with a full snapshot, must hold seqState.mutex
+func (r *Relay) applyStateSnapshot(peerID peer.ID, seqState *peerStateSequence, snapshot *gen.StateUpdate) {
+	r.MeshRooms.RemoveOwnedBy(peerID)
+	r.updateMeshRoomStates(peerID, snapshot.GetEntities())
+
+	seqState.synced = true
+	seqState.lastApplied = snapshot.GetSequenceNumber()
+	for seq := range seqState.pending {
+		if seq <= seqState.lastApplied {
+			delete(seqState.pending, seq)
+		}
+	}
+	r.applyPendingStateUpdates(peerID, seqState)
+}
+
+// requestStateRetransmission asynchronously requests missed updates (or a snapshot if nil) from a peer, must hold seqState.mutex
+func (r *Relay) requestStateRetransmission(peerID peer.ID, seqState *peerStateSequence, missing []uint64) {
+	if seqState.requesting {
+		return // Next update or announce will retry for anything still missing
+	}
+	seqState.requesting = true
+
+	requested := missing
+	if len(requested) == 0 {
+		requested = []uint64{0} // Sequence number 0 requests a full snapshot
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stateRequestTimeout)
+		defer cancel()
+
+		retransmissions, err := r.StateProtocol.RequestRetransmission(ctx, peerID, requested)
+
+		seqState.mutex.Lock()
+		defer seqState.mutex.Unlock()
+		seqState.requesting = false
+
+		if err != nil {
+			slog.Error("Failed to request state retransmission", "peer", peerID, "err", err)
+			return
+		}
+
+		// Retransmissions not matching the requested sequence number are snapshots, apply latest of those first
+		var snapshot *gen.StateUpdate
+		for i, retransmission := range retransmissions {
+			update := retransmission.GetStateUpdate()
+			if update == nil {
+				continue
+			}
+			if update.GetSequenceNumber() != requested[i] {
+				if snapshot == nil || update.GetSequenceNumber() > snapshot.GetSequenceNumber() {
+					snapshot = update
+				}
+			} else if update.GetSequenceNumber() > seqState.lastApplied {
+				seqState.pending[update.GetSequenceNumber()] = update
+			}
+		}
+		if snapshot != nil {
+			r.applyStateSnapshot(peerID, seqState, snapshot)
+		} else {
+			r.applyPendingStateUpdates(peerID, seqState)
+		}
+
+		if len(seqState.pending) > 0 {
+			slog.Debug("State updates still pending after retransmission", "peer", peerID, "last_applied", seqState.lastApplied, "pending", len(seqState.pending))
+		}
+	}()
+}
+
+// periodicStateAnnouncer periodically publishes room states, announcing the latest sequence number if nothing changed
+func (r *Relay) periodicStateAnnouncer(ctx context.Context) {
+	ticker := time.NewTicker(stateAnnounceInterval)
+	defer ticker.Stop()
+	gcTicker := time.NewTicker(tombstoneGCInterval)
+	defer gcTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping state announcer")
+			return
+		case <-ticker.C:
+			if err := r.publishRoomStates(ctx); err != nil {
+				slog.Error("Failed to announce room states", "err", err)
+			}
+		case <-gcTicker.C:
+			if collected := r.MeshRooms.CollectTombstones(tombstoneTTL); collected > 0 {
+				slog.Debug("Garbage collected room tombstones", "count", collected)
+			}
+		}
+	}
+}
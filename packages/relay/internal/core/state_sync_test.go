@@ -0,0 +1,217 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	gen "relay/internal/proto"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// roomEntities returns the published state of active rooms owned by a relay, all at the given version
+func roomEntities(owner peer.ID, version uint64, names ...string) map[string]*gen.EntityState {
+	entities := make(map[string]*gen.EntityState, len(names))
+	for _, name := range names {
+		entities[name] = &gen.EntityState{
+			EntityType:   entityTypeRoom,
+			EntityId:     name,
+			Active:       true,
+			OwnerRelayId: owner.String(),
+			Version:      version,
+		}
+	}
+	return entities
+}
+
+func TestStateHistory(t *testing.T) {
+	sh := newStateHistory(4)
+	owner := peer.ID("owner")
+
+	if update := sh.next(nil); update != nil {
+		t.Errorf("published update %v without any state", update)
+	}
+	first := sh.next(roomEntities(owner, 1, "a", "b"))
+	if first.GetSequenceNumber() != 1 || len(first.GetEntities()) != 2 {
+		t.Fatalf("first update is %v, want both rooms at sequence 1", first)
+	}
+	if update := sh.next(roomEntities(owner, 1, "a", "b")); update != nil {
+		t.Errorf("published update %v without changes", update)
+	}
+
+	// Only changed and removed entities are sent, removed ones as inactive
+	current := roomEntities(owner, 1, "a")
+	current["c"] = roomEntities(owner, 2, "c")["c"]
+	second := sh.next(current)
+	if second.GetSequenceNumber() != 2 || len(second.GetEntities()) != 2 {
+		t.Fatalf("second update is %v, want rooms b and c at sequence 2", second)
+	}
+	if removed := second.GetEntities()["b"]; removed == nil || removed.GetActive() {
+		t.Errorf("removed room published as %v, want it inactive", removed)
+	}
+	if added := second.GetEntities()["c"]; added == nil || !added.GetActive() {
+		t.Errorf("added room published as %v, want it active", added)
+	}
+	if snapshot := sh.snapshot(); snapshot.GetSequenceNumber() != 2 || len(snapshot.GetEntities()) != 2 {
+		t.Errorf("snapshot is %v, want rooms a and c at sequence 2", snapshot)
+	}
+
+	// Updates are kept until the ring wraps around
+	for version := uint64(3); version <= 5; version++ {
+		sh.next(roomEntities(owner, version, "a"))
+	}
+	if latest := sh.latest(); latest != 5 {
+		t.Fatalf("latest sequence %d, want 5", latest)
+	}
+	for _, test := range []struct {
+		sequence uint64
+		kept     bool
+	}{
+		{0, false}, // Requests a snapshot instead
+		{1, false}, // Overwritten by 5
+		{2, true},
+		{5, true},
+		{6, false}, // Not sent yet
+	} {
+		update, ok := sh.get(test.sequence)
+		if ok != test.kept || ok && update.GetSequenceNumber() != test.sequence {
+			t.Errorf("get(%d) = %v, %v, want kept %v", test.sequence, update, ok, test.kept)
+		}
+	}
+}
+
+// newTestStatePeers returns a publishing relay connected to a relay receiving its state updates
+func newTestStatePeers(t *testing.T) (*Relay, *Relay) {
+	t.Helper()
+	publisher, receiver := newTestRelay(t), newTestRelay(t)
+	if err := receiver.Host.Connect(context.Background(), peer.AddrInfo{ID: publisher.ID, Addrs: publisher.Host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	return publisher, receiver
+}
+
+// awaitStateSequence waits until all updates of a peer up to a sequence number are applied and no request is in flight
+func awaitStateSequence(t *testing.T, r *Relay, peerID peer.ID, sequence uint64) {
+	t.Helper()
+	seqState := r.getPeerStateSequence(peerID)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		seqState.mutex.Lock()
+		synced, applied, requesting := seqState.synced, seqState.lastApplied, seqState.requesting
+		seqState.mutex.Unlock()
+		if synced && applied >= sequence && !requesting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("applied updates up to %d (synced %v), want %d", applied, synced, sequence)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func hasMeshRooms(r *Relay, names ...string) bool {
+	for _, name := range names {
+		if !r.MeshRooms.Has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestStateUpdateGap loses an update on the way, the receiver has to request it back from the publisher
+func TestStateUpdateGap(t *testing.T) {
+	publisher, receiver := newTestStatePeers(t)
+
+	receiver.onStateUpdate(publisher.ID, &gen.StateUpdate{}) // Announce of nothing published yet
+	awaitStateSequence(t, receiver, publisher.ID, 0)
+
+	first := publisher.stateHistory.next(roomEntities(publisher.ID, 1, "a"))
+	lost := publisher.stateHistory.next(roomEntities(publisher.ID, 2, "a", "b"))
+	third := publisher.stateHistory.next(roomEntities(publisher.ID, 3, "a", "b", "c"))
+	receiver.onStateUpdate(publisher.ID, first)
+	receiver.onStateUpdate(publisher.ID, third)
+	awaitStateSequence(t, receiver, publisher.ID, third.GetSequenceNumber())
+	if !hasMeshRooms(receiver, "a", "b", "c") {
+		t.Errorf("mesh rooms %v after recovering update %d, want a, b and c", receiver.MeshRooms.Copy(), lost.GetSequenceNumber())
+	}
+
+	// Duplicates and updates announced only are ignored once applied
+	receiver.onStateUpdate(publisher.ID, lost)
+	receiver.onStateUpdate(publisher.ID, &gen.StateUpdate{SequenceNumber: third.GetSequenceNumber()})
+	seqState := receiver.getPeerStateSequence(publisher.ID)
+	seqState.mutex.Lock()
+	defer seqState.mutex.Unlock()
+	if seqState.lastApplied != third.GetSequenceNumber() || len(seqState.pending) != 0 || seqState.requesting {
+		t.Errorf("applied %d with %d pending after duplicates, want %d with nothing pending", seqState.lastApplied, len(seqState.pending), third.GetSequenceNumber())
+	}
+}
+
+// TestStateSnapshotFallback joins a receiver late and lets it fall too far behind, both times it has to
+// recover from a full snapshot
+func TestStateSnapshotFallback(t *testing.T) {
+	publisher, receiver := newTestStatePeers(t)
+
+	for version := uint64(1); version <= 3; version++ {
+		publisher.stateHistory.next(roomEntities(publisher.ID, version, "a"))
+	}
+	latest := publisher.stateHistory.next(roomEntities(publisher.ID, 4, "a", "b"))
+
+	// Receiver was not synced yet, the first update it hears of makes it request a snapshot
+	receiver.onStateUpdate(publisher.ID, &gen.StateUpdate{SequenceNumber: latest.GetSequenceNumber()})
+	awaitStateSequence(t, receiver, publisher.ID, latest.GetSequenceNumber())
+	if !hasMeshRooms(receiver, "a", "b") {
+		t.Fatalf("mesh rooms %v after snapshot, want a and b", receiver.MeshRooms.Copy())
+	}
+
+	// Gaps larger than the limit are recovered from a snapshot, dropping rooms no longer published
+	var update *gen.StateUpdate
+	for version := uint64(5); version <= 5+maxStateGap; version++ {
+		update = publisher.stateHistory.next(roomEntities(publisher.ID, version, "c"))
+	}
+	receiver.onStateUpdate(publisher.ID, update)
+	awaitStateSequence(t, receiver, publisher.ID, update.GetSequenceNumber())
+	if !hasMeshRooms(receiver, "c") || receiver.MeshRooms.Has("a") || receiver.MeshRooms.Has("b") {
+		t.Errorf("mesh rooms %v after snapshot, want only c", receiver.MeshRooms.Copy())
+	}
+}
+
+// TestRequestRetransmission asks for kept, evicted and snapshot sequence numbers over the state sync protocol
+func TestRequestRetransmission(t *testing.T) {
+	publisher, receiver := newTestStatePeers(t)
+	for version := uint64(1); version <= stateHistorySize+2; version++ {
+		publisher.stateHistory.next(roomEntities(publisher.ID, version, "a"))
+	}
+	latest := publisher.stateHistory.latest()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	requested := []uint64{latest, 1, 0}
+	retransmissions, err := receiver.StateProtocol.RequestRetransmission(ctx, publisher.ID, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retransmissions) != len(requested) {
+		t.Fatalf("got %d retransmissions for %d requests", len(retransmissions), len(requested))
+	}
+	for i, want := range []uint64{latest, latest, latest} {
+		retransmission := retransmissions[i]
+		if retransmission.GetRelayId() != publisher.ID.String() || retransmission.GetStateUpdate().GetSequenceNumber() != want {
+			t.Errorf("retransmission of %d is %v, want sequence %d from the publisher", requested[i], retransmission, want)
+		}
+	}
+	// Snapshots carry the full state, retransmitted updates only their changes
+	if entities := retransmissions[1].GetStateUpdate().GetEntities(); len(entities) != 1 || entities["a"].GetVersion() != latest {
+		t.Errorf("snapshot entities %v, want room a at version %d", entities, latest)
+	}
+
+	// Relays not admitted to the mesh are refused
+	meshKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.admission.meshKey = meshKey
+	if _, err = receiver.StateProtocol.RequestRetransmission(ctx, publisher.ID, []uint64{latest}); err == nil {
+		t.Error("relay not admitted to the mesh got retransmissions")
+	}
+}
@@ -0,0 +1,369 @@
+package core
+
+import (
+	"relay/internal/common"
+	"relay/internal/shared"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Snapshots ---
+
+// RTPStats is a snapshot of the counters of an RTP stream
+type RTPStats struct {
+	Packets     uint64        `json:"packets"`
+	Bytes       uint64        `json:"bytes"`
+	Bitrate     float64       `json:"bitrate"` // bits per second, over the last measurement window
+	PacketsLost uint64        `json:"packets_lost"`
+	LossRate    float64       `json:"loss_rate"` // fraction of packets lost, over the last measurement window
+	Jitter      time.Duration `json:"jitter"`    // interarrival jitter
+}
+
+// ViewerTrackStats is a snapshot of a track sent to a viewer, loss and jitter are as reported by the viewer
+type ViewerTrackStats struct {
+	RTPStats
+	RTT           time.Duration `json:"rtt"`
+	Dropped       uint64        `json:"dropped"`         // packets not sent for falling behind
+	Retransmitted uint64        `json:"retransmitted"`   // packets resent on NACK
+	Unrepaired    uint64        `json:"unrepaired"`      // NACKed packets no longer kept or never received
+	Layer         *shared.Layer `json:"layer,omitempty"` // forwarded of layered video
+}
+
+// ViewerStats is a snapshot of the tracks sent to a viewer of a room
+type ViewerStats struct {
+	ParticipantID    ulid.ULID        `json:"participant_id"`
+	Audio            ViewerTrackStats `json:"audio"`
+	Video            ViewerTrackStats `json:"video"`
+	EstimatedBitrate float64          `json:"estimated_bitrate"` // bits per second, congestion control estimate of what can be sent
+}
+
+// RoomStats is a snapshot of the tracks a room receives from upstream and sends to its viewers
+type RoomStats struct {
+	Room    string        `json:"room"`
+	Audio   RTPStats      `json:"audio"`
+	Video   RTPStats      `json:"video"`
+	Viewers []ViewerStats `json:"viewers"`
+}
+
+// TrafficSummary sums up the media moved by a relay, shared with the mesh in metrics
+type TrafficSummary struct {
+	Rooms          int     `json:"rooms"`
+	Viewers        int     `json:"viewers"`
+	IngressBitrate float64 `json:"ingress_bitrate"`    // bits per second received for rooms
+	EgressBitrate  float64 `json:"egress_bitrate"`     // bits per second sent to viewers
+	WorstIngress   float64 `json:"worst_ingress_loss"` // highest loss rate of a received room track
+	WorstViewer    float64 `json:"worst_viewer_loss"`  // highest loss rate reported by a viewer
+}
+
+// --- Counters ---
+
+// rateWindow measures bitrate and loss rate over windows of statsWindow
+type rateWindow struct {
+	start    time.Time
+	bytes    uint64
+	packets  uint64
+	lost     uint64
+	bitrate  float64
+	lossRate float64
+}
+
+func (w *rateWindow) add(now time.Time, bytes, packets, lost uint64) {
+	if w.start.IsZero() {
+		w.start = now
+	}
+	w.bytes += bytes
+	w.packets += packets
+	w.lost += lost
+	if elapsed := now.Sub(w.start); elapsed >= statsWindow {
+		bitrate := float64(w.bytes*8) / elapsed.Seconds()
+		lossRate := 0.0
+		if total := w.packets + w.lost; total > 0 {
+			lossRate = float64(w.lost) / float64(total)
+		}
+		*w = rateWindow{start: now, bitrate: bitrate, lossRate: lossRate}
+	}
+}
+
+// current returns the bitrate and loss rate of the last window, zero if the stream stalled since
+func (w *rateWindow) current(now time.Time) (float64, float64) {
+	if w.start.IsZero() || now.Sub(w.start) > 2*statsWindow {
+		return 0, 0
+	}
+	return w.bitrate, w.lossRate
+}
+
+// rtpCounters counts the packets of an RTP stream received for a room track
+type rtpCounters struct {
+	mutex       sync.Mutex
+	packets     uint64
+	bytes       uint64
+	lost        uint64 // from sequence number gaps, reduced by packets arriving late
+	started     bool
+	ssrc        uint32 // restarts sequence and jitter tracking when another simulcast encoding becomes primary
+	highestSeq  uint16
+	clockRate   uint32
+	lastArrival float64 // arrival time of last packet in timestamp units, relative to epoch
+	lastTS      uint32
+	jitter      float64 // in timestamp units (RFC 3550)
+	epoch       time.Time
+	window      rateWindow
+}
+
+func newRTPCounters() *rtpCounters {
+	return &rtpCounters{epoch: time.Now()}
+}
+
+// onPacket counts a received packet of a stream of given clock rate
+func (c *rtpCounters) onPacket(packet *rtp.Packet, clockRate uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	size := uint64(packet.MarshalSize())
+	c.packets++
+	c.bytes += size
+
+	var lost uint64
+	restarted := !c.started || c.clockRate != clockRate || c.ssrc != packet.SSRC
+	if restarted {
+		c.started = true
+		c.ssrc = packet.SSRC
+		c.highestSeq = packet.SequenceNumber
+		c.clockRate = clockRate
+		c.jitter = 0
+	} else if diff := int16(packet.SequenceNumber - c.highestSeq); diff > 0 {
+		lost = uint64(diff - 1)
+		c.lost += lost
+		c.highestSeq = packet.SequenceNumber
+	} else if c.lost > 0 {
+		c.lost-- // Reordered or retransmitted, was counted as lost before
+	}
+
+	arrival := now.Sub(c.epoch).Seconds() * float64(clockRate)
+	if !restarted {
+		d := (arrival - c.lastArrival) - float64(int32(packet.Timestamp-c.lastTS))
+		if d < 0 {
+			d = -d
+		}
+		c.jitter += (d - c.jitter) / 16
+	}
+	c.lastArrival = arrival
+	c.lastTS = packet.Timestamp
+	c.window.add(now, size, 1, lost)
+}
+
+func (c *rtpCounters) snapshot(now time.Time) RTPStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := RTPStats{
+		Packets:     c.packets,
+		Bytes:       c.bytes,
+		PacketsLost: c.lost,
+	}
+	stats.Bitrate, stats.LossRate = c.window.current(now)
+	if c.clockRate > 0 {
+		stats.Jitter = time.Duration(c.jitter / float64(c.clockRate) * float64(time.Second))
+	}
+	return stats
+}
+
+// viewerTrack keeps the latest receiver report of a viewer for a track sent to it
+type viewerTrack struct {
+	report    rtcp.ReceptionReport
+	rtt       time.Duration
+	sentBytes uint64 // sent bytes at the last bitrate measurement
+	sentAt    time.Time
+	bitrate   float64
+}
+
+// viewerStats keeps the feedback of a viewer about the tracks sent to it
+type viewerStats struct {
+	mutex  sync.Mutex
+	tracks map[webrtc.RTPCodecType]*viewerTrack
+}
+
+func newViewerStats() *viewerStats {
+	return &viewerStats{tracks: make(map[webrtc.RTPCodecType]*viewerTrack)}
+}
+
+// track returns the stats of the track of given kind, must hold vs.mutex
+func (vs *viewerStats) track(kind webrtc.RTPCodecType) *viewerTrack {
+	vt, ok := vs.tracks[kind]
+	if !ok {
+		vt = &viewerTrack{}
+		vs.tracks[kind] = vt
+	}
+	return vt
+}
+
+// onReceiverReport records the report block of a receiver report of the viewer about the track of given kind,
+// sent with given SSRC. Blocks about other streams, like RTX, are skipped. Returns the recorded block, false if none
+func (vs *viewerStats) onReceiverReport(kind webrtc.RTPCodecType, ssrc webrtc.SSRC, reports []rtcp.ReceptionReport) (rtcp.ReceptionReport, bool) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	for _, report := range reports {
+		if report.SSRC != uint32(ssrc) {
+			continue
+		}
+		vt := vs.track(kind)
+		vt.report = report
+		// Round trip is the time since the sender report was sent, minus the time the viewer held it.
+		// Zero if the viewer has not seen our sender reports yet
+		if report.LastSenderReport != 0 {
+			if rtt := ntpMiddle(time.Now()) - report.LastSenderReport - report.Delay; int32(rtt) >= 0 {
+				vt.rtt = time.Duration(uint64(rtt) * uint64(time.Second) >> 16)
+			}
+		}
+		return report, true
+	}
+	return rtcp.ReceptionReport{}, false
+}
+
+// snapshot returns the stats of the track of given kind, with the counts sent to the viewer so far
+func (vs *viewerStats) snapshot(kind webrtc.RTPCodecType, clockRate uint32, packets, bytes uint64, now time.Time) ViewerTrackStats {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	vt := vs.track(kind)
+	if elapsed := now.Sub(vt.sentAt); vt.sentAt.IsZero() || elapsed >= statsWindow {
+		if !vt.sentAt.IsZero() && bytes >= vt.sentBytes {
+			vt.bitrate = float64((bytes-vt.sentBytes)*8) / elapsed.Seconds()
+		}
+		vt.sentBytes = bytes
+		vt.sentAt = now
+	}
+	stats := ViewerTrackStats{
+		RTPStats: RTPStats{
+			Packets:     packets,
+			Bytes:       bytes,
+			Bitrate:     vt.bitrate,
+			PacketsLost: uint64(vt.report.TotalLost),
+			LossRate:    float64(vt.report.FractionLost) / 256,
+		},
+		RTT: vt.rtt,
+	}
+	if clockRate > 0 {
+		stats.Jitter = time.Duration(float64(vt.report.Jitter) / float64(clockRate) * float64(time.Second))
+	}
+	return stats
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp of t, the format of sender report references
+func ntpMiddle(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + 2208988800 // NTP epoch is 1900
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction>>16)
+}
+
+// --- Collection ---
+
+// getIngressStats returns the counters of the track of a kind received for a room, creating them if needed
+func (sp *StreamProtocol) getIngressStats(roomName string, kind webrtc.RTPCodecType) *rtpCounters {
+	return sp.ingressStats.GetOrCreate(roomName+"/"+kind.String(), newRTPCounters)
+}
+
+// forgetIngressStats drops the counters of the tracks received for a room
+func (sp *StreamProtocol) forgetIngressStats(roomName string) {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		sp.ingressStats.Delete(roomName + "/" + kind.String())
+	}
+}
+
+// getViewerStats returns the stats of a served participant, creating them if needed
+func (sp *StreamProtocol) getViewerStats(participantID ulid.ULID) *viewerStats {
+	return sp.viewerStats.GetOrCreate(participantID, newViewerStats)
+}
+
+// --- Relay API ---
+
+// RoomStats returns a snapshot of the RTP statistics of a local room, false if there is no such room
+func (r *Relay) RoomStats(roomName string) (RoomStats, bool) {
+	room := r.GetRoomByName(roomName)
+	if room == nil {
+		return RoomStats{}, false
+	}
+	return r.roomStats(room, time.Now()), true
+}
+
+// AllRoomStats returns snapshots of the RTP statistics of all local rooms
+func (r *Relay) AllRoomStats() []RoomStats {
+	now := time.Now()
+	var stats []RoomStats
+	r.LocalRooms.Range(func(_ ulid.ULID, room *shared.Room) bool {
+		stats = append(stats, r.roomStats(room, now))
+		return true
+	})
+	return stats
+}
+
+func (r *Relay) roomStats(room *shared.Room, now time.Time) RoomStats {
+	sp := r.StreamProtocol
+	stats := RoomStats{Room: room.Name}
+	if counters, ok := sp.ingressStats.Get(room.Name + "/" + webrtc.RTPCodecTypeAudio.String()); ok {
+		stats.Audio = counters.snapshot(now)
+	}
+	if counters, ok := sp.ingressStats.Get(room.Name + "/" + webrtc.RTPCodecTypeVideo.String()); ok {
+		stats.Video = counters.snapshot(now)
+	}
+
+	room.Participants.Range(func(id ulid.ULID, participant *shared.Participant) bool {
+		viewer := ViewerStats{ParticipantID: id}
+		vs := sp.getViewerStats(id)
+		if participant.PeerConnection == nil {
+			stats.Viewers = append(stats.Viewers, viewer)
+			return true
+		}
+		if estimate, ok := common.BandwidthEstimate(participant.PeerConnection); ok {
+			viewer.EstimatedBitrate = float64(estimate)
+		}
+		for _, sender := range participant.PeerConnection.GetSenders() {
+			track, ok := sender.Track().(*shared.RoomTrack)
+			if !ok {
+				continue
+			}
+			encodings := sender.GetParameters().Encodings
+			if len(encodings) == 0 {
+				continue
+			}
+			packets, bytes, dropped, _ := track.SentCounts(encodings[0].SSRC)
+			trackStats := vs.snapshot(track.Kind(), track.Codec().ClockRate, packets, bytes, now)
+			trackStats.Dropped = dropped
+			trackStats.Retransmitted, trackStats.Unrepaired, _ = track.RetransmitCounts(encodings[0].SSRC)
+			if layer, ok := track.ForwardedLayer(encodings[0].SSRC); ok && track.Layered() {
+				trackStats.Layer = &layer
+			}
+			if track.Kind() == webrtc.RTPCodecTypeAudio {
+				viewer.Audio = trackStats
+			} else {
+				viewer.Video = trackStats
+			}
+		}
+		stats.Viewers = append(stats.Viewers, viewer)
+		return true
+	})
+	return stats
+}
+
+// refreshTrafficSummary sums up the room statistics into the relay info shared with the mesh
+func (r *Relay) refreshTrafficSummary() {
+	summary := &TrafficSummary{}
+	for _, room := range r.AllRoomStats() {
+		summary.Rooms++
+		summary.Viewers += len(room.Viewers)
+		for _, track := range []RTPStats{room.Audio, room.Video} {
+			summary.IngressBitrate += track.Bitrate
+			summary.WorstIngress = max(summary.WorstIngress, track.LossRate)
+		}
+		for _, viewer := range room.Viewers {
+			for _, track := range []ViewerTrackStats{viewer.Audio, viewer.Video} {
+				summary.EgressBitrate += track.Bitrate
+				summary.WorstViewer = max(summary.WorstViewer, track.LossRate)
+			}
+		}
+	}
+	r.RelayInfo.Traffic = summary
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"math"
+	"relay/internal/shared"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRateWindow(t *testing.T) {
+	start := time.Now()
+	w := &rateWindow{}
+	w.add(start, 1000, 8, 0)
+	w.add(start.Add(statsWindow/2), 1000, 6, 2) // 2 lost of 20 sent
+	if bitrate, lossRate := w.current(start.Add(statsWindow / 2)); bitrate != 0 || lossRate != 0 {
+		t.Errorf("measured %v bps at %v loss before the window ended, want nothing", bitrate, lossRate)
+	}
+	w.add(start.Add(statsWindow), 500, 4, 0)
+	bitrate, lossRate := w.current(start.Add(statsWindow))
+	if want := float64(2500*8) / statsWindow.Seconds(); bitrate != want || lossRate != 0.1 {
+		t.Errorf("measured %v bps at %v loss, want %v at 0.1", bitrate, lossRate, want)
+	}
+	if bitrate, _ = w.current(start.Add(4 * statsWindow)); bitrate != 0 {
+		t.Errorf("measured %v bps after the stream stalled, want 0", bitrate)
+	}
+}
+
+func TestRTPCounters(t *testing.T) {
+	c := newRTPCounters()
+	send := func(ssrc uint32, seq uint16) {
+		c.onPacket(&rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq, Timestamp: uint32(seq) * 3000}, Payload: make([]byte, 100)}, 90000)
+	}
+	for _, seq := range []uint16{65533, 65534, 1, 2, 0, 5} { // Wraps, 65535 is lost and 0 arrives late
+		send(1, seq)
+	}
+	stats := c.snapshot(time.Now())
+	if stats.Packets != 6 || stats.PacketsLost != 3 || stats.Bytes != 6*uint64((&rtp.Packet{Payload: make([]byte, 100)}).MarshalSize()) {
+		t.Errorf("counted %+v, want 6 packets with 3 lost", stats)
+	}
+
+	// Another simulcast encoding becoming primary restarts sequence tracking without counting a gap
+	send(2, 1000)
+	send(2, 1001)
+	if stats = c.snapshot(time.Now()); stats.Packets != 8 || stats.PacketsLost != 3 {
+		t.Errorf("counted %+v after switching encodings, want 8 packets with 3 lost", stats)
+	}
+}
+
+func TestViewerReceiverReport(t *testing.T) {
+	vs := newViewerStats()
+	const ssrc, rtxSSRC = 1111, 2222
+	sentAt := time.Now().Add(-100 * time.Millisecond)
+	reports := []rtcp.ReceptionReport{
+		// Retransmissions, not the media stream
+		{SSRC: rtxSSRC, FractionLost: 255, TotalLost: 99},
+		// The sender report was held 20 ms by the viewer
+		{SSRC: ssrc, FractionLost: 64, TotalLost: 12, Jitter: 900, LastSenderReport: ntpMiddle(sentAt), Delay: 65536 / 50},
+	}
+
+	if _, ok := vs.onReceiverReport(webrtc.RTPCodecTypeVideo, 3333, reports); ok {
+		t.Error("recorded report blocks about other streams")
+	}
+	report, ok := vs.onReceiverReport(webrtc.RTPCodecTypeVideo, ssrc, reports)
+	if !ok || report.SSRC != ssrc {
+		t.Fatalf("recorded block %+v, want the one of the sent stream", report)
+	}
+
+	now := time.Now()
+	stats := vs.snapshot(webrtc.RTPCodecTypeVideo, 90000, 100, 10_000, now)
+	if stats.PacketsLost != 12 || stats.LossRate != 0.25 || stats.Jitter != 10*time.Millisecond {
+		t.Errorf("viewer stats %+v, want 12 lost at 0.25 loss with 10ms jitter", stats)
+	}
+	if rtt := stats.RTT; math.Abs(float64(rtt-80*time.Millisecond)) > float64(5*time.Millisecond) {
+		t.Errorf("round trip %v, want about 80ms", rtt)
+	}
+	if stats = vs.snapshot(webrtc.RTPCodecTypeVideo, 90000, 200, 20_000, now.Add(statsWindow)); stats.Bitrate != 80_000/statsWindow.Seconds() {
+		t.Errorf("sent %v bps, want %v", stats.Bitrate, 80_000/statsWindow.Seconds())
+	}
+	if stats = vs.snapshot(webrtc.RTPCodecTypeAudio, 48000, 0, 0, now); stats.PacketsLost != 0 || stats.RTT != 0 {
+		t.Errorf("audio stats %+v without any report, want none", stats)
+	}
+
+	// Viewers that haven't seen a sender report yet have no round trip
+	fresh := newViewerStats()
+	fresh.onReceiverReport(webrtc.RTPCodecTypeAudio, ssrc, []rtcp.ReceptionReport{{SSRC: ssrc, FractionLost: 128}})
+	if stats = fresh.snapshot(webrtc.RTPCodecTypeAudio, 48000, 0, 0, now); stats.RTT != 0 || stats.LossRate != 0.5 {
+		t.Errorf("audio stats %+v, want 0.5 loss without round trip", stats)
+	}
+}
+
+func TestRefreshTrafficSummary(t *testing.T) {
+	r := newTestRelay(t)
+	now := time.Now()
+	for i, name := range []string{"first", "second"} {
+		room := shared.NewRoom(name, ulid.Make(), r.ID)
+		r.LocalRooms.Set(room.ID, room)
+		room.AddParticipant(&shared.Participant{ID: ulid.Make()})
+		counters := r.StreamProtocol.getIngressStats(name, webrtc.RTPCodecTypeVideo)
+		counters.window = rateWindow{start: now, bitrate: float64(i+1) * 1_000_000, lossRate: float64(i+1) / 100}
+	}
+
+	r.refreshTrafficSummary()
+	summary := r.RelayInfo.Traffic
+	if summary.Rooms != 2 || summary.Viewers != 2 || summary.IngressBitrate != 3_000_000 || summary.WorstIngress != 0.02 {
+		t.Errorf("traffic summary %+v, want 2 rooms with a viewer each, receiving 3 Mbps at worst 0.02 loss", summary)
+	}
+
+	r.StreamProtocol.forgetIngressStats("second")
+	if stats, _ := r.RoomStats("second"); stats.Video.Bitrate != 0 || len(stats.Viewers) != 1 {
+		t.Errorf("room stats %+v after forgetting its ingress, want only its viewer", stats)
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"relay/internal/shared"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/oklog/ulid/v2"
+)
+
+// --- Structs ---
+
+// waitingList keeps stream requesters of offline rooms, to notify them when the room comes online
+type waitingList struct {
+	mutex sync.Mutex
+	rooms map[string]map[signalingChannel]peer.ID // room name -> requester stream -> requester peer
+}
+
+func newWaitingList() *waitingList {
+	return &waitingList{
+		rooms: make(map[string]map[signalingChannel]peer.ID),
+	}
+}
+
+// add puts a requester stream on the waiting list of a room
+func (wl *waitingList) add(roomName string, sig signalingChannel, peerID peer.ID) {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+	waiting, ok := wl.rooms[roomName]
+	if !ok {
+		waiting = make(map[signalingChannel]peer.ID)
+		wl.rooms[roomName] = waiting
+	}
+	waiting[sig] = peerID
+}
+
+// remove drops a requester stream from all waiting lists, once its stream is gone
+func (wl *waitingList) remove(sig signalingChannel) {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+	for roomName, waiting := range wl.rooms {
+		delete(waiting, sig)
+		if len(waiting) == 0 {
+			delete(wl.rooms, roomName)
+		}
+	}
+}
+
+// has checks if anyone waits for a room
+func (wl *waitingList) has(roomName string) bool {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+	return len(wl.rooms[roomName]) > 0
+}
+
+// take removes and returns the waiting list of a room
+func (wl *waitingList) take(roomName string) map[signalingChannel]peer.ID {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+	waiting := wl.rooms[roomName]
+	delete(wl.rooms, roomName)
+	return waiting
+}
+
+// --- Room Availability ---
+
+// roomPull is a pull of a remote room stream for waiting requesters, claimed before routing so only one starts
+type roomPull struct {
+	roomName string
+}
+
+// getOrCreateRoomCopy returns the local copy of a remote room, creating it if needed
+func (r *Relay) getOrCreateRoomCopy(info shared.RoomInfo) *shared.Room {
+	if room := r.GetRoomByName(info.Name); room != nil {
+		return room
+	}
+	created := shared.NewRoom(info.Name, ulid.Make(), info.OwnerID)
+	created.Version = info.Version
+	room := r.roomCopies.GetOrCreate(info.Name, func() *shared.Room { return created })
+	if room == created {
+		r.addLocalRoom(room)
+		slog.Debug("Created local copy of remote room", "room", room.Name, "owner", room.OwnerID)
+	}
+	return room
+}
+
+// pullRoomForWaiting starts pulling a remote room stream that viewers are waiting for, unless it's pulled already
+func (r *Relay) pullRoomForWaiting(roomName string) {
+	info, ok := r.MeshRooms.Get(roomName)
+	if !ok || info.OwnerID == r.ID || r.StreamProtocol.requestedConns.Has(roomName) {
+		return
+	}
+	pull := &roomPull{roomName: roomName}
+	if r.StreamProtocol.pulls.GetOrCreate(roomName, func() *roomPull { return pull }) != pull {
+		return // Already being pulled
+	}
+	room := r.getOrCreateRoomCopy(info)
+	route, err := r.routeStream(roomName, "")
+	if err != nil {
+		r.StreamProtocol.pulls.Delete(roomName)
+		slog.Error("Failed to route stream for waiting viewers", "room", roomName, "err", err)
+		return
+	}
+	slog.Debug("Pulling remote room stream for waiting viewers", "room", roomName, "source", route.Source)
+	go func() {
+		defer r.StreamProtocol.pulls.Delete(roomName)
+		if err := r.StreamProtocol.RequestStream(context.Background(), room, route.Source); err != nil {
+			slog.Error("Failed to request stream for waiting viewers", "room", roomName, "peer", route.Source, "err", err)
+			return
+		}
+		// Stays claimed until the stream flows, when requestedConns keeps others from pulling, or negotiation stalls
+		r.StreamProtocol.awaitUpstream(roomName, signalingTimeout)
+	}()
+}
+
+// onRoomOnline notifies everyone waiting for a room that it came online
+func (r *Relay) onRoomOnline(room *shared.Room) {
+	waiting := r.StreamProtocol.waiting.take(room.Name)
+	if len(waiting) == 0 {
+		return
+	}
+
+	for sig, peerID := range waiting {
+		if err := sig.send(&signalingMessage{Type: signalOnline, RoomName: room.Name}); err != nil {
+			slog.Error("Failed to send request stream online message", "room", room.Name, "peer", peerID, "err", err)
+			continue
+		}
+		slog.Debug("Notified waiting viewer of online room", "room", room.Name, "peer", peerID)
+	}
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"errors"
+	"relay/internal/common"
+	"relay/internal/shared"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/oklog/ulid/v2"
+)
+
+// newTestRelay returns a relay with a loopback libp2p host and its protocols, without joining any mesh
+func newTestRelay(t *testing.T) *Relay {
+	t.Helper()
+	p2pHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p2pHost.Close() })
+	r := &Relay{
+		RelayInfo: RelayInfo{
+			ID:            p2pHost.ID(),
+			MeshRooms:     NewRoomRegistry(),
+			MeshLatencies: common.NewSafeMap[string, time.Duration](),
+			MeshStreams:   common.NewSafeMap[string, []peer.ID](),
+			Approvals:     common.NewSafeMap[string, string](),
+		},
+		Host:               p2pHost,
+		LocalRooms:         common.NewSafeMap[ulid.ULID, *shared.Room](),
+		LocalMeshPeers:     common.NewSafeMap[peer.ID, *RelayInfo](),
+		roomCopies:         common.NewSafeMap[string, *shared.Room](),
+		stateHistory:       newStateHistory(stateHistorySize),
+		peerStateSequences: common.NewSafeMap[peer.ID, *peerStateSequence](),
+		streamRoutes:       common.NewSafeMap[string, *StreamRoute](),
+		failureDetector:    newFailureDetector(),
+		recordings:         common.NewSafeMap[string, *roomRecording](),
+		admission: &meshAdmission{ // Disabled, any relay is admitted
+			admitted: common.NewSafeMap[peer.ID, bool](),
+			trusted:  common.NewSafeMap[peer.ID, bool](),
+		},
+	}
+	r.ProtocolRegistry = NewProtocolRegistry(r)
+	return r
+}
+
+// recordSignaling keeps the messages sent over it, failing sends if err is set
+type recordSignaling struct {
+	mutex sync.Mutex
+	sent  []*signalingMessage
+	err   error
+}
+
+func (s *recordSignaling) send(msg *signalingMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func (s *recordSignaling) receive() (*signalingMessage, error) {
+	return nil, errors.New("not readable")
+}
+
+// messages returns the messages sent so far
+func (s *recordSignaling) messages() []*signalingMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*signalingMessage(nil), s.sent...)
+}
+
+func TestWaitingList(t *testing.T) {
+	wl := newWaitingList()
+	first, second := &recordSignaling{}, &recordSignaling{}
+	wl.add("room", first, "a")
+	wl.add("room", second, "b")
+	wl.add("other", first, "a")
+
+	wl.remove(first)
+	if !wl.has("room") || wl.has("other") {
+		t.Errorf("after removing a requester, room waited for: %v, other room: %v, want only room", wl.has("room"), wl.has("other"))
+	}
+	waiting := wl.take("room")
+	if len(waiting) != 1 || waiting[second] != "b" {
+		t.Errorf("took waiting list %v, want only the remaining requester", waiting)
+	}
+	if wl.has("room") {
+		t.Error("room still waited for after taking its waiting list")
+	}
+}
+
+// TestOnRoomOnlineNotifiesWaiting brings a room online, everyone waiting for it must be notified once, even
+// if notifying another one fails
+func TestOnRoomOnlineNotifiesWaiting(t *testing.T) {
+	r := newTestRelay(t)
+	broken := &recordSignaling{err: errors.New("stream reset")}
+	first, second, other := &recordSignaling{}, &recordSignaling{}, &recordSignaling{}
+	r.StreamProtocol.waiting.add("room", broken, "a")
+	r.StreamProtocol.waiting.add("room", first, "b")
+	r.StreamProtocol.waiting.add("room", second, "c")
+	r.StreamProtocol.waiting.add("other", other, "d")
+
+	room := shared.NewRoom("room", ulid.Make(), "owner")
+	r.onRoomOnline(room)
+	r.onRoomOnline(room)
+
+	for i, sig := range []*recordSignaling{first, second} {
+		messages := sig.messages()
+		if len(messages) != 1 || messages[0].Type != signalOnline || messages[0].RoomName != "room" {
+			t.Errorf("requester %d got %+v, want a single online message of room", i, messages)
+		}
+	}
+	if messages := other.messages(); len(messages) != 0 {
+		t.Errorf("requester of another room got %+v, want nothing", messages)
+	}
+	if !r.StreamProtocol.waiting.has("other") {
+		t.Error("requester of another room is no longer waiting")
+	}
+}
+
+// TestGetOrCreateRoomCopy looks up the copy of a remote room concurrently, a single one must be created
+func TestGetOrCreateRoomCopy(t *testing.T) {
+	r := newTestRelay(t)
+	info := shared.RoomInfo{Name: "room", OwnerID: "owner", Version: 3}
+
+	rooms := make([]*shared.Room, 16)
+	var wg sync.WaitGroup
+	for i := range rooms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rooms[i] = r.getOrCreateRoomCopy(info)
+		}()
+	}
+	wg.Wait()
+	for i, room := range rooms {
+		if room != rooms[0] {
+			t.Fatalf("lookup %d got another room copy", i)
+		}
+	}
+	if rooms[0].OwnerID != info.OwnerID || rooms[0].Version != info.Version {
+		t.Errorf("room copy has owner %s and version %d, want %s and %d", rooms[0].OwnerID, rooms[0].Version, info.OwnerID, info.Version)
+	}
+	if count := r.LocalRooms.Len(); count != 1 {
+		t.Errorf("relay has %d local rooms, want 1", count)
+	}
+}
+
+// TestPullRoomForWaitingOnce pulls a room already being pulled, and one without a route to pull it from
+func TestPullRoomForWaitingOnce(t *testing.T) {
+	r := newTestRelay(t)
+	r.MeshRooms.Merge(shared.RoomInfo{Name: "room", OwnerID: "owner", Version: 1}, false)
+
+	pending := &roomPull{roomName: "room"}
+	r.StreamProtocol.pulls.Set("room", pending)
+	r.pullRoomForWaiting("room")
+	if pull, _ := r.StreamProtocol.pulls.Get("room"); pull != pending {
+		t.Error("pending pull of room was replaced")
+	}
+	if r.GetRoomByName("room") != nil {
+		t.Error("room copy created for room already being pulled")
+	}
+
+	// Owner is not connected, so there is no route and the claim is given up for the next try
+	r.StreamProtocol.pulls.Delete("room")
+	r.pullRoomForWaiting("room")
+	if r.StreamProtocol.pulls.Has("room") {
+		t.Error("pull of unroutable room is still claimed")
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"relay/internal/common"
+	"relay/internal/connections"
+	"relay/internal/shared"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// whepRetryAfter is the Retry-After seconds of viewers of a room which is being pulled from the mesh
+const whepRetryAfter = "2"
+
+// handleWHEP serves the stream of the room named in the URL to a viewer over WHEP (RFC 9725 style egress),
+// the viewer joins the room as a participant. WHEP has no way to renegotiate from this side, so a codec change of
+// the room closes the session and the player has to reconnect
+func (he *httpEndpoint) handleWHEP(w http.ResponseWriter, req *http.Request) {
+	if !he.authorize(w, req) {
+		return
+	}
+	offerSDP, ok := readSDP(w, req, contentTypeSDP)
+	if !ok {
+		return
+	}
+
+	sp := he.relay.StreamProtocol
+	roomName := req.PathValue("room")
+	room := he.relay.GetRoomByName(roomName)
+	if room == nil || !room.IsOnline() {
+		if info, ok := he.relay.MeshRooms.Get(roomName); ok && info.OwnerID != he.relay.ID {
+			// Remote room, viewer may retry once it's pulled over here
+			he.relay.pullRoomForWaiting(roomName)
+			w.Header().Set("Retry-After", whepRetryAfter)
+			http.Error(w, "room stream is being pulled from the mesh", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "room is not online", http.StatusNotFound)
+		return
+	}
+
+	// HTTP viewers have no libp2p peer
+	participant, err := shared.NewParticipant("")
+	if err != nil {
+		slog.Error("Failed to create participant for WHEP viewer", "room", room.Name, "err", err)
+		http.Error(w, "failed to create participant", http.StatusInternalServerError)
+		return
+	}
+	session := &httpSession{
+		ID:   participant.ID,
+		Room: room.Name,
+	}
+
+	pc, err := common.CreatePeerConnection(func() {
+		slog.Info("PeerConnection closed for WHEP viewer", "room", room.Name, "participant", participant.ID)
+		he.sessions.Delete(session.ID)
+		// Cleanup the stream connection and participant
+		if ok := sp.servedConns.Has(participant.ID); ok {
+			sp.servedConns.Delete(participant.ID)
+		}
+		room.RemoveParticipantByID(participant.ID)
+		sp.forgetFeedback(room.Name, participant.ID)
+		sp.viewerStats.Delete(participant.ID)
+		sp.viewerLayers.Delete(participant.ID)
+		sp.relay.DeleteRoomIfEmpty(room)
+	}, nil) // WHEP player is the offering side and restarts ICE on disconnects
+	if err != nil {
+		slog.Error("Failed to create PeerConnection for WHEP viewer", "room", room.Name, "err", err)
+		http.Error(w, "failed to create PeerConnection", http.StatusInternalServerError)
+		return
+	}
+	participant.PeerConnection = pc
+	participant.OnRTCP(sp.onParticipantRTCP(room.Name, participant.ID))
+	sp.watchSendEstimate(room.Name, participant.ID, pc)
+	session.pc = pc
+
+	// Input from viewers is only forwarded to the room if allowed
+	conn := &StreamConnection{pc: pc}
+	if common.GetFlags().WHEPInput {
+		pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			ndc := connections.NewNestriDataChannel(dc)
+			participant.DataChannel = ndc
+			conn.ndc = ndc
+			ndc.RegisterMessageCallback("input", func(data []byte) {
+				if room.DataChannel != nil {
+					if err := room.DataChannel.SendBinary(data); err != nil {
+						slog.Error("Failed to forward input message from WHEP viewer to room", "room", room.Name, "err", err)
+					}
+				}
+			})
+			ndc.RegisterMessageCallback(clipMessageType, func(data []byte) {
+				sp.handleClipRequest(room.Name, participant.ID, ndc, data)
+			})
+			ndc.RegisterMessageCallback(viewportMessageType, func(data []byte) {
+				sp.handleViewport(room.Name, participant.ID, data)
+			})
+		})
+	}
+
+	// Tracks are added after the offer, so they're sent on the transceivers the player offered to receive on
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}); err != nil {
+		slog.Error("Failed to set remote description for WHEP viewer", "room", room.Name, "err", err)
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		_ = pc.Close()
+		return
+	}
+	for _, track := range []*shared.RoomTrack{room.AudioTrack, room.VideoTrack} {
+		if track == nil {
+			continue
+		}
+		if err = participant.AddTrack(track); err != nil {
+			slog.Error("Failed to add track for WHEP viewer", "room", room.Name, "track_kind", track.Kind().String(), "err", err)
+			http.Error(w, "failed to add track", http.StatusInternalServerError)
+			_ = pc.Close()
+			return
+		}
+	}
+
+	answer, err := completeAnswer(req.Context(), pc)
+	if err != nil {
+		slog.Error("Failed to answer WHEP offer", "room", room.Name, "err", err)
+		http.Error(w, "failed to answer offer", http.StatusInternalServerError)
+		_ = pc.Close()
+		return
+	}
+
+	sp.servedConns.Set(participant.ID, conn)
+	room.AddParticipant(participant)
+	he.sessions.Set(session.ID, session)
+	watchNegotiation(nil, room.Name, pc)
+
+	slog.Info("Serving room stream to WHEP viewer", "room", room.Name, "participant", participant.ID)
+	w.Header().Set("Content-Type", contentTypeSDP)
+	w.Header().Set("Location", fmt.Sprintf("/whep/%s/%s", url.PathEscape(room.Name), session.ID))
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write([]byte(answer.SDP)); err != nil {
+		slog.Error("Failed to write WHEP answer", "room", room.Name, "err", err)
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"net/http"
+	"relay/internal/shared"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWHEPRoomNotOnline(t *testing.T) {
+	r, server := newTestHTTPEndpoint(t, "")
+	r.MeshRooms.Merge(shared.RoomInfo{Name: "remote", OwnerID: "owner", Version: 1}, false)
+	addOnlineRoom(r, "online", r.ID)
+	offline := shared.NewRoom("offline", ulid.Make(), r.ID)
+	r.LocalRooms.Set(offline.ID, offline)
+	_, offer := newTestOffer(t, webrtc.RTPTransceiverDirectionRecvonly)
+
+	for _, test := range []struct {
+		room       string
+		status     int
+		retryAfter string
+	}{
+		{"unknown", http.StatusNotFound, ""},
+		{"offline", http.StatusNotFound, ""},
+		{"remote", http.StatusServiceUnavailable, whepRetryAfter}, // Pulled from the mesh meanwhile
+	} {
+		resp, _ := doHTTP(t, http.MethodPost, server.URL+"/whep/"+test.room, contentTypeSDP, offer, nil)
+		if resp.StatusCode != test.status || resp.Header.Get("Retry-After") != test.retryAfter {
+			t.Errorf("WHEP of %s room answered %d retrying after %q, want %d after %q", test.room, resp.StatusCode, resp.Header.Get("Retry-After"), test.status, test.retryAfter)
+		}
+	}
+}
+
+// TestWHEPSession plays a room over WHEP, the viewer joins the room until the session is deleted
+func TestWHEPSession(t *testing.T) {
+	r, server := newTestHTTPEndpoint(t, "")
+	room := shared.NewRoom("room", ulid.Make(), r.ID)
+	for kind, codec := range map[webrtc.RTPCodecType]webrtc.RTPCodecCapability{webrtc.RTPCodecTypeAudio: testOpusCodec, webrtc.RTPCodecTypeVideo: testVP8Codec} {
+		track, err := shared.NewRoomTrack(codec, kind.String(), "room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		room.SetTrack(kind, track)
+	}
+	r.LocalRooms.Set(room.ID, room)
+	_, offer := newTestOffer(t, webrtc.RTPTransceiverDirectionRecvonly)
+
+	resp, answer := doHTTP(t, http.MethodPost, server.URL+"/whep/room", contentTypeSDP, offer, nil)
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(answer, "v=0") {
+		t.Fatalf("WHEP offer answered %d: %s", resp.StatusCode, answer)
+	}
+	if sending := strings.Count(answer, "a=sendonly"); sending != 2 {
+		t.Errorf("answer sends %d tracks, want audio and video", sending)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/whep/room/") {
+		t.Fatalf("session location %q, want under /whep/room/", location)
+	}
+	participantID, err := ulid.Parse(strings.TrimPrefix(location, "/whep/room/"))
+	if err != nil {
+		t.Fatalf("session location %q doesn't end in the participant ID: %v", location, err)
+	}
+	if !room.Participants.Has(participantID) || !r.StreamProtocol.servedConns.Has(participantID) {
+		t.Fatal("viewer did not join the room")
+	}
+
+	if resp, _ = doHTTP(t, http.MethodPatch, server.URL+location, contentTypeSDPFrag, "a=mid:0\r\na=candidate:1 1 udp 2130706431 127.0.0.1 5000 typ host\r\n", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PATCH of trickled candidate answered %d, want 204", resp.StatusCode)
+	}
+	if resp, _ = doHTTP(t, http.MethodDelete, server.URL+location, "", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE of session answered %d, want 200", resp.StatusCode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for room.Participants.Has(participantID) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if room.Participants.Has(participantID) || r.StreamProtocol.servedConns.Has(participantID) {
+		t.Error("viewer of deleted session is still in the room")
+	}
+}
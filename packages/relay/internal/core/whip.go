@@ -0,0 +1,88 @@
+package core
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"relay/internal/common"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+// handleWHIP ingests a room stream offered over WHIP (RFC 9725), creating or claiming the room named in the URL
+func (he *httpEndpoint) handleWHIP(w http.ResponseWriter, req *http.Request) {
+	if !he.authorize(w, req) {
+		return
+	}
+	offerSDP, ok := readSDP(w, req, contentTypeSDP)
+	if !ok {
+		return
+	}
+
+	sp := he.relay.StreamProtocol
+	roomName := req.PathValue("room")
+	room, claim, code, err := sp.claimPushRoom(roomName)
+	if err != nil {
+		slog.Error("Cannot ingest WHIP stream to room", "room", roomName, "err", err)
+		http.Error(w, err.Error(), signalingErrorStatus(code))
+		return
+	}
+	// Connection is stored, or the push given up, by the time we respond
+	defer sp.releasePushClaim(claim)
+
+	session := &httpSession{
+		ID:   ulid.Make(),
+		Room: room.Name,
+	}
+	var pc *webrtc.PeerConnection
+	pc, err = common.CreatePeerConnection(func() {
+		slog.Info("PeerConnection closed for WHIP stream", "room", room.Name, "session", session.ID)
+		he.sessions.Delete(session.ID)
+		// Cleanup the stream connection, room goes away too if nobody is watching
+		if conn, ok := sp.incomingConns.Get(room.Name); ok && conn.pc == pc {
+			sp.incomingConns.Delete(room.Name)
+		}
+		sp.relay.DeleteRoomIfEmpty(room)
+	}, nil) // WHIP client is the offering side and restarts ICE on disconnects
+	if err != nil {
+		slog.Error("Failed to create PeerConnection for WHIP stream", "room", room.Name, "err", err)
+		http.Error(w, "failed to create PeerConnection", http.StatusInternalServerError)
+		sp.relay.DeleteRoomIfEmpty(room)
+		return
+	}
+	session.pc = pc
+
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		sp.ingestTrack(room, remoteTrack, receiver)
+	})
+
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}); err != nil {
+		slog.Error("Failed to set remote description for WHIP stream", "room", room.Name, "err", err)
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		_ = pc.Close()
+		return
+	}
+	answer, err := completeAnswer(req.Context(), pc)
+	if err != nil {
+		slog.Error("Failed to answer WHIP offer", "room", room.Name, "err", err)
+		http.Error(w, "failed to answer offer", http.StatusInternalServerError)
+		_ = pc.Close()
+		return
+	}
+
+	sp.incomingConns.Set(room.Name, &StreamConnection{
+		pc: pc,
+	})
+	he.sessions.Set(session.ID, session)
+	watchNegotiation(nil, room.Name, pc)
+
+	slog.Info("Ingesting WHIP stream for room", "room", room.Name, "session", session.ID)
+	w.Header().Set("Content-Type", contentTypeSDP)
+	w.Header().Set("Location", fmt.Sprintf("/whip/%s/%s", url.PathEscape(room.Name), session.ID))
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write([]byte(answer.SDP)); err != nil {
+		slog.Error("Failed to write WHIP answer", "room", room.Name, "err", err)
+	}
+}
@@ -28,12 +28,13 @@ type MeshMessage struct {
 	// Types that are valid to be assigned to Type:
 	//
 	//	*MeshMessage_StateUpdate
-	//	*MeshMessage_Ack
 	//	*MeshMessage_RetransmissionRequest
 	//	*MeshMessage_Retransmission
 	//	*MeshMessage_Heartbeat
 	//	*MeshMessage_SuspectRelay
 	//	*MeshMessage_Disconnect
+	//	*MeshMessage_IndirectProbe
+	//	*MeshMessage_IndirectProbeResult
 	//	*MeshMessage_ForwardSdp
 	//	*MeshMessage_ForwardIce
 	//	*MeshMessage_ForwardIngest
@@ -91,15 +92,6 @@ func (x *MeshMessage) GetStateUpdate() *StateUpdate {
 	return nil
 }
 
-func (x *MeshMessage) GetAck() *Ack {
-	if x != nil {
-		if x, ok := x.Type.(*MeshMessage_Ack); ok {
-			return x.Ack
-		}
-	}
-	return nil
-}
-
 func (x *MeshMessage) GetRetransmissionRequest() *RetransmissionRequest {
 	if x != nil {
 		if x, ok := x.Type.(*MeshMessage_RetransmissionRequest); ok {
@@ -145,6 +137,24 @@ func (x *MeshMessage) GetDisconnect() *Disconnect {
 	return nil
 }
 
+func (x *MeshMessage) GetIndirectProbe() *IndirectProbe {
+	if x != nil {
+		if x, ok := x.Type.(*MeshMessage_IndirectProbe); ok {
+			return x.IndirectProbe
+		}
+	}
+	return nil
+}
+
+func (x *MeshMessage) GetIndirectProbeResult() *IndirectProbeResult {
+	if x != nil {
+		if x, ok := x.Type.(*MeshMessage_IndirectProbeResult); ok {
+			return x.IndirectProbeResult
+		}
+	}
+	return nil
+}
+
 func (x *MeshMessage) GetForwardSdp() *ForwardSDP {
 	if x != nil {
 		if x, ok := x.Type.(*MeshMessage_ForwardSdp); ok {
@@ -208,10 +218,6 @@ type MeshMessage_StateUpdate struct {
 	StateUpdate *StateUpdate `protobuf:"bytes,1,opt,name=state_update,json=stateUpdate,proto3,oneof"`
 }
 
-type MeshMessage_Ack struct {
-	Ack *Ack `protobuf:"bytes,2,opt,name=ack,proto3,oneof"`
-}
-
 type MeshMessage_RetransmissionRequest struct {
 	RetransmissionRequest *RetransmissionRequest `protobuf:"bytes,3,opt,name=retransmission_request,json=retransmissionRequest,proto3,oneof"`
 }
@@ -232,6 +238,14 @@ type MeshMessage_Disconnect struct {
 	Disconnect *Disconnect `protobuf:"bytes,7,opt,name=disconnect,proto3,oneof"`
 }
 
+type MeshMessage_IndirectProbe struct {
+	IndirectProbe *IndirectProbe `protobuf:"bytes,14,opt,name=indirect_probe,json=indirectProbe,proto3,oneof"`
+}
+
+type MeshMessage_IndirectProbeResult struct {
+	IndirectProbeResult *IndirectProbeResult `protobuf:"bytes,15,opt,name=indirect_probe_result,json=indirectProbeResult,proto3,oneof"`
+}
+
 type MeshMessage_ForwardSdp struct {
 	// Level 1
 	ForwardSdp *ForwardSDP `protobuf:"bytes,8,opt,name=forward_sdp,json=forwardSdp,proto3,oneof"`
@@ -260,8 +274,6 @@ type MeshMessage_HandshakeResponse struct {
 
 func (*MeshMessage_StateUpdate) isMeshMessage_Type() {}
 
-func (*MeshMessage_Ack) isMeshMessage_Type() {}
-
 func (*MeshMessage_RetransmissionRequest) isMeshMessage_Type() {}
 
 func (*MeshMessage_Retransmission) isMeshMessage_Type() {}
@@ -272,6 +284,10 @@ func (*MeshMessage_SuspectRelay) isMeshMessage_Type() {}
 
 func (*MeshMessage_Disconnect) isMeshMessage_Type() {}
 
+func (*MeshMessage_IndirectProbe) isMeshMessage_Type() {}
+
+func (*MeshMessage_IndirectProbeResult) isMeshMessage_Type() {}
+
 func (*MeshMessage_ForwardSdp) isMeshMessage_Type() {}
 
 func (*MeshMessage_ForwardIce) isMeshMessage_Type() {}
@@ -287,8 +303,9 @@ func (*MeshMessage_HandshakeResponse) isMeshMessage_Type() {}
 // Handshake to inititiate new connection to mesh.
 type Handshake struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"`               // UUID of the relay
-	DhPublicKey   string                 `protobuf:"bytes,2,opt,name=dh_public_key,json=dhPublicKey,proto3" json:"dh_public_key,omitempty"` // base64 encoded Diffie-Hellman public key
+	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"`                                                                // UUID of the relay
+	DhPublicKey   string                 `protobuf:"bytes,2,opt,name=dh_public_key,json=dhPublicKey,proto3" json:"dh_public_key,omitempty"`                                                  // base64 encoded Diffie-Hellman public key
+	Approvals     map[string]string      `protobuf:"bytes,3,rep,name=approvals,proto3" json:"approvals,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"` // relay id (or "mesh" for operator key) to signature, credentials of the joiner
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -337,6 +354,13 @@ func (x *Handshake) GetDhPublicKey() string {
 	return ""
 }
 
+func (x *Handshake) GetApprovals() map[string]string {
+	if x != nil {
+		return x.Approvals
+	}
+	return nil
+}
+
 // HandshakeResponse to respond to a mesh joiner.
 type HandshakeResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -671,59 +695,6 @@ func (x *StateUpdate) GetEntities() map[string]*EntityState {
 	return nil
 }
 
-// Ack acknowledges receipt of a StateUpdate.
-type Ack struct {
-	state          protoimpl.MessageState `protogen:"open.v1"`
-	RelayId        string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"`                       // UUID of the acknowledging relay
-	SequenceNumber uint64                 `protobuf:"varint,2,opt,name=sequence_number,json=sequenceNumber,proto3" json:"sequence_number,omitempty"` // Sequence number being acknowledged
-	unknownFields  protoimpl.UnknownFields
-	sizeCache      protoimpl.SizeCache
-}
-
-func (x *Ack) Reset() {
-	*x = Ack{}
-	mi := &file_mesh_proto_msgTypes[8]
-	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-	ms.StoreMessageInfo(mi)
-}
-
-func (x *Ack) String() string {
-	return protoimpl.X.MessageStringOf(x)
-}
-
-func (*Ack) ProtoMessage() {}
-
-func (x *Ack) ProtoReflect() protoreflect.Message {
-	mi := &file_mesh_proto_msgTypes[8]
-	if x != nil {
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		if ms.LoadMessageInfo() == nil {
-			ms.StoreMessageInfo(mi)
-		}
-		return ms
-	}
-	return mi.MessageOf(x)
-}
-
-// Deprecated: Use Ack.ProtoReflect.Descriptor instead.
-func (*Ack) Descriptor() ([]byte, []int) {
-	return file_mesh_proto_rawDescGZIP(), []int{8}
-}
-
-func (x *Ack) GetRelayId() string {
-	if x != nil {
-		return x.RelayId
-	}
-	return ""
-}
-
-func (x *Ack) GetSequenceNumber() uint64 {
-	if x != nil {
-		return x.SequenceNumber
-	}
-	return 0
-}
-
 // RetransmissionRequest requests a missed StateUpdate.
 type RetransmissionRequest struct {
 	state          protoimpl.MessageState `protogen:"open.v1"`
@@ -735,7 +706,7 @@ type RetransmissionRequest struct {
 
 func (x *RetransmissionRequest) Reset() {
 	*x = RetransmissionRequest{}
-	mi := &file_mesh_proto_msgTypes[9]
+	mi := &file_mesh_proto_msgTypes[8]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -747,7 +718,7 @@ func (x *RetransmissionRequest) String() string {
 func (*RetransmissionRequest) ProtoMessage() {}
 
 func (x *RetransmissionRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_mesh_proto_msgTypes[9]
+	mi := &file_mesh_proto_msgTypes[8]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -760,7 +731,7 @@ func (x *RetransmissionRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RetransmissionRequest.ProtoReflect.Descriptor instead.
 func (*RetransmissionRequest) Descriptor() ([]byte, []int) {
-	return file_mesh_proto_rawDescGZIP(), []int{9}
+	return file_mesh_proto_rawDescGZIP(), []int{8}
 }
 
 func (x *RetransmissionRequest) GetRelayId() string {
@@ -788,7 +759,7 @@ type Retransmission struct {
 
 func (x *Retransmission) Reset() {
 	*x = Retransmission{}
-	mi := &file_mesh_proto_msgTypes[10]
+	mi := &file_mesh_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -800,7 +771,7 @@ func (x *Retransmission) String() string {
 func (*Retransmission) ProtoMessage() {}
 
 func (x *Retransmission) ProtoReflect() protoreflect.Message {
-	mi := &file_mesh_proto_msgTypes[10]
+	mi := &file_mesh_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -813,7 +784,7 @@ func (x *Retransmission) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Retransmission.ProtoReflect.Descriptor instead.
 func (*Retransmission) Descriptor() ([]byte, []int) {
-	return file_mesh_proto_rawDescGZIP(), []int{10}
+	return file_mesh_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *Retransmission) GetRelayId() string {
@@ -835,13 +806,14 @@ type Heartbeat struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"` // UUID of the sending relay
 	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`            // Time of the heartbeat
+	Incarnation   uint64                 `protobuf:"varint,3,opt,name=incarnation,proto3" json:"incarnation,omitempty"`       // Incarnation of the sending relay, increased to refute suspicion or removal
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Heartbeat) Reset() {
 	*x = Heartbeat{}
-	mi := &file_mesh_proto_msgTypes[11]
+	mi := &file_mesh_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -853,7 +825,7 @@ func (x *Heartbeat) String() string {
 func (*Heartbeat) ProtoMessage() {}
 
 func (x *Heartbeat) ProtoReflect() protoreflect.Message {
-	mi := &file_mesh_proto_msgTypes[11]
+	mi := &file_mesh_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -866,7 +838,7 @@ func (x *Heartbeat) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Heartbeat.ProtoReflect.Descriptor instead.
 func (*Heartbeat) Descriptor() ([]byte, []int) {
-	return file_mesh_proto_rawDescGZIP(), []int{11}
+	return file_mesh_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *Heartbeat) GetRelayId() string {
@@ -883,18 +855,26 @@ func (x *Heartbeat) GetTimestamp() *timestamppb.Timestamp {
 	return nil
 }
 
+func (x *Heartbeat) GetIncarnation() uint64 {
+	if x != nil {
+		return x.Incarnation
+	}
+	return 0
+}
+
 // SuspectRelay marks a relay as potentially unresponsive.
 type SuspectRelay struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"` // UUID of the suspected relay
 	Reason        string                 `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`                  // Reason for suspicion (e.g., "no heartbeat")
+	Incarnation   uint64                 `protobuf:"varint,3,opt,name=incarnation,proto3" json:"incarnation,omitempty"`       // Incarnation of the suspected relay the suspicion applies to
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *SuspectRelay) Reset() {
 	*x = SuspectRelay{}
-	mi := &file_mesh_proto_msgTypes[12]
+	mi := &file_mesh_proto_msgTypes[11]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -906,7 +886,7 @@ func (x *SuspectRelay) String() string {
 func (*SuspectRelay) ProtoMessage() {}
 
 func (x *SuspectRelay) ProtoReflect() protoreflect.Message {
-	mi := &file_mesh_proto_msgTypes[12]
+	mi := &file_mesh_proto_msgTypes[11]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -919,7 +899,7 @@ func (x *SuspectRelay) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SuspectRelay.ProtoReflect.Descriptor instead.
 func (*SuspectRelay) Descriptor() ([]byte, []int) {
-	return file_mesh_proto_rawDescGZIP(), []int{12}
+	return file_mesh_proto_rawDescGZIP(), []int{11}
 }
 
 func (x *SuspectRelay) GetRelayId() string {
@@ -936,18 +916,124 @@ func (x *SuspectRelay) GetReason() string {
 	return ""
 }
 
+func (x *SuspectRelay) GetIncarnation() uint64 {
+	if x != nil {
+		return x.Incarnation
+	}
+	return 0
+}
+
+// IndirectProbe asks a relay to probe another relay on behalf of the sender.
+type IndirectProbe struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"` // UUID of the relay to probe
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IndirectProbe) Reset() {
+	*x = IndirectProbe{}
+	mi := &file_mesh_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IndirectProbe) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IndirectProbe) ProtoMessage() {}
+
+func (x *IndirectProbe) ProtoReflect() protoreflect.Message {
+	mi := &file_mesh_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IndirectProbe.ProtoReflect.Descriptor instead.
+func (*IndirectProbe) Descriptor() ([]byte, []int) {
+	return file_mesh_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *IndirectProbe) GetRelayId() string {
+	if x != nil {
+		return x.RelayId
+	}
+	return ""
+}
+
+// IndirectProbeResult reports the outcome of an IndirectProbe.
+type IndirectProbeResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"` // UUID of the probed relay
+	Alive         bool                   `protobuf:"varint,2,opt,name=alive,proto3" json:"alive,omitempty"`                   // Whether the probed relay responded
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IndirectProbeResult) Reset() {
+	*x = IndirectProbeResult{}
+	mi := &file_mesh_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IndirectProbeResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IndirectProbeResult) ProtoMessage() {}
+
+func (x *IndirectProbeResult) ProtoReflect() protoreflect.Message {
+	mi := &file_mesh_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IndirectProbeResult.ProtoReflect.Descriptor instead.
+func (*IndirectProbeResult) Descriptor() ([]byte, []int) {
+	return file_mesh_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *IndirectProbeResult) GetRelayId() string {
+	if x != nil {
+		return x.RelayId
+	}
+	return ""
+}
+
+func (x *IndirectProbeResult) GetAlive() bool {
+	if x != nil {
+		return x.Alive
+	}
+	return false
+}
+
 // Disconnect signals to remove a relay from the mesh.
 type Disconnect struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	RelayId       string                 `protobuf:"bytes,1,opt,name=relay_id,json=relayId,proto3" json:"relay_id,omitempty"` // UUID of the relay to disconnect
 	Reason        string                 `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`                  // Reason for disconnection (e.g., "unresponsive")
+	Incarnation   uint64                 `protobuf:"varint,3,opt,name=incarnation,proto3" json:"incarnation,omitempty"`       // Incarnation of the relay the disconnection applies to
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Disconnect) Reset() {
 	*x = Disconnect{}
-	mi := &file_mesh_proto_msgTypes[13]
+	mi := &file_mesh_proto_msgTypes[14]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -959,7 +1045,7 @@ func (x *Disconnect) String() string {
 func (*Disconnect) ProtoMessage() {}
 
 func (x *Disconnect) ProtoReflect() protoreflect.Message {
-	mi := &file_mesh_proto_msgTypes[13]
+	mi := &file_mesh_proto_msgTypes[14]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -972,7 +1058,7 @@ func (x *Disconnect) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Disconnect.ProtoReflect.Descriptor instead.
 func (*Disconnect) Descriptor() ([]byte, []int) {
-	return file_mesh_proto_rawDescGZIP(), []int{13}
+	return file_mesh_proto_rawDescGZIP(), []int{14}
 }
 
 func (x *Disconnect) GetRelayId() string {
@@ -989,23 +1075,30 @@ func (x *Disconnect) GetReason() string {
 	return ""
 }
 
+func (x *Disconnect) GetIncarnation() uint64 {
+	if x != nil {
+		return x.Incarnation
+	}
+	return 0
+}
+
 var File_mesh_proto protoreflect.FileDescriptor
 
 const file_mesh_proto_rawDesc = "" +
 	"\n" +
 	"\n" +
-	"mesh.proto\x12\x05proto\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\vstate.proto\x1a\fwebrtc.proto\"\x90\x06\n" +
+	"mesh.proto\x12\x05proto\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\vstate.proto\x1a\fwebrtc.proto\"\x87\a\n" +
 	"\vMeshMessage\x127\n" +
-	"\fstate_update\x18\x01 \x01(\v2\x12.proto.StateUpdateH\x00R\vstateUpdate\x12\x1e\n" +
-	"\x03ack\x18\x02 \x01(\v2\n" +
-	".proto.AckH\x00R\x03ack\x12U\n" +
+	"\fstate_update\x18\x01 \x01(\v2\x12.proto.StateUpdateH\x00R\vstateUpdate\x12U\n" +
 	"\x16retransmission_request\x18\x03 \x01(\v2\x1c.proto.RetransmissionRequestH\x00R\x15retransmissionRequest\x12?\n" +
 	"\x0eretransmission\x18\x04 \x01(\v2\x15.proto.RetransmissionH\x00R\x0eretransmission\x120\n" +
 	"\theartbeat\x18\x05 \x01(\v2\x10.proto.HeartbeatH\x00R\theartbeat\x12:\n" +
 	"\rsuspect_relay\x18\x06 \x01(\v2\x13.proto.SuspectRelayH\x00R\fsuspectRelay\x123\n" +
 	"\n" +
 	"disconnect\x18\a \x01(\v2\x11.proto.DisconnectH\x00R\n" +
-	"disconnect\x124\n" +
+	"disconnect\x12=\n" +
+	"\x0eindirect_probe\x18\x0e \x01(\v2\x14.proto.IndirectProbeH\x00R\rindirectProbe\x12P\n" +
+	"\x15indirect_probe_result\x18\x0f \x01(\v2\x1a.proto.IndirectProbeResultH\x00R\x13indirectProbeResult\x124\n" +
 	"\vforward_sdp\x18\b \x01(\v2\x11.proto.ForwardSDPH\x00R\n" +
 	"forwardSdp\x124\n" +
 	"\vforward_ice\x18\t \x01(\v2\x11.proto.ForwardICEH\x00R\n" +
@@ -1015,10 +1108,14 @@ const file_mesh_proto_rawDesc = "" +
 	"\x0estream_request\x18\v \x01(\v2\x14.proto.StreamRequestH\x00R\rstreamRequest\x120\n" +
 	"\thandshake\x18\f \x01(\v2\x10.proto.HandshakeH\x00R\thandshake\x12I\n" +
 	"\x12handshake_response\x18\r \x01(\v2\x18.proto.HandshakeResponseH\x00R\x11handshakeResponseB\x06\n" +
-	"\x04type\"J\n" +
+	"\x04typeJ\x04\b\x02\x10\x03\"\xc7\x01\n" +
 	"\tHandshake\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12\"\n" +
-	"\rdh_public_key\x18\x02 \x01(\tR\vdhPublicKey\"\xd7\x01\n" +
+	"\rdh_public_key\x18\x02 \x01(\tR\vdhPublicKey\x12=\n" +
+	"\tapprovals\x18\x03 \x03(\v2\x1f.proto.Handshake.ApprovalsEntryR\tapprovals\x1a<\n" +
+	"\x0eApprovalsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xd7\x01\n" +
 	"\x11HandshakeResponse\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12\"\n" +
 	"\rdh_public_key\x18\x02 \x01(\tR\vdhPublicKey\x12E\n" +
@@ -1046,26 +1143,31 @@ const file_mesh_proto_rawDesc = "" +
 	"\bentities\x18\x02 \x03(\v2 .proto.StateUpdate.EntitiesEntryR\bentities\x1aO\n" +
 	"\rEntitiesEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12(\n" +
-	"\x05value\x18\x02 \x01(\v2\x12.proto.EntityStateR\x05value:\x028\x01\"I\n" +
-	"\x03Ack\x12\x19\n" +
-	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12'\n" +
-	"\x0fsequence_number\x18\x02 \x01(\x04R\x0esequenceNumber\"[\n" +
+	"\x05value\x18\x02 \x01(\v2\x12.proto.EntityStateR\x05value:\x028\x01\"[\n" +
 	"\x15RetransmissionRequest\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12'\n" +
 	"\x0fsequence_number\x18\x02 \x01(\x04R\x0esequenceNumber\"b\n" +
 	"\x0eRetransmission\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x125\n" +
-	"\fstate_update\x18\x02 \x01(\v2\x12.proto.StateUpdateR\vstateUpdate\"`\n" +
+	"\fstate_update\x18\x02 \x01(\v2\x12.proto.StateUpdateR\vstateUpdate\"\x82\x01\n" +
 	"\tHeartbeat\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x128\n" +
-	"\ttimestamp\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\"A\n" +
+	"\ttimestamp\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12 \n" +
+	"\vincarnation\x18\x03 \x01(\x04R\vincarnation\"c\n" +
 	"\fSuspectRelay\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12\x16\n" +
-	"\x06reason\x18\x02 \x01(\tR\x06reason\"?\n" +
+	"\x06reason\x18\x02 \x01(\tR\x06reason\x12 \n" +
+	"\vincarnation\x18\x03 \x01(\x04R\vincarnation\"*\n" +
+	"\rIndirectProbe\x12\x19\n" +
+	"\brelay_id\x18\x01 \x01(\tR\arelayId\"F\n" +
+	"\x13IndirectProbeResult\x12\x19\n" +
+	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12\x14\n" +
+	"\x05alive\x18\x02 \x01(\bR\x05alive\"a\n" +
 	"\n" +
 	"Disconnect\x12\x19\n" +
 	"\brelay_id\x18\x01 \x01(\tR\arelayId\x12\x16\n" +
-	"\x06reason\x18\x02 \x01(\tR\x06reasonB\x16Z\x14relay/internal/protob\x06proto3"
+	"\x06reason\x18\x02 \x01(\tR\x06reason\x12 \n" +
+	"\vincarnation\x18\x03 \x01(\x04R\vincarnationB\x16Z\x14relay/internal/protob\x06proto3"
 
 var (
 	file_mesh_proto_rawDescOnce sync.Once
@@ -1079,7 +1181,7 @@ func file_mesh_proto_rawDescGZIP() []byte {
 	return file_mesh_proto_rawDescData
 }
 
-var file_mesh_proto_msgTypes = make([]protoimpl.MessageInfo, 16)
+var file_mesh_proto_msgTypes = make([]protoimpl.MessageInfo, 18)
 var file_mesh_proto_goTypes = []any{
 	(*MeshMessage)(nil),           // 0: proto.MeshMessage
 	(*Handshake)(nil),             // 1: proto.Handshake
@@ -1089,43 +1191,47 @@ var file_mesh_proto_goTypes = []any{
 	(*ForwardIngest)(nil),         // 5: proto.ForwardIngest
 	(*StreamRequest)(nil),         // 6: proto.StreamRequest
 	(*StateUpdate)(nil),           // 7: proto.StateUpdate
-	(*Ack)(nil),                   // 8: proto.Ack
-	(*RetransmissionRequest)(nil), // 9: proto.RetransmissionRequest
-	(*Retransmission)(nil),        // 10: proto.Retransmission
-	(*Heartbeat)(nil),             // 11: proto.Heartbeat
-	(*SuspectRelay)(nil),          // 12: proto.SuspectRelay
-	(*Disconnect)(nil),            // 13: proto.Disconnect
-	nil,                           // 14: proto.HandshakeResponse.ApprovalsEntry
-	nil,                           // 15: proto.StateUpdate.EntitiesEntry
-	(*ICECandidateInit)(nil),      // 16: proto.ICECandidateInit
-	(*timestamppb.Timestamp)(nil), // 17: google.protobuf.Timestamp
-	(*EntityState)(nil),           // 18: proto.EntityState
+	(*RetransmissionRequest)(nil), // 8: proto.RetransmissionRequest
+	(*Retransmission)(nil),        // 9: proto.Retransmission
+	(*Heartbeat)(nil),             // 10: proto.Heartbeat
+	(*SuspectRelay)(nil),          // 11: proto.SuspectRelay
+	(*IndirectProbe)(nil),         // 12: proto.IndirectProbe
+	(*IndirectProbeResult)(nil),   // 13: proto.IndirectProbeResult
+	(*Disconnect)(nil),            // 14: proto.Disconnect
+	nil,                           // 15: proto.Handshake.ApprovalsEntry
+	nil,                           // 16: proto.HandshakeResponse.ApprovalsEntry
+	nil,                           // 17: proto.StateUpdate.EntitiesEntry
+	(*ICECandidateInit)(nil),      // 18: proto.ICECandidateInit
+	(*timestamppb.Timestamp)(nil), // 19: google.protobuf.Timestamp
+	(*EntityState)(nil),           // 20: proto.EntityState
 }
 var file_mesh_proto_depIdxs = []int32{
 	7,  // 0: proto.MeshMessage.state_update:type_name -> proto.StateUpdate
-	8,  // 1: proto.MeshMessage.ack:type_name -> proto.Ack
-	9,  // 2: proto.MeshMessage.retransmission_request:type_name -> proto.RetransmissionRequest
-	10, // 3: proto.MeshMessage.retransmission:type_name -> proto.Retransmission
-	11, // 4: proto.MeshMessage.heartbeat:type_name -> proto.Heartbeat
-	12, // 5: proto.MeshMessage.suspect_relay:type_name -> proto.SuspectRelay
-	13, // 6: proto.MeshMessage.disconnect:type_name -> proto.Disconnect
-	3,  // 7: proto.MeshMessage.forward_sdp:type_name -> proto.ForwardSDP
-	4,  // 8: proto.MeshMessage.forward_ice:type_name -> proto.ForwardICE
-	5,  // 9: proto.MeshMessage.forward_ingest:type_name -> proto.ForwardIngest
-	6,  // 10: proto.MeshMessage.stream_request:type_name -> proto.StreamRequest
-	1,  // 11: proto.MeshMessage.handshake:type_name -> proto.Handshake
-	2,  // 12: proto.MeshMessage.handshake_response:type_name -> proto.HandshakeResponse
-	14, // 13: proto.HandshakeResponse.approvals:type_name -> proto.HandshakeResponse.ApprovalsEntry
-	16, // 14: proto.ForwardICE.candidate:type_name -> proto.ICECandidateInit
-	15, // 15: proto.StateUpdate.entities:type_name -> proto.StateUpdate.EntitiesEntry
-	7,  // 16: proto.Retransmission.state_update:type_name -> proto.StateUpdate
-	17, // 17: proto.Heartbeat.timestamp:type_name -> google.protobuf.Timestamp
-	18, // 18: proto.StateUpdate.EntitiesEntry.value:type_name -> proto.EntityState
-	19, // [19:19] is the sub-list for method output_type
-	19, // [19:19] is the sub-list for method input_type
-	19, // [19:19] is the sub-list for extension type_name
-	19, // [19:19] is the sub-list for extension extendee
-	0,  // [0:19] is the sub-list for field type_name
+	8,  // 1: proto.MeshMessage.retransmission_request:type_name -> proto.RetransmissionRequest
+	9,  // 2: proto.MeshMessage.retransmission:type_name -> proto.Retransmission
+	10, // 3: proto.MeshMessage.heartbeat:type_name -> proto.Heartbeat
+	11, // 4: proto.MeshMessage.suspect_relay:type_name -> proto.SuspectRelay
+	14, // 5: proto.MeshMessage.disconnect:type_name -> proto.Disconnect
+	12, // 6: proto.MeshMessage.indirect_probe:type_name -> proto.IndirectProbe
+	13, // 7: proto.MeshMessage.indirect_probe_result:type_name -> proto.IndirectProbeResult
+	3,  // 8: proto.MeshMessage.forward_sdp:type_name -> proto.ForwardSDP
+	4,  // 9: proto.MeshMessage.forward_ice:type_name -> proto.ForwardICE
+	5,  // 10: proto.MeshMessage.forward_ingest:type_name -> proto.ForwardIngest
+	6,  // 11: proto.MeshMessage.stream_request:type_name -> proto.StreamRequest
+	1,  // 12: proto.MeshMessage.handshake:type_name -> proto.Handshake
+	2,  // 13: proto.MeshMessage.handshake_response:type_name -> proto.HandshakeResponse
+	15, // 14: proto.Handshake.approvals:type_name -> proto.Handshake.ApprovalsEntry
+	16, // 15: proto.HandshakeResponse.approvals:type_name -> proto.HandshakeResponse.ApprovalsEntry
+	18, // 16: proto.ForwardICE.candidate:type_name -> proto.ICECandidateInit
+	17, // 17: proto.StateUpdate.entities:type_name -> proto.StateUpdate.EntitiesEntry
+	7,  // 18: proto.Retransmission.state_update:type_name -> proto.StateUpdate
+	19, // 19: proto.Heartbeat.timestamp:type_name -> google.protobuf.Timestamp
+	20, // 20: proto.StateUpdate.EntitiesEntry.value:type_name -> proto.EntityState
+	21, // [21:21] is the sub-list for method output_type
+	21, // [21:21] is the sub-list for method input_type
+	21, // [21:21] is the sub-list for extension type_name
+	21, // [21:21] is the sub-list for extension extendee
+	0,  // [0:21] is the sub-list for field type_name
 }
 
 func init() { file_mesh_proto_init() }
@@ -1137,12 +1243,13 @@ func file_mesh_proto_init() {
 	file_webrtc_proto_init()
 	file_mesh_proto_msgTypes[0].OneofWrappers = []any{
 		(*MeshMessage_StateUpdate)(nil),
-		(*MeshMessage_Ack)(nil),
 		(*MeshMessage_RetransmissionRequest)(nil),
 		(*MeshMessage_Retransmission)(nil),
 		(*MeshMessage_Heartbeat)(nil),
 		(*MeshMessage_SuspectRelay)(nil),
 		(*MeshMessage_Disconnect)(nil),
+		(*MeshMessage_IndirectProbe)(nil),
+		(*MeshMessage_IndirectProbeResult)(nil),
 		(*MeshMessage_ForwardSdp)(nil),
 		(*MeshMessage_ForwardIce)(nil),
 		(*MeshMessage_ForwardIngest)(nil),
@@ -1156,7 +1263,7 @@ func file_mesh_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_mesh_proto_rawDesc), len(file_mesh_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   16,
+			NumMessages:   18,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -125,6 +125,329 @@ func (x *ProtoMessageInput) GetData() *ProtoInput {
 	return nil
 }
 
+// Request of a participant to save the last seconds of the room stream as a clip
+type ProtoClipRequest struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	DurationSeconds uint32                 `protobuf:"varint,1,opt,name=duration_seconds,json=durationSeconds,proto3" json:"duration_seconds,omitempty"` // 0 for everything buffered
+	RequestId       uint32                 `protobuf:"varint,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`                   // Echoed in the result, to match results of requests forwarded between relays
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *ProtoClipRequest) Reset() {
+	*x = ProtoClipRequest{}
+	mi := &file_messages_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoClipRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoClipRequest) ProtoMessage() {}
+
+func (x *ProtoClipRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoClipRequest.ProtoReflect.Descriptor instead.
+func (*ProtoClipRequest) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ProtoClipRequest) GetDurationSeconds() uint32 {
+	if x != nil {
+		return x.DurationSeconds
+	}
+	return 0
+}
+
+func (x *ProtoClipRequest) GetRequestId() uint32 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+type ProtoMessageClip struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MessageBase   *ProtoMessageBase      `protobuf:"bytes,1,opt,name=message_base,json=messageBase,proto3" json:"message_base,omitempty"`
+	Data          *ProtoClipRequest      `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProtoMessageClip) Reset() {
+	*x = ProtoMessageClip{}
+	mi := &file_messages_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoMessageClip) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoMessageClip) ProtoMessage() {}
+
+func (x *ProtoMessageClip) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoMessageClip.ProtoReflect.Descriptor instead.
+func (*ProtoMessageClip) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ProtoMessageClip) GetMessageBase() *ProtoMessageBase {
+	if x != nil {
+		return x.MessageBase
+	}
+	return nil
+}
+
+func (x *ProtoMessageClip) GetData() *ProtoClipRequest {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// Result of a clip request, sent back to the requesting participant
+type ProtoClipResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []string               `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`                           // Names of the written clip files
+	Error         string                 `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`                           // Set if the clip could not be saved
+	RequestId     uint32                 `protobuf:"varint,3,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"` // Of the request this is the result of
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProtoClipResult) Reset() {
+	*x = ProtoClipResult{}
+	mi := &file_messages_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoClipResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoClipResult) ProtoMessage() {}
+
+func (x *ProtoClipResult) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoClipResult.ProtoReflect.Descriptor instead.
+func (*ProtoClipResult) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ProtoClipResult) GetFiles() []string {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
+func (x *ProtoClipResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *ProtoClipResult) GetRequestId() uint32 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+type ProtoMessageClipResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MessageBase   *ProtoMessageBase      `protobuf:"bytes,1,opt,name=message_base,json=messageBase,proto3" json:"message_base,omitempty"`
+	Data          *ProtoClipResult       `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProtoMessageClipResult) Reset() {
+	*x = ProtoMessageClipResult{}
+	mi := &file_messages_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoMessageClipResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoMessageClipResult) ProtoMessage() {}
+
+func (x *ProtoMessageClipResult) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoMessageClipResult.ProtoReflect.Descriptor instead.
+func (*ProtoMessageClipResult) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ProtoMessageClipResult) GetMessageBase() *ProtoMessageBase {
+	if x != nil {
+		return x.MessageBase
+	}
+	return nil
+}
+
+func (x *ProtoMessageClipResult) GetData() *ProtoClipResult {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// Size a participant displays the room video at, in device pixels, to choose a video layer for it
+type ProtoViewport struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Width         uint32                 `protobuf:"varint,1,opt,name=width,proto3" json:"width,omitempty"`
+	Height        uint32                 `protobuf:"varint,2,opt,name=height,proto3" json:"height,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProtoViewport) Reset() {
+	*x = ProtoViewport{}
+	mi := &file_messages_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoViewport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoViewport) ProtoMessage() {}
+
+func (x *ProtoViewport) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoViewport.ProtoReflect.Descriptor instead.
+func (*ProtoViewport) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ProtoViewport) GetWidth() uint32 {
+	if x != nil {
+		return x.Width
+	}
+	return 0
+}
+
+func (x *ProtoViewport) GetHeight() uint32 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+type ProtoMessageViewport struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MessageBase   *ProtoMessageBase      `protobuf:"bytes,1,opt,name=message_base,json=messageBase,proto3" json:"message_base,omitempty"`
+	Data          *ProtoViewport         `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProtoMessageViewport) Reset() {
+	*x = ProtoMessageViewport{}
+	mi := &file_messages_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoMessageViewport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoMessageViewport) ProtoMessage() {}
+
+func (x *ProtoMessageViewport) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoMessageViewport.ProtoReflect.Descriptor instead.
+func (*ProtoMessageViewport) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ProtoMessageViewport) GetMessageBase() *ProtoMessageBase {
+	if x != nil {
+		return x.MessageBase
+	}
+	return nil
+}
+
+func (x *ProtoMessageViewport) GetData() *ProtoViewport {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
 var File_messages_proto protoreflect.FileDescriptor
 
 const file_messages_proto_rawDesc = "" +
@@ -135,7 +458,28 @@ const file_messages_proto_rawDesc = "" +
 	"\alatency\x18\x02 \x01(\v2\x1a.proto.ProtoLatencyTrackerR\alatency\"v\n" +
 	"\x11ProtoMessageInput\x12:\n" +
 	"\fmessage_base\x18\x01 \x01(\v2\x17.proto.ProtoMessageBaseR\vmessageBase\x12%\n" +
-	"\x04data\x18\x02 \x01(\v2\x11.proto.ProtoInputR\x04dataB\x16Z\x14relay/internal/protob\x06proto3"
+	"\x04data\x18\x02 \x01(\v2\x11.proto.ProtoInputR\x04data\"\\\n" +
+	"\x10ProtoClipRequest\x12)\n" +
+	"\x10duration_seconds\x18\x01 \x01(\rR\x0fdurationSeconds\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\rR\trequestId\"{\n" +
+	"\x10ProtoMessageClip\x12:\n" +
+	"\fmessage_base\x18\x01 \x01(\v2\x17.proto.ProtoMessageBaseR\vmessageBase\x12+\n" +
+	"\x04data\x18\x02 \x01(\v2\x17.proto.ProtoClipRequestR\x04data\"\\\n" +
+	"\x0fProtoClipResult\x12\x14\n" +
+	"\x05files\x18\x01 \x03(\tR\x05files\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x03 \x01(\rR\trequestId\"\x80\x01\n" +
+	"\x16ProtoMessageClipResult\x12:\n" +
+	"\fmessage_base\x18\x01 \x01(\v2\x17.proto.ProtoMessageBaseR\vmessageBase\x12*\n" +
+	"\x04data\x18\x02 \x01(\v2\x16.proto.ProtoClipResultR\x04data\"=\n" +
+	"\rProtoViewport\x12\x14\n" +
+	"\x05width\x18\x01 \x01(\rR\x05width\x12\x16\n" +
+	"\x06height\x18\x02 \x01(\rR\x06height\"|\n" +
+	"\x14ProtoMessageViewport\x12:\n" +
+	"\fmessage_base\x18\x01 \x01(\v2\x17.proto.ProtoMessageBaseR\vmessageBase\x12(\n" +
+	"\x04data\x18\x02 \x01(\v2\x14.proto.ProtoViewportR\x04dataB\x16Z\x14relay/internal/protob\x06proto3"
 
 var (
 	file_messages_proto_rawDescOnce sync.Once
@@ -149,22 +493,34 @@ func file_messages_proto_rawDescGZIP() []byte {
 	return file_messages_proto_rawDescData
 }
 
-var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_messages_proto_goTypes = []any{
-	(*ProtoMessageBase)(nil),    // 0: proto.ProtoMessageBase
-	(*ProtoMessageInput)(nil),   // 1: proto.ProtoMessageInput
-	(*ProtoLatencyTracker)(nil), // 2: proto.ProtoLatencyTracker
-	(*ProtoInput)(nil),          // 3: proto.ProtoInput
+	(*ProtoMessageBase)(nil),       // 0: proto.ProtoMessageBase
+	(*ProtoMessageInput)(nil),      // 1: proto.ProtoMessageInput
+	(*ProtoClipRequest)(nil),       // 2: proto.ProtoClipRequest
+	(*ProtoMessageClip)(nil),       // 3: proto.ProtoMessageClip
+	(*ProtoClipResult)(nil),        // 4: proto.ProtoClipResult
+	(*ProtoMessageClipResult)(nil), // 5: proto.ProtoMessageClipResult
+	(*ProtoViewport)(nil),          // 6: proto.ProtoViewport
+	(*ProtoMessageViewport)(nil),   // 7: proto.ProtoMessageViewport
+	(*ProtoLatencyTracker)(nil),    // 8: proto.ProtoLatencyTracker
+	(*ProtoInput)(nil),             // 9: proto.ProtoInput
 }
 var file_messages_proto_depIdxs = []int32{
-	2, // 0: proto.ProtoMessageBase.latency:type_name -> proto.ProtoLatencyTracker
+	8, // 0: proto.ProtoMessageBase.latency:type_name -> proto.ProtoLatencyTracker
 	0, // 1: proto.ProtoMessageInput.message_base:type_name -> proto.ProtoMessageBase
-	3, // 2: proto.ProtoMessageInput.data:type_name -> proto.ProtoInput
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	9, // 2: proto.ProtoMessageInput.data:type_name -> proto.ProtoInput
+	0, // 3: proto.ProtoMessageClip.message_base:type_name -> proto.ProtoMessageBase
+	2, // 4: proto.ProtoMessageClip.data:type_name -> proto.ProtoClipRequest
+	0, // 5: proto.ProtoMessageClipResult.message_base:type_name -> proto.ProtoMessageBase
+	4, // 6: proto.ProtoMessageClipResult.data:type_name -> proto.ProtoClipResult
+	0, // 7: proto.ProtoMessageViewport.message_base:type_name -> proto.ProtoMessageBase
+	6, // 8: proto.ProtoMessageViewport.data:type_name -> proto.ProtoViewport
+	9, // [9:9] is the sub-list for method output_type
+	9, // [9:9] is the sub-list for method input_type
+	9, // [9:9] is the sub-list for extension type_name
+	9, // [9:9] is the sub-list for extension extendee
+	0, // [0:9] is the sub-list for field type_name
 }
 
 func init() { file_messages_proto_init() }
@@ -180,7 +536,7 @@ func file_messages_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_messages_proto_rawDesc), len(file_messages_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
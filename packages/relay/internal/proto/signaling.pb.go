@@ -0,0 +1,496 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: signaling.proto
+
+package proto
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// SignalingMessage is the envelope of stream-request and stream-push signaling.
+type SignalingMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Type:
+	//
+	//	*SignalingMessage_RoomRequest
+	//	*SignalingMessage_Accepted
+	//	*SignalingMessage_Offer
+	//	*SignalingMessage_Answer
+	//	*SignalingMessage_IceCandidate
+	//	*SignalingMessage_Online
+	//	*SignalingMessage_Offline
+	//	*SignalingMessage_Error
+	Type          isSignalingMessage_Type `protobuf_oneof:"type"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalingMessage) Reset() {
+	*x = SignalingMessage{}
+	mi := &file_signaling_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalingMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalingMessage) ProtoMessage() {}
+
+func (x *SignalingMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalingMessage.ProtoReflect.Descriptor instead.
+func (*SignalingMessage) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SignalingMessage) GetType() isSignalingMessage_Type {
+	if x != nil {
+		return x.Type
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetRoomRequest() *RoomRequest {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_RoomRequest); ok {
+			return x.RoomRequest
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetAccepted() *RoomStatus {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_Accepted); ok {
+			return x.Accepted
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetOffer() *SessionDescription {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_Offer); ok {
+			return x.Offer
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetAnswer() *SessionDescription {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_Answer); ok {
+			return x.Answer
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetIceCandidate() *ICECandidateInit {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_IceCandidate); ok {
+			return x.IceCandidate
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetOnline() *RoomStatus {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_Online); ok {
+			return x.Online
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetOffline() *RoomStatus {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_Offline); ok {
+			return x.Offline
+		}
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetError() *SignalingError {
+	if x != nil {
+		if x, ok := x.Type.(*SignalingMessage_Error); ok {
+			return x.Error
+		}
+	}
+	return nil
+}
+
+type isSignalingMessage_Type interface {
+	isSignalingMessage_Type()
+}
+
+type SignalingMessage_RoomRequest struct {
+	RoomRequest *RoomRequest `protobuf:"bytes,1,opt,name=room_request,json=roomRequest,proto3,oneof"` // request or push of a room stream
+}
+
+type SignalingMessage_Accepted struct {
+	Accepted *RoomStatus `protobuf:"bytes,2,opt,name=accepted,proto3,oneof"` // push accepted for room
+}
+
+type SignalingMessage_Offer struct {
+	Offer *SessionDescription `protobuf:"bytes,3,opt,name=offer,proto3,oneof"`
+}
+
+type SignalingMessage_Answer struct {
+	Answer *SessionDescription `protobuf:"bytes,4,opt,name=answer,proto3,oneof"`
+}
+
+type SignalingMessage_IceCandidate struct {
+	IceCandidate *ICECandidateInit `protobuf:"bytes,5,opt,name=ice_candidate,json=iceCandidate,proto3,oneof"`
+}
+
+type SignalingMessage_Online struct {
+	Online *RoomStatus `protobuf:"bytes,6,opt,name=online,proto3,oneof"` // requested room came online
+}
+
+type SignalingMessage_Offline struct {
+	Offline *RoomStatus `protobuf:"bytes,7,opt,name=offline,proto3,oneof"` // requested room is offline
+}
+
+type SignalingMessage_Error struct {
+	Error *SignalingError `protobuf:"bytes,8,opt,name=error,proto3,oneof"`
+}
+
+func (*SignalingMessage_RoomRequest) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_Accepted) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_Offer) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_Answer) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_IceCandidate) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_Online) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_Offline) isSignalingMessage_Type() {}
+
+func (*SignalingMessage_Error) isSignalingMessage_Type() {}
+
+// RoomRequest names the room a stream is requested from or pushed to.
+type RoomRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RoomName      string                 `protobuf:"bytes,1,opt,name=room_name,json=roomName,proto3" json:"room_name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RoomRequest) Reset() {
+	*x = RoomRequest{}
+	mi := &file_signaling_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RoomRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RoomRequest) ProtoMessage() {}
+
+func (x *RoomRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RoomRequest.ProtoReflect.Descriptor instead.
+func (*RoomRequest) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RoomRequest) GetRoomName() string {
+	if x != nil {
+		return x.RoomName
+	}
+	return ""
+}
+
+// RoomStatus tells the availability of a room.
+type RoomStatus struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RoomName      string                 `protobuf:"bytes,1,opt,name=room_name,json=roomName,proto3" json:"room_name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RoomStatus) Reset() {
+	*x = RoomStatus{}
+	mi := &file_signaling_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RoomStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RoomStatus) ProtoMessage() {}
+
+func (x *RoomStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RoomStatus.ProtoReflect.Descriptor instead.
+func (*RoomStatus) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RoomStatus) GetRoomName() string {
+	if x != nil {
+		return x.RoomName
+	}
+	return ""
+}
+
+// SessionDescription is an SDP offer or answer, type is given by the envelope.
+type SessionDescription struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sdp           string                 `protobuf:"bytes,1,opt,name=sdp,proto3" json:"sdp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionDescription) Reset() {
+	*x = SessionDescription{}
+	mi := &file_signaling_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionDescription) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionDescription) ProtoMessage() {}
+
+func (x *SessionDescription) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionDescription.ProtoReflect.Descriptor instead.
+func (*SessionDescription) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SessionDescription) GetSdp() string {
+	if x != nil {
+		return x.Sdp
+	}
+	return ""
+}
+
+// SignalingError rejects a signaling request.
+type SignalingError struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          string                 `protobuf:"bytes,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	RoomName      string                 `protobuf:"bytes,3,opt,name=room_name,json=roomName,proto3" json:"room_name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalingError) Reset() {
+	*x = SignalingError{}
+	mi := &file_signaling_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalingError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalingError) ProtoMessage() {}
+
+func (x *SignalingError) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalingError.ProtoReflect.Descriptor instead.
+func (*SignalingError) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SignalingError) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *SignalingError) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *SignalingError) GetRoomName() string {
+	if x != nil {
+		return x.RoomName
+	}
+	return ""
+}
+
+var File_signaling_proto protoreflect.FileDescriptor
+
+const file_signaling_proto_rawDesc = "" +
+	"\n" +
+	"\x0fsignaling.proto\x12\x05proto\x1a\fwebrtc.proto\"\xb7\x03\n" +
+	"\x10SignalingMessage\x127\n" +
+	"\froom_request\x18\x01 \x01(\v2\x12.proto.RoomRequestH\x00R\vroomRequest\x12/\n" +
+	"\baccepted\x18\x02 \x01(\v2\x11.proto.RoomStatusH\x00R\baccepted\x121\n" +
+	"\x05offer\x18\x03 \x01(\v2\x19.proto.SessionDescriptionH\x00R\x05offer\x123\n" +
+	"\x06answer\x18\x04 \x01(\v2\x19.proto.SessionDescriptionH\x00R\x06answer\x12>\n" +
+	"\rice_candidate\x18\x05 \x01(\v2\x17.proto.ICECandidateInitH\x00R\ficeCandidate\x12+\n" +
+	"\x06online\x18\x06 \x01(\v2\x11.proto.RoomStatusH\x00R\x06online\x12-\n" +
+	"\aoffline\x18\a \x01(\v2\x11.proto.RoomStatusH\x00R\aoffline\x12-\n" +
+	"\x05error\x18\b \x01(\v2\x15.proto.SignalingErrorH\x00R\x05errorB\x06\n" +
+	"\x04type\"*\n" +
+	"\vRoomRequest\x12\x1b\n" +
+	"\troom_name\x18\x01 \x01(\tR\broomName\")\n" +
+	"\n" +
+	"RoomStatus\x12\x1b\n" +
+	"\troom_name\x18\x01 \x01(\tR\broomName\"&\n" +
+	"\x12SessionDescription\x12\x10\n" +
+	"\x03sdp\x18\x01 \x01(\tR\x03sdp\"[\n" +
+	"\x0eSignalingError\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\tR\x04code\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12\x1b\n" +
+	"\troom_name\x18\x03 \x01(\tR\broomNameB\x16Z\x14relay/internal/protob\x06proto3"
+
+var (
+	file_signaling_proto_rawDescOnce sync.Once
+	file_signaling_proto_rawDescData []byte
+)
+
+func file_signaling_proto_rawDescGZIP() []byte {
+	file_signaling_proto_rawDescOnce.Do(func() {
+		file_signaling_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_signaling_proto_rawDesc), len(file_signaling_proto_rawDesc)))
+	})
+	return file_signaling_proto_rawDescData
+}
+
+var file_signaling_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_signaling_proto_goTypes = []any{
+	(*SignalingMessage)(nil),   // 0: proto.SignalingMessage
+	(*RoomRequest)(nil),        // 1: proto.RoomRequest
+	(*RoomStatus)(nil),         // 2: proto.RoomStatus
+	(*SessionDescription)(nil), // 3: proto.SessionDescription
+	(*SignalingError)(nil),     // 4: proto.SignalingError
+	(*ICECandidateInit)(nil),   // 5: proto.ICECandidateInit
+}
+var file_signaling_proto_depIdxs = []int32{
+	1, // 0: proto.SignalingMessage.room_request:type_name -> proto.RoomRequest
+	2, // 1: proto.SignalingMessage.accepted:type_name -> proto.RoomStatus
+	3, // 2: proto.SignalingMessage.offer:type_name -> proto.SessionDescription
+	3, // 3: proto.SignalingMessage.answer:type_name -> proto.SessionDescription
+	5, // 4: proto.SignalingMessage.ice_candidate:type_name -> proto.ICECandidateInit
+	2, // 5: proto.SignalingMessage.online:type_name -> proto.RoomStatus
+	2, // 6: proto.SignalingMessage.offline:type_name -> proto.RoomStatus
+	4, // 7: proto.SignalingMessage.error:type_name -> proto.SignalingError
+	8, // [8:8] is the sub-list for method output_type
+	8, // [8:8] is the sub-list for method input_type
+	8, // [8:8] is the sub-list for extension type_name
+	8, // [8:8] is the sub-list for extension extendee
+	0, // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_signaling_proto_init() }
+func file_signaling_proto_init() {
+	if File_signaling_proto != nil {
+		return
+	}
+	file_webrtc_proto_init()
+	file_signaling_proto_msgTypes[0].OneofWrappers = []any{
+		(*SignalingMessage_RoomRequest)(nil),
+		(*SignalingMessage_Accepted)(nil),
+		(*SignalingMessage_Offer)(nil),
+		(*SignalingMessage_Answer)(nil),
+		(*SignalingMessage_IceCandidate)(nil),
+		(*SignalingMessage_Online)(nil),
+		(*SignalingMessage_Offline)(nil),
+		(*SignalingMessage_Error)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_signaling_proto_rawDesc), len(file_signaling_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_signaling_proto_goTypes,
+		DependencyIndexes: file_signaling_proto_depIdxs,
+		MessageInfos:      file_signaling_proto_msgTypes,
+	}.Build()
+	File_signaling_proto = out.File
+	file_signaling_proto_goTypes = nil
+	file_signaling_proto_depIdxs = nil
+}
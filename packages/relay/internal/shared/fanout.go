@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// fanoutQueueSize is how many packets may wait for a binding before it's considered behind, power of two
+	fanoutQueueSize = 1024
+	// fanoutPacketSize is the initial buffer capacity of pooled packets, enough for a packet of common MTU
+	fanoutPacketSize = 1500
+)
+
+// --- Pooled Packets ---
+
+// fanoutPacket is a pooled copy of a packet written to a track, shared by the queues of its bindings and the
+// keyframe cache. Returned to the pool once all of them released it
+type fanoutPacket struct {
+	packet     rtp.Packet // unmarshaled from buf, so it's all in pooled memory
+	buf        []byte
+	keyframe   bool   // whether the packet starts a keyframe
+	encoding   int    // simulcast encoding the packet belongs to
+	layer      Layer  // spatial layer is the encoding for simulcast
+	frameStart bool   // whether the packet starts a frame of its layer
+	frameEnd   bool   // whether the packet ends a frame of its layer
+	switchUp   bool   // whether higher temporal layers may be switched to from here on
+	generation uint64 // keyframe cache generation the packet was written in
+	refs       atomic.Int32
+}
+
+var fanoutPacketPool = sync.Pool{
+	New: func() any {
+		return &fanoutPacket{buf: make([]byte, fanoutPacketSize)}
+	},
+}
+
+// newFanoutPacket copies a packet into a pooled one, holding a single reference
+func newFanoutPacket(packet *rtp.Packet, keyframe bool, encoding int, packetLayer PacketLayer) (*fanoutPacket, error) {
+	fp := fanoutPacketPool.Get().(*fanoutPacket)
+	size := packet.MarshalSize()
+	if cap(fp.buf) < size {
+		fp.buf = make([]byte, size)
+	}
+	n, err := packet.MarshalTo(fp.buf[:size])
+	if err == nil {
+		err = fp.packet.Unmarshal(fp.buf[:n])
+	}
+	if err != nil {
+		fanoutPacketPool.Put(fp)
+		return nil, err
+	}
+	fp.keyframe = keyframe
+	fp.encoding = encoding
+	fp.layer = Layer{Spatial: packetLayer.Spatial, Temporal: packetLayer.Temporal}
+	fp.frameStart = packetLayer.FrameStart
+	fp.frameEnd = packetLayer.FrameEnd
+	fp.switchUp = packetLayer.SwitchUp
+	fp.generation = 0
+	fp.refs.Store(1)
+	return fp, nil
+}
+
+// retain takes another reference to the packet
+func (fp *fanoutPacket) retain() {
+	fp.refs.Add(1)
+}
+
+// release drops a reference to the packet, returning it to the pool with the last one
+func (fp *fanoutPacket) release() {
+	if fp.refs.Add(-1) == 0 {
+		fanoutPacketPool.Put(fp)
+	}
+}
+
+// --- Queue ---
+
+// queuedPacket is a packet queued for a binding, with the sequence number, timestamp and marker it's sent with
+type queuedPacket struct {
+	fp             *fanoutPacket
+	sequenceNumber uint16
+	timestamp      uint32
+	marker         bool
+	layer          Layer // layer the binding was forwarding when the packet was queued
+	svc            bool  // whether the track carries SVC spatial layers, frames of which end a picture for the binding
+}
+
+// fanoutQueue is a bounded lock-free ring of packets, with a single producer and a single consumer
+type fanoutQueue struct {
+	slots [fanoutQueueSize]queuedPacket
+	head  atomic.Uint64 // next slot to pop, advanced by the consumer
+	tail  atomic.Uint64 // next slot to push, advanced by the producer
+	ready chan struct{} // wakes up the consumer after a push
+}
+
+func newFanoutQueue() *fanoutQueue {
+	return &fanoutQueue{ready: make(chan struct{}, 1)}
+}
+
+// push queues a packet, false if the queue is full
+func (q *fanoutQueue) push(entry queuedPacket) bool {
+	tail := q.tail.Load()
+	if tail-q.head.Load() == fanoutQueueSize {
+		return false
+	}
+	q.slots[tail%fanoutQueueSize] = entry
+	q.tail.Store(tail + 1)
+	select {
+	case q.ready <- struct{}{}:
+	default: // Consumer is already woken up
+	}
+	return true
+}
+
+// pop dequeues the oldest packet, false if the queue is empty
+func (q *fanoutQueue) pop() (queuedPacket, bool) {
+	head := q.head.Load()
+	if head == q.tail.Load() {
+		return queuedPacket{}, false
+	}
+	entry := q.slots[head%fanoutQueueSize]
+	q.slots[head%fanoutQueueSize] = queuedPacket{}
+	q.head.Store(head + 1)
+	return entry, true
+}
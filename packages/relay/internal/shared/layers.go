@@ -0,0 +1,295 @@
+package shared
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Layer is a video layer served to participants. For simulcast the spatial layer is the index of an encoding,
+// for SVC it's the spatial layer ID. Temporal layers of either are identified by their ID
+type Layer struct {
+	Spatial  int `json:"spatial"`
+	Temporal int `json:"temporal"`
+}
+
+// Resolution is the size of video frames in pixels
+type Resolution struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// LayerInfo describes a layer of a video track as received, for choosing one to serve
+type LayerInfo struct {
+	Layer
+	Resolution         // zero if not known
+	Bitrate    float64 // bits per second, including lower layers the layer depends on
+}
+
+// PacketLayer is the layer of a video packet, as far as its payload descriptor or header extensions tell
+type PacketLayer struct {
+	Spatial     int
+	Temporal    int
+	FrameStart  bool         // whether the packet starts a frame of its layer
+	FrameEnd    bool         // whether the packet ends a frame of its layer
+	SwitchUp    bool         // whether higher temporal layers may be switched to from this frame on
+	Resolutions []Resolution // of each spatial layer, set by packets announcing them
+}
+
+// --- Parsing ---
+
+// LayerParser parses the layers of the packets of a received video track
+type LayerParser struct {
+	mimeType      string
+	ddExtensionID uint8              // ID of the dependency descriptor header extension, 0 if not negotiated
+	ddStructure   *templateStructure // latest template dependency structure announced
+}
+
+// NewLayerParser creates a parser of the layers of a video track of given codec. AV1 layers are only known from
+// the dependency descriptor header extension with given ID, 0 if the track has none
+func NewLayerParser(mimeType string, ddExtensionID uint8) *LayerParser {
+	return &LayerParser{
+		mimeType:      mimeType,
+		ddExtensionID: ddExtensionID,
+	}
+}
+
+// Parse returns the layer of a packet, the zero layer for codecs and packets without layer information
+func (p *LayerParser) Parse(packet *rtp.Packet) PacketLayer {
+	switch {
+	case strings.EqualFold(p.mimeType, webrtc.MimeTypeVP8):
+		return parseVP8Layer(packet.Payload)
+	case strings.EqualFold(p.mimeType, webrtc.MimeTypeVP9):
+		return parseVP9Layer(packet.Payload)
+	case p.ddExtensionID != 0:
+		if descriptor := packet.GetExtension(p.ddExtensionID); descriptor != nil {
+			return p.parseDependencyDescriptor(descriptor)
+		}
+	}
+	return PacketLayer{}
+}
+
+// parseVP8Layer parses the temporal layer of a VP8 packet, and the resolution of keyframes
+func parseVP8Layer(payload []byte) PacketLayer {
+	var layer PacketLayer
+	if len(payload) < 1 {
+		return layer
+	}
+	i := 1
+	if payload[0]&0x80 != 0 { // Extended control bits
+		if len(payload) < 2 {
+			return layer
+		}
+		ext := payload[1]
+		i = 2
+		if ext&0x80 != 0 && i < len(payload) { // PictureID, 7 or 15 bits
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 && i < len(payload) { // TID/Y/KEYIDX
+			layer.Temporal = int(payload[i] >> 6)
+			layer.SwitchUp = payload[i]&0x20 != 0
+			i++
+		}
+	}
+	layer.FrameStart = payload[0]&0x10 != 0 && payload[0]&0x07 == 0
+	// Keyframes start with a start code followed by the frame size
+	if layer.FrameStart && i+10 <= len(payload) && payload[i]&0x01 == 0 &&
+		payload[i+3] == 0x9d && payload[i+4] == 0x01 && payload[i+5] == 0x2a {
+		layer.Resolutions = []Resolution{{
+			Width:  int(binary.LittleEndian.Uint16(payload[i+6:]) & 0x3fff),
+			Height: int(binary.LittleEndian.Uint16(payload[i+8:]) & 0x3fff),
+		}}
+	}
+	return layer
+}
+
+// parseVP9Layer parses the spatial and temporal layer of a VP9 packet, and the resolutions of its scalability structure
+func parseVP9Layer(payload []byte) PacketLayer {
+	var layer PacketLayer
+	if len(payload) < 1 {
+		return layer
+	}
+	flexible := payload[0]&0x10 != 0
+	layer.FrameStart = payload[0]&0x08 != 0
+	layer.FrameEnd = payload[0]&0x04 != 0
+	i := 1
+	if payload[0]&0x80 != 0 && i < len(payload) { // Picture ID, 7 or 15 bits
+		if payload[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if payload[0]&0x20 != 0 && i < len(payload) { // Layer indices
+		layer.Temporal = int(payload[i] >> 5)
+		layer.SwitchUp = payload[i]&0x10 != 0
+		layer.Spatial = int(payload[i]>>1) & 0x07
+		i++
+		if !flexible {
+			i++ // TL0PICIDX
+		}
+	}
+	if flexible && payload[0]&0x40 != 0 { // Reference indices, up to three
+		for n := 0; n < 3 && i < len(payload); n++ {
+			i++
+			if payload[i-1]&0x01 == 0 {
+				break
+			}
+		}
+	}
+	if payload[0]&0x02 != 0 && i < len(payload) { // Scalability structure
+		spatialLayers := int(payload[i]>>5) + 1
+		hasResolutions := payload[i]&0x10 != 0
+		i++
+		if hasResolutions && i+4*spatialLayers <= len(payload) {
+			layer.Resolutions = make([]Resolution, spatialLayers)
+			for s := range layer.Resolutions {
+				layer.Resolutions[s] = Resolution{
+					Width:  int(binary.BigEndian.Uint16(payload[i:])),
+					Height: int(binary.BigEndian.Uint16(payload[i+2:])),
+				}
+				i += 4
+			}
+		}
+	}
+	return layer
+}
+
+// --- Dependency Descriptor ---
+
+// templateStructure is the part of a template dependency structure of the AV1 dependency descriptor
+// needed to tell the layers of frames
+type templateStructure struct {
+	templateIDOffset int
+	spatial          []int // template index -> spatial layer ID
+	temporal         []int // template index -> temporal layer ID
+	resolutions      []Resolution
+}
+
+// parseDependencyDescriptor parses the layer of a frame from its dependency descriptor, keeping announced
+// template dependency structures for the frames that follow
+func (p *LayerParser) parseDependencyDescriptor(descriptor []byte) PacketLayer {
+	var layer PacketLayer
+	if len(descriptor) < 3 {
+		return layer
+	}
+	layer.FrameStart = descriptor[0]&0x80 != 0
+	layer.FrameEnd = descriptor[0]&0x40 != 0
+	templateID := int(descriptor[0] & 0x3f)
+
+	if len(descriptor) > 3 && descriptor[3]&0x80 != 0 {
+		if structure, ok := parseTemplateStructure(&bitReader{data: descriptor, offset: 3*8 + 5}); ok {
+			p.ddStructure = structure
+			layer.Resolutions = structure.resolutions
+		}
+	}
+	if p.ddStructure == nil {
+		return layer
+	}
+	index := (templateID + 64 - p.ddStructure.templateIDOffset) % 64
+	if index >= len(p.ddStructure.spatial) {
+		return layer
+	}
+	layer.Spatial = p.ddStructure.spatial[index]
+	layer.Temporal = p.ddStructure.temporal[index]
+	// Base temporal frames of common structures are referenced by all frames that follow
+	layer.SwitchUp = layer.Temporal == 0
+	return layer
+}
+
+// parseTemplateStructure parses a template dependency structure, false if it's malformed
+func parseTemplateStructure(r *bitReader) (*templateStructure, bool) {
+	structure := &templateStructure{templateIDOffset: r.read(6)}
+	decodeTargets := r.read(5) + 1
+
+	// Template layers
+	spatial, temporal, maxSpatial := 0, 0, 0
+	for {
+		structure.spatial = append(structure.spatial, spatial)
+		structure.temporal = append(structure.temporal, temporal)
+		next := r.read(2)
+		if next == 1 {
+			temporal++
+		} else if next == 2 {
+			temporal = 0
+			spatial++
+			maxSpatial = spatial
+		}
+		if next == 3 || r.failed || len(structure.spatial) > 64 {
+			break
+		}
+	}
+	templates := len(structure.spatial)
+
+	// Decode target indications, frame diffs and chains are only skipped over
+	r.skip(2 * templates * decodeTargets)
+	for t := 0; t < templates && !r.failed; t++ {
+		for r.read(1) == 1 && !r.failed {
+			r.skip(4)
+		}
+	}
+	if chains := r.readNonSymmetric(decodeTargets + 1); chains > 0 {
+		for dt := 0; dt < decodeTargets; dt++ {
+			r.readNonSymmetric(chains)
+		}
+		r.skip(4 * templates * chains)
+	}
+
+	if r.read(1) == 1 { // Render resolutions
+		for s := 0; s <= maxSpatial; s++ {
+			structure.resolutions = append(structure.resolutions, Resolution{
+				Width:  r.read(16) + 1,
+				Height: r.read(16) + 1,
+			})
+		}
+	}
+	return structure, !r.failed
+}
+
+// bitReader reads big-endian bit fields, failing on reads past the end
+type bitReader struct {
+	data   []byte
+	offset int // in bits
+	failed bool
+}
+
+func (r *bitReader) read(bits int) int {
+	value := 0
+	for ; bits > 0; bits-- {
+		if r.offset >= len(r.data)*8 {
+			r.failed = true
+			return 0
+		}
+		value = value<<1 | int(r.data[r.offset/8]>>(7-r.offset%8))&1
+		r.offset++
+	}
+	return value
+}
+
+func (r *bitReader) skip(bits int) {
+	r.offset += bits
+	if r.offset > len(r.data)*8 {
+		r.failed = true
+	}
+}
+
+// readNonSymmetric reads a non-symmetric unsigned value of less than n
+func (r *bitReader) readNonSymmetric(n int) int {
+	w := 0
+	for x := n; x != 0; x >>= 1 {
+		w++
+	}
+	m := 1<<w - n
+	v := r.read(w - 1)
+	if v < m {
+		return v
+	}
+	return v<<1 - m + r.read(1)
+}
@@ -0,0 +1,238 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+// bitWriter writes big-endian bit fields, the counterpart of bitReader
+type bitWriter struct {
+	data []byte
+	bits int
+}
+
+func (w *bitWriter) write(value, bits int) {
+	for bits--; bits >= 0; bits-- {
+		if w.bits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte((value>>bits)&1) << (7 - w.bits%8)
+		w.bits++
+	}
+}
+
+// testDescriptor returns a dependency descriptor of a frame of given template ID, announcing a template
+// dependency structure of two spatial layers with two temporal layers each if structure is set
+func testDescriptor(templateID int, structure bool) []byte {
+	w := &bitWriter{}
+	w.write(1, 1)          // Start of frame
+	w.write(1, 1)          // End of frame
+	w.write(templateID, 6) // Template ID
+	w.write(1234, 16)      // Frame number
+	if !structure {
+		return w.data
+	}
+	w.write(1, 1) // Template dependency structure present
+	w.write(0, 4) // No active decode targets, custom DTIs, frame diffs or chains
+
+	const templates, decodeTargets = 4, 4
+	w.write(10, 6)              // Template ID offset
+	w.write(decodeTargets-1, 5) // Decode targets
+	w.write(1, 2)               // S0T0 -> S0T1
+	w.write(2, 2)               // S0T1 -> S1T0
+	w.write(1, 2)               // S1T0 -> S1T1
+	w.write(3, 2)               // No more templates
+	w.write(0, 2*templates*decodeTargets)
+	for range templates {
+		w.write(0, 1) // No frame diffs
+	}
+	w.write(0, 2) // No chains
+	w.write(1, 1) // Render resolutions
+	for _, resolution := range []Resolution{{640, 360}, {1280, 720}} {
+		w.write(resolution.Width-1, 16)
+		w.write(resolution.Height-1, 16)
+	}
+	return w.data
+}
+
+func TestParseDependencyDescriptor(t *testing.T) {
+	parser := NewLayerParser("video/AV1", 1)
+
+	// Frames are of unknown layers until a structure is announced
+	if layer := parser.parseDependencyDescriptor(testDescriptor(12, false)); layer.Spatial != 0 || layer.Temporal != 0 || !layer.FrameStart {
+		t.Errorf("frame without structure has layer %+v, want base layer starting a frame", layer)
+	}
+
+	layer := parser.parseDependencyDescriptor(testDescriptor(12, true))
+	want := PacketLayer{
+		Spatial:     1,
+		FrameStart:  true,
+		FrameEnd:    true,
+		SwitchUp:    true,
+		Resolutions: []Resolution{{640, 360}, {1280, 720}},
+	}
+	if !reflect.DeepEqual(layer, want) {
+		t.Errorf("frame announcing structure has layer %+v, want %+v", layer, want)
+	}
+
+	// Following frames use the announced structure
+	tests := []struct {
+		templateID int
+		want       Layer
+	}{
+		{10, Layer{0, 0}},
+		{11, Layer{0, 1}},
+		{12, Layer{1, 0}},
+		{13, Layer{1, 1}},
+		{14, Layer{0, 0}}, // Not a template of the structure
+		{9, Layer{0, 0}},
+	}
+	for _, tt := range tests {
+		layer = parser.parseDependencyDescriptor(testDescriptor(tt.templateID, false))
+		if got := (Layer{layer.Spatial, layer.Temporal}); got != tt.want {
+			t.Errorf("frame of template %d has layer %+v, want %+v", tt.templateID, got, tt.want)
+		}
+		if layer.Resolutions != nil {
+			t.Errorf("frame of template %d announces resolutions %v, want none", tt.templateID, layer.Resolutions)
+		}
+	}
+
+	// Truncated structures are ignored, the previous one stays
+	full := testDescriptor(13, true)
+	for size := 4; size < len(full); size++ {
+		layer = parser.parseDependencyDescriptor(full[:size])
+		if layer.Resolutions != nil || layer.Spatial != 1 || layer.Temporal != 1 {
+			t.Errorf("descriptor truncated to %d bytes has layer %+v, want S1T1 of previous structure", size, layer)
+		}
+	}
+	if layer = parser.parseDependencyDescriptor(full[:2]); !reflect.DeepEqual(layer, PacketLayer{}) {
+		t.Errorf("descriptor truncated to 2 bytes has layer %+v, want none", layer)
+	}
+}
+
+func TestParseVP8Layer(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    PacketLayer
+	}{
+		{
+			name:    "keyframe with resolution",
+			payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0x68, 0x01},
+			want:    PacketLayer{FrameStart: true, Resolutions: []Resolution{{640, 360}}},
+		},
+		{
+			name:    "keyframe truncated before resolution",
+			payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02},
+			want:    PacketLayer{FrameStart: true},
+		},
+		{
+			name:    "temporal layer with long picture id",
+			payload: []byte{0x90, 0xe0, 0x80, 0x01, 0x05, 0xa0, 0x01},
+			want:    PacketLayer{Temporal: 2, SwitchUp: true, FrameStart: true},
+		},
+		{
+			name:    "temporal layer with short picture id",
+			payload: []byte{0x90, 0xa0, 0x05, 0x40, 0x01},
+			want:    PacketLayer{Temporal: 1, FrameStart: true},
+		},
+		{
+			name:    "continuation",
+			payload: []byte{0x80, 0x20, 0x40},
+			want:    PacketLayer{Temporal: 1},
+		},
+		{
+			name:    "truncated extension",
+			payload: []byte{0x90},
+			want:    PacketLayer{},
+		},
+		{
+			name:    "truncated picture id",
+			payload: []byte{0x90, 0xe0},
+			want:    PacketLayer{FrameStart: true},
+		},
+		{
+			name:    "truncated temporal layer",
+			payload: []byte{0x90, 0xe0, 0x80, 0x01, 0x05},
+			want:    PacketLayer{FrameStart: true},
+		},
+		{
+			name:    "empty",
+			payload: nil,
+			want:    PacketLayer{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseVP8Layer(tt.payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVP8Layer(% x) = %+v, want %+v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVP9Layer(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    PacketLayer
+	}{
+		{
+			name:    "layer indices",
+			payload: []byte{0x28, 0x52, 0x00},
+			want:    PacketLayer{Spatial: 1, Temporal: 2, SwitchUp: true, FrameStart: true},
+		},
+		{
+			name:    "layer indices with long picture id",
+			payload: []byte{0xac, 0x80, 0x01, 0x52, 0x00},
+			want:    PacketLayer{Spatial: 1, Temporal: 2, SwitchUp: true, FrameStart: true, FrameEnd: true},
+		},
+		{
+			name:    "flexible mode with reference indices",
+			payload: []byte{0xf8, 0x05, 0x24, 0x03, 0x04, 0xff},
+			want:    PacketLayer{Spatial: 2, Temporal: 1, FrameStart: true},
+		},
+		{
+			name:    "scalability structure with resolutions",
+			payload: []byte{0x2a, 0x00, 0x00, 0x30, 0x02, 0x80, 0x01, 0x68, 0x05, 0x00, 0x02, 0xd0},
+			want:    PacketLayer{FrameStart: true, Resolutions: []Resolution{{640, 360}, {1280, 720}}},
+		},
+		{
+			name:    "scalability structure truncated",
+			payload: []byte{0x2a, 0x00, 0x00, 0x30, 0x02, 0x80, 0x01, 0x68, 0x05},
+			want:    PacketLayer{FrameStart: true},
+		},
+		{
+			name:    "continuation",
+			payload: []byte{0x24, 0x02, 0x00},
+			want:    PacketLayer{Spatial: 1, FrameEnd: true},
+		},
+		{
+			name:    "truncated picture id",
+			payload: []byte{0xa8},
+			want:    PacketLayer{FrameStart: true},
+		},
+		{
+			name:    "truncated layer indices",
+			payload: []byte{0xa8, 0x80, 0x01},
+			want:    PacketLayer{FrameStart: true},
+		},
+		{
+			name:    "truncated reference indices",
+			payload: []byte{0xf8, 0x05, 0x24, 0x03},
+			want:    PacketLayer{Spatial: 2, Temporal: 1, FrameStart: true},
+		},
+		{
+			name:    "empty",
+			payload: nil,
+			want:    PacketLayer{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseVP9Layer(tt.payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVP9Layer(% x) = %+v, want %+v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,40 +5,137 @@ import (
 	"relay/internal/common"
 	"relay/internal/connections"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
 
+// RTCPHandler is called with RTCP feedback a Participant sent for a track of given kind, sent to it with given SSRC
+type RTCPHandler func(kind webrtc.RTPCodecType, ssrc webrtc.SSRC, packets []rtcp.Packet)
+
 type Participant struct {
 	ID             ulid.ULID
+	PeerID         peer.ID // libp2p peer the participant session belongs to
+	Relay          bool    // whether the peer is a mesh relay, sent all video layers to select from for its own participants
 	PeerConnection *webrtc.PeerConnection
 	DataChannel    *connections.NestriDataChannel
+	rtcpHandler    RTCPHandler
 }
 
-func NewParticipant() (*Participant, error) {
+func NewParticipant(peerID peer.ID) (*Participant, error) {
 	id, err := common.NewULID()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ULID for Participant: %w", err)
 	}
 	return &Participant{
-		ID: id,
+		ID:     id,
+		PeerID: peerID,
 	}, nil
 }
 
-func (p *Participant) addTrack(trackLocal *webrtc.TrackLocalStaticRTP) error {
-	rtpSender, err := p.PeerConnection.AddTrack(trackLocal)
+// OnRTCP sets the handler of RTCP feedback for tracks added afterwards
+func (p *Participant) OnRTCP(handler RTCPHandler) {
+	p.rtcpHandler = handler
+}
+
+// AddTrack adds a track to the Participant's PeerConnection, reading RTCP so interceptors keep working,
+// answering NACKs from the track and handing it to the RTCP handler, if any. Relays are sent video as
+// simulcast of all encodings, or with all layers, and select layers themselves
+func (p *Participant) AddTrack(trackLocal *RoomTrack) error {
+	var tracks []webrtc.TrackLocal
+	var relayTracks []*relayTrack
+	if p.Relay && trackLocal.Kind() == webrtc.RTPCodecTypeVideo {
+		relayTracks = trackLocal.relayTracks()
+		for _, track := range relayTracks {
+			tracks = append(tracks, track)
+		}
+	} else {
+		tracks = append(tracks, trackLocal)
+	}
+	if len(tracks) == 0 {
+		// Simulcast track whose encodings were all removed, as while its upstream fails over
+		return fmt.Errorf("track %s has no simulcast encodings to send", trackLocal.ID())
+	}
+
+	rtpSender, err := p.PeerConnection.AddTrack(tracks[0])
 	if err != nil {
 		return err
 	}
-
-	go func() {
-		rtcpBuffer := make([]byte, 1400)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuffer); rtcpErr != nil {
-				break
+	// Encodings are sent with the MID, known once bound
+	for _, transceiver := range p.PeerConnection.GetTransceivers() {
+		if transceiver.Sender() == rtpSender {
+			for _, track := range relayTracks {
+				track.transceiver = transceiver
 			}
 		}
-	}()
+	}
+	for _, track := range tracks[1:] {
+		if err = rtpSender.AddEncoding(track); err != nil {
+			_ = p.PeerConnection.RemoveTrack(rtpSender)
+			return fmt.Errorf("failed to add simulcast encoding %s: %w", track.RID(), err)
+		}
+	}
 
+	for _, track := range tracks {
+		go p.readRTCP(rtpSender, track.RID(), trackLocal.Kind())
+	}
 	return nil
 }
+
+// Sends reports whether a sender of the Participant sends a track as it would be added now.
+// Relays are sent video per simulcast encoding, so the encodings must match too
+func (p *Participant) Sends(sender *webrtc.RTPSender, track *RoomTrack) bool {
+	if SentTrack(sender) != track {
+		return false
+	}
+	if !p.Relay || track.Kind() != webrtc.RTPCodecTypeVideo {
+		return true
+	}
+	encodings := sender.GetParameters().Encodings
+	tracks := track.relayTracks()
+	if len(encodings) != len(tracks) {
+		return false
+	}
+	for i, encoding := range encodings {
+		if encoding.RID != tracks[i].rid {
+			return false
+		}
+	}
+	return true
+}
+
+// readRTCP reads RTCP of an encoding of a sender until it's closed
+func (p *Participant) readRTCP(rtpSender *webrtc.RTPSender, rid string, kind webrtc.RTPCodecType) {
+	handler := p.rtcpHandler
+	var ssrc webrtc.SSRC
+	for _, encoding := range rtpSender.GetParameters().Encodings {
+		if encoding.RID == rid {
+			ssrc = encoding.SSRC
+			break
+		}
+	}
+	for {
+		var packets []rtcp.Packet
+		var err error
+		if len(rid) > 0 {
+			packets, _, err = rtpSender.ReadSimulcastRTCP(rid)
+		} else {
+			packets, _, err = rtpSender.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				// Track may have been replaced since added, NACKs belong to the one currently sent
+				if track := SentTrack(rtpSender); track != nil {
+					track.Retransmit(nack)
+				}
+			}
+		}
+		if handler != nil {
+			handler(kind, ssrc, packets)
+		}
+	}
+}
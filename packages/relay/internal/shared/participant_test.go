@@ -0,0 +1,274 @@
+package shared
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// newLoopbackAPI returns an API without interceptors, connecting over loopback
+func newLoopbackAPI(t *testing.T) *webrtc.API {
+	t.Helper()
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.SDESRepairRTPStreamIDURI} {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
+}
+
+// signal completes the offer/answer exchange between two PeerConnections
+func signal(t *testing.T, offerer, answerer *webrtc.PeerConnection) {
+	t.Helper()
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err = answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err = offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestParticipantRetransmitAfterReplaceTrack NACKs packets after the sent track was replaced, which must be
+// answered by the replacing track
+func TestParticipantRetransmitAfterReplaceTrack(t *testing.T) {
+	api := newLoopbackAPI(t)
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	first, err := NewRoomTrack(capability, "video", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewRoomTrack(capability, "video", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	participant := &Participant{PeerConnection: sender}
+	if err = participant.AddTrack(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Receiver keeps the last received sequence number
+	var lastSequenceNumber atomic.Int32
+	lastSequenceNumber.Store(-1)
+	var mediaSSRC atomic.Uint32
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		mediaSSRC.Store(uint32(track.SSRC()))
+		for {
+			packet, _, readErr := track.ReadRTP()
+			if readErr != nil {
+				return
+			}
+			lastSequenceNumber.Store(int32(packet.SequenceNumber))
+		}
+	})
+	signal(t, sender, receiver)
+
+	// Keyframes only, so every packet is forwarded right away
+	done := make(chan struct{})
+	defer close(done)
+	var current atomic.Pointer[RoomTrack]
+	current.Store(first)
+	go func() {
+		packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SSRC: 1234, Marker: true}}
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			packet.SequenceNumber++
+			packet.Timestamp += 3000
+			packet.Payload = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+			_ = current.Load().WriteRTP(packet)
+		}
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for lastSequenceNumber.Load() < 0 {
+		select {
+		case <-deadline:
+			t.Fatal("no packets received")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	rtpSender := sender.GetSenders()[0]
+	if err = rtpSender.ReplaceTrack(second); err != nil {
+		t.Fatal(err)
+	}
+	current.Store(second)
+	ssrc := rtpSender.GetParameters().Encodings[0].SSRC
+
+	for {
+		nack := &rtcp.TransportLayerNack{
+			MediaSSRC: mediaSSRC.Load(),
+			Nacks:     rtcp.NackPairsFromSequenceNumbers([]uint16{uint16(lastSequenceNumber.Load())}),
+		}
+		if err = receiver.WriteRTCP([]rtcp.Packet{nack}); err != nil {
+			t.Fatal(err)
+		}
+		if retransmitted, _, ok := second.RetransmitCounts(ssrc); ok && retransmitted > 0 {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatal("NACKs were not answered by the replacing track")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// TestParticipantRelaySimulcast sends a simulcast track to a relay, which must receive every encoding
+func TestParticipantRelaySimulcast(t *testing.T) {
+	api := newLoopbackAPI(t)
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	track, err := NewRoomTrack(capability, "video", "simulcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := []int{track.AddEncoding("l"), track.AddEncoding("h")}
+
+	participant := &Participant{PeerConnection: sender, Relay: true}
+	if err = participant.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if rids := len(sender.GetSenders()[0].GetParameters().Encodings); rids != 2 {
+		t.Fatalf("relay is sent %d encodings, want 2", rids)
+	}
+	if !participant.Sends(sender.GetSenders()[0], track) {
+		t.Fatal("relay is not sent the track as added")
+	}
+
+	var mutex sync.Mutex
+	received := make(map[string]bool)
+	receiver.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, readErr := remote.ReadRTP(); readErr != nil {
+				return
+			}
+			mutex.Lock()
+			received[remote.RID()] = true
+			mutex.Unlock()
+		}
+	})
+	signal(t, sender, receiver)
+
+	// Keyframes only, so every packet is forwarded right away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		packets := make([]*rtp.Packet, len(encodings))
+		for i := range packets {
+			packets[i] = &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SSRC: uint32(100 + i), Marker: true}}
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			for i, packet := range packets {
+				packet.SequenceNumber++
+				packet.Timestamp += 3000
+				packet.Payload = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+				_ = track.WriteLayerRTP(packet, encodings[i], PacketLayer{})
+			}
+		}
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		mutex.Lock()
+		complete := received["l"] && received["h"]
+		mutex.Unlock()
+		if complete {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("relay received encodings %v, want l and h", received)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestParticipantRelayWithoutEncodings adds a simulcast track whose encodings were all removed to a relay,
+// which must fail without adding anything
+func TestParticipantRelayWithoutEncodings(t *testing.T) {
+	sender, err := newLoopbackAPI(t).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	track, err := NewRoomTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "simulcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rid := range []string{"l", "h"} {
+		track.AddEncoding(rid)
+	}
+	for _, rid := range []string{"l", "h"} {
+		track.RemoveEncoding(rid)
+	}
+
+	participant := &Participant{PeerConnection: sender, Relay: true}
+	if err = participant.AddTrack(track); err == nil {
+		t.Fatal("added simulcast track without encodings to relay")
+	}
+	if senders := len(sender.GetSenders()); senders != 0 {
+		t.Errorf("relay has %d senders, want none", senders)
+	}
+}
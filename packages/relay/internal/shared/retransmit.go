@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// retransmitHistorySize is how many recent packets of each encoding, and of each binding, are kept to answer
+// NACKs with, power of two
+const retransmitHistorySize = 1024
+
+// --- Packet History ---
+
+// retransmitCache keeps the recent packets of a video encoding by sequence number, shared by all bindings
+type retransmitCache struct {
+	packets [retransmitHistorySize]*fanoutPacket
+}
+
+// add keeps a written packet, replacing the one of the same slot
+func (c *retransmitCache) add(fp *fanoutPacket) {
+	slot := &c.packets[fp.packet.SequenceNumber%retransmitHistorySize]
+	if *slot != nil {
+		(*slot).release()
+	}
+	fp.retain()
+	*slot = fp
+}
+
+// get returns the kept packet of given sequence number retained for the caller, nil if it's not kept
+func (c *retransmitCache) get(sequenceNumber uint16) *fanoutPacket {
+	fp := c.packets[sequenceNumber%retransmitHistorySize]
+	if fp == nil || fp.packet.SequenceNumber != sequenceNumber {
+		return nil
+	}
+	fp.retain()
+	return fp
+}
+
+// sentPacket is where a packet sent to a binding came from, so it can be looked up when NACKed
+type sentPacket struct {
+	sequenceNumber       uint16 // as sent to the binding
+	sourceSequenceNumber uint16 // as written to the track
+	encoding             int
+	timestamp            uint32 // as sent to the binding
+	marker               bool
+	valid                bool
+}
+
+// retransmitter answers NACKs of a binding, with RTX if negotiated or otherwise by resending packets as they were
+type retransmitter struct {
+	ssrc           uint32 // of the RTX stream, 0 if RTX is not negotiated
+	payloadType    uint8
+	sequenceNumber uint16 // next of the RTX stream
+	sent           [retransmitHistorySize]sentPacket
+	payload        []byte // reused for RTX payloads
+}
+
+// newRetransmitter returns the retransmitter of a binding, sending RTX if a payload type is negotiated for the codec
+func newRetransmitter(ctx webrtc.TrackLocalContext, codec webrtc.RTPCodecParameters) *retransmitter {
+	r := &retransmitter{sequenceNumber: uint16(rand.Uint32())}
+	if ssrc := ctx.SSRCRetransmission(); ssrc != 0 {
+		if payloadType, ok := rtxPayloadType(ctx.CodecParameters(), codec.PayloadType); ok {
+			r.ssrc = uint32(ssrc)
+			r.payloadType = payloadType
+		}
+	}
+	return r
+}
+
+// rtxPayloadType returns the payload type of the RTX codec negotiated for a payload type, false if there is none
+func rtxPayloadType(codecs []webrtc.RTPCodecParameters, payloadType webrtc.PayloadType) (uint8, bool) {
+	apt := fmt.Sprintf("apt=%d", payloadType)
+	for _, codec := range codecs {
+		if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+			continue
+		}
+		for _, parameter := range strings.Split(codec.SDPFmtpLine, ";") {
+			if strings.TrimSpace(parameter) == apt {
+				return uint8(codec.PayloadType), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// --- NACK Responder ---
+
+// Retransmit answers a NACK of a binding from the kept packets. Packets no longer kept, or never received from
+// upstream, are skipped. Those missing upstream are NACKed there by the receiving side and forwarded when repaired
+func (t *RoomTrack) Retransmit(nack *rtcp.TransportLayerNack) {
+	t.mutex.Lock()
+	binding := t.binding(webrtc.SSRC(nack.MediaSSRC))
+	t.mutex.Unlock()
+	if binding == nil || binding.retransmitter == nil {
+		return
+	}
+	for _, pair := range nack.Nacks {
+		pair.Range(func(sequenceNumber uint16) bool {
+			t.retransmit(binding, sequenceNumber)
+			return true
+		})
+	}
+}
+
+// retransmit resends a packet sent to a binding, if it's still kept
+func (t *RoomTrack) retransmit(binding *trackBinding, sequenceNumber uint16) {
+	binding.rtxMutex.Lock()
+	defer binding.rtxMutex.Unlock()
+	r := binding.retransmitter
+	sent := r.sent[sequenceNumber%retransmitHistorySize]
+	if !sent.valid || sent.sequenceNumber != sequenceNumber {
+		binding.unrepaired.Add(1)
+		return
+	}
+	t.mutex.Lock()
+	fp := t.history(sent.encoding).get(sent.sourceSequenceNumber)
+	t.mutex.Unlock()
+	if fp == nil {
+		binding.unrepaired.Add(1)
+		return
+	}
+	defer fp.release()
+
+	header := fp.packet.Header
+	header.Extensions = append([]rtp.Extension(nil), header.Extensions...)
+	header.Timestamp = sent.timestamp
+	header.Marker = sent.marker
+	payload := fp.packet.Payload
+	if r.ssrc != 0 {
+		// RTX payload is the original sequence number followed by the original payload (RFC 4588)
+		header.SSRC = r.ssrc
+		header.PayloadType = r.payloadType
+		header.SequenceNumber = r.sequenceNumber
+		r.sequenceNumber++
+		r.payload = append(append(r.payload[:0], byte(sequenceNumber>>8), byte(sequenceNumber)), payload...)
+		payload = r.payload
+		setExtensions(&header, binding.repairSDES)
+	} else {
+		header.SSRC = binding.ssrc
+		header.PayloadType = binding.payloadType
+		header.SequenceNumber = sequenceNumber
+		setExtensions(&header, binding.sdes)
+	}
+	if _, err := binding.writeStream.WriteRTP(&header, payload); err != nil {
+		return // Binding is broken, its sending goroutine reports it
+	}
+	binding.retransmitted.Add(1)
+}
+
+// remember records where a packet sent to the binding came from. Must hold the rtxMutex of the binding
+func (r *retransmitter) remember(fp *fanoutPacket, sequenceNumber uint16, timestamp uint32, marker bool) {
+	r.sent[sequenceNumber%retransmitHistorySize] = sentPacket{
+		sequenceNumber:       sequenceNumber,
+		sourceSequenceNumber: fp.packet.SequenceNumber,
+		encoding:             fp.encoding,
+		timestamp:            timestamp,
+		marker:               marker,
+		valid:                true,
+	}
+}
+
+// history returns the retransmit cache of an encoding, creating it if needed. Must hold t.mutex
+func (t *RoomTrack) history(encoding int) *retransmitCache {
+	for len(t.histories) <= encoding {
+		t.histories = append(t.histories, &retransmitCache{})
+	}
+	return t.histories[encoding]
+}
@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"relay/internal/common"
 	"relay/internal/connections"
+	"sync"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/oklog/ulid/v2"
@@ -14,15 +15,30 @@ type RoomInfo struct {
 	ID      ulid.ULID `json:"id"`
 	Name    string    `json:"name"`
 	OwnerID peer.ID   `json:"owner_id"`
+	Version uint64    `json:"version"` // Lamport clock of the last ownership change
+}
+
+// Supersedes reports whether this RoomInfo wins over other in last-writer-wins order,
+// higher version wins and equal versions are deterministically broken by owner ID
+func (ri *RoomInfo) Supersedes(other *RoomInfo) bool {
+	if ri.Version != other.Version {
+		return ri.Version > other.Version
+	}
+	return ri.OwnerID > other.OwnerID
 }
 
 type Room struct {
 	RoomInfo
 	PeerConnection *webrtc.PeerConnection
-	AudioTrack     *webrtc.TrackLocalStaticRTP
-	VideoTrack     *webrtc.TrackLocalStaticRTP
+	AudioTrack     *RoomTrack
+	VideoTrack     *RoomTrack
 	DataChannel    *connections.NestriDataChannel
 	Participants   *common.SafeMap[ulid.ULID, *Participant]
+
+	eventMutex    sync.Mutex
+	eventHandlers []RoomEventHandler
+	eventQueue    []queuedEvent // events waiting for delivery, in order
+	eventWorker   bool          // whether a goroutine is delivering queued events
 }
 
 func NewRoom(name string, roomID ulid.ULID, ownerID peer.ID) *Room {
@@ -42,8 +58,8 @@ func (r *Room) AddParticipant(participant *Participant) {
 	r.Participants.Set(participant.ID, participant)
 }
 
-// Removes a Participant from a Room by participant's ID
-func (r *Room) removeParticipantByID(pID ulid.ULID) {
+// RemoveParticipantByID removes a Participant from a Room by participant's ID
+func (r *Room) RemoveParticipantByID(pID ulid.ULID) {
 	if _, ok := r.Participants.Get(pID); ok {
 		r.Participants.Delete(pID)
 	}
@@ -65,8 +81,21 @@ func (r *Room) IsOnline() bool {
 	return r.AudioTrack != nil && r.VideoTrack != nil
 }
 
-func (r *Room) SetTrack(trackType webrtc.RTPCodecType, track *webrtc.TrackLocalStaticRTP) {
-	//oldOnline := r.IsOnline()
+// GetTrack returns the current track of given type, nil if not set
+func (r *Room) GetTrack(trackType webrtc.RTPCodecType) *RoomTrack {
+	switch trackType {
+	case webrtc.RTPCodecTypeAudio:
+		return r.AudioTrack
+	case webrtc.RTPCodecTypeVideo:
+		return r.VideoTrack
+	default:
+		return nil
+	}
+}
+
+// SetTrack sets or clears (nil) a track of the room, emitting events for the change
+func (r *Room) SetTrack(trackType webrtc.RTPCodecType, track *RoomTrack) {
+	oldOnline := r.IsOnline()
 
 	switch trackType {
 	case webrtc.RTPCodecTypeAudio:
@@ -75,70 +104,106 @@ func (r *Room) SetTrack(trackType webrtc.RTPCodecType, track *webrtc.TrackLocalS
 		r.VideoTrack = track
 	default:
 		slog.Warn("Unknown track type", "room", r.Name, "trackType", trackType)
+		return
 	}
 
-	/*newOnline := r.IsOnline()
-	if oldOnline != newOnline {
+	events := make([]RoomEvent, 0, 2)
+	if track != nil {
+		events = append(events, RoomEventTrackSet)
+	} else {
+		events = append(events, RoomEventTrackCleared)
+	}
+	if newOnline := r.IsOnline(); oldOnline != newOnline {
 		if newOnline {
-			slog.Debug("Room online, participants will be signaled", "room", r.Name)
-			r.signalParticipantsWithTracks()
+			slog.Debug("Room online", "room", r.Name)
+			events = append(events, RoomEventOnline)
 		} else {
-			slog.Debug("Room offline, signaling participants", "room", r.Name)
-			r.signalParticipantsOffline()
+			slog.Debug("Room offline", "room", r.Name)
+			events = append(events, RoomEventOffline)
 		}
-
-		// TODO: Publish updated state to mesh
-		go func() {
-			if err := r.Relay.publishRoomStates(context.Background()); err != nil {
-				slog.Error("Failed to publish room states on change", "room", r.Name, "err", err)
-			}
-		}()
-	}*/
+	}
+	r.emit(trackType, events...)
 }
 
-/* TODO: libp2p'ify
-func (r *Room) signalParticipantsWithTracks() {
-	for _, participant := range r.Participants.Copy() {
-		if err := r.signalParticipantWithTracks(participant); err != nil {
-			slog.Error("Failed to signal participant with tracks", "participant", participant.ID, "room", r.Name, "err", err)
-		}
+// --- Room Events ---
+
+// RoomEvent is a change of a Room's tracks or availability
+type RoomEvent int
+
+const (
+	RoomEventTrackSet     RoomEvent = iota // A track was set
+	RoomEventTrackCleared                  // A track was cleared
+	RoomEventOnline                        // Room got both tracks
+	RoomEventOffline                       // Room lost a track while online
+)
+
+func (e RoomEvent) String() string {
+	switch e {
+	case RoomEventTrackSet:
+		return "track-set"
+	case RoomEventTrackCleared:
+		return "track-cleared"
+	case RoomEventOnline:
+		return "online"
+	case RoomEventOffline:
+		return "offline"
+	default:
+		return "unknown"
 	}
 }
 
-func (r *Room) signalParticipantWithTracks(participant *Participant) error {
-	if r.AudioTrack != nil {
-		if err := participant.addTrack(r.AudioTrack); err != nil {
-			return fmt.Errorf("failed to add audio track: %w", err)
-		}
+// RoomEventHandler is called for each event of a Room, with the type of track that changed
+type RoomEventHandler func(room *Room, event RoomEvent, trackType webrtc.RTPCodecType)
+
+// OnEvent registers a handler for events of the Room
+func (r *Room) OnEvent(handler RoomEventHandler) {
+	r.eventMutex.Lock()
+	defer r.eventMutex.Unlock()
+	r.eventHandlers = append(r.eventHandlers, handler)
+}
+
+// queuedEvent is an event waiting for delivery to the handlers of a Room
+type queuedEvent struct {
+	event     RoomEvent
+	trackType webrtc.RTPCodecType
+}
+
+// emit queues events for the handlers, delivered in background by a single goroutine so handlers see all events
+// of the Room in the order they were emitted
+func (r *Room) emit(trackType webrtc.RTPCodecType, events ...RoomEvent) {
+	r.eventMutex.Lock()
+	defer r.eventMutex.Unlock()
+	if len(r.eventHandlers) == 0 {
+		return
 	}
-	if r.VideoTrack != nil {
-		if err := participant.addTrack(r.VideoTrack); err != nil {
-			return fmt.Errorf("failed to add video track: %w", err)
-		}
+	for _, event := range events {
+		r.eventQueue = append(r.eventQueue, queuedEvent{event: event, trackType: trackType})
 	}
-	if err := participant.signalOffer(); err != nil {
-		return fmt.Errorf("failed to signal offer: %w", err)
+	if !r.eventWorker {
+		r.eventWorker = true
+		go r.deliverEvents()
 	}
-	return nil
 }
 
-func (r *Room) signalParticipantsOffline() {
-	for _, participant := range r.Participants.Copy() {
-		if err := r.signalParticipantOffline(participant); err != nil {
-			slog.Error("Failed to signal participant offline", "participant", participant.ID, "room", r.Name, "err", err)
+// deliverEvents calls the handlers for queued events until the queue is empty
+func (r *Room) deliverEvents() {
+	for {
+		r.eventMutex.Lock()
+		if len(r.eventQueue) == 0 {
+			r.eventWorker = false
+			r.eventMutex.Unlock()
+			return
+		}
+		queued := r.eventQueue
+		r.eventQueue = nil
+		handlers := make([]RoomEventHandler, len(r.eventHandlers))
+		copy(handlers, r.eventHandlers)
+		r.eventMutex.Unlock()
+
+		for _, qe := range queued {
+			for _, handler := range handlers {
+				handler(r, qe.event, qe.trackType)
+			}
 		}
 	}
 }
-
-// signalParticipantOffline signals a single participant offline
-func (r *Room) signalParticipantOffline(participant *Participant) error {
-	// Skip if websocket is nil or closed
-	if participant.WebSocket == nil || participant.WebSocket.IsClosed() {
-		return nil
-	}
-	if err := participant.WebSocket.SendAnswerMessageWS(connections.AnswerOffline); err != nil {
-		return err
-	}
-	return nil
-}
-*/
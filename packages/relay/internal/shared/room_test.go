@@ -0,0 +1,24 @@
+package shared
+
+import "testing"
+
+func TestRoomInfoSupersedes(t *testing.T) {
+	tests := []struct {
+		name        string
+		info, other RoomInfo
+		want        bool
+	}{
+		{"higher version", RoomInfo{OwnerID: "a", Version: 6}, RoomInfo{OwnerID: "b", Version: 5}, true},
+		{"lower version", RoomInfo{OwnerID: "b", Version: 4}, RoomInfo{OwnerID: "a", Version: 5}, false},
+		{"equal version higher owner", RoomInfo{OwnerID: "b", Version: 5}, RoomInfo{OwnerID: "a", Version: 5}, true},
+		{"equal version lower owner", RoomInfo{OwnerID: "a", Version: 5}, RoomInfo{OwnerID: "b", Version: 5}, false},
+		{"identical", RoomInfo{OwnerID: "a", Version: 5}, RoomInfo{OwnerID: "a", Version: 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.Supersedes(&tt.other); got != tt.want {
+				t.Errorf("%+v.Supersedes(%+v) = %v, want %v", tt.info, tt.other, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,827 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"relay/internal/common"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// maxKeyframeCacheSize limits the payload bytes cached from the latest keyframe onwards
+	maxKeyframeCacheSize = 2 * 1024 * 1024
+	// layerRateWindow is the window bitrates of layers are measured over
+	layerRateWindow = time.Second
+	// primarySwitchRatio is how much more bitrate an encoding needs to take over as primary one
+	primarySwitchRatio = 1.5
+	// maxTemporalLayer is the highest temporal layer ID codecs can signal
+	maxTemporalLayer = 7
+	// maxSpatialLayer is the highest spatial layer ID codecs can signal
+	maxSpatialLayer = 7
+)
+
+// RoomTrack is a local track of a room served to its participants. Packets written to it are fanned out through
+// a queue per binding, each drained by its own goroutine so a stalled participant holds up nobody else. Video
+// bindings falling behind drop packets until the next keyframe. It also caches the packets from the latest keyframe
+// onwards and replays them to newly bound participants so they can start decoding right away, and keeps the recent
+// video packets to answer NACKs of participants with.
+// Video may be written as several simulcast encodings or with SVC layers, each binding is then forwarded the layer
+// selected for it, switching at keyframes or switch points with sequence numbers and timestamps kept continuous.
+// A codec change means a new RoomTrack, so the cache goes with the old one
+type RoomTrack struct {
+	*webrtc.TrackLocalStaticRTP // negotiates the codec of bindings, packets are written to them here
+
+	mutex            sync.Mutex
+	bindings         map[string]*trackBinding // binding ID -> binding of a sender
+	caches           []*keyframeCache         // encoding -> packets from its latest keyframe onwards
+	histories        []*retransmitCache       // encoding -> recent video packets, for retransmissions
+	encodings        []string                 // encoding -> RID of simulcast encoding, empty once it ended
+	activeEncodings  int
+	layers           map[Layer]*layerRate
+	resolutions      map[int]Resolution // spatial layer -> resolution
+	simulcast        bool               // whether several encodings were written
+	svc              bool               // whether packets of SVC spatial layers were written
+	primary          atomic.Int32       // encoding standing for the track in recordings and statistics
+	primaryPending   int                // encoding taking over as primary at its next keyframe, -1 if none
+	onKeyframeNeeded func()             // called when a binding waits for a keyframe
+}
+
+// keyframeCache keeps the packets of an encoding from its latest keyframe onwards
+type keyframeCache struct {
+	packets    []*fanoutPacket
+	size       int
+	collecting bool   // whether packets are still appended
+	generation uint64 // bumped whenever the cache restarts on a new keyframe
+}
+
+// layerRate measures the bitrate of a layer
+type layerRate struct {
+	start   time.Time
+	bytes   uint64
+	bitrate float64
+	lastAt  time.Time
+}
+
+// trackBinding is a sender the track is bound to
+type trackBinding struct {
+	ssrc        uint32
+	payloadType uint8
+	writeStream webrtc.TrackLocalWriter
+	queue       *fanoutQueue
+	done        chan struct{}
+	lagging     bool // whether packets are dropped until the next keyframe, owned by the writer of the track
+
+	// Layer forwarding, owned by the writer of the track
+	target     Layer
+	pinned     bool // whether the target is fixed, for relays selecting layers themselves
+	current    Layer
+	forwarding bool // whether a layer is forwarded yet
+	seqOffset  uint16
+	tsOffset   uint32
+	lastInSeq  uint16 // highest sequence number written of the forwarded encoding
+	lastSeq    uint16 // highest sequence number queued
+	lastTS     uint32
+	lastAt     time.Time
+
+	// Owned by the sending goroutine of the binding
+	started    bool // whether packets got through, the cache is replayed before that
+	failed     bool // whether a write error was logged already
+	header     rtp.Header
+	extensions []rtp.Extension // reused for the header extensions of each write
+
+	// MID and RID header extensions of a simulcast encoding sent to a relay, which tells encodings apart by them
+	sdes       []headerExtension
+	repairSDES []headerExtension // of its retransmissions
+
+	rtxMutex      sync.Mutex
+	retransmitter *retransmitter // nil for audio
+
+	packets       atomic.Uint64
+	bytes         atomic.Uint64
+	dropped       atomic.Uint64
+	replayed      atomic.Uint64 // cached packets written ahead of the first queued one, counted in packets too
+	retransmitted atomic.Uint64
+	unrepaired    atomic.Uint64 // NACKed packets no longer kept or never received
+}
+
+func NewRoomTrack(capability webrtc.RTPCodecCapability, id, streamID string) (*RoomTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(capability, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomTrack{
+		TrackLocalStaticRTP: track,
+		bindings:            make(map[string]*trackBinding),
+		layers:              make(map[Layer]*layerRate),
+		resolutions:         make(map[int]Resolution),
+		primaryPending:      -1,
+	}, nil
+}
+
+// OnKeyframeNeeded sets a callback for when a binding waits for a keyframe, after falling behind
+// or to switch layers, so one can be requested
+func (t *RoomTrack) OnKeyframeNeeded(f func()) {
+	t.mutex.Lock()
+	t.onKeyframeNeeded = f
+	t.mutex.Unlock()
+}
+
+// Bind binds the track to a sender, starting to send queued packets to it
+func (t *RoomTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	return t.bind(ctx, ctx.ID(), nil)
+}
+
+// bind binds the track to a sender under given key, forwarding it the default layer until one is selected.
+// The binding may be configured further before it's forwarded anything
+func (t *RoomTrack) bind(ctx webrtc.TrackLocalContext, key string, configure func(binding *trackBinding)) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+	binding := &trackBinding{
+		ssrc:        uint32(ctx.SSRC()),
+		payloadType: uint8(codec.PayloadType),
+		writeStream: ctx.WriteStream(),
+		queue:       newFanoutQueue(),
+		done:        make(chan struct{}),
+	}
+	if t.Kind() == webrtc.RTPCodecTypeVideo {
+		binding.retransmitter = newRetransmitter(ctx, codec)
+	}
+	t.mutex.Lock()
+	binding.target = t.defaultLayer(time.Now())
+	if configure != nil {
+		configure(binding)
+	}
+	t.bindings[key] = binding
+	t.mutex.Unlock()
+	go t.send(binding)
+	return codec, nil
+}
+
+// Unbind unbinds the track from a sender
+func (t *RoomTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	return t.unbind(ctx, ctx.ID())
+}
+
+// unbind unbinds the track from a sender bound under given key
+func (t *RoomTrack) unbind(ctx webrtc.TrackLocalContext, key string) error {
+	t.mutex.Lock()
+	if binding, ok := t.bindings[key]; ok {
+		delete(t.bindings, key)
+		close(binding.done)
+	}
+	t.mutex.Unlock()
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+// WriteRTP queues a packet to all bindings. The packet is copied, so it may be reused after returning
+func (t *RoomTrack) WriteRTP(packet *rtp.Packet) error {
+	return t.WriteLayerRTP(packet, 0, PacketLayer{})
+}
+
+// WriteLayerRTP queues a packet of a simulcast encoding and layer to the bindings forwarded it
+func (t *RoomTrack) WriteLayerRTP(packet *rtp.Packet, encoding int, layer PacketLayer) error {
+	fp, err := newFanoutPacket(packet, common.IsKeyframeStart(t.Codec().MimeType, packet.Payload), encoding, layer)
+	if err != nil {
+		return err
+	}
+	video := t.Kind() == webrtc.RTPCodecTypeVideo
+	clockRate := t.Codec().ClockRate
+	now := time.Now()
+
+	t.mutex.Lock()
+	if t.simulcast {
+		fp.layer.Spatial = encoding
+	} else if fp.layer.Spatial > 0 {
+		t.svc = true
+	}
+	t.measure(fp, layer.Resolutions, now)
+	t.cache(encoding).add(fp)
+	if video {
+		t.history(encoding).add(fp)
+	}
+	for _, binding := range t.bindings {
+		t.enqueue(binding, fp, video, clockRate, now)
+	}
+	t.mutex.Unlock()
+
+	fp.release()
+	return nil
+}
+
+// SentCounts returns how many packets and bytes were sent to the binding of given SSRC and how many packets
+// it dropped for falling behind, false if there is none
+func (t *RoomTrack) SentCounts(ssrc webrtc.SSRC) (packets, bytes, dropped uint64, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if binding := t.binding(ssrc); binding != nil {
+		return binding.packets.Load(), binding.bytes.Load(), binding.dropped.Load(), true
+	}
+	return 0, 0, 0, false
+}
+
+// RetransmitCounts returns how many NACKed packets were retransmitted to the binding of given SSRC and how many
+// could not be, false if there is none
+func (t *RoomTrack) RetransmitCounts(ssrc webrtc.SSRC) (retransmitted, unrepaired uint64, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if binding := t.binding(ssrc); binding != nil {
+		return binding.retransmitted.Load(), binding.unrepaired.Load(), true
+	}
+	return 0, 0, false
+}
+
+// Write writes a marshaled RTP packet to all bindings
+func (t *RoomTrack) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return len(b), t.WriteRTP(packet)
+}
+
+// binding returns the binding of given SSRC, nil if there is none. Must hold t.mutex
+func (t *RoomTrack) binding(ssrc webrtc.SSRC) *trackBinding {
+	for _, binding := range t.bindings {
+		if binding.ssrc == uint32(ssrc) {
+			return binding
+		}
+	}
+	return nil
+}
+
+// --- Layers ---
+
+// AddEncoding registers a simulcast encoding of given RID written to the track, returning its index
+// packets of it are written with
+func (t *RoomTrack) AddEncoding(rid string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	index := len(t.encodings)
+	for i, existing := range t.encodings {
+		if existing == rid {
+			return i
+		}
+		if len(existing) == 0 && index == len(t.encodings) {
+			index = i // Reuse slot of ended encoding
+		}
+	}
+	if index == len(t.encodings) {
+		t.encodings = append(t.encodings, rid)
+	} else {
+		t.encodings[index] = rid
+	}
+	t.activeEncodings++
+	if t.activeEncodings > 1 {
+		t.simulcast = true
+	}
+	return index
+}
+
+// RemoveEncoding unregisters a simulcast encoding that ended, returning how many are left
+func (t *RoomTrack) RemoveEncoding(rid string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, existing := range t.encodings {
+		if existing == rid && t.activeEncodings > 0 {
+			t.encodings[i] = ""
+			t.activeEncodings--
+			break
+		}
+	}
+	return t.activeEncodings
+}
+
+// RIDs returns the RIDs of the simulcast encodings currently written
+func (t *RoomTrack) RIDs() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var rids []string
+	for _, rid := range t.encodings {
+		if len(rid) > 0 {
+			rids = append(rids, rid)
+		}
+	}
+	return rids
+}
+
+// Primary returns the encoding standing for the track in recordings and statistics, the highest bitrate one
+func (t *RoomTrack) Primary() int {
+	return int(t.primary.Load())
+}
+
+// Layered reports whether the track has several layers to select from
+func (t *RoomTrack) Layered() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	active := 0
+	for _, rate := range t.layers {
+		if rate.active(now) {
+			active++
+		}
+	}
+	return t.simulcast || active > 1
+}
+
+// Layers returns the layers currently received, by ascending bitrate
+func (t *RoomTrack) Layers() []LayerInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	var layers []LayerInfo
+	for layer, rate := range t.layers {
+		if !rate.active(now) {
+			continue
+		}
+		layers = append(layers, LayerInfo{
+			Layer:      layer,
+			Resolution: t.resolutions[layer.Spatial],
+			Bitrate:    t.layerBitrate(layer, now),
+		})
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].Bitrate < layers[j].Bitrate
+	})
+	return layers
+}
+
+// SelectLayer sets the layer forwarded to the binding of given SSRC, taking effect at the next switch point.
+// Returns false if there is no such binding or its layer is pinned
+func (t *RoomTrack) SelectLayer(ssrc webrtc.SSRC, layer Layer) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	binding := t.binding(ssrc)
+	if binding == nil || binding.pinned {
+		return false
+	}
+	if binding.target == layer {
+		return true
+	}
+	binding.target = layer
+	// Other encodings and higher spatial layers can only be switched to at a keyframe
+	if binding.forwarding && t.onKeyframeNeeded != nil &&
+		((t.simulcast && layer.Spatial != binding.current.Spatial) || (!t.simulcast && layer.Spatial > binding.current.Spatial)) {
+		go t.onKeyframeNeeded()
+	}
+	return true
+}
+
+// ForwardedLayer returns the layer forwarded to the binding of given SSRC, false if there is none
+func (t *RoomTrack) ForwardedLayer(ssrc webrtc.SSRC) (Layer, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if binding := t.binding(ssrc); binding != nil && binding.forwarding {
+		return binding.current, true
+	}
+	return Layer{}, false
+}
+
+// --- Relay Tracks ---
+
+// relayTrack is a RoomTrack as sent to a relay, which selects layers for its own participants: one of its
+// simulcast encodings with all temporal layers, or all layers if it's not simulcast
+type relayTrack struct {
+	*RoomTrack
+	rid         string
+	layer       Layer
+	transceiver *webrtc.RTPTransceiver // sending the track, its MID is sent along with the RID
+}
+
+// RID returns the RID of the simulcast encoding sent, empty if the track is not simulcast
+func (rt *relayTrack) RID() string {
+	return rt.rid
+}
+
+// Bind binds the encoding to a sender, encodings of a sender share its binding ID
+func (rt *relayTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	return rt.RoomTrack.bind(ctx, ctx.ID()+"/"+rt.rid, func(binding *trackBinding) {
+		binding.target = rt.layer
+		binding.pinned = true
+		if len(rt.rid) == 0 || rt.transceiver == nil {
+			return
+		}
+		for _, extension := range ctx.HeaderExtensions() {
+			switch extension.URI {
+			case sdp.SDESMidURI:
+				mid := headerExtension{id: uint8(extension.ID), payload: []byte(rt.transceiver.Mid())}
+				binding.sdes = append(binding.sdes, mid)
+				binding.repairSDES = append(binding.repairSDES, mid)
+			case sdp.SDESRTPStreamIDURI:
+				binding.sdes = append(binding.sdes, headerExtension{id: uint8(extension.ID), payload: []byte(rt.rid)})
+			case sdp.SDESRepairRTPStreamIDURI:
+				binding.repairSDES = append(binding.repairSDES, headerExtension{id: uint8(extension.ID), payload: []byte(rt.rid)})
+			}
+		}
+	})
+}
+
+// Unbind unbinds the encoding from a sender
+func (rt *relayTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	return rt.RoomTrack.unbind(ctx, ctx.ID()+"/"+rt.rid)
+}
+
+// relayTracks returns what a relay is sent of the track, a track per simulcast encoding currently written or
+// a single one forwarding all layers
+func (t *RoomTrack) relayTracks() []*relayTrack {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.simulcast {
+		return []*relayTrack{{RoomTrack: t, layer: Layer{Spatial: maxSpatialLayer, Temporal: maxTemporalLayer}}}
+	}
+	var tracks []*relayTrack
+	for encoding, rid := range t.encodings {
+		if len(rid) > 0 {
+			tracks = append(tracks, &relayTrack{RoomTrack: t, rid: rid, layer: Layer{Spatial: encoding, Temporal: maxTemporalLayer}})
+		}
+	}
+	return tracks
+}
+
+// SentTrack returns the RoomTrack a sender sends, in full or as relay track, nil if it sends none
+func SentTrack(sender *webrtc.RTPSender) *RoomTrack {
+	switch track := sender.Track().(type) {
+	case *RoomTrack:
+		return track
+	case *relayTrack:
+		return track.RoomTrack
+	}
+	return nil
+}
+
+// measure counts a written packet to the bitrate of its layer, switching the primary encoding when another
+// one got far more bitrate. Must hold t.mutex
+func (t *RoomTrack) measure(fp *fanoutPacket, resolutions []Resolution, now time.Time) {
+	rate, ok := t.layers[fp.layer]
+	if !ok {
+		rate = &layerRate{}
+		t.layers[fp.layer] = rate
+	}
+	rolled := rate.add(now, len(fp.packet.Payload))
+	if t.simulcast && len(resolutions) > 0 {
+		t.resolutions[fp.encoding] = resolutions[0]
+	} else {
+		for spatial, resolution := range resolutions {
+			t.resolutions[spatial] = resolution
+		}
+	}
+	if !t.simulcast {
+		return
+	}
+
+	if rolled {
+		primary := int(t.primary.Load())
+		best, bestBitrate := primary, t.encodingBitrate(primary, now)
+		for encoding := range t.encodings {
+			if bitrate := t.encodingBitrate(encoding, now); bitrate > bestBitrate*primarySwitchRatio {
+				best, bestBitrate = encoding, bitrate
+			}
+		}
+		if best != primary && best != t.primaryPending {
+			t.primaryPending = best
+			if t.onKeyframeNeeded != nil {
+				go t.onKeyframeNeeded()
+			}
+		}
+	}
+	if fp.encoding == t.primaryPending && fp.keyframe {
+		// Switch at a keyframe, so recordings of the primary encoding stay decodable
+		t.primary.Store(int32(fp.encoding))
+		t.primaryPending = -1
+	}
+}
+
+// layerBitrate returns the bitrate of a layer, including the lower layers it depends on. Must hold t.mutex
+func (t *RoomTrack) layerBitrate(layer Layer, now time.Time) float64 {
+	var bitrate float64
+	for other, rate := range t.layers {
+		sameSpatial := other.Spatial == layer.Spatial || (!t.simulcast && other.Spatial < layer.Spatial)
+		if sameSpatial && other.Temporal <= layer.Temporal && rate.active(now) {
+			bitrate += rate.bitrate
+		}
+	}
+	return bitrate
+}
+
+// encodingBitrate returns the bitrate of all layers of a simulcast encoding. Must hold t.mutex
+func (t *RoomTrack) encodingBitrate(encoding int, now time.Time) float64 {
+	return t.layerBitrate(Layer{Spatial: encoding, Temporal: maxTemporalLayer}, now)
+}
+
+// defaultLayer returns the layer new bindings start with, the lowest bitrate spatial layer with all its
+// temporal layers, until one is selected for them. Must hold t.mutex
+func (t *RoomTrack) defaultLayer(now time.Time) Layer {
+	layer := Layer{Temporal: maxTemporalLayer}
+	if !t.simulcast {
+		return layer
+	}
+	lowest := -1.0
+	for encoding, rid := range t.encodings {
+		bitrate := t.encodingBitrate(encoding, now)
+		if len(rid) > 0 && bitrate > 0 && (lowest < 0 || bitrate < lowest) {
+			layer.Spatial, lowest = encoding, bitrate
+		}
+	}
+	return layer
+}
+
+// add counts bytes of a layer, returning true when a measurement window ended
+func (r *layerRate) add(now time.Time, bytes int) bool {
+	if r.start.IsZero() {
+		r.start = now
+	}
+	r.bytes += uint64(bytes)
+	r.lastAt = now
+	if elapsed := now.Sub(r.start); elapsed >= layerRateWindow {
+		r.bitrate = float64(r.bytes*8) / elapsed.Seconds()
+		r.start = now
+		r.bytes = 0
+		return true
+	}
+	return false
+}
+
+// active reports whether packets of the layer were written recently
+func (r *layerRate) active(now time.Time) bool {
+	return now.Sub(r.lastAt) <= 2*layerRateWindow
+}
+
+// --- Keyframe Cache ---
+
+// cache returns the keyframe cache of an encoding, creating it if needed. Must hold t.mutex
+func (t *RoomTrack) cache(encoding int) *keyframeCache {
+	for len(t.caches) <= encoding {
+		t.caches = append(t.caches, &keyframeCache{})
+	}
+	return t.caches[encoding]
+}
+
+// add updates the cache with a written packet
+func (c *keyframeCache) add(fp *fanoutPacket) {
+	if fp.keyframe {
+		if len(c.packets) == 0 || c.packets[0].packet.Timestamp != fp.packet.Timestamp {
+			// New keyframe, bindings are better off waiting for it than getting the previous one
+			for _, cached := range c.packets {
+				cached.release()
+			}
+			c.packets = c.packets[:0]
+			c.size = 0
+			c.generation++
+		}
+		c.collecting = true
+	}
+	fp.generation = c.generation
+	if !c.collecting {
+		return
+	}
+	if c.size+len(fp.packet.Payload) > maxKeyframeCacheSize {
+		// GOP outgrew the cache, keep its complete frames only, none if the keyframe itself does not fit
+		c.collecting = false
+		for len(c.packets) > 0 && c.packets[len(c.packets)-1].packet.Timestamp == fp.packet.Timestamp {
+			c.packets[len(c.packets)-1].release()
+			c.packets = c.packets[:len(c.packets)-1]
+		}
+		return
+	}
+	fp.retain()
+	c.packets = append(c.packets, fp)
+	c.size += len(fp.packet.Payload)
+}
+
+// cachedBefore returns the cached packets of the layer forwarded with a queued packet that precede it,
+// each retained for the caller
+func (t *RoomTrack) cachedBefore(entry queuedPacket) []*fanoutPacket {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cache := t.cache(entry.fp.encoding)
+	if entry.fp.generation != cache.generation {
+		return nil // A newer keyframe follows in the queue
+	}
+	end := len(cache.packets) // Not cached as the GOP outgrew the cache, its complete frames precede the packet
+	for i, cached := range cache.packets {
+		if cached == entry.fp {
+			end = i
+			break
+		}
+	}
+	var preceding []*fanoutPacket
+	for _, cached := range cache.packets[:end] {
+		if cached.layer.Spatial <= entry.layer.Spatial && cached.layer.Temporal <= entry.layer.Temporal {
+			cached.retain()
+			preceding = append(preceding, cached)
+		}
+	}
+	return preceding
+}
+
+// --- Fan-out ---
+
+// enqueue queues a written packet to a binding, if it's forwarded the packet's layer and did not fall behind
+func (t *RoomTrack) enqueue(binding *trackBinding, fp *fanoutPacket, video bool, clockRate uint32, now time.Time) {
+	entry, ok := binding.forward(fp, t.simulcast, t.svc, clockRate, now)
+	if !ok {
+		return
+	}
+	if binding.lagging && !fp.keyframe {
+		binding.dropped.Add(1)
+		return
+	}
+	fp.retain()
+	if binding.queue.push(entry) {
+		binding.lagging = false
+		return
+	}
+	fp.release()
+	binding.dropped.Add(1)
+	if !video {
+		return // Audio has no keyframes to wait for, just loses what does not fit
+	}
+	if !binding.lagging || fp.keyframe {
+		// Missed a keyframe either way, ask for another one
+		slog.Debug("Track binding fell behind, dropping packets until next keyframe", "track", t.ID(), "ssrc", binding.ssrc)
+		binding.lagging = true
+		if t.onKeyframeNeeded != nil {
+			go t.onKeyframeNeeded()
+		}
+	}
+}
+
+// forward decides whether a written packet is forwarded to the binding, switching to its target layer where
+// the packet allows it, and returns the packet as queued for the binding
+func (b *trackBinding) forward(fp *fanoutPacket, simulcast, svc bool, clockRate uint32, now time.Time) (queuedPacket, bool) {
+	packet := &fp.packet
+	if !b.forwarding {
+		if simulcast && fp.layer.Spatial != b.target.Spatial {
+			return queuedPacket{}, false
+		}
+		// Starts anywhere, the keyframe cache is replayed before the first packet
+		b.current = b.target
+		b.forwarding = true
+		b.lastInSeq = packet.SequenceNumber - 1
+	}
+
+	pictureStart := fp.frameStart && (simulcast || fp.layer.Spatial == 0)
+	if b.target.Spatial != b.current.Spatial {
+		switch {
+		case simulcast && fp.layer.Spatial == b.target.Spatial && fp.keyframe:
+			// Continue right after the last packet of the previous encoding, advancing timestamp by the time passed
+			elapsed := uint32(now.Sub(b.lastAt).Seconds() * float64(clockRate))
+			b.seqOffset = b.lastSeq + 1 - packet.SequenceNumber
+			b.tsOffset = b.lastTS + max(elapsed, 1) - packet.Timestamp
+			b.lastInSeq = packet.SequenceNumber - 1
+			b.current.Spatial = b.target.Spatial
+		case !simulcast && pictureStart && (b.target.Spatial < b.current.Spatial || fp.keyframe):
+			// Lower spatial layers don't depend on higher ones, higher ones need a keyframe
+			b.current.Spatial = b.target.Spatial
+		}
+	}
+	if simulcast && fp.layer.Spatial != b.current.Spatial {
+		return queuedPacket{}, false // Another encoding, in another sequence number space
+	}
+	if b.target.Temporal != b.current.Temporal && pictureStart &&
+		(b.target.Temporal < b.current.Temporal || fp.switchUp || fp.keyframe) {
+		b.current.Temporal = b.target.Temporal
+	}
+
+	inOrder := int16(packet.SequenceNumber-b.lastInSeq) > 0
+	if inOrder {
+		b.lastInSeq = packet.SequenceNumber
+	}
+	if fp.layer.Spatial > b.current.Spatial || fp.layer.Temporal > b.current.Temporal {
+		if inOrder {
+			b.seqOffset-- // Close the gap, so viewers don't take it for loss
+		}
+		return queuedPacket{}, false
+	}
+
+	entry := queuedPacket{
+		fp:             fp,
+		sequenceNumber: packet.SequenceNumber + b.seqOffset,
+		timestamp:      packet.Timestamp + b.tsOffset,
+		// Pictures end with the highest spatial layer forwarded
+		marker: packet.Marker || (svc && fp.frameEnd && fp.layer.Spatial == b.current.Spatial),
+		layer:  b.current,
+		svc:    svc,
+	}
+	if inOrder {
+		b.lastSeq = entry.sequenceNumber
+		b.lastTS = entry.timestamp
+		b.lastAt = now
+	}
+	return entry, true
+}
+
+// send writes the packets queued for a binding until it's unbound
+func (t *RoomTrack) send(binding *trackBinding) {
+	for {
+		select {
+		case <-binding.done:
+			for entry, ok := binding.queue.pop(); ok; entry, ok = binding.queue.pop() {
+				entry.fp.release()
+			}
+			return
+		case <-binding.queue.ready:
+		}
+		for entry, ok := binding.queue.pop(); ok; entry, ok = binding.queue.pop() {
+			t.sendPacket(binding, entry)
+			entry.fp.release()
+		}
+	}
+}
+
+// sendPacket writes a queued packet to a binding, replaying the cache first if nothing got through to it yet
+func (t *RoomTrack) sendPacket(binding *trackBinding, entry queuedPacket) {
+	if !binding.started && !t.replay(binding, entry) {
+		return // Transport not ready yet, the packet would be dropped too
+	}
+	n, err := binding.write(entry.fp, entry.sequenceNumber, entry.timestamp, entry.marker)
+	if err != nil {
+		if !binding.failed && !errors.Is(err, io.ErrClosedPipe) {
+			slog.Error("Failed to write RTP to track binding", "track", t.ID(), "ssrc", binding.ssrc, "err", err)
+		}
+		binding.failed = true
+		return
+	}
+	if n > 0 {
+		binding.started = true
+	}
+}
+
+// replay writes the cached packets preceding a queued one to a binding, renumbered to lead right up to it.
+// Returns false if the binding can't send yet, so it's retried with the next queued packet
+func (t *RoomTrack) replay(binding *trackBinding, entry queuedPacket) bool {
+	preceding := t.cachedBefore(entry)
+	defer func() {
+		for _, cached := range preceding {
+			cached.release()
+		}
+	}()
+
+	first := entry.sequenceNumber - uint16(len(preceding))
+	tsOffset := entry.timestamp - entry.fp.packet.Timestamp
+	for i, cached := range preceding {
+		marker := cached.packet.Marker || (entry.svc && cached.frameEnd && cached.layer.Spatial == entry.layer.Spatial)
+		n, err := binding.write(cached, first+uint16(i), cached.packet.Timestamp+tsOffset, marker)
+		if err != nil {
+			return true // Binding is broken, the queued packet reports it
+		}
+		if n == 0 && i == 0 {
+			return false // Transport not ready yet
+		}
+		if n > 0 {
+			binding.replayed.Add(1)
+		}
+	}
+	if len(preceding) > 0 {
+		binding.started = true
+	}
+	return true
+}
+
+// write sends a packet to the binding, rewritten to its SSRC and payload type and given sequence number,
+// timestamp and marker
+func (b *trackBinding) write(fp *fanoutPacket, sequenceNumber uint16, timestamp uint32, marker bool) (int, error) {
+	// Interceptors may set header extensions, so each binding needs its own
+	b.header = fp.packet.Header
+	b.header.Extensions = append(b.extensions[:0], fp.packet.Extensions...)
+	b.header.SSRC = b.ssrc
+	b.header.PayloadType = b.payloadType
+	b.header.SequenceNumber = sequenceNumber
+	b.header.Timestamp = timestamp
+	b.header.Marker = marker
+	setExtensions(&b.header, b.sdes)
+	if b.retransmitter != nil {
+		b.rtxMutex.Lock()
+		b.retransmitter.remember(fp, sequenceNumber, timestamp, marker)
+		b.rtxMutex.Unlock()
+	}
+	n, err := b.writeStream.WriteRTP(&b.header, fp.packet.Payload)
+	b.extensions = b.header.Extensions[:0]
+	if n > 0 {
+		b.packets.Add(1)
+		b.bytes.Add(uint64(b.header.MarshalSize() + len(fp.packet.Payload)))
+	}
+	return n, err
+}
+
+// headerExtension is an RTP header extension set on packets of a binding
+type headerExtension struct {
+	id      uint8
+	payload []byte
+}
+
+// setExtensions sets header extensions of a header, replacing those of the same IDs
+func setExtensions(header *rtp.Header, extensions []headerExtension) {
+	for _, extension := range extensions {
+		_ = header.SetExtension(extension.id, extension.payload)
+	}
+}
@@ -0,0 +1,430 @@
+package shared
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// benchWriter counts the packets written to a binding
+type benchWriter struct {
+	packets *atomic.Uint64
+}
+
+func (w benchWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.packets.Add(1)
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (w benchWriter) Write(b []byte) (int, error) {
+	w.packets.Add(1)
+	return len(b), nil
+}
+
+// recordWriter keeps the headers of the packets written to a binding
+type recordWriter struct {
+	mutex   sync.Mutex
+	headers []rtp.Header
+}
+
+func (w *recordWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.headers = append(w.headers, *header)
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
+
+// written returns the headers of the packets written so far
+func (w *recordWriter) written() []rtp.Header {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]rtp.Header(nil), w.headers...)
+}
+
+// benchContext binds a track to a writer
+type benchContext struct {
+	id     string
+	ssrc   webrtc.SSRC
+	codec  webrtc.RTPCodecParameters
+	writer webrtc.TrackLocalWriter
+}
+
+func (c benchContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{c.codec}
+}
+func (c benchContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c benchContext) SSRC() webrtc.SSRC                                      { return c.ssrc }
+func (c benchContext) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (c benchContext) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c benchContext) WriteStream() webrtc.TrackLocalWriter                   { return c.writer }
+func (c benchContext) ID() string                                             { return c.id }
+func (c benchContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+// BenchmarkRoomTrackFanout writes video packets to a track bound to a number of viewers, reporting allocations
+// per written packet, sent or dropped, and how many packets viewers dropped for falling behind
+func BenchmarkRoomTrackFanout(b *testing.B) {
+	for _, viewers := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("viewers=%d", viewers), func(b *testing.B) {
+			benchmarkFanout(b, viewers)
+		})
+	}
+}
+
+func benchmarkFanout(b *testing.B, viewers int) {
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	track, err := NewRoomTrack(capability, "video", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	written := &atomic.Uint64{}
+	contexts := make([]benchContext, viewers)
+	for i := range contexts {
+		contexts[i] = benchContext{
+			id:     strconv.Itoa(i),
+			ssrc:   webrtc.SSRC(i + 1),
+			codec:  webrtc.RTPCodecParameters{RTPCodecCapability: capability, PayloadType: 96},
+			writer: benchWriter{packets: written},
+		}
+		if _, err = track.Bind(contexts[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, ctx := range contexts {
+			_ = track.Unbind(ctx)
+		}
+	}()
+
+	keyframe := make([]byte, 1200)
+	keyframe[0] = 0x10 // VP8 start of partition, inter frame bit unset
+	interframe := make([]byte, 1200)
+	interframe[0], interframe[1] = 0x10, 0x01
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SSRC: 1234, Marker: true}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet.SequenceNumber = uint16(i)
+		packet.Timestamp = uint32(i) * 3000
+		packet.Payload = interframe
+		if i%100 == 0 {
+			packet.Payload = keyframe
+		}
+		if err = track.WriteRTP(packet); err != nil {
+			b.Fatal(err)
+		}
+		if (i+1)%(fanoutQueueSize/4) == 0 {
+			// Pace writing like a live stream would, so viewers only fall behind if sending is too slow
+			waitForViewers(track, contexts, written, i+1)
+		}
+	}
+	dropped := waitForViewers(track, contexts, written, b.N)
+	b.StopTimer()
+	b.ReportMetric(float64(dropped)/float64(b.N*viewers), "dropped/packet")
+}
+
+// waitForViewers waits until every viewer either got or dropped given number of packets, returning the drops.
+// Cached packets replayed ahead of the first queued one are written too, so they're not counted as got
+func waitForViewers(track *RoomTrack, contexts []benchContext, written *atomic.Uint64, packets int) uint64 {
+	for {
+		// Replays are counted after being written, so loading written first never counts one it did not get
+		got := written.Load()
+		var dropped, replayed uint64
+		track.mutex.Lock()
+		for _, ctx := range contexts {
+			if binding := track.binding(ctx.ssrc); binding != nil {
+				dropped += binding.dropped.Load()
+				replayed += binding.replayed.Load()
+			}
+		}
+		track.mutex.Unlock()
+		if got+dropped >= uint64(packets*len(contexts))+replayed {
+			return dropped
+		}
+		runtime.Gosched()
+	}
+}
+
+// newRecordContext returns a binding context of a VP8 track recording what's written to it
+func newRecordContext(id string, ssrc webrtc.SSRC) (benchContext, *recordWriter) {
+	writer := &recordWriter{}
+	return benchContext{
+		id:     id,
+		ssrc:   ssrc,
+		codec:  webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+		writer: writer,
+	}, writer
+}
+
+// waitWritten waits until a writer got given number of packets, failing the test if it does not in time
+func waitWritten(t *testing.T, writer *recordWriter, packets int) []rtp.Header {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		headers := writer.written()
+		if len(headers) >= packets {
+			return headers
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d packets, want %d", len(headers), packets)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockingWriter records packets written to a binding once released, blocking the sending goroutine until then
+type blockingWriter struct {
+	recordWriter
+	blocked chan struct{} // closed when the first packet is written
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{blocked: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *blockingWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.once.Do(func() { close(w.blocked) })
+	<-w.release
+	return w.recordWriter.WriteRTP(header, payload)
+}
+
+// writeVP8 writes a single packet frame of a VP8 track in given temporal layer, failing the test on error
+func writeVP8(t *testing.T, track *RoomTrack, sequenceNumber uint16, keyframe bool, temporal int) {
+	t.Helper()
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    96,
+			SSRC:           1234,
+			SequenceNumber: sequenceNumber,
+			Timestamp:      uint32(sequenceNumber) * 3000,
+			Marker:         true,
+		},
+		Payload: []byte{0x10, 0x01, 0x00},
+	}
+	if keyframe {
+		packet.Payload = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+	}
+	layer := PacketLayer{Temporal: temporal, FrameStart: true, FrameEnd: true}
+	if err := track.WriteLayerRTP(packet, 0, layer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFanoutQueueWraparound(t *testing.T) {
+	q := newFanoutQueue()
+	var pushed, popped uint16
+	for round := 0; round < 3; round++ {
+		for q.tail.Load()-q.head.Load() < fanoutQueueSize {
+			if !q.push(queuedPacket{sequenceNumber: pushed}) {
+				t.Fatalf("round %d: push %d failed with %d queued", round, pushed, q.tail.Load()-q.head.Load())
+			}
+			pushed++
+		}
+		if q.push(queuedPacket{sequenceNumber: pushed}) {
+			t.Fatalf("round %d: pushed to full queue", round)
+		}
+		// Pop part of the queue, so the next round's pushes wrap around the ring
+		for i := 0; i < fanoutQueueSize/2+round; i++ {
+			entry, ok := q.pop()
+			if !ok || entry.sequenceNumber != popped {
+				t.Fatalf("round %d: popped %d, %v, want %d", round, entry.sequenceNumber, ok, popped)
+			}
+			popped++
+		}
+	}
+	for entry, ok := q.pop(); ok; entry, ok = q.pop() {
+		if entry.sequenceNumber != popped {
+			t.Fatalf("popped %d, want %d", entry.sequenceNumber, popped)
+		}
+		popped++
+	}
+	if popped != pushed {
+		t.Errorf("popped %d packets, want %d", popped, pushed)
+	}
+	if _, ok := q.pop(); ok {
+		t.Error("popped from empty queue")
+	}
+}
+
+// TestRoomTrackDropsUntilKeyframe fills the queue of a binding that does not send, so it falls behind. Packets
+// are then dropped until the next keyframe, which is requested
+func TestRoomTrackDropsUntilKeyframe(t *testing.T) {
+	track, err := NewRoomTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "lagging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyframeNeeded := make(chan struct{}, 1)
+	track.OnKeyframeNeeded(func() {
+		select {
+		case keyframeNeeded <- struct{}{}:
+		default:
+		}
+	})
+	ctx, _ := newRecordContext("viewer", 1)
+	writer := newBlockingWriter()
+	ctx.writer = writer
+	if _, err = track.Bind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = track.Unbind(ctx) }()
+
+	// The first packet blocks the sending goroutine, the following ones fill the queue
+	writeVP8(t, track, 0, true, 0)
+	<-writer.blocked
+	for i := 1; i <= fanoutQueueSize; i++ {
+		writeVP8(t, track, uint16(i), false, 0)
+	}
+	if _, _, dropped, _ := track.SentCounts(ctx.ssrc); dropped != 0 {
+		t.Fatalf("dropped %d packets fitting the queue, want none", dropped)
+	}
+
+	const behind = fanoutQueueSize + 1
+	for i := behind; i < behind+5; i++ {
+		writeVP8(t, track, uint16(i), false, 0)
+	}
+	select {
+	case <-keyframeNeeded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no keyframe requested after falling behind")
+	}
+
+	// Interframes are dropped after catching up too, until the next keyframe
+	close(writer.release)
+	waitWritten(t, &writer.recordWriter, behind)
+	writeVP8(t, track, behind+5, false, 0)
+	writeVP8(t, track, behind+6, true, 0)
+	writeVP8(t, track, behind+7, false, 0)
+	headers := waitWritten(t, &writer.recordWriter, behind+2)
+
+	for i, header := range headers[:behind] {
+		if header.SequenceNumber != uint16(i) {
+			t.Fatalf("packet %d has sequence number %d, want %d", i, header.SequenceNumber, i)
+		}
+	}
+	if got := []uint16{headers[behind].SequenceNumber, headers[behind+1].SequenceNumber}; got[0] != behind+6 || got[1] != behind+7 {
+		t.Errorf("packets after catching up have sequence numbers %v, want keyframe %d and %d", got, behind+6, behind+7)
+	}
+	if _, _, dropped, _ := track.SentCounts(ctx.ssrc); dropped != 6 {
+		t.Errorf("dropped %d packets, want 6", dropped)
+	}
+}
+
+// TestRoomTrackReplaysKeyframeCache binds a viewer of the base temporal layer after a keyframe was written. The
+// cached packets of that layer are replayed, renumbered to lead right up to the first forwarded packet
+func TestRoomTrackReplaysKeyframeCache(t *testing.T) {
+	track, err := NewRoomTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeVP8(t, track, 100, true, 0)
+	writeVP8(t, track, 101, false, 1)
+	writeVP8(t, track, 102, false, 0)
+	writeVP8(t, track, 103, false, 1)
+
+	ctx, writer := newRecordContext("viewer", 1)
+	if _, err = track.Bind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = track.Unbind(ctx) }()
+	if !track.SelectLayer(ctx.ssrc, Layer{}) {
+		t.Fatal("failed to select base layer")
+	}
+	writeVP8(t, track, 104, false, 0)
+	writeVP8(t, track, 105, false, 1)
+	writeVP8(t, track, 106, false, 0)
+
+	headers := waitWritten(t, writer, 4)
+	want := []struct {
+		sequenceNumber uint16
+		timestamp      uint32
+	}{
+		{102, 100 * 3000}, // Replayed keyframe
+		{103, 102 * 3000}, // Replayed
+		{104, 104 * 3000},
+		{105, 106 * 3000}, // Gap of the higher temporal layer closed
+	}
+	if len(headers) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(headers), len(want))
+	}
+	for i, header := range headers {
+		if header.SequenceNumber != want[i].sequenceNumber || header.Timestamp != want[i].timestamp {
+			t.Errorf("packet %d has sequence number %d and timestamp %d, want %d and %d",
+				i, header.SequenceNumber, header.Timestamp, want[i].sequenceNumber, want[i].timestamp)
+		}
+	}
+	track.mutex.Lock()
+	replayed := track.binding(ctx.ssrc).replayed.Load()
+	track.mutex.Unlock()
+	if replayed != 2 {
+		t.Errorf("replayed %d packets, want 2", replayed)
+	}
+}
+
+// TestRelayTrackForwardsAllLayers binds a viewer and a relay to an SVC track. The viewer is forwarded the lowest
+// spatial layer until another one is selected, while the relay is forwarded all of them
+func TestRelayTrackForwardsAllLayers(t *testing.T) {
+	track, err := NewRoomTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerContext, viewer := newRecordContext("viewer", 1)
+	relayContext, relay := newRecordContext("relay", 2)
+	if _, err = track.Bind(viewerContext); err != nil {
+		t.Fatal(err)
+	}
+	relayTracks := track.relayTracks()
+	if len(relayTracks) != 1 {
+		t.Fatalf("got %d relay tracks of track without simulcast, want 1", len(relayTracks))
+	}
+	if _, err = relayTracks[0].Bind(relayContext); err != nil {
+		t.Fatal(err)
+	}
+	if track.SelectLayer(relayContext.ssrc, Layer{}) {
+		t.Fatal("selected layer of relay binding")
+	}
+
+	// Pictures of two spatial layers, a keyframe first
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SSRC: 1234}}
+	for i := 0; i < 10; i++ {
+		packet.SequenceNumber = uint16(i)
+		packet.Timestamp = uint32(i/2) * 3000
+		packet.Marker = i%2 == 1
+		packet.Payload = []byte{0x10, 0x01, 0x00}
+		if i == 0 {
+			packet.Payload = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+		}
+		layer := PacketLayer{Spatial: i % 2, FrameStart: true, FrameEnd: true}
+		if err = track.WriteLayerRTP(packet, 0, layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if headers := waitWritten(t, relay, 10); len(headers) != 10 {
+		t.Errorf("relay got %d packets, want 10", len(headers))
+	}
+	headers := waitWritten(t, viewer, 5)
+	for i, header := range headers {
+		if header.SequenceNumber != uint16(i) {
+			t.Errorf("viewer packet %d has sequence number %d, want %d without gaps", i, header.SequenceNumber, i)
+		}
+	}
+}
@@ -16,12 +16,15 @@ pub struct EntityState {
     /// Relay ID that owns this entity
     #[prost(string, tag="4")]
     pub owner_relay_id: ::prost::alloc::string::String,
+    /// Lamport clock of the last change, ties broken by owner_relay_id
+    #[prost(uint64, tag="5")]
+    pub version: u64,
 }
 /// MeshMessage is the top-level message for all relay-to-relay communication.
 #[allow(clippy::derive_partial_eq_without_eq)]
 #[derive(Clone, PartialEq, ::prost::Message)]
 pub struct MeshMessage {
-    #[prost(oneof="mesh_message::Type", tags="1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13")]
+    #[prost(oneof="mesh_message::Type", tags="1, 3, 4, 5, 6, 7, 14, 15, 8, 9, 10, 11, 12, 13")]
     pub r#type: ::core::option::Option<mesh_message::Type>,
 }
 /// Nested message and enum types in `MeshMessage`.
@@ -32,8 +35,6 @@ pub mod mesh_message {
         /// Level 0
         #[prost(message, tag="1")]
         StateUpdate(super::StateUpdate),
-        #[prost(message, tag="2")]
-        Ack(super::Ack),
         #[prost(message, tag="3")]
         RetransmissionRequest(super::RetransmissionRequest),
         #[prost(message, tag="4")]
@@ -44,6 +45,10 @@ pub mod mesh_message {
         SuspectRelay(super::SuspectRelay),
         #[prost(message, tag="7")]
         Disconnect(super::Disconnect),
+        #[prost(message, tag="14")]
+        IndirectProbe(super::IndirectProbe),
+        #[prost(message, tag="15")]
+        IndirectProbeResult(super::IndirectProbeResult),
         /// Level 1
         #[prost(message, tag="8")]
         ForwardSdp(super::ForwardSdp),
@@ -70,6 +75,9 @@ pub struct Handshake {
     /// base64 encoded Diffie-Hellman public key
     #[prost(string, tag="2")]
     pub dh_public_key: ::prost::alloc::string::String,
+    /// relay id (or "mesh" for operator key) to signature, credentials of the joiner
+    #[prost(map="string, string", tag="3")]
+    pub approvals: ::std::collections::HashMap<::prost::alloc::string::String, ::prost::alloc::string::String>,
 }
 /// HandshakeResponse to respond to a mesh joiner.
 #[allow(clippy::derive_partial_eq_without_eq)]
@@ -105,8 +113,8 @@ pub struct ForwardIce {
     pub room_name: ::prost::alloc::string::String,
     #[prost(string, tag="2")]
     pub participant_id: ::prost::alloc::string::String,
-    #[prost(string, tag="3")]
-    pub candidate: ::prost::alloc::string::String,
+    #[prost(message, optional, tag="3")]
+    pub candidate: ::core::option::Option<IceCandidateInit>,
 }
 /// Forwarded ingest room from another relay.
 #[allow(clippy::derive_partial_eq_without_eq)]
@@ -133,17 +141,6 @@ pub struct StateUpdate {
     #[prost(map="string, message", tag="2")]
     pub entities: ::std::collections::HashMap<::prost::alloc::string::String, EntityState>,
 }
-/// Ack acknowledges receipt of a StateUpdate.
-#[allow(clippy::derive_partial_eq_without_eq)]
-#[derive(Clone, PartialEq, ::prost::Message)]
-pub struct Ack {
-    /// UUID of the acknowledging relay
-    #[prost(string, tag="1")]
-    pub relay_id: ::prost::alloc::string::String,
-    /// Sequence number being acknowledged
-    #[prost(uint64, tag="2")]
-    pub sequence_number: u64,
-}
 /// RetransmissionRequest requests a missed StateUpdate.
 #[allow(clippy::derive_partial_eq_without_eq)]
 #[derive(Clone, PartialEq, ::prost::Message)]
@@ -176,6 +173,9 @@ pub struct Heartbeat {
     /// Time of the heartbeat
     #[prost(message, optional, tag="2")]
     pub timestamp: ::core::option::Option<::prost_types::Timestamp>,
+    /// Incarnation of the sending relay, increased to refute suspicion or removal
+    #[prost(uint64, tag="3")]
+    pub incarnation: u64,
 }
 /// SuspectRelay marks a relay as potentially unresponsive.
 #[allow(clippy::derive_partial_eq_without_eq)]
@@ -187,6 +187,28 @@ pub struct SuspectRelay {
     /// Reason for suspicion (e.g., "no heartbeat")
     #[prost(string, tag="2")]
     pub reason: ::prost::alloc::string::String,
+    /// Incarnation of the suspected relay the suspicion applies to
+    #[prost(uint64, tag="3")]
+    pub incarnation: u64,
+}
+/// IndirectProbe asks a relay to probe another relay on behalf of the sender.
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct IndirectProbe {
+    /// UUID of the relay to probe
+    #[prost(string, tag="1")]
+    pub relay_id: ::prost::alloc::string::String,
+}
+/// IndirectProbeResult reports the outcome of an IndirectProbe.
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct IndirectProbeResult {
+    /// UUID of the probed relay
+    #[prost(string, tag="1")]
+    pub relay_id: ::prost::alloc::string::String,
+    /// Whether the probed relay responded
+    #[prost(bool, tag="2")]
+    pub alive: bool,
 }
 /// Disconnect signals to remove a relay from the mesh.
 #[allow(clippy::derive_partial_eq_without_eq)]
@@ -198,5 +220,20 @@ pub struct Disconnect {
     /// Reason for disconnection (e.g., "unresponsive")
     #[prost(string, tag="2")]
     pub reason: ::prost::alloc::string::String,
+    /// Incarnation of the relay the disconnection applies to
+    #[prost(uint64, tag="3")]
+    pub incarnation: u64,
+}
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct IceCandidateInit {
+    #[prost(string, tag="1")]
+    pub candidate: ::prost::alloc::string::String,
+    #[prost(string, optional, tag="2")]
+    pub sdp_mid: ::core::option::Option<::prost::alloc::string::String>,
+    #[prost(uint32, optional, tag="3")]
+    pub sdp_m_line_index: ::core::option::Option<u32>,
+    #[prost(string, optional, tag="4")]
+    pub username_fragment: ::core::option::Option<::prost::alloc::string::String>,
 }
 // @@protoc_insertion_point(module)
@@ -136,4 +136,62 @@ pub struct ProtoMessageInput {
     #[prost(message, optional, tag="2")]
     pub data: ::core::option::Option<ProtoInput>,
 }
+/// Request of a participant to save the last seconds of the room stream as a clip
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoClipRequest {
+    /// 0 for everything buffered
+    #[prost(uint32, tag="1")]
+    pub duration_seconds: u32,
+    /// Echoed in the result, to match results of requests forwarded between relays
+    #[prost(uint32, tag="2")]
+    pub request_id: u32,
+}
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoMessageClip {
+    #[prost(message, optional, tag="1")]
+    pub message_base: ::core::option::Option<ProtoMessageBase>,
+    #[prost(message, optional, tag="2")]
+    pub data: ::core::option::Option<ProtoClipRequest>,
+}
+/// Result of a clip request, sent back to the requesting participant
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoClipResult {
+    /// Names of the written clip files
+    #[prost(string, repeated, tag="1")]
+    pub files: ::prost::alloc::vec::Vec<::prost::alloc::string::String>,
+    /// Set if the clip could not be saved
+    #[prost(string, tag="2")]
+    pub error: ::prost::alloc::string::String,
+    /// Of the request this is the result of
+    #[prost(uint32, tag="3")]
+    pub request_id: u32,
+}
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoMessageClipResult {
+    #[prost(message, optional, tag="1")]
+    pub message_base: ::core::option::Option<ProtoMessageBase>,
+    #[prost(message, optional, tag="2")]
+    pub data: ::core::option::Option<ProtoClipResult>,
+}
+/// Size a participant displays the room video at, in device pixels, to choose a video layer for it
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoViewport {
+    #[prost(uint32, tag="1")]
+    pub width: u32,
+    #[prost(uint32, tag="2")]
+    pub height: u32,
+}
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoMessageViewport {
+    #[prost(message, optional, tag="1")]
+    pub message_base: ::core::option::Option<ProtoMessageBase>,
+    #[prost(message, optional, tag="2")]
+    pub data: ::core::option::Option<ProtoViewport>,
+}
 // @@protoc_insertion_point(module)